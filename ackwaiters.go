@@ -0,0 +1,88 @@
+package multipath
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ackWaiters wakes up the goroutines waiting for the frames in flight to be
+// acked or given up on, e.g. Flush, rather than having them poll. Signaling
+// costs an atomic load as long as nobody waits.
+type ackWaiters struct {
+	waiting int32 // accessed atomically
+	mu      sync.Mutex
+	waiters map[*ackWaiter]struct{}
+	chAcked chan struct{}
+}
+
+// ackWaiter is a goroutine waiting for the frames up to upTo.
+type ackWaiter struct {
+	upTo      uint64
+	abandoned bool
+}
+
+// add registers a waiter for the frames up to upTo. It must be called before
+// checking if they are done for the first time, and paired with remove.
+func (aw *ackWaiters) add(upTo uint64) *ackWaiter {
+	w := &ackWaiter{upTo: upTo}
+	aw.mu.Lock()
+	if aw.waiters == nil {
+		aw.waiters = make(map[*ackWaiter]struct{})
+	}
+	aw.waiters[w] = struct{}{}
+	atomic.AddInt32(&aw.waiting, 1)
+	aw.mu.Unlock()
+	return w
+}
+
+// remove unregisters w and tells if any of the frames it waits for was given
+// up on in the meantime.
+func (aw *ackWaiters) remove(w *ackWaiter) (abandoned bool) {
+	aw.mu.Lock()
+	delete(aw.waiters, w)
+	atomic.AddInt32(&aw.waiting, -1)
+	abandoned = w.abandoned
+	aw.mu.Unlock()
+	return
+}
+
+// changed returns a channel which is closed when the next frame is acked or
+// given up on. The waiter should get it before checking its condition, so
+// that the changes in between are not missed.
+func (aw *ackWaiters) changed() <-chan struct{} {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if aw.chAcked == nil {
+		aw.chAcked = make(chan struct{})
+	}
+	return aw.chAcked
+}
+
+// signal wakes up the waiters after frames are acked or no longer pending.
+func (aw *ackWaiters) signal() {
+	if atomic.LoadInt32(&aw.waiting) == 0 {
+		return
+	}
+	aw.mu.Lock()
+	if aw.chAcked != nil {
+		close(aw.chAcked)
+		aw.chAcked = nil
+	}
+	aw.mu.Unlock()
+}
+
+// gaveUp marks the waiters for frame fn that it's never going to be acked,
+// and wakes them up.
+func (aw *ackWaiters) gaveUp(fn uint64) {
+	if atomic.LoadInt32(&aw.waiting) == 0 {
+		return
+	}
+	aw.mu.Lock()
+	for w := range aw.waiters {
+		if fn <= w.upTo {
+			w.abandoned = true
+		}
+	}
+	aw.mu.Unlock()
+	aw.signal()
+}
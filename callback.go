@@ -0,0 +1,204 @@
+package multipath
+
+import (
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// recoverCallback recovers from a panic in the user supplied callback, so a
+// buggy one doesn't take down the goroutines driving the connection. It must
+// be deferred directly.
+func recoverCallback(name string) {
+	if r := recover(); r != nil {
+		log.Errorf("%s panicked: %v\n%s", name, r, debug.Stack())
+	}
+}
+
+// guardCallbacks wraps all user supplied callbacks in the config with
+// recoverCallback.
+func (cfg *config) guardCallbacks() {
+	if cb := cfg.onStateChange; cb != nil {
+		cfg.onStateChange = func(conn Conn, from, to ConnState) {
+			defer recoverCallback("state callback")
+			cb(conn, from, to)
+		}
+	}
+	if cb := cfg.onAsymmetry; cb != nil {
+		cfg.onAsymmetry = func(conn Conn, subflow string, asymmetric bool) {
+			defer recoverCallback("asymmetry callback")
+			cb(conn, subflow, asymmetric)
+		}
+	}
+	if cb := cfg.onDelivered; cb != nil {
+		cfg.onDelivered = func(conn Conn, fn uint64, subflow string, size int) {
+			defer recoverCallback("delivery callback")
+			cb(conn, fn, subflow, size)
+		}
+	}
+	if cb := cfg.onRetransmit; cb != nil {
+		cfg.onRetransmit = func(conn Conn, event RetransmitEvent) {
+			defer recoverCallback("retransmit callback")
+			cb(conn, event)
+		}
+	}
+	if cb := cfg.onWrite; cb != nil {
+		cfg.onWrite = func(conn Conn, event WriteEvent) {
+			defer recoverCallback("write callback")
+			cb(conn, event)
+		}
+	}
+	if cb := cfg.onSubflowAdded; cb != nil {
+		cfg.onSubflowAdded = func(conn Conn, subflow string, raw net.Conn) {
+			defer recoverCallback("subflow callback")
+			cb(conn, subflow, raw)
+		}
+	}
+	if cb := cfg.onCollapse; cb != nil {
+		cfg.onCollapse = func(conn Conn, subflow string, collapsed bool) {
+			defer recoverCallback("collapse callback")
+			cb(conn, subflow, collapsed)
+		}
+	}
+	if cb := cfg.onAck; cb != nil {
+		cfg.onAck = func(conn Conn, tag uint64) {
+			defer recoverCallback("ack callback")
+			cb(conn, tag)
+		}
+	}
+	if cb := cfg.onControl; cb != nil {
+		cfg.onControl = func(conn Conn, msg []byte) {
+			defer recoverCallback("control callback")
+			cb(conn, msg)
+		}
+	}
+	if cb := cfg.onAbandon; cb != nil {
+		cfg.onAbandon = func(conn Conn, frame AbandonedFrame) {
+			defer recoverCallback("abandon callback")
+			cb(conn, frame)
+		}
+	}
+	if cb := cfg.onBelowMinSubflows; cb != nil {
+		cfg.onBelowMinSubflows = func(conn Conn, healthy int) {
+			defer recoverCallback("min subflows callback")
+			cb(conn, healthy)
+		}
+	}
+	if newEstimator := cfg.newRTTEstimator; newEstimator != nil {
+		cfg.newRTTEstimator = func() (estimator RTTEstimator) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("RTT estimator constructor panicked: %v", r)
+					estimator = newEWMAEstimator()
+				}
+			}()
+			estimator = newEstimator()
+			switch estimator.(type) {
+			case nil:
+				return newEWMAEstimator()
+			case *ewmaEstimator:
+				// the default one doesn't need guarding
+				return estimator
+			}
+			return &recoveringEstimator{RTTEstimator: estimator, fallback: newEWMAEstimator()}
+		}
+	}
+	if allow := cfg.allowRetransmit; allow != nil {
+		cfg.allowRetransmit = func(subflow string) (allowed bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("retransmit policy panicked: %v", r)
+					allowed = true
+				}
+			}()
+			return allow(subflow)
+		}
+	}
+	if dscp := cfg.dscp; dscp != nil {
+		cfg.dscp = func(subflow string) (class int) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("DSCP selector panicked: %v", r)
+					class = -1
+				}
+			}()
+			return dscp(subflow)
+		}
+	}
+	if class := cfg.costClass; class != nil {
+		cfg.costClass = func(subflow string) (c int) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("cost class selector panicked: %v", r)
+					c = 0
+				}
+			}()
+			return class(subflow)
+		}
+	}
+	if inOrder := cfg.inOrderSubflows; inOrder != nil {
+		cfg.inOrderSubflows = func(subflow string) (trusted bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("in-order subflow selector panicked: %v", r)
+					trusted = false
+				}
+			}()
+			return inOrder(subflow)
+		}
+	}
+	if mtu := cfg.subflowMTU; mtu != nil {
+		cfg.subflowMTU = func(subflow string) (m int) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("subflow MTU selector panicked: %v", r)
+					m = 0
+				}
+			}()
+			return mtu(subflow)
+		}
+	}
+	if order := cfg.retransmitOrder; order != nil {
+		cfg.retransmitOrder = func(a, b PendingFrame) (less bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("retransmit order panicked: %v", r)
+					less = OldestFrameFirst(a, b)
+				}
+			}()
+			return order(a, b)
+		}
+	}
+}
+
+// safeTracker guards a user supplied StatsTracker against panics.
+type safeTracker struct {
+	StatsTracker
+}
+
+func (st safeTracker) OnRecv(n uint64) {
+	defer recoverCallback("StatsTracker.OnRecv")
+	st.StatsTracker.OnRecv(n)
+}
+
+func (st safeTracker) OnSent(n uint64) {
+	defer recoverCallback("StatsTracker.OnSent")
+	st.StatsTracker.OnSent(n)
+}
+
+func (st safeTracker) OnRetransmit(n uint64) {
+	defer recoverCallback("StatsTracker.OnRetransmit")
+	st.StatsTracker.OnRetransmit(n)
+}
+
+func (st safeTracker) UpdateRTT(rtt time.Duration) {
+	defer recoverCallback("StatsTracker.UpdateRTT")
+	st.StatsTracker.UpdateRTT(rtt)
+}
+
+func (st safeTracker) OnWriteBlocked() {
+	if tracker, ok := st.StatsTracker.(WriteBlockedTracker); ok {
+		defer recoverCallback("StatsTracker.OnWriteBlocked")
+		tracker.OnWriteBlocked()
+	}
+}
@@ -1,6 +1,10 @@
 package multipath
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"sort"
 	"sync"
@@ -8,236 +12,2199 @@ import (
 	"time"
 )
 
+// Conn is the multipath connection returned by the dialer and the listener.
+type Conn interface {
+	net.Conn
+	// State returns the current lifecycle state of the connection.
+	State() ConnState
+	// Flush blocks until all frames written so far are acknowledged by the
+	// peer, or ctx is done, or the connection is closed. It returns
+	// ErrAbandoned if any of them was given up on rather than acked, see
+	// WithMaxRetransmissions.
+	Flush(ctx context.Context) error
+	// Subflows returns the status of each active subflow, the ones with
+	// earlier estimated delivery first within each cost class, the cheaper
+	// classes first.
+	Subflows() []SubflowInfo
+	// SetSubflowRateLimit caps the bytes per second sent on the subflow
+	// labeled to, as reported by Subflows. Other subflows are preferred when
+	// the cap is hit. Zero or a negative value removes the cap. It returns
+	// ErrUnknownSubflow if there's no such subflow.
+	SetSubflowRateLimit(to string, bytesPerSec int) error
+	// PauseSubflow stops sending data frames on the subflow labeled to, e.g.
+	// for maintenance, while acks and probes keep flowing. If drain is true,
+	// the data frames queued or in flight on it are retransmitted on the
+	// other subflows right away rather than waiting for them to time out.
+	// Pausing all subflows makes them carry data frames again. It returns
+	// ErrUnknownSubflow if there's no such subflow.
+	PauseSubflow(to string, drain bool) error
+	// ResumeSubflow undoes PauseSubflow. It returns ErrUnknownSubflow if
+	// there's no such subflow.
+	ResumeSubflow(to string) error
+	// BytesInFlight returns the total payload size of the frames sent but not
+	// acked yet.
+	BytesInFlight() int
+	// QueuedFrames returns the number of frames, including acks and probes,
+	// waiting in the send queues of all subflows to be written. Unlike the
+	// frames in flight, they haven't reached the network yet, so a high
+	// count means the writes outpace the subflows.
+	QueuedFrames() int
+	// SetNoDelay controls whether each Write is sent right away as its own
+	// frame, overriding write coalescing if enabled. Setting it to true also
+	// sends the writes being held immediately. It doesn't affect the subflow
+	// rate limits, which pace frames rather than hold them for coalescing,
+	// nor the underlying conns, though TCP conns dialed with the standard
+	// library have TCP_NODELAY set by default. Defaults to false, i.e.
+	// coalescing applies if enabled.
+	SetNoDelay(noDelay bool) error
+	// WriteRedundant is like Write but sends the frame on the best k
+	// subflows at once, for the frames worth the bandwidth to be delivered
+	// as soon as possible. The receiver takes whichever copy arrives first.
+	// Only the frame itself waits for room on a subflow, the copies are held
+	// by the subflows whose send queues are full, or dropped if they hold too
+	// many already.
+	WriteRedundant(b []byte, k int) (n int, err error)
+	// BlockedWrites returns the number of times a write had to wait because
+	// the send queues of all subflows were full.
+	BlockedWrites() uint64
+	// BytesRead and BytesWritten return the total payload read and written
+	// by the application, on all streams, for quick debugging without a
+	// StatsTracker.
+	BytesRead() uint64
+	BytesWritten() uint64
+	// QueueHighWaterMarks returns the peak occupancy of the queues of the
+	// connection since last called.
+	QueueHighWaterMarks() QueueStats
+	// HeadOfLineBlocking returns how often and how long the received frames
+	// were held back waiting for a missing frame to arrive, which is the
+	// penalty of the reordering among the subflows.
+	HeadOfLineBlocking() HOLStats
+	// Goodput returns the data delivered to the application so far, compared
+	// with the data received on the wire.
+	Goodput() GoodputStats
+	// HighestDelivered returns the frame number up to which the frames of
+	// the default stream were all read, i.e. the cumulative sequence of the
+	// receiving side, or zero if none yet. The frame numbers are the ones
+	// passed to the callback set by WithDeliveryCallback. The frames the
+	// reader moved past without reading count too, i.e. those skipped after
+	// the gap timeout, given up on by the peer, or carrying another stream.
+	HighestDelivered() uint64
+	// Delivered tells if frame fn is at or below HighestDelivered.
+	Delivered(fn uint64) bool
+	// LastFrameNumber returns the number of the last frame this end
+	// numbered, i.e. of the data frames of all streams and the control
+	// messages, or zero if none yet. Once all frames are read, it matches
+	// the HighestDelivered of the peer.
+	LastFrameNumber() uint64
+	// Churn returns how long the connection has been up and how many
+	// subflows were added and removed over its lifetime. A connection which
+	// keeps losing and regaining subflows is on unstable paths even if it
+	// stays up.
+	Churn() ChurnStats
+	// Diagnose probes all subflows and reports the health of each, along
+	// with the head-of-line blocking of the receive queue, e.g. for a
+	// support tool. It waits for the probes to be answered, or ctx to be
+	// done, in which case the subflows which didn't answer are reported
+	// unresponsive.
+	Diagnose(ctx context.Context) DiagnosisReport
+	// FrameWindow returns how much of the frame number window set by
+	// WithFrameWindow is in use.
+	FrameWindow() FrameWindowStats
+	// PeerPaths returns the subflows as last advertised by the peer, e.g. to
+	// spot a path this end has but the peer doesn't see because of a NAT.
+	// It's empty unless the peer enables WithPathAdvertisement.
+	PeerPaths() PeerPaths
+	// TimeToReady returns how long it took from the start of dialing until
+	// the first subflow was established and probed, i.e. the connection
+	// became usable, including the time spent on the paths which failed. It's
+	// zero on the accepting side.
+	TimeToReady() time.Duration
+	// Done returns a channel which is closed when the connection is closed,
+	// either by Close or because all subflows are gone.
+	Done() <-chan struct{}
+	// Migrate moves the connection to an entirely new set of subflows, e.g.
+	// when the device changes networks and all the existing paths are dead.
+	// The new conns must reach the same listener. Once at least one of them
+	// joins the connection, the existing subflows are closed and the frames
+	// pending on them are retransmitted via the new ones. The stream carries
+	// on without resetting. The new subflows report to the StatsTracker of
+	// the existing ones, the first new conn to the one of the best existing
+	// subflow and so on. Only the dialing side can migrate.
+	Migrate(newConns []net.Conn) error
+	// ReadStream and WriteStream are like Read and Write but on one of the
+	// independent ordered streams multiplexed over the connection, so data
+	// missing on one stream doesn't hold back the others. The stream ID is
+	// from 1 to 255, or 0 for the default stream used by Read and Write.
+	// Streams exist as soon as either end uses them. Both ends must support
+	// streams. A stream which isn't read eventually stalls the others, as
+	// the subflows wait for room in its receive queue.
+	ReadStream(id uint64, b []byte) (n int, err error)
+	WriteStream(id uint64, b []byte) (n int, err error)
+	// WritableReady returns a channel which receives a value when a subflow
+	// finishes writing a frame, or a new subflow is added, i.e. a Write may
+	// no longer block. It's edge triggered: a single value is kept until
+	// received however many times it happens in the meantime, so the
+	// receiver should write until Write would block again before waiting on
+	// the channel.
+	WritableReady() <-chan struct{}
+	// WriteTagged is like Write but attaches an opaque tag to the frame,
+	// which is passed to the callback set by WithAckCallback once the peer
+	// acks the frame, to correlate the acks with the application events.
+	// Tagged writes are never coalesced. Zero means no tag.
+	WriteTagged(b []byte, tag uint64) (n int, err error)
+	// SendControl sends b as a control message, which the peer hands to the
+	// callback set by WithControlCallback rather than returning it from
+	// Read, so the application doesn't have to frame its control messages
+	// within the data. It's delivered reliably, but not necessarily in order
+	// with the data or the other control messages. An empty b sends nothing.
+	SendControl(b []byte) error
+	// WriteDeadline is like Write but fails with context.DeadlineExceeded if
+	// the frame can't be queued on a subflow before deadline, on top of the
+	// WithWriteTimeout. Unlike SetWriteDeadline, it applies to this call only,
+	// so concurrent writers don't clobber each other's deadlines. Once queued,
+	// the frame is written and retransmitted in the background like any
+	// other, regardless of the deadline. It's never coalesced.
+	WriteDeadline(b []byte, deadline time.Time) (n int, err error)
+	// PauseRetransmission stops retransmitting the frames timing out, e.g.
+	// while all the paths are known to be down briefly because the device
+	// sleeps or a tunnel migrates, so the retransmissions don't pile up on
+	// the dead paths and they aren't marked lossy. The pending frames are
+	// kept. ResumeRetransmission restarts the retransmission timeout of all
+	// pending frames, so they are retransmitted only if they still aren't
+	// acked after that. Neither affects the retransmissions upon a subflow
+	// closing.
+	PauseRetransmission()
+	ResumeRetransmission()
+	// Abort tears the connection down immediately, like a TCP RST. Unlike
+	// Close, the frames written but not acked yet are discarded rather than
+	// retransmitted, and the peer is told so that its reads and writes fail
+	// with ErrConnReset, after discarding the data it has received but not
+	// read yet.
+	Abort() error
+	// RecentSchedules returns, oldest first, which subflow the last data
+	// frames were sent on and why, to debug why traffic went to a particular
+	// path. It's empty unless enabled by WithScheduleLog.
+	RecentSchedules() []ScheduleDecision
+	// Scheduling returns how often the subflow the scheduler picked as the
+	// best turned out to be a wrong guess, as a proxy for its accuracy.
+	Scheduling() SchedulingStats
+	// SetUserData attaches arbitrary application data to the connection,
+	// e.g. a tenant or session, replacing the previous one.
+	SetUserData(data interface{})
+	// UserData returns the data set by SetUserData, nil if none.
+	UserData() interface{}
+}
+
+// ConnState is the lifecycle state of a multipath connection.
+type ConnState uint32
+
+const (
+	// Connecting means no subflow has been added yet.
+	Connecting ConnState = iota
+	// Established means the connection has at least one subflow, and if it
+	// ever had more than one, it still has.
+	Established
+	// Degraded means the connection is down to one subflow after having more,
+	// so there's no redundancy anymore.
+	Degraded
+	// Closing means Close has been called and the subflows are being closed.
+	Closing
+	// Closed means the connection is closed, either by Close or because all
+	// subflows are gone.
+	Closed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Established:
+		return "established"
+	case Degraded:
+		return "degraded"
+	case Closing:
+		return "closing"
+	case Closed:
+		return "closed"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint32(s))
+	}
+}
+
 type mpConn struct {
 	cid              connectionID
+	cfg              *config
+	clientSide       bool
+	timeToReady      time.Duration
+	blockedWrites    uint64 // accessed atomically
+	receivedBytes    uint64 // accessed atomically
+	bytesRead        uint64 // accessed atomically
+	bytesWritten     uint64 // accessed atomically
+	subflowsAdded    uint64 // accessed atomically
+	subflowsRemoved  uint64 // accessed atomically
+	createdAt        time.Time
+	state            uint32 // ConnState, accessed atomically
 	remoteAddr       net.Addr
 	lastFN           uint64
 	subflows         []*subflow
+	activeSubflow    *subflow // in failover mode, protected by muSubflows
 	muSubflows       sync.RWMutex
 	recvQueue        *receiveQueue
 	closed           uint32 // 1 == true, 0 == false
+	closedLocally    uint32 // 1 == true, 0 == false
+	resetByPeer      uint32 // 1 == true, 0 == false
+	closedByPeer     uint32 // 1 == true, 0 == false
 	writerMaybeReady chan bool
+	chWritable       chan struct{}
+	chComposing      chan struct{} // held while composing and queuing a data frame, see WithOrderedWrites
 	tryRetransmit    chan bool
+	// retransmitQueue holds the frames timed out, in the order given by
+	// WithRetransmitOrder, for retransmitter to retransmit one after another.
+	retransmitQueue    []*sendFrame
+	muRetransmitQueue  sync.Mutex
+	chRetransmitQueued chan struct{}
 
 	pendingAckMap map[uint64]*pendingAck
-	pendingAckMu  *sync.RWMutex
+	// queuedFrames are the data frames written but not sent on any subflow
+	// yet, so not in pendingAckMap. Also protected by pendingAckMu.
+	queuedFrames map[uint64]*sendFrame
+	pendingAckMu *sync.RWMutex
+	// ackWaiters are signaled whenever frames leave pendingAckMap or
+	// queuedFrames, or the untracked ones are acked.
+	ackWaiters ackWaiters
+
+	// unsentAcks are the acks to the frames received which are waiting to be
+	// piggybacked on outgoing data frames.
+	unsentAcks      map[uint64]*subflow
+	ackFlushPending bool
+	muUnsentAcks    sync.Mutex
+
+	// fecEncoder and fecDecoder are nil unless forward error correction is
+	// enabled.
+	fecEncoder *fecEncoder
+	fecDecoder *fecDecoder
+	// scheduleLog records the recent scheduling decisions, nil if disabled.
+	scheduleLog *scheduleLog
+	// saturatedSince is when the fastest subflow was first found with its
+	// send queue full in the AggregateWhenSaturated mode, in Unix
+	// nanoseconds, or zero if it isn't saturated. Accessed atomically.
+	saturatedSince int64
+	// passthrough keeps the frames sent by the single path fast path.
+	passthrough passthrough
+	// writersBlocked is the number of writes waiting for room on the
+	// subflows. Accessed atomically.
+	writersBlocked int32
+	// degradedBuffer holds the frames written while degraded, if the
+	// policy is BufferWhenDegraded, nil otherwise.
+	degradedBuffer chan *sendFrame
+	// frameWindowBlocked is the number of writes which waited for the frame
+	// window to advance. Accessed atomically.
+	frameWindowBlocked uint64
+	// muFrameWindow is held while checking the frame window has room and
+	// taking it, see reserveFrame.
+	muFrameWindow sync.Mutex
+	// scheduledBest is the number of data frames sent on the best subflow,
+	// and scheduleMisses the number of them retransmitted soon after, see
+	// Scheduling. Accessed atomically.
+	scheduledBest  uint64
+	scheduleMisses uint64
+	// chPathsChanged tells to advertise the subflows to the peer, nil
+	// unless enabled by WithPathAdvertisement. peerPaths are those last
+	// advertised by the peer.
+	chPathsChanged chan struct{}
+	peerPaths      PeerPaths
+	muPeerPaths    sync.Mutex
+	// userData is set by SetUserData.
+	userData   interface{}
+	muUserData sync.Mutex
+
+	// coalesced are the small writes being held by write coalescing.
+	// coalesceTurn is closed once the last writes taken from it are sent,
+	// see takeCoalesced.
+	coalesced     []byte
+	coalesceTimer *time.Timer
+	coalesceTurn  chan struct{}
+	muCoalesce    sync.Mutex
+	noDelay       uint32 // 1 == true, 0 == false
+
+	retransmitPaused uint32 // 1 == true, 0 == false
+
+	// belowMinSubflows is 1 once the healthy subflows dropped below the
+	// configured minimum, until they are back. redial is set on the dialing
+	// side to dial the missing subflows again.
+	belowMinSubflows uint32
+	redial           func()
+	redialing        uint32 // 1 == true, 0 == false
+
+	chDone    chan struct{}
+	closeOnce sync.Once
+	// chPeerClosed is closed once the close from the peer is received.
+	chPeerClosed  chan struct{}
+	peerCloseOnce sync.Once
+
+	// The data frames first sent on each subflow in the current window, to
+	// detect the traffic collapsing onto one of them.
+	muCollapse    sync.Mutex
+	windowSent    map[*subflow]int
+	windowTotal   int
+	collapsedOnto string // empty if not collapsed
+
+	// streams are the streams other than the default one, by ID.
+	streams   map[uint64]*stream
+	muStreams sync.Mutex
 }
 
-func newMPConn(cid connectionID, remoteAddr net.Addr) *mpConn {
+func newMPConn(cid connectionID, remoteAddr net.Addr, cfg *config) *mpConn {
 	mpc := &mpConn{
 		cid:              cid,
+		cfg:              cfg,
+		createdAt:        time.Now(),
 		remoteAddr:       remoteAddr,
 		lastFN:           minFrameNumber - 1,
-		recvQueue:        newReceiveQueue(recieveQueueLength),
+		recvQueue:        cfg.newReceiveQueue(),
 		writerMaybeReady: make(chan bool, 1),
+		chWritable:       make(chan struct{}, 1),
+		chComposing:      make(chan struct{}, 1),
 		tryRetransmit:    make(chan bool, 1),
 		pendingAckMap:    make(map[uint64]*pendingAck),
+		queuedFrames:     make(map[uint64]*sendFrame),
 		pendingAckMu:     &sync.RWMutex{},
+		unsentAcks:       make(map[uint64]*subflow),
+		windowSent:       make(map[*subflow]int),
+		streams:          make(map[uint64]*stream),
+		chDone:           make(chan struct{}),
+		chPeerClosed:     make(chan struct{}),
+	}
+	mpc.chRetransmitQueued = make(chan struct{}, 1)
+	mpc.recvQueue.onStreamFrame = mpc.gotStreamFrame
+	mpc.recvQueue.onPathAdvert = mpc.gotPathAdvert
+	if cfg.onDelivered != nil {
+		mpc.recvQueue.onDelivered = func(fn uint64, via string, size int) {
+			cfg.onDelivered(mpc, fn, via, size)
+		}
+	}
+	if cfg.onControl != nil {
+		mpc.recvQueue.onControl = func(b []byte) {
+			cfg.onControl(mpc, b)
+		}
+	}
+	if cfg.scheduleLogDepth > 0 {
+		mpc.scheduleLog = newScheduleLog(cfg.scheduleLogDepth)
+	}
+	if cfg.fecGroupSize > 0 {
+		mpc.fecEncoder = newFECEncoder(cfg.fecGroupSize, cfg.fecParityFrames)
+		mpc.fecDecoder = newFECDecoder(cfg.fecGroupSize, cfg.maxReceiveQueueLength)
+	}
+	if cfg.degradedWritePolicy == BufferWhenDegraded {
+		mpc.degradedBuffer = make(chan *sendFrame, cfg.degradedBufferSize)
+		go mpc.drainDegraded()
+	}
+	if cfg.pathAdvertInterval > 0 {
+		mpc.chPathsChanged = make(chan struct{}, 1)
+		go mpc.advertisePaths(cfg.pathAdvertInterval)
 	}
 	go mpc.retransmitLoop()
+	go mpc.retransmitter()
 	return mpc
 }
 
+// Read reads the data received in order. Once the connection is closed by the
+// peer or loses all subflows, the data already received can still be read
+// before it returns ErrClosed, but after Close it returns ErrClosed right away.
+// The frames arriving after that are handled according to the
+// LateFramePolicy.
 func (bc *mpConn) Read(b []byte) (n int, err error) {
-	return bc.recvQueue.read(b)
+	if atomic.LoadUint32(&bc.closedLocally) == 1 {
+		return 0, ErrClosed
+	}
+	n, err = bc.recvQueue.read(b)
+	atomic.AddUint64(&bc.bytesRead, uint64(n))
+	if err == ErrClosed {
+		err = bc.readClosedErr()
+	}
+	return
+}
+
+func (bc *mpConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&bc.bytesRead)
+}
+
+func (bc *mpConn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&bc.bytesWritten)
+}
+
+// closedErr returns the error telling why the connection is closed.
+func (bc *mpConn) closedErr() error {
+	if atomic.LoadUint32(&bc.resetByPeer) == 1 {
+		return ErrConnReset
+	}
+	return ErrClosed
+}
+
+// readClosedErr is like closedErr for the reads, which return io.EOF if the
+// peer closed the connection cleanly.
+func (bc *mpConn) readClosedErr() error {
+	if atomic.LoadUint32(&bc.closedByPeer) == 1 {
+		return io.EOF
+	}
+	return bc.closedErr()
 }
 
+// Write sends b as a single frame. It returns ErrFrameTooLarge without
+// sending anything if b is larger than the configured max frame size, and
+// ErrClosed if the connection is closed. Larger data has to be split by the
+// caller, as Write never fragments it, e.g. with io.Copy which writes 32KB at
+// a time. As each frame is written atomically by a subflow, a large frame
+// occupies a slow subflow for a long time, during which the other subflows
+// keep carrying the subsequent writes. If write coalescing is enabled, small
+// writes may be held for a while and sent along with the subsequent ones in a
+// single frame, in which case the write succeeds even if the data held is
+// lost on close, see WithWriteCoalescing.
+//
+// A write which returns before another starts is always read first by the
+// peer. Concurrent writes don't wait for each other, so their frames may be
+// queued out of the order of their numbers, unless WithOrderedWrites is set.
 func (bc *mpConn) Write(b []byte) (n int, err error) {
-	frame := composeFrame(atomic.AddUint64(&bc.lastFN, 1), b)
+	return bc.write(b, bc.cfg.redundancy, 0, time.Time{})
+}
+
+func (bc *mpConn) WriteRedundant(b []byte, k int) (n int, err error) {
+	return bc.write(b, k, 0, time.Time{})
+}
+
+// WriteTagged keeps the tag along with the frame, it never goes on the wire.
+func (bc *mpConn) WriteTagged(b []byte, tag uint64) (n int, err error) {
+	return bc.write(b, bc.cfg.redundancy, tag, time.Time{})
+}
+
+func (bc *mpConn) SendControl(b []byte) error {
+	if atomic.LoadUint32(&bc.closed) == 1 || atomic.LoadUint32(&bc.closedLocally) == 1 {
+		return bc.closedErr()
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) > bc.cfg.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	_, err := bc.sendData(func() *sendFrame {
+		return composeControlFrame(frameTypeControl, atomic.AddUint64(&bc.lastFN, 1), b)
+	}, b, 1, time.Time{})
+	return err
+}
+
+func (bc *mpConn) WriteDeadline(b []byte, deadline time.Time) (n int, err error) {
+	return bc.write(b, bc.cfg.redundancy, 0, deadline)
+}
+
+// write sends b, or holds it for coalescing if enabled and none of k, tag and
+// deadline requires sending it right away. A zero deadline means none.
+func (bc *mpConn) write(b []byte, k int, tag uint64, deadline time.Time) (n int, err error) {
+	defer func() { atomic.AddUint64(&bc.bytesWritten, uint64(n)) }()
+	if atomic.LoadUint32(&bc.closed) == 1 || atomic.LoadUint32(&bc.closedLocally) == 1 {
+		return 0, bc.closedErr()
+	}
+	if len(b) == 0 {
+		// an empty frame would be taken as an ack by the peer
+		return 0, nil
+	}
+	if len(b) > bc.cfg.maxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	if bc.cfg.coalesceDelay == 0 {
+		return bc.send(b, k, tag, deadline)
+	}
+	if atomic.LoadUint32(&bc.noDelay) == 1 || k != bc.cfg.redundancy || tag != 0 || !deadline.IsZero() {
+		bc.muCoalesce.Lock()
+		// keep the order with the writes held before
+		turn := bc.takeCoalesced()
+		bc.muCoalesce.Unlock()
+		defer turn.done()
+		if err := turn.send(); err != nil {
+			return 0, err
+		}
+		return bc.send(b, k, tag, deadline)
+	}
+	return bc.coalesce(b)
+}
+
+func (bc *mpConn) SetNoDelay(noDelay bool) error {
+	if !noDelay {
+		atomic.StoreUint32(&bc.noDelay, 0)
+		return nil
+	}
+	atomic.StoreUint32(&bc.noDelay, 1)
+	return bc.flushCoalesced()
+}
+
+// coalesce buffers b to be sent later along with the other small writes,
+// until the buffered data reaches the coalescing size or the oldest of them
+// has been held for the max delay. Writes not smaller than the coalescing
+// size are sent right away after the buffered data. The data is sent outside
+// muCoalesce, so the other small writes aren't held up by a slow send.
+func (bc *mpConn) coalesce(b []byte) (int, error) {
+	bc.muCoalesce.Lock()
+	if len(bc.coalesced)+len(b) > bc.cfg.coalesceSize || len(b) >= bc.cfg.coalesceSize {
+		turn := bc.takeCoalesced()
+		bc.muCoalesce.Unlock()
+		if len(b) >= bc.cfg.coalesceSize {
+			defer turn.done()
+			if err := turn.send(); err != nil {
+				return 0, err
+			}
+			return bc.send(b, bc.cfg.redundancy, 0, time.Time{})
+		}
+		err := turn.send()
+		turn.done()
+		if err != nil {
+			return 0, err
+		}
+		bc.muCoalesce.Lock()
+	}
+	if atomic.LoadUint32(&bc.closed) == 1 {
+		bc.muCoalesce.Unlock()
+		return 0, ErrClosed
+	}
+	bc.coalesced = append(bc.coalesced, b...)
+	if len(bc.coalesced) >= bc.cfg.coalesceSize {
+		turn := bc.takeCoalesced()
+		bc.muCoalesce.Unlock()
+		defer turn.done()
+		if err := turn.send(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if bc.coalesceTimer == nil {
+		bc.coalesceTimer = time.AfterFunc(bc.cfg.coalesceDelay, func() {
+			if err := bc.flushCoalesced(); err != nil {
+				log.Debugf("failed to send coalesced writes of %x: %v", bc.cid, err)
+			}
+		})
+	}
+	bc.muCoalesce.Unlock()
+	return len(b), nil
+}
+
+// flushCoalesced sends the writes being held by coalescing, if any, after
+// those taken before.
+func (bc *mpConn) flushCoalesced() error {
+	bc.muCoalesce.Lock()
+	turn := bc.takeCoalesced()
+	bc.muCoalesce.Unlock()
+	defer turn.done()
+	return turn.send()
+}
+
+// coalesceTurn is the writes taken from the coalescing buffer, to be sent
+// once those taken before are sent.
+type coalesceTurn struct {
+	bc   *mpConn
+	held []byte
+	prev chan struct{}
+	sent chan struct{}
+}
+
+// takeCoalesced takes the writes being held, if any, along with a turn to
+// send them, so that they are sent in order without holding muCoalesce. It
+// must be called with muCoalesce held, and followed by turn.send and
+// turn.done once muCoalesce is unlocked. The writes sent in between keep the
+// order too.
+func (bc *mpConn) takeCoalesced() *coalesceTurn {
+	if bc.coalesceTimer != nil {
+		bc.coalesceTimer.Stop()
+		bc.coalesceTimer = nil
+	}
+	turn := &coalesceTurn{bc: bc, held: bc.coalesced, prev: bc.coalesceTurn, sent: make(chan struct{})}
+	bc.coalesced = nil
+	bc.coalesceTurn = turn.sent
+	return turn
+}
+
+// send waits for the turns taken before, then sends the writes held.
+func (turn *coalesceTurn) send() error {
+	if turn.prev != nil {
+		<-turn.prev
+	}
+	if len(turn.held) == 0 {
+		return nil
+	}
+	_, err := turn.bc.send(turn.held, turn.bc.cfg.redundancy, 0, time.Time{})
+	return err
+}
+
+// done lets the next turn go.
+func (turn *coalesceTurn) done() {
+	close(turn.sent)
+}
+
+// send sends b as a single frame tagged tag on the best subflow available,
+// and copies of it on the next best k-1 subflows, giving up at deadline unless
+// it's zero.
+func (bc *mpConn) send(b []byte, k int, tag uint64, deadline time.Time) (n int, err error) {
+	return bc.sendData(func() *sendFrame {
+		frame := composeFrame(atomic.AddUint64(&bc.lastFN, 1), b)
+		frame.tag = tag
+		return frame
+	}, b, k, deadline)
+}
+
+// sendData sends the data frame of payload b composed by compose like send.
+// If the write times out after composing the frame, the peer is told to skip
+// its frame number rather than wait for it, see giveBack.
+func (bc *mpConn) sendData(compose func() *sendFrame, b []byte, k int, deadline time.Time) (n int, err error) {
+	var timeout <-chan time.Time
+	wait := bc.cfg.writeTimeout
+	if !deadline.IsZero() {
+		until := time.Until(deadline)
+		if until <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		if wait == 0 || until < wait {
+			wait = until
+		}
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if bc.cfg.orderedWrites {
+		select {
+		case bc.chComposing <- struct{}{}:
+			defer func() { <-bc.chComposing }()
+		case <-timeout:
+			return 0, context.DeadlineExceeded
+		case <-bc.chDone:
+			return 0, ErrClosed
+		}
+	}
+	mem := bc.cfg.memoryLimiter
+	for {
+		acquired, chFreed := mem.acquireOrWait(len(b))
+		if acquired {
+			break
+		}
+		select {
+		case <-chFreed:
+		case <-timeout:
+			return 0, context.DeadlineExceeded
+		case <-bc.chDone:
+			return 0, ErrClosed
+		}
+	}
+	frame, err := bc.reserveFrame(func() *sendFrame {
+		frame := compose()
+		frame.mem, frame.memSize = mem, int64(len(b))
+		return frame
+	}, timeout)
+	if err != nil {
+		mem.release(len(b))
+		return 0, err
+	}
 
+	blocked := false
 	for {
 		bc.pendingAckMu.RLock()
 		inflight := len(bc.pendingAckMap)
 		bc.pendingAckMu.RUnlock()
 		if inflight > 500 {
-			time.Sleep(time.Millisecond * 100)
 			log.Tracef("too many inflights")
+			select {
+			case <-time.After(time.Millisecond * 100):
+			case <-timeout:
+				bc.giveBack(frame)
+				return 0, context.DeadlineExceeded
+			}
+			continue
+		}
+
+		subflows := bc.dataSubflows()
+		if bc.cfg.subflowMTU != nil {
+			subflows = byMTU(subflows, len(frame.buf))
+		}
+		frame.untracked = bc.canPassThrough(frame, k)
+		if len(bc.degradedBuffer) > 0 {
+			// keep the order with the frames buffered before
+			return bc.bufferDegraded(frame, b, timeout)
+		}
+		failover := false
+		if bc.cfg.aggregationMode == Failover {
+			if active := bc.active(); active != nil {
+				subflows = []*subflow{active}
+				failover = true
+			}
+		}
+		saturated := false
+		if bc.cfg.aggregationMode == AggregateWhenSaturated && len(subflows) > 1 {
+			fastest := bc.fastest(subflows)
+			if len(fastest.sendQueue) == 0 && atomic.LoadUint64(&fastest.actuallyBusyOnWrite) == 0 {
+				atomic.StoreInt64(&bc.saturatedSince, 0)
+			}
+			select {
+			case fastest.sendQueue <- frame:
+				fastest.queued()
+				reason := ScheduledBest
+				if blocked {
+					reason = ScheduledAfterBlocking
+				}
+				bc.scheduled(frame, fastest, reason)
+				bc.sentData(frame, fastest, b, k)
+				return len(b), nil
+			default:
+			}
+			if wait := bc.saturationWait(); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-bc.writerMaybeReady:
+				case <-timer.C:
+				case <-timeout:
+					timer.Stop()
+					bc.giveBack(frame)
+					return 0, context.DeadlineExceeded
+				case <-bc.chDone:
+					timer.Stop()
+					bc.drop(frame)
+					return 0, ErrClosed
+				}
+				timer.Stop()
+				blocked = true
+				continue
+			}
+			saturated = true
+		}
+		for i, sf := range subflows {
+
+			if atomic.LoadUint64(&sf.actuallyBusyOnWrite) == 1 {
+				// Avoid a possibly blocked writer for a retransmit
+				continue
+			}
+			if sf.rateLimited() {
+				// Prefer the subflows which can send right away
+				continue
+			}
+
+			select {
+			case sf.sendQueue <- frame:
+				sf.queued()
+				reason := ScheduledBest
+				switch {
+				case failover:
+					reason = ScheduledFailover
+				case saturated:
+					reason = ScheduledSaturated
+				case blocked:
+					reason = ScheduledAfterBlocking
+				case i > 0:
+					reason = ScheduledNotFull
+				}
+				bc.scheduled(frame, sf, reason)
+				bc.sentData(frame, sf, b, k)
+				return len(b), nil
+			default:
+			}
+		}
+		for _, sf := range subflows {
+			if !sf.rateLimited() {
+				continue
+			}
+			// All other subflows are busy, so queue on a rate limited one
+			// rather than stalling.
+			select {
+			case sf.sendQueue <- frame:
+				sf.queued()
+				bc.scheduled(frame, sf, ScheduledRateLimited)
+				bc.sentData(frame, sf, b, k)
+				return len(b), nil
+			default:
+			}
+		}
+		if len(bc.sortedSubflows()) == 0 {
+			bc.drop(frame)
+			return 0, ErrClosed
+		}
+
+		if bc.State() == Degraded {
+			switch bc.cfg.degradedWritePolicy {
+			case FailWhenDegraded:
+				bc.giveBack(frame)
+				return 0, ErrDegraded
+			case BufferWhenDegraded:
+				return bc.bufferDegraded(frame, b, timeout)
+			}
+		}
+
+		bc.writeBlocked(subflows)
+		blocked = true
+		atomic.AddInt32(&bc.writersBlocked, 1)
+		select {
+		case <-bc.writerMaybeReady:
+		case <-timeout:
+			atomic.AddInt32(&bc.writersBlocked, -1)
+			bc.giveBack(frame)
+			return 0, context.DeadlineExceeded
+		case <-bc.chDone:
+			atomic.AddInt32(&bc.writersBlocked, -1)
+			bc.drop(frame)
+			return 0, ErrClosed
+		}
+		atomic.AddInt32(&bc.writersBlocked, -1)
+	}
+}
+
+// reserveFrame composes a frame and queues it once the frame window has room
+// for it, see WithFrameWindow. The room is checked and taken by numbering the
+// frame under muFrameWindow, so that concurrent writes can't all take the
+// last slot. Waiting writes are woken up by the acks advancing the window.
+func (bc *mpConn) reserveFrame(compose func() *sendFrame, timeout <-chan time.Time) (*sendFrame, error) {
+	window := bc.cfg.frameWindow
+	if window == 0 {
+		return bc.queue(compose()), nil
+	}
+	var w *ackWaiter
+	defer func() {
+		if w != nil {
+			bc.ackWaiters.remove(w)
+		}
+	}()
+	for {
+		var chAcked <-chan struct{}
+		if w != nil {
+			chAcked = bc.ackWaiters.changed()
+		}
+		bc.muFrameWindow.Lock()
+		if bc.frameWindowOccupied() < window {
+			frame := bc.queue(compose())
+			bc.muFrameWindow.Unlock()
+			return frame, nil
+		}
+		bc.muFrameWindow.Unlock()
+		if w == nil {
+			atomic.AddUint64(&bc.frameWindowBlocked, 1)
+			// check again once registered, not to miss the acks in between
+			w = bc.ackWaiters.add(0)
+			continue
+		}
+		select {
+		case <-chAcked:
+		case <-timeout:
+			return nil, context.DeadlineExceeded
+		case <-bc.chDone:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// queue registers the frame just composed as written but not sent yet.
+func (bc *mpConn) queue(frame *sendFrame) *sendFrame {
+	bc.pendingAckMu.Lock()
+	bc.queuedFrames[frame.fn] = frame
+	bc.pendingAckMu.Unlock()
+	return frame
+}
+
+// frameWindowOccupied returns the number of frame numbers from the lowest one
+// not acked yet to the last one sent, or zero if all are acked.
+func (bc *mpConn) frameWindowOccupied() int {
+	lowest := uint64(0)
+	consider := func(fn uint64) {
+		if lowest == 0 || fn < lowest {
+			lowest = fn
+		}
+	}
+	bc.pendingAckMu.RLock()
+	for fn := range bc.pendingAckMap {
+		consider(fn)
+	}
+	for fn := range bc.queuedFrames {
+		consider(fn)
+	}
+	bc.pendingAckMu.RUnlock()
+	bc.passthrough.mu.Lock()
+	for _, frame := range bc.passthrough.frames {
+		consider(frame.fn)
+	}
+	bc.passthrough.mu.Unlock()
+	if lowest == 0 {
+		return 0
+	}
+	return int(atomic.LoadUint64(&bc.lastFN) - lowest + 1)
+}
+
+// bufferDegraded queues the data frame carrying b to be sent by drainDegraded,
+// waiting for room in the buffer, see BufferWhenDegraded.
+func (bc *mpConn) bufferDegraded(frame *sendFrame, b []byte, timeout <-chan time.Time) (int, error) {
+	select {
+	case bc.degradedBuffer <- frame:
+		bc.addToFEC(frame, b)
+		return len(b), nil
+	case <-timeout:
+		bc.giveBack(frame)
+		return 0, context.DeadlineExceeded
+	case <-bc.chDone:
+		bc.drop(frame)
+		return 0, ErrClosed
+	}
+}
+
+// drainDegraded sends the frames buffered by bufferDegraded in order, each
+// once a subflow has room for it.
+func (bc *mpConn) drainDegraded() {
+	for {
+		var frame *sendFrame
+		select {
+		case frame = <-bc.degradedBuffer:
+		case <-bc.chDone:
+			return
+		}
+		for !bc.sendBuffered(frame) {
+			select {
+			case <-bc.writerMaybeReady:
+			case <-bc.chDone:
+				bc.drop(frame)
+				return
+			}
+		}
+	}
+}
+
+func (bc *mpConn) sendBuffered(frame *sendFrame) bool {
+	for _, sf := range bc.dataSubflows() {
+		select {
+		case sf.sendQueue <- frame:
+			sf.queued()
+			bc.scheduled(frame, sf, ScheduledBuffered)
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// congested tells if the retransmissions should make way for the new data,
+// see WithRealTimeFirst.
+func (bc *mpConn) congested() bool {
+	return bc.cfg.staleAfter > 0 && atomic.LoadInt32(&bc.writersBlocked) > 0
+}
+
+// tooLate tells if the frame is not worth retransmitting while congested, see
+// WithRealTimeFirst. The frames still being written are never too late, as
+// they may be delivered yet, and their buffer is in use. It must be called
+// with the frame lock held.
+func (bc *mpConn) tooLate(frame *sendFrame) bool {
+	return bc.congested() && len(frame.sentVia) > 0 && time.Since(frame.sentVia[0].txTime) > bc.cfg.staleAfter &&
+		atomic.LoadInt32(&frame.writing) == 0
+}
+
+// sentData sends the copies of the data frame just queued on sf, and accounts
+// it for the parity frames.
+func (bc *mpConn) sentData(frame *sendFrame, sf *subflow, b []byte, k int) {
+	bc.sendCopies(frame, sf, k-1)
+	bc.addToFEC(frame, b)
+}
+
+// addToFEC covers the data frame carrying b with the parity frames, if
+// enabled. Each frame has to be added once, in any order.
+func (bc *mpConn) addToFEC(frame *sendFrame, b []byte) {
+	if bc.fecEncoder != nil {
+		covered := b
+		if frame.stream != 0 || frame.control {
+			covered = nil
+		}
+		for _, parity := range bc.fecEncoder.add(frame.fn, covered) {
+			go bc.sendParity(parity)
+		}
+	}
+}
+
+// giveBack drops the frame never sent, and tells the peer to skip its frame
+// number, along with its stream sequence number if any, as the frames composed
+// since may already be numbered after it.
+func (bc *mpConn) giveBack(frame *sendFrame) {
+	bc.unqueue(frame)
+	// keeps its group of parity frames complete
+	bc.addToFEC(frame, nil)
+	bc.sendAbandonNotice(frame)
+	frame.release()
+}
+
+// active returns the subflow carrying the data in failover mode, promoting the
+// best one if there's no active subflow or it's lossy.
+func (bc *mpConn) active() *subflow {
+	bc.muSubflows.RLock()
+	active := bc.activeSubflow
+	bc.muSubflows.RUnlock()
+	if active != nil && !active.lossy() {
+		return active
+	}
+	subflows := bc.dataSubflows()
+	if len(subflows) == 0 {
+		return nil
+	}
+	bc.muSubflows.Lock()
+	defer bc.muSubflows.Unlock()
+	if bc.activeSubflow == active {
+		bc.activeSubflow = subflows[0]
+		if active != nil {
+			log.Debugf("failing over from %s to %s", active.to, subflows[0].to)
+		}
+	}
+	return bc.activeSubflow
+}
+
+// fastest returns the subflow with the lowest RTT among subflows, regardless
+// of the frames queued on it, for the AggregateWhenSaturated mode. Only the
+// subflows of the cheapest cost class are considered, and the lossy ones only
+// if all of them are.
+func (bc *mpConn) fastest(subflows []*subflow) *subflow {
+	rtts := bc.schedulingRTTs(subflows)
+	fastest := subflows[0]
+	lossy := fastest.lossy()
+	for _, sf := range subflows[1:] {
+		if sf.costClass != fastest.costClass || sf.lossy() != lossy {
 			continue
 		}
+		a, b := rtts[sf], rtts[fastest]
+		a.queued, b.queued = 0, 0
+		if a.less(b) {
+			fastest = sf
+		}
+	}
+	return fastest
+}
+
+// saturationWait returns how long the fastest subflow still has to stay
+// saturated before the other subflows are used, marking it saturated from
+// now if it wasn't yet.
+func (bc *mpConn) saturationWait() time.Duration {
+	now := time.Now().UnixNano()
+	atomic.CompareAndSwapInt64(&bc.saturatedSince, 0, now)
+	return bc.cfg.saturationThreshold - time.Duration(now-atomic.LoadInt64(&bc.saturatedSince))
+}
+
+func (bc *mpConn) WritableReady() <-chan struct{} {
+	return bc.chWritable
+}
+
+func (bc *mpConn) signalWritable() {
+	select {
+	case bc.chWritable <- struct{}{}:
+	default:
+	}
+}
+
+// acked is called once the data frame of pending is acked.
+func (bc *mpConn) acked(pending *pendingAck) {
+	if bc.cfg.onAck == nil || pending.framePtr == nil || pending.framePtr.tag == 0 {
+		return
+	}
+	bc.cfg.onAck(bc, pending.framePtr.tag)
+}
+
+func (bc *mpConn) unqueue(frame *sendFrame) {
+	bc.pendingAckMu.Lock()
+	delete(bc.queuedFrames, frame.fn)
+	bc.pendingAckMu.Unlock()
+	bc.ackWaiters.signal()
+}
+
+// drop unqueues the frame never sent as the connection is closed, and releases
+// it, giving its memory back to the MemoryLimiter as releaseMemory can't reach
+// it anymore.
+func (bc *mpConn) drop(frame *sendFrame) {
+	bc.unqueue(frame)
+	frame.release()
+}
+
+// writeBlocked records that a write has to wait for the subflows to drain
+// their send queues.
+func (bc *mpConn) writeBlocked(subflows []*subflow) {
+	atomic.AddUint64(&bc.blockedWrites, 1)
+	for _, sf := range subflows {
+		if tracker, ok := sf.tracker.(WriteBlockedTracker); ok {
+			tracker.OnWriteBlocked()
+		}
+	}
+}
+
+// recordSent accounts a data frame first sent on sf, and tells if all traffic
+// collapses onto a single subflow, or no longer does, at the end of each window.
+func (bc *mpConn) recordSent(sf *subflow) {
+	// counted before taking muCollapse, as every frame sent goes through it
+	bc.muSubflows.RLock()
+	subflows := len(bc.subflows)
+	bc.muSubflows.RUnlock()
+	bc.muCollapse.Lock()
+	bc.windowSent[sf]++
+	bc.windowTotal++
+	if bc.windowTotal < collapseWindow {
+		bc.muCollapse.Unlock()
+		return
+	}
+	var busiest *subflow
+	for candidate, sent := range bc.windowSent {
+		if busiest == nil || sent > bc.windowSent[busiest] {
+			busiest = candidate
+		}
+	}
+	collapsedOnto := ""
+	if subflows > 1 && float64(bc.windowSent[busiest]) > collapseShare*float64(bc.windowTotal) {
+		collapsedOnto = busiest.to
+	}
+	previous := bc.collapsedOnto
+	bc.collapsedOnto = collapsedOnto
+	bc.windowSent = make(map[*subflow]int)
+	bc.windowTotal = 0
+	bc.muCollapse.Unlock()
+	if collapsedOnto == previous {
+		return
+	}
+	if collapsedOnto != "" {
+		log.Debugf("connection %x sends almost everything via %s", bc.cid, collapsedOnto)
+	}
+	if cb := bc.cfg.onCollapse; cb != nil {
+		if previous != "" {
+			cb(bc, previous, false)
+		}
+		if collapsedOnto != "" {
+			cb(bc, collapsedOnto, true)
+		}
+	}
+}
+
+func (bc *mpConn) BlockedWrites() uint64 {
+	return atomic.LoadUint64(&bc.blockedWrites)
+}
+
+// sendCopies sends copies of the frame just sent on primary on the next best n
+// subflows. It never blocks, the copies which don't fit in the send queues are
+// held by the subflows until there's room, see holdCopy.
+func (bc *mpConn) sendCopies(frame *sendFrame, primary *subflow, n int) {
+	for _, sf := range bc.dataSubflows() {
+		if n <= 0 {
+			return
+		}
+		if sf == primary {
+			continue
+		}
+		select {
+		case sf.sendQueue <- frame:
+			sf.queued()
+		default:
+			sf.holdCopy(frame)
+		}
+		bc.scheduleLog.add(frame.fn, sf, ScheduledRedundant)
+		n--
+	}
+}
+
+// sendParity sends the parity frame on the fastest subflow available. It's
+// best effort, the frame is dropped if the connection is closed in the
+// meantime.
+func (bc *mpConn) sendParity(frame *sendFrame) {
+	for _, sf := range bc.dataSubflows() {
+		select {
+		case sf.sendQueue <- frame:
+			sf.queued()
+			return
+		case <-sf.chClose:
+		}
+	}
+	frame.release()
+}
+
+// releaseMemory gives the memory taken by the frames not acked yet back to
+// the MemoryLimiter once the connection is closed, as they're never released
+// otherwise.
+func (bc *mpConn) releaseMemory() {
+	if bc.cfg.memoryLimiter == nil {
+		return
+	}
+	bc.pendingAckMu.RLock()
+	defer bc.pendingAckMu.RUnlock()
+	for _, pending := range bc.pendingAckMap {
+		if pending.framePtr != nil {
+			pending.framePtr.releaseMemory()
+		}
+	}
+	for _, frame := range bc.queuedFrames {
+		frame.releaseMemory()
+	}
+	bc.releasePassedThroughMemory()
+}
+
+// Flush blocks until all frames written so far are acknowledged by the peer,
+// or ctx is done, or the connection is closed. The writes held by coalescing
+// are sent right away. Unlike Close, the connection stays open and can be
+// written to concurrently, though frames written after Flush is called are
+// not waited for. It's woken up by the acks rather than polling.
+func (bc *mpConn) Flush(ctx context.Context) error {
+	if err := bc.flushCoalesced(); err != nil {
+		return err
+	}
+	lastFN := atomic.LoadUint64(&bc.lastFN)
+	w := bc.ackWaiters.add(lastFN)
+	for {
+		chAcked := bc.ackWaiters.changed()
+		if !bc.hasUnackedUpTo(lastFN) && !bc.hasPassedThroughUpTo(lastFN) {
+			if bc.ackWaiters.remove(w) {
+				return ErrAbandoned
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			bc.ackWaiters.remove(w)
+			return ctx.Err()
+		case <-bc.chDone:
+			bc.ackWaiters.remove(w)
+			return ErrClosed
+		case <-chAcked:
+		}
+	}
+}
+
+func (bc *mpConn) hasUnackedUpTo(lastFN uint64) bool {
+	bc.pendingAckMu.RLock()
+	defer bc.pendingAckMu.RUnlock()
+	for fn := range bc.pendingAckMap {
+		if fn <= lastFN {
+			return true
+		}
+	}
+	for fn := range bc.queuedFrames {
+		if fn <= lastFN {
+			return true
+		}
+	}
+	return false
+}
+
+// Close lets the peer know the connection is closed and waits up to a second
+// for the peer to do the same before closing all subflows, so that the peer
+// reads io.EOF rather than an error, even if both sides close at the same
+// time. The data written but not acked yet is not waited for, call Flush
+// beforehand for that.
+func (bc *mpConn) Close() error {
+	bc.setState(Closing)
+	bc.flushCoalesced()
+	if atomic.CompareAndSwapUint32(&bc.closedLocally, 0, 1) {
+		bc.closeHandshake()
+	}
+	bc.close()
+	bc.recvQueue.discard()
+	bc.eachStream((*receiveQueue).discard)
+	for _, sf := range bc.sortedSubflows() {
+		sf.close()
+	}
+	return nil
+}
+
+func (bc *mpConn) Abort() error {
+	bc.setState(Closing)
+	atomic.StoreUint32(&bc.closedLocally, 1)
+	bc.close()
+	bc.recvQueue.discard()
+	bc.eachStream((*receiveQueue).discard)
+	bc.releaseMemory()
+	bc.pendingAckMu.Lock()
+	bc.pendingAckMap = make(map[uint64]*pendingAck)
+	bc.queuedFrames = make(map[uint64]*sendFrame)
+	bc.pendingAckMu.Unlock()
+	var wg sync.WaitGroup
+	for _, sf := range bc.sortedSubflows() {
+		wg.Add(1)
+		go func(sf *subflow) {
+			defer wg.Done()
+			sf.reset()
+		}(sf)
+	}
+	wg.Wait()
+	return nil
+}
+
+// gotReset tears the connection down as the peer aborted it.
+func (bc *mpConn) gotReset() {
+	log.Debugf("connection %x is reset by the peer", bc.cid)
+	atomic.StoreUint32(&bc.resetByPeer, 1)
+	bc.close()
+	bc.recvQueue.discard()
+	bc.eachStream((*receiveQueue).discard)
+	for _, sf := range bc.sortedSubflows() {
+		go sf.close()
+	}
+}
+
+// closeHandshake sends close on all subflows and waits for the close from the
+// peer, unless it's already received or the connection is closed anyway.
+func (bc *mpConn) closeHandshake() {
+	if atomic.LoadUint32(&bc.closedByPeer) == 1 || atomic.LoadUint32(&bc.closed) == 1 {
+		return
+	}
+	for _, sf := range bc.sortedSubflows() {
+		go sf.ack(frameTypeClose)
+	}
+	timer := time.NewTimer(closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-bc.chPeerClosed:
+	case <-bc.chDone:
+	case <-timer.C:
+		log.Debugf("connection %x is not closed by the peer in time", bc.cid)
+	}
+}
+
+// gotClose handles the close from the peer received on sf. If the connection
+// isn't closing locally, it sends close back on sf and closes it. As each
+// subflow delivers in order, all the data sent before the close on sf is
+// received by then, and the connection is closed along with the last
+// subflow, leaving the data received in order to be read before io.EOF.
+func (bc *mpConn) gotClose(sf *subflow) {
+	bc.peerCloseOnce.Do(func() {
+		log.Debugf("connection %x is closed by the peer", bc.cid)
+		atomic.StoreUint32(&bc.closedByPeer, 1)
+		close(bc.chPeerClosed)
+	})
+	if atomic.LoadUint32(&bc.closedLocally) == 1 {
+		// Close tears the connection down once it sees the close
+		return
+	}
+	bc.setState(Closing)
+	go func() {
+		sf.ack(frameTypeClose)
+		sf.close()
+	}()
+}
+
+// fail closes the connection and all its subflows as it can't make progress.
+// Unlike Close, the data already received in order can still be read.
+func (bc *mpConn) fail() {
+	bc.close()
+	for _, sf := range bc.sortedSubflows() {
+		sf.close()
+	}
+}
+
+// close marks the connection as closed. The data already received in order
+// can still be read afterwards.
+func (bc *mpConn) close() {
+	atomic.StoreUint32(&bc.closed, 1)
+	bc.recvQueue.close()
+	bc.eachStream((*receiveQueue).close)
+	bc.setState(Closed)
+	bc.closeOnce.Do(func() { close(bc.chDone) })
+}
+
+func (bc *mpConn) SetUserData(data interface{}) {
+	bc.muUserData.Lock()
+	bc.userData = data
+	bc.muUserData.Unlock()
+}
+
+func (bc *mpConn) UserData() interface{} {
+	bc.muUserData.Lock()
+	defer bc.muUserData.Unlock()
+	return bc.userData
+}
+
+func (bc *mpConn) TimeToReady() time.Duration {
+	return bc.timeToReady
+}
+
+func (bc *mpConn) Done() <-chan struct{} {
+	return bc.chDone
+}
+
+func (bc *mpConn) State() ConnState {
+	return ConnState(atomic.LoadUint32(&bc.state))
+}
+
+// setState transitions the connection to the new state and calls the state
+// callback if there's any. A closing or closed connection never goes back to
+// an active state.
+func (bc *mpConn) setState(to ConnState) {
+	for {
+		from := bc.State()
+		if from == to || from == Closed || (from == Closing && to != Closed) {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&bc.state, uint32(from), uint32(to)) {
+			log.Tracef("connection %x is %v, was %v", bc.cid, to, from)
+			if bc.cfg.onStateChange != nil {
+				bc.cfg.onStateChange(bc, from, to)
+			}
+			return
+		}
+	}
+}
+
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "multipath" }
+func (fakeAddr) String() string  { return "multipath" }
+
+func (bc *mpConn) LocalAddr() net.Addr {
+	return fakeAddr{}
+}
+
+func (bc *mpConn) RemoteAddr() net.Addr {
+	return bc.remoteAddr
+}
+
+func (bc *mpConn) SetDeadline(t time.Time) error {
+	bc.SetReadDeadline(t)
+	return bc.SetWriteDeadline(t)
+}
+
+func (bc *mpConn) SetReadDeadline(t time.Time) error {
+	bc.recvQueue.setReadDeadline(t)
+	bc.eachStream(func(rq *receiveQueue) { rq.setReadDeadline(t) })
+	return nil
+}
+
+func (bc *mpConn) SetWriteDeadline(t time.Time) error {
+	bc.muSubflows.RLock()
+	defer bc.muSubflows.RUnlock()
+	for _, sf := range bc.subflows {
+		if err := sf.conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bc *mpConn) retransmit(frame *sendFrame, reason RetransmitReason) {
+	var event *RetransmitEvent
+	if bc.cfg.onRetransmit != nil {
+		defer func() {
+			// called after releasing the frame lock
+			if event != nil {
+				bc.cfg.onRetransmit(bc, *event)
+			}
+		}()
+	}
+	tooLate := false
+	defer func() {
+		// called after releasing the frame lock
+		if tooLate {
+			bc.abandon(frame)
+		}
+	}()
+	frame.changeLock.Lock()
+	defer frame.changeLock.Unlock()
+	frame.retransmitQueued = false
+
+	if atomic.LoadUint64(&frame.beingRetransmitted) == 1 {
+		return
+	}
+	// tracked from now on, as it's no longer on the single path
+	frame.untracked = false
+	bc.checkScheduleMiss(frame, reason)
+	atomic.StoreUint64(&frame.beingRetransmitted, 1)
+	defer func() {
+		atomic.StoreUint64(&frame.beingRetransmitted, 0)
+	}()
+
+	subflows := bc.retransmitCandidates()
+
+	var stalled <-chan time.Time
+	if bc.cfg.retransmitStall > 0 {
+		timer := time.NewTimer(bc.cfg.retransmitStall)
+		defer timer.Stop()
+		stalled = timer.C
+	}
+	alreadyTransmittedOnAllSubflows := false
+	for {
+		abort := false
+		if atomic.LoadUint32(&bc.closed) == 1 {
+			return
+		}
+		if bc.congested() {
+			if bc.tooLate(frame) {
+				tooLate = true
+				return
+			}
+			// let the blocked writes go first
+			select {
+			case <-bc.tryRetransmit:
+			case <-time.After(10 * time.Millisecond):
+			case <-bc.chDone:
+				return
+			}
+			continue
+		}
+
+		var selectedSubflow *subflow
+
+		abort, alreadyTransmittedOnAllSubflows, selectedSubflow = selectSubflowForRetransmit(subflows, frame, false)
+		if selectedSubflow == nil {
+			abort, alreadyTransmittedOnAllSubflows, selectedSubflow = selectSubflowForRetransmit(subflows, frame, true)
+			if selectedSubflow == nil {
+				abort = true
+				alreadyTransmittedOnAllSubflows = true
+				break
+			}
+		}
+
+		select {
+		case <-selectedSubflow.chClose:
+			// never pick it again, or it would spin
+			remains := make([]*subflow, 0, len(subflows))
+			for _, sf := range subflows {
+				if sf != selectedSubflow {
+					remains = append(remains, sf)
+				}
+			}
+			subflows = remains
+			continue
+		case selectedSubflow.sendQueue <- frame:
+			selectedSubflow.queued()
+			frame.retransmissions++
+			log.Debugf("retransmitted frame %d via %s", frame.fn, selectedSubflow.to)
+			if bc.cfg.onRetransmit != nil {
+				event = newRetransmitEvent(frame, selectedSubflow, reason)
+			}
+			if frame.sentVia == nil {
+				frame.sentVia = make([]transmissionDatapoint, 0)
+			}
+			frame.sentVia = append(frame.sentVia, transmissionDatapoint{selectedSubflow, time.Now()})
+			return
+		default:
+		}
+
+		if abort {
+			break
+		}
+		select {
+		case <-bc.tryRetransmit:
+		case <-stalled:
+			if atomic.LoadUint32(&bc.retransmitPaused) == 1 {
+				// waiting out the outage, not stalled
+				stalled = time.After(bc.cfg.retransmitStall)
+				continue
+			}
+			log.Errorf("no room to retransmit frame %d on any subflow of %x for %v, closing", frame.fn, bc.cid, bc.cfg.retransmitStall)
+			// the subflows may need the frame lock to close
+			go bc.fail()
+			return
+		case <-bc.chDone:
+			return
+		}
+	}
+
+	if !alreadyTransmittedOnAllSubflows {
+		log.Debugf("frame %d is being retransmitted on all subflows of %x", frame.fn, bc.cid)
+	}
+
+	return
+}
+
+// abandon gives up on the frame which has been retransmitted too many times,
+// and tells the peer to skip it.
+func (bc *mpConn) abandon(frame *sendFrame) {
+	bc.pendingAckMu.Lock()
+	_, pending := bc.pendingAckMap[frame.fn]
+	delete(bc.pendingAckMap, frame.fn)
+	bc.pendingAckMu.Unlock()
+	if !pending {
+		// acked in the meantime
+		return
+	}
+	bc.ackWaiters.gaveUp(frame.fn)
+	frame.changeLock.Lock()
+	log.Debugf("giving up on frame %d after %d retransmissions", frame.fn, frame.retransmissions)
+	var abandoned *AbandonedFrame
+	if bc.cfg.onAbandon != nil {
+		abandoned = &AbandonedFrame{
+			FN:              frame.fn,
+			Tag:             frame.tag,
+			Stream:          frame.stream,
+			Payload:         append([]byte(nil), frame.buf[len(frame.buf)-int(frame.sz):]...),
+			Retransmissions: frame.retransmissions,
+		}
+	}
+	frame.release()
+	frame.changeLock.Unlock()
+	if abandoned != nil {
+		bc.cfg.onAbandon(bc, *abandoned)
+	}
+	bc.sendAbandonNotice(frame)
+}
+
+// sendAbandonNotice tells the peer to skip the frame on all subflows.
+func (bc *mpConn) sendAbandonNotice(frame *sendFrame) {
+	fn, stream, seq := frame.fn, frame.stream, frame.seq
+	for _, sf := range bc.sortedSubflows() {
+		go func(sf *subflow) {
+			notice := composeAbandonFrame(fn, stream, seq)
+			select {
+			case sf.sendQueue <- notice:
+				sf.queued()
+			case <-sf.chClose:
+				notice.release()
+			}
+		}(sf)
+	}
+}
+
+func (bc *mpConn) PauseRetransmission() {
+	atomic.StoreUint32(&bc.retransmitPaused, 1)
+}
+
+func (bc *mpConn) ResumeRetransmission() {
+	if !atomic.CompareAndSwapUint32(&bc.retransmitPaused, 1, 0) {
+		return
+	}
+	now := bc.cfg.now()
+	bc.pendingAckMu.Lock()
+	defer bc.pendingAckMu.Unlock()
+	for fn, pending := range bc.pendingAckMap {
+		restarted := *pending
+		restarted.sentAt = now
+		bc.pendingAckMap[fn] = &restarted
+	}
+}
+
+// newRetransmitEvent describes the frame being retransmitted on to. It must be
+// called before the retransmission is added to sentVia.
+func newRetransmitEvent(frame *sendFrame, to *subflow, reason RetransmitReason) *RetransmitEvent {
+	event := &RetransmitEvent{
+		FN:              frame.fn,
+		To:              to.to,
+		Retransmissions: frame.retransmissions,
+		Reason:          reason,
+	}
+	if n := len(frame.sentVia); n > 0 {
+		last := frame.sentVia[n-1]
+		event.From = last.sf.to
+		event.SinceSent = time.Since(last.txTime)
+	}
+	return event
+}
+
+// retransmitCandidates returns the subflows the frames can be retransmitted
+// on according to the retransmit policy, best first.
+func (bc *mpConn) retransmitCandidates() []*subflow {
+	subflows := bc.dataSubflows()
+	allow := bc.cfg.allowRetransmit
+	if allow == nil {
+		return subflows
+	}
+	allowed := subflows[:0]
+	for _, sf := range subflows {
+		if allow(sf.to) {
+			allowed = append(allowed, sf)
+		}
+	}
+	return allowed
+}
+
+// selectSubflowForRetransmit picks the subflow to retransmit the frame on,
+// spreading the attempts across different subflows to maximize the chance of
+// delivery. The subflows it has never been sent on come first in the order
+// given. If there's none and timeFallback is true, the subflow it has been
+// tried on the fewest times is picked, then the least recently, skipping
+// those tried within the last second. The subflow it was last sent on is the
+// suspect of the loss, so it's only picked if no other one qualifies.
+func selectSubflowForRetransmit(subflows []*subflow, frame *sendFrame, timeFallback bool) (bool, bool, *subflow) {
+	var suspect *subflow
+	if n := len(frame.sentVia); n > 0 {
+		suspect = frame.sentVia[n-1].sf
+	}
+	var selectedSubflow *subflow
+	var selectedAttempts int
+	var selectedLast time.Time
+	suspectQualifies := false
+	for _, sf := range subflows {
+		if atomic.LoadUint64(&sf.actuallyBusyOnWrite) == 1 {
+			// Avoid a possibly blocked writer for a retransmit
+			// let's avoid re-sending a frame down the same socket twice.
+			// Since at best, it just double sends a frame into the send buffer
+			// and at worst it blocks other frames from entering a send buffer.
+			continue
+		}
+		attempts, last := frame.attemptsVia(sf)
+		if attempts == 0 {
+			return false, false, sf
+		}
+		if !timeFallback || time.Since(last) <= time.Second {
+			continue
+		}
+		if sf == suspect {
+			suspectQualifies = true
+			continue
+		}
+		if selectedSubflow == nil || attempts < selectedAttempts ||
+			(attempts == selectedAttempts && last.Before(selectedLast)) {
+			selectedSubflow, selectedAttempts, selectedLast = sf, attempts, last
+		}
+	}
+	if selectedSubflow == nil && suspectQualifies {
+		selectedSubflow = suspect
+	}
+	if selectedSubflow != nil {
+		return false, false, selectedSubflow
+	}
+	return true, true, nil
+}
+
+// hasOtherWritableSubflow tells if any subflow other than sf is open and not
+// in the middle of a write, i.e. could take the frames rescheduled from sf.
+func (bc *mpConn) hasOtherWritableSubflow(sf *subflow) bool {
+	bc.muSubflows.RLock()
+	defer bc.muSubflows.RUnlock()
+	for _, other := range bc.subflows {
+		if other == sf || atomic.LoadUint64(&other.actuallyBusyOnWrite) == 1 {
+			continue
+		}
+		select {
+		case <-other.chClose:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (bc *mpConn) sortedSubflows() []*subflow {
+	bc.muSubflows.RLock()
+	subflows := make([]*subflow, len(bc.subflows))
+	copy(subflows, bc.subflows)
+	bc.muSubflows.RUnlock()
+	rtts := bc.schedulingRTTs(subflows)
+	// the cheaper cost classes go first, and the lossy subflows to the back
+	// of their class regardless of their RTT
+	var lossy map[*subflow]bool
+	if bc.cfg.lossCooldown > 0 {
+		lossy = make(map[*subflow]bool, len(subflows))
+		for _, sf := range subflows {
+			lossy[sf] = sf.lossy()
+		}
+	}
+	sort.Slice(subflows, func(i, j int) bool {
+		a, b := subflows[i], subflows[j]
+		if a.costClass != b.costClass {
+			return a.costClass < b.costClass
+		}
+		if lossy[a] != lossy[b] {
+			return !lossy[a]
+		}
+		return rtts[a].less(rtts[b])
+	})
+	return subflows
+}
+
+// dataSubflows is like sortedSubflows but leaves out the subflows warming up,
+// unless all of them are.
+func (bc *mpConn) dataSubflows() []*subflow {
+	subflows := bc.sortedSubflows()
+	unpaused := make([]*subflow, 0, len(subflows))
+	for _, sf := range subflows {
+		if !sf.isPaused() {
+			unpaused = append(unpaused, sf)
+		}
+	}
+	if len(unpaused) > 0 {
+		subflows = unpaused
+	}
+	if bc.cfg.subflowWarmup == 0 {
+		return subflows
+	}
+	now := time.Now()
+	warmedUp := make([]*subflow, 0, len(subflows))
+	for _, sf := range subflows {
+		if !now.Before(sf.warmUntil) {
+			warmedUp = append(warmedUp, sf)
+		}
+	}
+	if len(warmedUp) == 0 {
+		return subflows
+	}
+	return warmedUp
+}
+
+// byMTU moves the subflows whose MTU is too small for a frame of sz bytes
+// after the others, the largest MTU first, see WithSubflowMTU.
+func byMTU(subflows []*subflow, sz int) []*subflow {
+	fits := make([]*subflow, 0, len(subflows))
+	var tooSmall []*subflow
+	for _, sf := range subflows {
+		if sf.mtu <= 0 || sf.mtu >= sz {
+			fits = append(fits, sf)
+		} else {
+			tooSmall = append(tooSmall, sf)
+		}
+	}
+	if len(tooSmall) == 0 {
+		return subflows
+	}
+	sort.SliceStable(tooSmall, func(i, j int) bool { return tooSmall[i].mtu > tooSmall[j].mtu })
+	return append(fits, tooSmall...)
+}
 
-		for _, sf := range bc.sortedSubflows() {
+type schedulingRTT struct {
+	rtt      time.Duration
+	measured bool
+	// queued is the delay of the frames queued on the subflow.
+	queued time.Duration
+}
 
-			if atomic.LoadUint64(&sf.actuallyBusyOnWrite) == 1 {
-				// Avoid a possibly blocked writer for a retransmit
-				continue
-			}
+// delivery is the estimated time for a new frame to be delivered.
+func (a schedulingRTT) delivery() time.Duration {
+	return a.rtt + a.queued
+}
 
-			select {
-			case sf.sendQueue <- frame:
-				return len(b), nil
-			default:
+// less prefers the earlier estimated delivery, and the measured one if they are
+// the same.
+func (a schedulingRTT) less(b schedulingRTT) bool {
+	if a.delivery() == b.delivery() {
+		return a.measured && !b.measured
+	}
+	return a.delivery() < b.delivery()
+}
+
+// schedulingRTTs returns the RTT the scheduler uses for each subflow, along
+// with the delay of the frames already queued on it. The ones yet to be
+// measured get the configured estimate, or the median RTT of the measured
+// ones, so that a new subflow is neither flooded with traffic nor left idle
+// before its first probe completes. It can't be lower than the time the probe
+// has been waiting for though. If the one-way delays of all subflows are
+// measured, the differences between their forward delays are used instead,
+// as the way back doesn't matter to delivery, see forwardRTTs.
+func (bc *mpConn) schedulingRTTs(subflows []*subflow) map[*subflow]schedulingRTT {
+	rtts := make(map[*subflow]schedulingRTT, len(subflows))
+	forwardRTTs := forwardRTTs(subflows)
+	var measured []time.Duration
+	var unmeasured []*subflow
+	for _, sf := range subflows {
+		rtt := sf.getRTT()
+		if forward, ok := forwardRTTs[sf]; ok {
+			rtt = forward
+		}
+		if atomic.LoadUint32(&sf.measured) == 1 {
+			rtts[sf] = schedulingRTT{rtt, true, sf.queueDelay()}
+			measured = append(measured, rtt)
+		} else {
+			unmeasured = append(unmeasured, sf)
+		}
+	}
+	estimate := bc.cfg.unmeasuredRTT
+	if estimate == 0 && len(measured) > 0 {
+		sort.Slice(measured, func(i, j int) bool { return measured[i] < measured[j] })
+		estimate = measured[len(measured)/2]
+	}
+	for _, sf := range unmeasured {
+		rtt := sf.getRTT()
+		if estimate > 0 {
+			rtt = estimate
+			if waited := sf.probeAge(); waited > rtt {
+				rtt = waited
 			}
 		}
-		if len(bc.sortedSubflows()) == 0 {
-			return 0, ErrClosed
+		rtts[sf] = schedulingRTT{rtt, false, sf.queueDelay()}
+	}
+	return rtts
+}
+
+// forwardRTTs returns the RTTs the subflows would have if both ways were as
+// slow as their forward delay, nil unless the forward delays of all of them
+// are measured. The forward delays are offset by the difference between the
+// clocks of both ends, so only the differences between them are used, on top
+// of the RTT of the subflow with the lowest forward delay, which cancels the
+// offset out.
+func forwardRTTs(subflows []*subflow) map[*subflow]time.Duration {
+	forwards := make(map[*subflow]time.Duration, len(subflows))
+	var lowest *subflow
+	for _, sf := range subflows {
+		forward, ok := sf.owd.forwardDelay()
+		if !ok {
+			return nil
 		}
+		forwards[sf] = forward
+		if lowest == nil || forward < forwards[lowest] {
+			lowest = sf
+		}
+	}
+	if lowest == nil {
+		return nil
+	}
+	base := lowest.getRTT()
+	rtts := make(map[*subflow]time.Duration, len(subflows))
+	for sf, forward := range forwards {
+		rtts[sf] = base + 2*(forward-forwards[lowest])
+	}
+	return rtts
+}
 
-		<-bc.writerMaybeReady
+func (bc *mpConn) Subflows() []SubflowInfo {
+	inflight := make(map[*subflow]int)
+	bc.pendingAckMu.RLock()
+	for _, pending := range bc.pendingAckMap {
+		inflight[pending.outboundSf] += int(pending.sz)
+	}
+	bc.pendingAckMu.RUnlock()
+	var infos []SubflowInfo
+	subflows := bc.sortedSubflows()
+	rtts := bc.schedulingRTTs(subflows)
+	for _, sf := range subflows {
+		info := sf.info()
+		info.BytesInFlight = inflight[sf]
+		info.EstimatedDelivery = rtts[sf].delivery()
+		infos = append(infos, info)
 	}
+	return infos
 }
 
-func (bc *mpConn) Close() error {
-	bc.close()
+// QueueStats are the peak occupancy of the queues of a connection over a
+// period of time. They tell if the queues are adequately sized.
+type QueueStats struct {
+	// ReceiveQueue is the maximum number of frames buffered to be read, and
+	// ReceiveQueueSize the current number of frames the queue can hold.
+	ReceiveQueue     int
+	ReceiveQueueSize int
+	// SendQueues are the maximum number of frames waiting to be sent on each
+	// subflow, including the one being sent, keyed by subflow label.
+	SendQueues map[string]int
+}
+
+func (bc *mpConn) QueueHighWaterMarks() QueueStats {
+	var stats QueueStats
+	stats.ReceiveQueue, stats.ReceiveQueueSize = bc.recvQueue.takePeakBuffered()
+	stats.SendQueues = make(map[string]int)
 	for _, sf := range bc.sortedSubflows() {
-		sf.close()
+		stats.SendQueues[sf.to] = int(atomic.SwapUint64(&sf.peakSendQueue, 0))
 	}
-	return nil
+	return stats
 }
 
-func (bc *mpConn) close() {
-	atomic.StoreUint32(&bc.closed, 1)
-	bc.recvQueue.close()
+// HOLStats quantify the head-of-line blocking of a connection.
+type HOLStats struct {
+	// Stalls is the number of times a missing frame held back the frames
+	// received after it, until it arrived either on a slower subflow or
+	// retransmitted.
+	Stalls uint64
+	// Total is the accumulated time of the stalls, and Longest the longest
+	// one.
+	Total   time.Duration
+	Longest time.Duration
+	// FastPathed is the number of frames received on the in-order subflows
+	// which were handed to Read right away, see WithInOrderSubflows.
+	FastPathed uint64
 }
 
-type fakeAddr struct{}
-
-func (fakeAddr) Network() string { return "multipath" }
-func (fakeAddr) String() string  { return "multipath" }
+func (bc *mpConn) HeadOfLineBlocking() HOLStats {
+	return bc.recvQueue.holStats()
+}
 
-func (bc *mpConn) LocalAddr() net.Addr {
-	return fakeAddr{}
+// GoodputStats compare the data delivered to the application with the data
+// received, the gap being the waste of the duplicates from retransmissions
+// and redundant sends.
+type GoodputStats struct {
+	// Delivered is the payload bytes read, each once and in order, from all
+	// streams.
+	Delivered uint64
+	// Received is the payload bytes of all data frames received on the
+	// subflows, including the duplicates.
+	Received uint64
+	// Since is when the connection was created, to calculate the rates.
+	Since time.Time
 }
 
-func (bc *mpConn) RemoteAddr() net.Addr {
-	return bc.remoteAddr
+func (bc *mpConn) Goodput() GoodputStats {
+	stats := GoodputStats{
+		Delivered: bc.recvQueue.deliveredBytes(),
+		Received:  atomic.LoadUint64(&bc.receivedBytes),
+		Since:     bc.createdAt,
+	}
+	bc.eachStream(func(rq *receiveQueue) {
+		stats.Delivered += rq.deliveredBytes()
+	})
+	return stats
 }
 
-func (bc *mpConn) SetDeadline(t time.Time) error {
-	bc.SetReadDeadline(t)
-	return bc.SetWriteDeadline(t)
+func (bc *mpConn) HighestDelivered() uint64 {
+	return bc.recvQueue.highestDelivered()
 }
 
-func (bc *mpConn) SetReadDeadline(t time.Time) error {
-	bc.recvQueue.setReadDeadline(t)
-	return nil
+func (bc *mpConn) Delivered(fn uint64) bool {
+	return fn >= minFrameNumber && fn <= bc.recvQueue.highestDelivered()
 }
 
-func (bc *mpConn) SetWriteDeadline(t time.Time) error {
-	bc.muSubflows.RLock()
-	defer bc.muSubflows.RUnlock()
-	for _, sf := range bc.subflows {
-		if err := sf.conn.SetWriteDeadline(t); err != nil {
-			return err
-		}
+func (bc *mpConn) LastFrameNumber() uint64 {
+	fn := atomic.LoadUint64(&bc.lastFN)
+	if fn < minFrameNumber {
+		return 0
 	}
-	return nil
+	return fn
 }
 
-func (bc *mpConn) retransmit(frame *sendFrame) {
-	frame.changeLock.Lock()
-	defer frame.changeLock.Unlock()
+// ChurnStats tell how stable the subflows of a connection are.
+type ChurnStats struct {
+	// Uptime is how long ago the connection was created.
+	Uptime time.Duration
+	// SubflowsAdded and SubflowsRemoved are the number of subflows ever
+	// added to and removed from the connection, including the ones removed
+	// when it's closed.
+	SubflowsAdded   uint64
+	SubflowsRemoved uint64
+}
 
-	if atomic.LoadUint64(&frame.beingRetransmitted) == 1 {
-		return
+func (bc *mpConn) Churn() ChurnStats {
+	return ChurnStats{
+		Uptime:          time.Since(bc.createdAt),
+		SubflowsAdded:   atomic.LoadUint64(&bc.subflowsAdded),
+		SubflowsRemoved: atomic.LoadUint64(&bc.subflowsRemoved),
 	}
-	atomic.StoreUint64(&frame.beingRetransmitted, 1)
-	defer func() {
-		atomic.StoreUint64(&frame.beingRetransmitted, 0)
-	}()
-
-	subflows := bc.sortedSubflows()
+}
 
-	alreadyTransmittedOnAllSubflows := false
-	for {
-		abort := false
-		if bc.closed == 1 {
-			return
-		}
+// FrameWindowStats are the occupancy of the frame number window of a
+// connection, see WithFrameWindow.
+type FrameWindowStats struct {
+	// Size is the configured window, zero if unlimited.
+	Size int
+	// Occupied is the number of frame numbers from the lowest one not acked
+	// yet to the last one sent, zero if all are acked. It's tracked even if
+	// the window is unlimited.
+	Occupied int
+	// Blocked is the number of writes which had to wait for the window to
+	// advance.
+	Blocked uint64
+}
 
-		var selectedSubflow *subflow
+func (bc *mpConn) FrameWindow() FrameWindowStats {
+	return FrameWindowStats{
+		Size:     bc.cfg.frameWindow,
+		Occupied: bc.frameWindowOccupied(),
+		Blocked:  atomic.LoadUint64(&bc.frameWindowBlocked),
+	}
+}
 
-		abort, alreadyTransmittedOnAllSubflows, selectedSubflow = selectSubflowForRetransmit(subflows, frame, false)
-		if selectedSubflow == nil {
-			abort, alreadyTransmittedOnAllSubflows, selectedSubflow = selectSubflowForRetransmit(subflows, frame, true)
-			if selectedSubflow == nil {
-				abort = true
-				alreadyTransmittedOnAllSubflows = true
-				break
-			}
-		}
+func (bc *mpConn) BytesInFlight() int {
+	bc.pendingAckMu.RLock()
+	defer bc.pendingAckMu.RUnlock()
+	total := 0
+	for _, pending := range bc.pendingAckMap {
+		total += int(pending.sz)
+	}
+	return total
+}
 
-		select {
-		case <-selectedSubflow.chClose:
-			continue
-		case selectedSubflow.sendQueue <- frame:
-			frame.retransmissions++
-			log.Debugf("retransmitted frame %d via %s", frame.fn, selectedSubflow.to)
-			if frame.sentVia == nil {
-				frame.sentVia = make([]transmissionDatapoint, 0)
-			}
-			frame.sentVia = append(frame.sentVia, transmissionDatapoint{selectedSubflow, time.Now()})
-			return
-		default:
-		}
+func (bc *mpConn) QueuedFrames() int {
+	total := 0
+	for _, sf := range bc.sortedSubflows() {
+		total += len(sf.sendQueue)
+	}
+	return total
+}
 
-		if abort {
-			break
-		}
-		<-bc.tryRetransmit
+func (bc *mpConn) SetSubflowRateLimit(to string, bytesPerSec int) error {
+	sf := bc.subflowTo(to)
+	if sf == nil {
+		return ErrUnknownSubflow
 	}
+	sf.setRateLimit(bytesPerSec)
+	return nil
+}
 
-	if !alreadyTransmittedOnAllSubflows {
-		log.Debugf("frame %d is being retransmitted on all subflows of %x", frame.fn, bc.cid)
+func (bc *mpConn) PauseSubflow(to string, drain bool) error {
+	sf := bc.subflowTo(to)
+	if sf == nil {
+		return ErrUnknownSubflow
+	}
+	atomic.StoreUint32(&sf.paused, 1)
+	if drain && bc.hasUnpausedSubflowOtherThan(sf) {
+		bc.drain(sf)
 	}
+	return nil
+}
 
-	return
+func (bc *mpConn) ResumeSubflow(to string) error {
+	sf := bc.subflowTo(to)
+	if sf == nil {
+		return ErrUnknownSubflow
+	}
+	if atomic.CompareAndSwapUint32(&sf.paused, 1, 0) {
+		// the writers may be waiting for room
+		bc.signalWritable()
+	}
+	return nil
 }
 
-func selectSubflowForRetransmit(subflows []*subflow, frame *sendFrame, timeFallback bool) (bool, bool, *subflow) {
-	var selectedSubflow *subflow
-	for _, sf := range subflows {
-		if atomic.LoadUint64(&sf.actuallyBusyOnWrite) == 1 {
-			// Avoid a possibly blocked writer for a retransmit
-			// let's avoid re-sending a frame down the same socket twice.
-			// Since at best, it just double sends a frame into the send buffer
-			// and at worst it blocks other frames from entering a send buffer.
-			continue
-		}
-		// Have we used this subflow before for this frame?
-		usedBefore := false
-		var avoidTime time.Time
-		for _, avoidSF := range frame.sentVia {
-			if sf == avoidSF.sf {
-				usedBefore = true
-				avoidTime = avoidSF.txTime
-			}
+// hasUnpausedSubflowOtherThan tells if there's anywhere else to drain the
+// frames of sf to.
+func (bc *mpConn) hasUnpausedSubflowOtherThan(sf *subflow) bool {
+	for _, other := range bc.sortedSubflows() {
+		if other != sf && !other.isPaused() {
+			return true
 		}
+	}
+	return false
+}
 
-		// It may be acceptable to use a subflow that has been used before
-		// if we are in timeFallback mode
-		if usedBefore {
-			if timeFallback {
-				if time.Since(avoidTime) > time.Second {
-					usedBefore = false
-				}
+// drain retransmits the data frames queued or in flight on the paused sf on
+// the other subflows.
+func (bc *mpConn) drain(sf *subflow) {
+	for drained := false; !drained; {
+		select {
+		case frame := <-sf.sendQueue:
+			if frame.isDataFrame() && frame.fn >= minFrameNumber {
+				go bc.retransmit(frame, RetransmitSubflowPaused)
 			} else {
-				continue
+				// acks and probes are still sent on it
+				go sf.requeue(frame)
 			}
+		default:
+			drained = true
 		}
-
-		if !usedBefore {
-			// frame.sentVia
-			return false, false, sf
+	}
+	var inFlight []*sendFrame
+	bc.pendingAckMu.RLock()
+	for _, pending := range bc.pendingAckMap {
+		if pending.outboundSf == sf && pending.framePtr != nil {
+			inFlight = append(inFlight, pending.framePtr)
+		}
+	}
+	bc.pendingAckMu.RUnlock()
+	for _, frame := range inFlight {
+		frame.changeLock.Lock()
+		if bc.isPendingAck(frame.fn) && frame.beingRetransmitted == 0 {
+			go bc.retransmit(frame, RetransmitSubflowPaused)
 		}
+		frame.changeLock.Unlock()
 	}
-	return true, true, selectedSubflow
+	bc.reschedulePassedThrough(sf)
 }
 
-func (bc *mpConn) sortedSubflows() []*subflow {
+func (bc *mpConn) subflowTo(to string) *subflow {
 	bc.muSubflows.RLock()
-	subflows := make([]*subflow, len(bc.subflows))
-	copy(subflows, bc.subflows)
-	bc.muSubflows.RUnlock()
-	sort.Slice(subflows, func(i, j int) bool {
-		return subflows[i].getRTT() < subflows[j].getRTT()
-	})
-	return subflows
+	defer bc.muSubflows.RUnlock()
+	for _, sf := range bc.subflows {
+		if sf.to == to {
+			return sf
+		}
+	}
+	return nil
 }
 
 func (bc *mpConn) add(to string, c net.Conn, clientSide bool, probeStart time.Time, tracker StatsTracker) {
+	bc.markSubflow(to, c)
+	if cb := bc.cfg.onSubflowAdded; cb != nil {
+		cb(bc, to, c)
+	}
 	bc.muSubflows.Lock()
-	defer bc.muSubflows.Unlock()
+	if atomic.LoadUint32(&bc.closed) == 1 {
+		// e.g. the connection is closed while dialing the rest subflows
+		bc.muSubflows.Unlock()
+		c.Close()
+		return
+	}
 	bc.subflows = append(bc.subflows, startSubflow(to, c, bc, clientSide, probeStart, tracker))
+	bc.muSubflows.Unlock()
+	atomic.AddUint64(&bc.subflowsAdded, 1)
+	bc.setState(Established)
+	bc.signalWritable()
+	bc.checkMinSubflows(false)
+	bc.pathsChanged()
 }
 
 func (bc *mpConn) remove(theSubflow *subflow) {
@@ -248,28 +2215,197 @@ func (bc *mpConn) remove(theSubflow *subflow) {
 			remains = append(remains, sf)
 		}
 	}
+	removed := len(remains) < len(bc.subflows)
 	bc.subflows = remains
+	if bc.activeSubflow == theSubflow {
+		bc.activeSubflow = nil
+	}
 	left := len(remains)
 	bc.muSubflows.Unlock()
+	if removed {
+		atomic.AddUint64(&bc.subflowsRemoved, 1)
+		bc.pathsChanged()
+	}
 	if left == 0 {
 		bc.close()
+		return
+	} else if left == 1 {
+		bc.setState(Degraded)
+	} else {
+		bc.setState(Established)
+	}
+	bc.checkMinSubflows(true)
+}
+
+// checkMinSubflows compares the healthy subflows with the configured minimum,
+// and takes the actions if they just dropped below it. As subflows are added
+// one by one when connecting, the actions are only taken if dropped is true,
+// i.e. a subflow has just gone or become lossy.
+func (bc *mpConn) checkMinSubflows(dropped bool) {
+	min := bc.cfg.minSubflows
+	if min == 0 || atomic.LoadUint32(&bc.closed) == 1 {
+		return
+	}
+	healthy := 0
+	for _, sf := range bc.sortedSubflows() {
+		if !sf.lossy() {
+			healthy++
+		}
+	}
+	if healthy >= min {
+		atomic.StoreUint32(&bc.belowMinSubflows, 0)
+		return
+	}
+	if !dropped || !atomic.CompareAndSwapUint32(&bc.belowMinSubflows, 0, 1) {
+		return
+	}
+	log.Debugf("%x is down to %d healthy subflows, below the min %d", bc.cid, healthy, min)
+	if cb := bc.cfg.onBelowMinSubflows; cb != nil {
+		cb(bc, healthy)
+	}
+	if bc.cfg.redialBelowMin && bc.redial != nil && atomic.CompareAndSwapUint32(&bc.redialing, 0, 1) {
+		go func() {
+			defer atomic.StoreUint32(&bc.redialing, 0)
+			bc.redial()
+		}()
+	}
+}
+
+func (bc *mpConn) Migrate(newConns []net.Conn) error {
+	if !bc.clientSide {
+		return ErrNotClientSide
+	}
+	if atomic.LoadUint32(&bc.closed) == 1 {
+		return ErrClosed
+	}
+	oldSubflows := bc.sortedSubflows()
+	var lastErr error
+	joined := 0
+	for i, conn := range newConns {
+		// the new subflows take over the stats of the ones they replace
+		var tracker StatsTracker = NullTracker{}
+		if len(oldSubflows) > 0 {
+			tracker = oldSubflows[i%len(oldSubflows)].tracker
+		}
+		if err := bc.join(conn, tracker); err != nil {
+			log.Errorf("failed to handshake %v when migrating, continuing: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		if lastErr == nil {
+			lastErr = ErrFailOnAllDialers
+		}
+		return lastErr
+	}
+
+	isOld := make(map[*subflow]bool)
+	for _, sf := range oldSubflows {
+		isOld[sf] = true
+	}
+	var stranded []*sendFrame
+	bc.pendingAckMu.RLock()
+	for _, pending := range bc.pendingAckMap {
+		if isOld[pending.outboundSf] {
+			stranded = append(stranded, pending.framePtr)
+		}
+	}
+	bc.pendingAckMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, sf := range oldSubflows {
+		wg.Add(1)
+		go func(sf *subflow) {
+			sf.close()
+			wg.Done()
+		}(sf)
+	}
+	wg.Wait()
+	// Frames still queued on the old subflows are rescheduled when their
+	// send loops exit. Take care of the ones already sent on them here rather
+	// than waiting for them to time out.
+	for _, frame := range stranded {
+		if bc.isPendingAck(frame.fn) {
+			go bc.retransmit(frame, RetransmitSubflowFailed)
+		}
+	}
+	return nil
+}
+
+// join does the handshake on an already connected conn and adds it to the
+// connection as a new subflow reporting to tracker.
+func (bc *mpConn) join(conn net.Conn, tracker StatsTracker) error {
+	ctx := context.Background()
+	if bc.cfg.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bc.cfg.dialTimeout)
+		defer cancel()
 	}
+	_, probeStart, err := handshake(ctx, conn, bc.cid, bc.cfg.joinSecret)
+	if err != nil {
+		return err
+	}
+	bc.add(fmt.Sprintf("%x(%s)", bc.cid, conn.RemoteAddr()), conn, true, probeStart, tracker)
+	return nil
+}
+
+// jitterRand draws the retransmission jitters. Unlike the global source, which
+// isn't seeded before Go 1.20, it differs among processes, so that the peers
+// of a server recovering from the same blip don't draw the same jitters.
+var jitterRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// retransmitJitter draws the jitter added to the retransmission timeout of a
+// frame each time it's written, see WithRetransmitJitter.
+func (bc *mpConn) retransmitJitter() time.Duration {
+	max := bc.cfg.retransmitJitter
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(jitterRand.Int63n(int64(max)))
 }
 
 func (bc *mpConn) retransmitLoop() {
-	evalTick := time.NewTicker(time.Millisecond * 100)
+	evalTick := time.NewTicker(retransmitEvalInterval)
+	defer evalTick.Stop()
+	defer bc.releaseMemory()
 	for {
 		select {
 		case <-evalTick.C:
+		case <-bc.chDone:
+			return
 		}
 		if atomic.LoadUint32(&bc.closed) == 1 {
 			return
 		}
+		if atomic.LoadUint32(&bc.retransmitPaused) == 1 {
+			continue
+		}
 
 		bc.pendingAckMu.RLock()
 		RetransmitFrames := make([]pendingAck, 0)
 		for fn, frame := range bc.pendingAckMap {
-			if time.Since(frame.sentAt) > frame.outboundSf.retransTimer() {
+			if frame.age() > frame.outboundSf.retransTimer()+frame.framePtr.retransmitJitter() {
 				if bc.pendingAckMap[fn] != nil {
 					RetransmitFrames = append(RetransmitFrames, *frame)
 				}
@@ -277,18 +2413,24 @@ func (bc *mpConn) retransmitLoop() {
 		}
 		bc.pendingAckMu.RUnlock()
 
-		sort.Slice(RetransmitFrames, func(i, j int) bool {
-			return RetransmitFrames[i].fn < RetransmitFrames[j].fn
-		})
+		sortForRetransmit(RetransmitFrames, bc.cfg.retransmitOrder)
 
+		var timedOut []*sendFrame
 		for _, frame := range RetransmitFrames {
 			sendframe := frame.framePtr
 			sendframe.changeLock.Lock()
 			if bc.isPendingAck(frame.fn) {
 				// No ack means the subflow fails or has a longer RTT
 				// log.Errorf("Retransmitting! %#v", frame.fn)
-				if sendframe.beingRetransmitted == 0 {
-					go bc.retransmit(sendframe)
+				if max := bc.cfg.maxRetransmissions; (max > 0 && sendframe.retransmissions >= max) || bc.tooLate(sendframe) {
+					sendframe.changeLock.Unlock()
+					bc.abandon(sendframe)
+					continue
+				}
+				if sendframe.beingRetransmitted == 0 && !sendframe.retransmitQueued {
+					frame.outboundSf.recordLoss()
+					sendframe.retransmitQueued = true
+					timedOut = append(timedOut, sendframe)
 				}
 				sendframe.changeLock.Unlock()
 			} else {
@@ -299,14 +2441,102 @@ func (bc *mpConn) retransmitLoop() {
 				bc.pendingAckMu.Lock()
 				delete(bc.pendingAckMap, frame.fn)
 				bc.pendingAckMu.Unlock()
+				bc.ackWaiters.signal()
+			}
+		}
+		bc.queueRetransmits(timedOut)
+	}
+}
+
+// queueRetransmits appends the frames to the retransmit queue.
+func (bc *mpConn) queueRetransmits(frames []*sendFrame) {
+	if len(frames) == 0 {
+		return
+	}
+	bc.muRetransmitQueue.Lock()
+	bc.retransmitQueue = append(bc.retransmitQueue, frames...)
+	bc.muRetransmitQueue.Unlock()
+	select {
+	case bc.chRetransmitQueued <- struct{}{}:
+	default:
+	}
+}
+
+// retransmitter retransmits the frames in the retransmit queue one at a time,
+// so that they are sent in the order they were sorted. The ones acked while
+// waiting in the queue are skipped.
+func (bc *mpConn) retransmitter() {
+	for {
+		select {
+		case <-bc.chRetransmitQueued:
+		case <-bc.chDone:
+			return
+		}
+		for {
+			bc.muRetransmitQueue.Lock()
+			if len(bc.retransmitQueue) == 0 {
+				bc.muRetransmitQueue.Unlock()
+				break
+			}
+			frame := bc.retransmitQueue[0]
+			bc.retransmitQueue[0] = nil
+			bc.retransmitQueue = bc.retransmitQueue[1:]
+			bc.muRetransmitQueue.Unlock()
+			if bc.isPendingAck(frame.fn) {
+				bc.retransmit(frame, RetransmitTimeout)
 			}
 		}
+	}
+}
+
+// queueAck sends the ack to frame fn via sf, or if ack piggybacking is
+// enabled, holds it so that it can be carried by outgoing data frames, and
+// sends it via sf only if there's no data to send within the ack delay.
+func (bc *mpConn) queueAck(fn uint64, sf *subflow) {
+	if bc.cfg.ackDelay == 0 {
+		sf.ack(fn)
+		return
+	}
+	bc.muUnsentAcks.Lock()
+	bc.unsentAcks[fn] = sf
+	if !bc.ackFlushPending {
+		bc.ackFlushPending = true
+		time.AfterFunc(bc.cfg.ackDelay, bc.flushAcks)
+	}
+	bc.muUnsentAcks.Unlock()
+}
+
+func (bc *mpConn) flushAcks() {
+	bc.muUnsentAcks.Lock()
+	acks := bc.unsentAcks
+	bc.unsentAcks = make(map[uint64]*subflow)
+	bc.ackFlushPending = false
+	bc.muUnsentAcks.Unlock()
+	for fn, sf := range acks {
+		sf.ack(fn)
+	}
+}
 
+// ackedUpTo drops the held acks which are covered by the cumulative ackFN
+// being piggybacked.
+func (bc *mpConn) ackedUpTo(ackFN uint64) {
+	bc.muUnsentAcks.Lock()
+	for fn := range bc.unsentAcks {
+		if fn <= ackFN {
+			delete(bc.unsentAcks, fn)
+		}
 	}
+	bc.muUnsentAcks.Unlock()
+}
+
+func sortForRetransmit(frames []pendingAck, order RetransmitOrder) {
+	sort.Slice(frames, func(i, j int) bool {
+		return order(frames[i].toPendingFrame(), frames[j].toPendingFrame())
+	})
 }
 
 func (bc *mpConn) isPendingAck(fn uint64) bool {
-	if fn > minFrameNumber {
+	if fn >= minFrameNumber {
 		bc.pendingAckMu.RLock()
 		defer bc.pendingAckMu.RUnlock()
 		return bc.pendingAckMap[fn] != nil
@@ -0,0 +1,2092 @@
+package multipath
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/ema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxFrameSize(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 1, WithMaxFrameSize(1000))
+	n, err := client.Write(make([]byte, 1001))
+	assert.Equal(t, ErrFrameTooLarge, err)
+	assert.Zero(t, n)
+
+	n, err = client.Write(nil)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = client.Write(make([]byte, 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, n)
+	_, err = io.ReadFull(server, make([]byte, 1000))
+	assert.NoError(t, err)
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	transitions := make(map[Conn][]string)
+	client, _, _ := newTestConnPair(t, 2, WithStateCallback(func(conn Conn, from, to ConnState) {
+		mu.Lock()
+		transitions[conn] = append(transitions[conn], from.String()+"->"+to.String())
+		mu.Unlock()
+	}))
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, Established, client.(Conn).State())
+
+	bc.sortedSubflows()[0].close()
+	assert.Equal(t, Degraded, client.(Conn).State())
+	client.Close()
+	assert.Equal(t, Closed, client.(Conn).State())
+	mu.Lock()
+	assert.Equal(t, []string{"connecting->established", "established->degraded", "degraded->closing", "closing->closed"}, transitions[client.(Conn)])
+	mu.Unlock()
+}
+
+func TestReadBufferedDataAfterTransportClose(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	for _, s := range []string{"hello", " ", "world"} {
+		_, err := server.Write([]byte(s))
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		bc.recvQueue.readLock.Lock()
+		defer bc.recvQueue.readLock.Unlock()
+		return bc.recvQueue.buf[(minFrameNumber+2)%bc.recvQueue.size].bytes != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// the transport drops without the connection being closed
+	for _, sf := range bc.sortedSubflows() {
+		sf.conn.Close()
+	}
+	assert.Eventually(t, func() bool { return bc.State() == Closed }, 2*time.Second, 10*time.Millisecond)
+
+	b, err := io.ReadAll(client)
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, "hello world", string(b))
+	_, err = client.Read(make([]byte, 10))
+	assert.Equal(t, ErrClosed, err)
+}
+
+// pausableConn blocks reading while paused.
+type pausableConn struct {
+	net.Conn
+	paused *int32
+}
+
+func (c *pausableConn) Read(b []byte) (int, error) {
+	for atomic.LoadInt32(c.paused) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	return c.Conn.Read(b)
+}
+
+func TestFlush(t *testing.T) {
+	var paused int32
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &pausableConn{c, &paused}
+	})
+	go io.Copy(io.Discard, server)
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, client.(Conn).Flush(context.Background()))
+	bc := client.(*mpConn)
+	assert.False(t, bc.hasUnackedUpTo(atomic.LoadUint64(&bc.lastFN)))
+
+	atomic.StoreInt32(&paused, 1)
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.(Conn).Flush(ctx))
+
+	atomic.StoreInt32(&paused, 0)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.(Conn).Flush(ctx))
+}
+
+func TestRetransmitJitter(t *testing.T) {
+	bc := &mpConn{cfg: defaultConfig()}
+	assert.Zero(t, bc.retransmitJitter(), "should be disabled by default")
+
+	bc.cfg = newConfig([]Option{WithRetransmitJitter(time.Second)})
+	ticks := make(map[time.Duration]bool)
+	jitters := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		jitter := bc.retransmitJitter()
+		assert.True(t, jitter >= 0 && jitter < time.Second, "%v", jitter)
+		ticks[jitter/(100*time.Millisecond)] = true
+		jitters[jitter] = true
+	}
+	assert.Len(t, ticks, 10, "should spread the frames timing out together over the evaluation ticks")
+	assert.Greater(t, len(jitters), 900, "should draw a random jitter each time")
+
+	client, server, _ := newTestConnPair(t, 1, WithRetransmitJitter(time.Second))
+	defer server.Close()
+	defer client.Close()
+	frame := composeFrame(minFrameNumber, []byte("a"))
+	client.(*mpConn).subflows[0].writeQueued(frame)
+	assert.NotZero(t, frame.retransmitJitter(), "should draw the jitter when the frame is written")
+}
+
+func TestRetransmitOrder(t *testing.T) {
+	now := time.Now()
+	frames := []pendingAck{
+		{fn: 12, sentAt: now.Add(-3 * time.Second)},
+		{fn: 10, sentAt: now.Add(-1 * time.Second)},
+		{fn: 11, sentAt: now.Add(-2 * time.Second)},
+	}
+	fns := func() (fns []uint64) {
+		for _, f := range frames {
+			fns = append(fns, f.fn)
+		}
+		return
+	}
+	sortForRetransmit(frames, OldestFrameFirst)
+	assert.Equal(t, []uint64{10, 11, 12}, fns())
+	sortForRetransmit(frames, NewestFrameFirst)
+	assert.Equal(t, []uint64{12, 11, 10}, fns())
+	sortForRetransmit(frames, LongestWaitingFirst)
+	assert.Equal(t, []uint64{12, 11, 10}, fns())
+	frames[0].sentAt = now
+	sortForRetransmit(frames, LongestWaitingFirst)
+	assert.Equal(t, []uint64{11, 10, 12}, fns())
+}
+
+func TestRetransmitInOrder(t *testing.T) {
+	var paused int32
+	chFN := make(chan uint64, 100)
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &pausableConn{c, &paused}
+	}, WithInitialRTO(100*time.Millisecond), WithMaxRTO(100*time.Millisecond),
+		WithRetransmitCallback(func(conn Conn, event RetransmitEvent) {
+			if event.Retransmissions == 1 {
+				chFN <- event.FN
+			}
+		}))
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+	assert.Eventually(t, func() bool { return len(client.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	atomic.StoreInt32(&paused, 1)
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}
+	var fns []uint64
+	for len(fns) < 10 {
+		select {
+		case fn := <-chFN:
+			fns = append(fns, fn)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d frames retransmitted", len(fns))
+		}
+	}
+	atomic.StoreInt32(&paused, 0)
+	assert.True(t, sort.SliceIsSorted(fns, func(i, j int) bool { return fns[i] < fns[j] }), "should retransmit in the order sorted: %v", fns)
+}
+
+func TestBytesInFlight(t *testing.T) {
+	var paused int32
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &pausableConn{c, &paused}
+	})
+	go io.Copy(io.Discard, server)
+	atomic.StoreInt32(&paused, 1)
+	for i := 0; i < 5; i++ {
+		_, err := client.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool { return client.(Conn).BytesInFlight() == 500 }, time.Second, 10*time.Millisecond)
+	infos := client.(Conn).Subflows()
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, 500, infos[0].BytesInFlight)
+	}
+	atomic.StoreInt32(&paused, 0)
+	assert.Eventually(t, func() bool { return client.(Conn).BytesInFlight() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestQueuedFrames(t *testing.T) {
+	var stalled int32
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &stallingConn{c, &stalled}
+	})
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	assert.Eventually(t, func() bool { return client.(Conn).QueuedFrames() == 0 }, time.Second, 10*time.Millisecond)
+	atomic.StoreInt32(&stalled, 1)
+	chWritten := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			_, err := client.Write([]byte{byte(i)})
+			assert.NoError(t, err)
+		}
+		close(chWritten)
+	}()
+	assert.Eventually(t, func() bool { return client.(Conn).QueuedFrames() == 1 }, time.Second, 10*time.Millisecond,
+		"should count the frame queued behind the one being written")
+	infos := client.(Conn).Subflows()
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, 1, infos[0].QueuedFrames)
+	}
+	atomic.StoreInt32(&stalled, 0)
+	<-chWritten
+	assert.Eventually(t, func() bool { return client.(Conn).QueuedFrames() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestFrameWindow(t *testing.T) {
+	t.Run("unordered", func(t *testing.T) { testFrameWindow(t) })
+	t.Run("ordered", func(t *testing.T) { testFrameWindow(t, WithOrderedWrites()) })
+}
+
+func testFrameWindow(t *testing.T, opts ...Option) {
+	var paused int32
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &pausableConn{c, &paused}
+	}, append(opts, WithFrameWindow(3))...)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	atomic.StoreInt32(&paused, 1)
+	for i := 0; i < 3; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, FrameWindowStats{Size: 3, Occupied: 3}, client.(Conn).FrameWindow())
+	chWritten := make(chan struct{})
+	go func() {
+		_, err := client.Write([]byte{3})
+		assert.NoError(t, err)
+		close(chWritten)
+	}()
+	select {
+	case <-chWritten:
+		assert.Fail(t, "should block until the acks advance the window")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.EqualValues(t, 1, client.(Conn).FrameWindow().Blocked)
+	atomic.StoreInt32(&paused, 0)
+	<-chWritten
+	assert.Eventually(t, func() bool { return client.(Conn).FrameWindow().Occupied == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestFrameWindowConcurrentWriters(t *testing.T) {
+	bc := newMPConn(zeroCID, nil, newConfig([]Option{WithFrameWindow(3)}))
+	defer bc.Close()
+	compose := func() *sendFrame {
+		// leaves time for the other writers to find the same room
+		time.Sleep(time.Millisecond)
+		return composeFrame(atomic.AddUint64(&bc.lastFN, 1), []byte{0})
+	}
+	chReserved := make(chan *sendFrame, 20)
+	chErr := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			frame, err := bc.reserveFrame(compose, nil)
+			if err != nil {
+				chErr <- err
+				return
+			}
+			chReserved <- frame
+		}()
+	}
+	var reserved []*sendFrame
+	for len(reserved) < 3 {
+		reserved = append(reserved, <-chReserved)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, chReserved, 0, "should not let concurrent writes take the same room")
+	assert.Equal(t, 3, bc.FrameWindow().Occupied)
+
+	// the window advancing wakes up a single one of them
+	lowest := reserved[0]
+	for _, frame := range reserved {
+		if frame.fn < lowest.fn {
+			lowest = frame
+		}
+	}
+	bc.unqueue(lowest)
+	select {
+	case <-chReserved:
+	case <-time.After(time.Second):
+		assert.Fail(t, "should wake up a writer once the window advances")
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, chReserved, 0)
+	assert.Equal(t, 3, bc.FrameWindow().Occupied)
+
+	bc.Close()
+	for i := 0; i < 16; i++ {
+		assert.Equal(t, ErrClosed, <-chErr)
+	}
+}
+
+func TestDegradedWritePolicy(t *testing.T) {
+	degrade := func(opts ...Option) (Conn, net.Conn, *int32) {
+		var stalled int32
+		client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+			return &stallingConn{c, &stalled}
+		}, opts...)
+		bc := client.(*mpConn)
+		assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+		bc.sortedSubflows()[0].close()
+		assert.Equal(t, Degraded, bc.State())
+		// let the acks and probes queued by then go
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&stalled, 1)
+		return bc, server, &stalled
+	}
+
+	client, server, stalled := degrade(WithDegradedWritePolicy(FailWhenDegraded, 0))
+	var err error
+	written := 0
+	for ; written < 10; written++ {
+		if _, err = client.Write([]byte{byte(written)}); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, ErrDegraded)
+	assert.LessOrEqual(t, written, 2, "should fail once the subflow is full")
+	atomic.StoreInt32(stalled, 0)
+	assert.Eventually(t, func() bool {
+		_, err := client.Write([]byte{byte(written)})
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "should succeed again once the subflow drains")
+	b := make([]byte, written+1)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	client.Close()
+	server.Close()
+
+	client, server, stalled = degrade(WithDegradedWritePolicy(BufferWhenDegraded, 5))
+	defer client.Close()
+	defer server.Close()
+	written = 0
+	for ; written < 20; written++ {
+		if _, err = client.WriteDeadline([]byte{byte(written)}, time.Now().Add(50*time.Millisecond)); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "should wait once the buffer is full")
+	assert.GreaterOrEqual(t, written, 5)
+	assert.LessOrEqual(t, written, 8)
+	atomic.StoreInt32(stalled, 0)
+	b = make([]byte, written)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	for i := range b {
+		assert.Equal(t, byte(i), b[i], "should send the buffered frames in order")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	oldL, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer oldL.Close()
+	newL, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer newL.Close()
+	bl := NewListener([]net.Listener{oldL, newL}, []StatsTracker{NullTracker{}, NullTracker{}})
+	defer bl.Close()
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := bl.Accept()
+		if assert.NoError(t, err) {
+			chAccepted <- conn
+		}
+	}()
+	var dead int32
+	td := newTestDialer(oldL.Addr().String(), 0)
+	td.wrap = func(c net.Conn) net.Conn { return &deadPathConn{c, &dead} }
+	client, err := NewDialer("endpoint", []Dialer{td}).DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	server := <-chAccepted
+	defer server.Close()
+	assert.Equal(t, ErrNotClientSide, server.(Conn).Migrate(nil))
+
+	// the old path goes dead with some frames pending on it
+	atomic.StoreInt32(&dead, 1)
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	conn, err := net.Dial("tcp", newL.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, client.(Conn).Migrate([]net.Conn{conn}))
+	infos := client.(Conn).Subflows()
+	if assert.Len(t, infos, 1) {
+		assert.Contains(t, infos[0].To, newL.Addr().String())
+	}
+	assert.Equal(t, Degraded, client.(Conn).State())
+
+	b := make([]byte, 10)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, b)
+
+	_, err = server.Write([]byte("back"))
+	assert.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(client, b[:4])
+	assert.NoError(t, err)
+	assert.Equal(t, "back", string(b[:4]))
+}
+
+// deadPathConn silently drops everything written while dead.
+type deadPathConn struct {
+	net.Conn
+	dead *int32
+}
+
+func (c *deadPathConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(c.dead) == 1 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestDeliveryCallback(t *testing.T) {
+	type delivery struct {
+		fn      uint64
+		subflow string
+		size    int
+	}
+	var mu sync.Mutex
+	var deliveries []delivery
+	client, server, _ := newTestConnPair(t, 2, WithDeliveryCallback(func(conn Conn, fn uint64, subflow string, size int) {
+		mu.Lock()
+		deliveries = append(deliveries, delivery{fn, subflow, size})
+		mu.Unlock()
+	}))
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}
+	// read in small chunks so that a frame takes multiple reads
+	b := make([]byte, 3)
+	total := 0
+	for total < 50 {
+		n, err := server.Read(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		total += n
+	}
+	labels := make(map[string]bool)
+	for _, info := range server.(Conn).Subflows() {
+		labels[info.To] = true
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, deliveries, 10) {
+		for i, d := range deliveries {
+			assert.Equal(t, minFrameNumber+uint64(i), d.fn)
+			assert.True(t, labels[d.subflow], d.subflow)
+			assert.Equal(t, 5, d.size)
+		}
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	var frames int32
+	client, server, _ := newTestConnPair(t, 2, WithWriteCoalescing(time.Hour, 100), WithDeliveryCallback(func(Conn, uint64, string, int) {
+		atomic.AddInt32(&frames, 1)
+	}))
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}
+	// reaching the size triggers sending the data held, followed by the large write
+	_, err := client.Write(make([]byte, 100))
+	assert.NoError(t, err)
+	b := make([]byte, 150)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hellohello", string(b[:10]))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&frames))
+
+	_, err = client.Write([]byte("flush"))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.(Conn).Flush(ctx))
+	_, err = io.ReadFull(server, b[:5])
+	assert.NoError(t, err)
+	assert.Equal(t, "flush", string(b[:5]))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&frames))
+}
+
+func TestWriteCoalescingKeepsOrder(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2, WithWriteCoalescing(10*time.Millisecond, 100))
+	defer server.Close()
+	defer client.Close()
+	const writers, writes = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				record := []byte{byte(w), byte(i >> 8), byte(i)}
+				var err error
+				if w == 0 && i%10 == 0 {
+					// sent right away after the writes held
+					_, err = client.(Conn).WriteTagged(record, uint64(i+1))
+				} else {
+					_, err = client.Write(record)
+				}
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	b := make([]byte, 3*writers*writes)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	wg.Wait()
+	next := make([]int, writers)
+	for i := 0; i < len(b); i += 3 {
+		w, seq := int(b[i]), int(b[i+1])<<8|int(b[i+2])
+		if !assert.Equal(t, next[w], seq, "writes of %d out of order", w) {
+			return
+		}
+		next[w]++
+	}
+}
+
+func TestWriteCoalescingMaxDelay(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 1, WithWriteCoalescing(50*time.Millisecond, 1000))
+	start := time.Now()
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestSetNoDelay(t *testing.T) {
+	var frames int32
+	client, server, _ := newTestConnPair(t, 1, WithWriteCoalescing(time.Hour, 1000), WithDeliveryCallback(func(Conn, uint64, string, int) {
+		atomic.AddInt32(&frames, 1)
+	}))
+	_, err := client.Write([]byte("held"))
+	assert.NoError(t, err)
+	// the write held is sent when no delay is set
+	assert.NoError(t, client.(Conn).SetNoDelay(true))
+	for i := 0; i < 3; i++ {
+		_, err := client.Write([]byte("each"))
+		assert.NoError(t, err)
+	}
+	b := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "heldeacheacheach", string(b))
+	assert.EqualValues(t, 4, atomic.LoadInt32(&frames))
+
+	assert.NoError(t, client.(Conn).SetNoDelay(false))
+	_, err = client.Write([]byte("held"))
+	assert.NoError(t, err)
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = server.Read(b)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDone(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	select {
+	case <-client.(Conn).Done():
+		t.Fatal("should not be done before closing")
+	default:
+	}
+	client.Close()
+	select {
+	case <-client.(Conn).Done():
+	case <-time.After(time.Second):
+		t.Fatal("should be done after closing")
+	}
+	// the peer is done once all subflows are gone
+	select {
+	case <-server.(Conn).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer should be done after the subflows are gone")
+	}
+	client.Close()
+}
+
+func TestWriteRedundant(t *testing.T) {
+	client, server, trackers := newTestConnPair(t, 3)
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 3 }, time.Second, 10*time.Millisecond)
+	received := func() (total uint64) {
+		for _, tracker := range trackers {
+			total += atomic.LoadUint64(&tracker.recv)
+		}
+		return
+	}
+	b := make([]byte, 5)
+	_, err := client.Write([]byte("plain"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return received() == 1 }, time.Second, 10*time.Millisecond)
+
+	_, err = client.(Conn).WriteRedundant([]byte("twice"), 2)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "twice", string(b))
+	assert.Eventually(t, func() bool { return received() == 3 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 3, received(), "should be sent on exactly 2 subflows")
+
+	// the duplicate is dropped
+	_, err = client.Write([]byte("after"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "after", string(b))
+}
+
+func TestSendCopiesDoesNotBlock(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	for i, to := range []string{"a", "b", "c"} {
+		// ordered by the cost classes
+		mpc.subflows = append(mpc.subflows, &subflow{to: to, mpc: mpc, rtt: newEWMAEstimator(), emaSerialization: ema.NewDuration(0, rttAlpha), costClass: i, sendQueue: make(chan *sendFrame, 1)})
+	}
+	a, b, c := mpc.subflows[0], mpc.subflows[1], mpc.subflows[2]
+	full := composeFrame(minFrameNumber, []byte("full"))
+	b.sendQueue <- full
+	frame := composeFrame(minFrameNumber+1, []byte("copy"))
+	done := make(chan struct{})
+	go func() {
+		mpc.sendCopies(frame, a, 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("should not wait for room for the copies")
+	}
+	assert.Len(t, a.sendQueue, 0, "should not copy on the primary")
+	select {
+	case copied := <-c.sendQueue:
+		assert.Equal(t, frame, copied)
+	default:
+		assert.Fail(t, "should copy on the subflow with room")
+	}
+	assert.Equal(t, full, <-b.sendQueue)
+	b.queueHeldCopy()
+	select {
+	case copied := <-b.sendQueue:
+		assert.Equal(t, frame, copied, "should queue the copy held once there's room")
+	default:
+		assert.Fail(t, "should hold the copy for the full subflow")
+	}
+
+	// the first one goes to the send queue
+	for i := 0; i < maxHeldCopies+2; i++ {
+		b.holdCopy(frame)
+	}
+	assert.Len(t, b.sendQueue, 1)
+	assert.Equal(t, maxHeldCopies, len(b.heldCopies), "should drop the copies beyond the limit")
+}
+
+func TestScheduleLog(t *testing.T) {
+	var disabled *scheduleLog
+	disabled.add(1, &subflow{to: "a"}, ScheduledBest)
+	assert.Nil(t, disabled.decisions())
+
+	client, server, _ := newTestConnPair(t, 2, WithScheduleLog(3))
+	defer client.Close()
+	defer server.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, client.(Conn).RecentSchedules())
+
+	b := make([]byte, 5)
+	_, err := client.Write([]byte("plain"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	_, err = client.(Conn).WriteRedundant([]byte("twice"), 2)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	var decisions []ScheduleDecision
+	assert.Eventually(t, func() bool {
+		decisions = client.(Conn).RecentSchedules()
+		return len(decisions) == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, ScheduledBest, decisions[0].Reason)
+	assert.Equal(t, decisions[0].FN+1, decisions[1].FN)
+	assert.Equal(t, decisions[1].FN, decisions[2].FN)
+	assert.Equal(t, ScheduledRedundant, decisions[2].Reason, "the copy should be recorded")
+	assert.NotEqual(t, decisions[1].To, decisions[2].To, "the copy should go to the other subflow")
+
+	_, err = client.Write([]byte("after"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	decisions = client.(Conn).RecentSchedules()
+	assert.Len(t, decisions, 3, "should keep the last decisions only")
+	assert.Equal(t, decisions[0].FN+1, decisions[2].FN, "should be oldest first")
+	assert.Equal(t, "redundant", ScheduledRedundant.String())
+}
+
+func TestBlockedWrites(t *testing.T) {
+	var stalled int32
+	client, server, trackers := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &stallingConn{c, &stalled}
+	})
+	atomic.StoreInt32(&stalled, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// one being written, one in the send queue, and the last one blocks
+		for i := 0; i < 3; i++ {
+			_, err := server.Write([]byte("hello"))
+			assert.NoError(t, err)
+		}
+	}()
+	assert.Eventually(t, func() bool { return server.(Conn).BlockedWrites() > 0 }, time.Second, 10*time.Millisecond)
+	assert.True(t, atomic.LoadUint64(&trackers[0].blocked) > 0)
+	atomic.StoreInt32(&stalled, 0)
+	<-done
+	b := make([]byte, 15)
+	_, err := io.ReadFull(client, b)
+	assert.NoError(t, err)
+	assert.Zero(t, client.(Conn).BlockedWrites())
+}
+
+// stallingConn blocks writing while stalled.
+type stallingConn struct {
+	net.Conn
+	stalled *int32
+}
+
+// delayedConn delays each write by delay nanoseconds, which can be changed
+// on the fly.
+type delayedConn struct {
+	net.Conn
+	delay *int64
+}
+
+func (c *delayedConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(atomic.LoadInt64(c.delay)))
+	return c.Conn.Write(b)
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	for atomic.LoadInt32(c.stalled) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSelectSubflowForRetransmit(t *testing.T) {
+	a, b, c := &subflow{to: "a"}, &subflow{to: "b"}, &subflow{to: "c"}
+	old := time.Now().Add(-2 * time.Second)
+	frame := &sendFrame{sentVia: []transmissionDatapoint{{a, old}, {b, old}, {a, old}}}
+
+	_, _, selected := selectSubflowForRetransmit([]*subflow{a, b, c}, frame, false)
+	assert.Equal(t, c, selected, "should prefer the subflow never tried")
+	_, _, selected = selectSubflowForRetransmit([]*subflow{a, b}, frame, false)
+	assert.Nil(t, selected)
+
+	_, _, selected = selectSubflowForRetransmit([]*subflow{a, b}, frame, true)
+	assert.Equal(t, b, selected, "should prefer the subflow tried the fewest times")
+	frame.sentVia = append(frame.sentVia, transmissionDatapoint{b, old.Add(time.Second / 2)})
+	_, _, selected = selectSubflowForRetransmit([]*subflow{a, b}, frame, true)
+	assert.Equal(t, a, selected, "should prefer the subflow tried the least recently")
+	frame.sentVia = append(frame.sentVia, transmissionDatapoint{a, time.Now()})
+	_, _, selected = selectSubflowForRetransmit([]*subflow{a, b}, frame, true)
+	assert.Equal(t, b, selected, "should skip the subflow just tried")
+
+	frame = &sendFrame{sentVia: []transmissionDatapoint{{b, old}, {b, old}, {a, old}}}
+	_, _, selected = selectSubflowForRetransmit([]*subflow{a, b}, frame, true)
+	assert.Equal(t, b, selected, "should avoid the subflow last sent on")
+	_, _, selected = selectSubflowForRetransmit([]*subflow{a}, frame, true)
+	assert.Equal(t, a, selected, "should fall back to the subflow last sent on if it's the only one")
+}
+
+func TestRetransmitOnDifferentSubflow(t *testing.T) {
+	var dropped sync.Once
+	chEvent := make(chan RetransmitEvent, 1)
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber, once: &dropped}
+	}, WithRetransmitCallback(func(_ Conn, event RetransmitEvent) {
+		select {
+		case chEvent <- event:
+		default:
+		}
+	}))
+	defer server.Close()
+	defer client.Close()
+	assert.Eventually(t, func() bool { return len(client.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	select {
+	case event := <-chEvent:
+		assert.Equal(t, RetransmitTimeout, event.Reason)
+		assert.NotEqual(t, event.From, event.To, "should retransmit on the other subflow")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "should retransmit the lost frame")
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(server, make([]byte, 1))
+	assert.NoError(t, err)
+}
+
+func TestMaxQueueWait(t *testing.T) {
+	var reasons sync.Map
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &stallingConn{Conn: c, stalled: new(int32)}
+	}, WithMaxQueueWait(50*time.Millisecond), WithInitialRTO(100*time.Millisecond),
+		WithRetransmitCallback(func(_ Conn, event RetransmitEvent) {
+			reasons.Store(event.Reason, true)
+		}))
+	defer server.Close()
+	defer client.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	stalled := bc.sortedSubflows()[0].conn.(*laggedConn).conn.(*stallingConn).stalled
+	atomic.StoreInt32(stalled, 1)
+	defer atomic.StoreInt32(stalled, 0)
+
+	// the frame being written on the stalled subflow has to time out, but
+	// the ones queued behind it shouldn't wait for the stall to end
+	for i := 0; i < 20; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	b := make([]byte, 20)
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	for i := range b {
+		assert.Equal(t, byte(i), b[i])
+	}
+	_, rescheduled := reasons.Load(RetransmitQueueWait)
+	assert.True(t, rescheduled, "should reschedule the frames queued on the stalled subflow")
+}
+
+func TestRetransmitCallback(t *testing.T) {
+	events := make(chan RetransmitEvent, 10)
+	var dropped sync.Once
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber, once: &dropped}
+	}, WithRetransmitCallback(func(conn Conn, event RetransmitEvent) {
+		events <- event
+	}))
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	select {
+	case event := <-events:
+		assert.Equal(t, minFrameNumber, event.FN)
+		assert.Equal(t, RetransmitTimeout, event.Reason)
+		assert.Equal(t, 1, event.Retransmissions)
+		assert.NotEmpty(t, event.From)
+		assert.NotEqual(t, event.From, event.To)
+		assert.True(t, event.SinceSent > 0)
+	case <-time.After(time.Second):
+		t.Fatal("no retransmission reported")
+	}
+}
+
+func TestWriteCallback(t *testing.T) {
+	events := make(chan WriteEvent, 100)
+	client, server, _ := newTestConnPair(t, 1, WithWriteCallback(func(conn Conn, event WriteEvent) {
+		if event.Data {
+			events <- event
+		}
+	}))
+	defer server.Close()
+	defer client.Close()
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	select {
+	case event := <-events:
+		assert.Equal(t, minFrameNumber, event.FN)
+		assert.Equal(t, client.(Conn).Subflows()[0].To, event.Subflow)
+		assert.True(t, event.Size > len(b), "should include the header")
+		assert.Zero(t, event.Retransmissions)
+	case <-time.After(time.Second):
+		t.Fatal("no write reported")
+	}
+}
+
+func TestQueueHighWaterMarks(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 1)
+	for i := 0; i < 5; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		peak, _ := server.(*mpConn).recvQueue.takePeakBuffered()
+		return peak == 5
+	}, time.Second, 10*time.Millisecond)
+	b := make([]byte, 25)
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	stats := server.(Conn).QueueHighWaterMarks()
+	assert.Equal(t, 5, stats.ReceiveQueue, "should be the peak since last taken")
+	assert.True(t, stats.ReceiveQueueSize > 0)
+	assert.Zero(t, server.(Conn).QueueHighWaterMarks().ReceiveQueue, "should be reset")
+
+	stats = client.(Conn).QueueHighWaterMarks()
+	if assert.Len(t, stats.SendQueues, 1) {
+		for _, peak := range stats.SendQueues {
+			assert.True(t, peak >= 1)
+		}
+	}
+	for _, peak := range client.(Conn).QueueHighWaterMarks().SendQueues {
+		assert.Zero(t, peak)
+	}
+}
+
+func TestNoGoroutineLeakAfterClose(t *testing.T) {
+	run := func(t *testing.T) {
+		client, server, _ := newTestConnPair(t, 2)
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(server, b)
+		assert.NoError(t, err)
+		// leave some goroutines blocked on the connections being closed
+		server.SetReadDeadline(time.Now().Add(time.Hour))
+		go server.Read(b)
+	}
+	// warm up so the lazily started goroutines don't count as leaks
+	t.Run("warmup", run)
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		t.Run(strconv.Itoa(i), run)
+	}
+	// not using assert.Eventually as it runs the condition in a goroutine
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(5 * time.Second); after > before && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if after > before {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines before, %d after:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestSubflowCallback(t *testing.T) {
+	var mu sync.Mutex
+	added := make(map[string]bool)
+	cb := func(conn Conn, subflow string, raw net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		added[subflow] = true
+		if tcpConn, ok := raw.(*net.TCPConn); ok {
+			assert.NoError(t, tcpConn.SetNoDelay(false))
+		}
+	}
+	client, server, _ := newTestConnPair(t, 2, WithSubflowCallback(cb))
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(added) == 4
+	}, time.Second, 10*time.Millisecond, "should be called for each subflow on both sides")
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestUseAfterClose(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return server.(*mpConn).recvQueue.getReceivedTip() == minFrameNumber
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, server.Close())
+	lastFN := atomic.LoadUint64(&server.(*mpConn).lastFN)
+	for _, b := range [][]byte{[]byte("hello"), nil} {
+		n, err := server.Write(b)
+		assert.Equal(t, ErrClosed, err)
+		assert.Zero(t, n)
+	}
+	_, err = server.(Conn).WriteRedundant([]byte("hello"), 2)
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, lastFN, atomic.LoadUint64(&server.(*mpConn).lastFN), "should not even compose a frame")
+	n, err := server.Read(make([]byte, 5))
+	assert.Equal(t, ErrClosed, err, "should not read the data received before Close")
+	assert.Zero(t, n)
+
+	// the peer closed
+	assert.Eventually(t, func() bool {
+		_, err := client.Write([]byte("hello"))
+		return err == ErrClosed
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = client.Read(make([]byte, 5))
+	assert.Equal(t, io.EOF, err, "should read EOF as the peer closed cleanly")
+	assert.NoError(t, client.Close())
+	_, err = client.Read(make([]byte, 5))
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err)
+
+	conns := []net.Conn{client, server}
+	chReadErr := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			_, err := conn.Read(make([]byte, 5))
+			chReadErr <- err
+		}(conn)
+	}
+	// let the reads block
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			assert.NoError(t, conn.Close())
+		}(conn)
+	}
+	wg.Wait()
+	assert.Less(t, int64(time.Since(start)), int64(closeTimeout), "should not wait for the close timeout")
+	for range conns {
+		select {
+		case err := <-chReadErr:
+			assert.Equal(t, io.EOF, err)
+		case <-time.After(time.Second):
+			t.Fatal("the read should have returned")
+		}
+	}
+	for _, conn := range conns {
+		assert.Equal(t, Closed, conn.(Conn).State())
+		assert.EqualValues(t, 1, atomic.LoadUint32(&conn.(*mpConn).closedByPeer))
+	}
+}
+
+func TestCloseByPeer(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	_, err := server.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return client.(Conn).Goodput().Received == 5 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, server.Close())
+	select {
+	case <-client.(Conn).Done():
+	case <-time.After(time.Second):
+		t.Fatal("the peer should have closed too")
+	}
+	b, err := io.ReadAll(client)
+	assert.NoError(t, err, "should read EOF")
+	assert.Equal(t, "hello", string(b))
+	assert.NoError(t, client.Close())
+}
+
+func TestUserData(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 1)
+	defer server.Close()
+	defer client.Close()
+	bc := client.(Conn)
+	assert.Nil(t, bc.UserData())
+	bc.SetUserData("tenant")
+	assert.Equal(t, "tenant", bc.UserData())
+	assert.Nil(t, server.(Conn).UserData(), "should not be shared with the peer")
+	bc.SetUserData(42)
+	assert.Equal(t, 42, bc.UserData())
+	bc.SetUserData(nil)
+	assert.Nil(t, bc.UserData())
+}
+
+func TestPanickingCallbacks(t *testing.T) {
+	var called int32
+	opts := []Option{
+		WithStateCallback(func(Conn, ConnState, ConnState) {
+			atomic.AddInt32(&called, 1)
+			panic("state")
+		}),
+		WithDeliveryCallback(func(Conn, uint64, string, int) {
+			atomic.AddInt32(&called, 1)
+			panic("delivery")
+		}),
+		WithSubflowCallback(func(Conn, string, net.Conn) {
+			atomic.AddInt32(&called, 1)
+			panic("subflow")
+		}),
+		WithRetransmitOrder(func(a, b PendingFrame) bool {
+			panic("order")
+		}),
+	}
+	client, server, _ := newTestConnPair(t, 2, opts...)
+	defer client.Close()
+	defer server.Close()
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(server, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	}
+	assert.Greater(t, atomic.LoadInt32(&called), int32(10))
+	frames := []pendingAck{{fn: 12}, {fn: 11}}
+	sortForRetransmit(frames, client.(*mpConn).cfg.retransmitOrder)
+	assert.EqualValues(t, 11, frames[0].fn, "should fall back to the default order")
+}
+
+func TestFailoverMode(t *testing.T) {
+	client, server, trackers := newTestConnPair(t, 3, WithAggregationMode(Failover))
+	defer client.Close()
+	defer server.Close()
+	bc := server.(*mpConn)
+	assert.Eventually(t, func() bool {
+		return len(bc.sortedSubflows()) == 3
+	}, time.Second, 10*time.Millisecond)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			if _, err := client.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	writeAndWait := func(frames int) {
+		for i := 0; i < frames; i++ {
+			_, err := server.Write(make([]byte, 100))
+			assert.NoError(t, err)
+		}
+		assert.Eventually(t, func() bool {
+			return bc.BytesInFlight() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	usedTrackers := func() []*countingTracker {
+		var used []*countingTracker
+		for _, tracker := range trackers {
+			if atomic.LoadUint64(&tracker.sent) > 0 {
+				used = append(used, tracker)
+			}
+		}
+		return used
+	}
+
+	writeAndWait(50)
+	if !assert.Len(t, usedTrackers(), 1, "should send on a single subflow") {
+		return
+	}
+	primary := usedTrackers()[0]
+	assert.EqualValues(t, 50, atomic.LoadUint64(&primary.sent))
+	for _, sf := range bc.sortedSubflows() {
+		if sf.tracker == StatsTracker(safeTracker{primary}) {
+			sf.conn.Close()
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return len(bc.sortedSubflows()) == 2
+	}, time.Second, 10*time.Millisecond)
+	writeAndWait(50)
+	used := usedTrackers()
+	if assert.Len(t, used, 2, "should promote a single standby subflow") {
+		assert.EqualValues(t, 50, atomic.LoadUint64(&primary.sent))
+	}
+}
+
+func TestAggregateWhenSaturated(t *testing.T) {
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &stallingConn{Conn: &delayedConn{Conn: c, delay: new(int64)}, stalled: new(int32)}
+	}, WithAggregationMode(AggregateWhenSaturated), WithSaturationThreshold(20*time.Millisecond), WithScheduleLog(100))
+	defer client.Close()
+	defer server.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	wrapped := func(sf *subflow) *stallingConn {
+		return sf.conn.(*laggedConn).conn.(*stallingConn)
+	}
+	subflows := bc.sortedSubflows()
+	fast, slow := subflows[0], subflows[1]
+	atomic.StoreInt64(wrapped(slow).Conn.(*delayedConn).delay, int64(20*time.Millisecond))
+	assert.Eventually(t, func() bool {
+		slow.probe()
+		return slow.getRTT() > 10*time.Millisecond
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, fast, bc.fastest(bc.sortedSubflows()))
+
+	for i := 0; i < 20; i++ {
+		_, err := client.Write(make([]byte, 100))
+		assert.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	for _, decision := range client.(Conn).RecentSchedules() {
+		assert.Equal(t, fast.to, decision.To, "should keep to the fastest subflow while it keeps up")
+	}
+
+	stalled := wrapped(fast).stalled
+	atomic.StoreInt32(stalled, 1)
+	defer atomic.StoreInt32(stalled, 0)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := client.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond, "should wait for the fastest subflow first")
+	spilled := 0
+	for _, decision := range client.(Conn).RecentSchedules() {
+		if decision.Reason == ScheduledSaturated {
+			assert.Equal(t, slow.to, decision.To)
+			spilled++
+		}
+	}
+	assert.NotZero(t, spilled, "should use the other subflow once the fastest one is saturated")
+}
+
+func TestCostClass(t *testing.T) {
+	expensive := func(subflow string) bool { return strings.Contains(subflow, "#0") }
+	client, server, _ := newWrappedTestConnPair(t, 3, func(c net.Conn) net.Conn {
+		return &stallingConn{Conn: c, stalled: new(int32)}
+	}, WithScheduleLog(100), WithCostClass(func(subflow string) int {
+		if expensive(subflow) {
+			return 1
+		}
+		return 0
+	}))
+	defer client.Close()
+	defer server.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 3 }, time.Second, 10*time.Millisecond)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	infos := client.(Conn).Subflows()
+	assert.True(t, expensive(infos[2].To), "should sort the expensive class last")
+	assert.Equal(t, 1, infos[2].CostClass)
+	assert.Zero(t, infos[0].CostClass)
+
+	for i := 0; i < 20; i++ {
+		_, err := client.Write(make([]byte, 100))
+		assert.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	for _, decision := range client.(Conn).RecentSchedules() {
+		assert.False(t, expensive(decision.To), "should keep to the cheap class while it keeps up")
+	}
+
+	for _, sf := range bc.sortedSubflows() {
+		if !expensive(sf.to) {
+			stalled := sf.conn.(*laggedConn).conn.(*stallingConn).stalled
+			atomic.StoreInt32(stalled, 1)
+			defer atomic.StoreInt32(stalled, 0)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		_, err := client.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	decisions := client.(Conn).RecentSchedules()
+	assert.True(t, expensive(decisions[len(decisions)-1].To), "should use the expensive class once the cheap one is busy")
+}
+
+func TestSubflowLastActivity(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 1)
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool {
+		infos := client.(Conn).Subflows()
+		return len(infos) == 1 && !infos[0].LastSent.IsZero() && !infos[0].LastRecv.IsZero()
+	}, time.Second, 10*time.Millisecond, "probes should count")
+	before := client.(Conn).Subflows()[0]
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		after := client.(Conn).Subflows()[0]
+		// sent the frame and received the ack
+		return !after.LastSent.Before(start) && !after.LastRecv.Before(start)
+	}, time.Second, 10*time.Millisecond)
+	after := client.(Conn).Subflows()[0]
+	assert.True(t, after.LastSent.After(before.LastSent))
+	assert.True(t, server.(Conn).Subflows()[0].LastRecv.After(before.LastSent))
+}
+
+func TestRetransmitPolicy(t *testing.T) {
+	var allowed atomic.Value
+	allowed.Store("")
+	events := make(chan RetransmitEvent, 10)
+	var dropped sync.Once
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber, once: &dropped}
+	}, WithRetransmitCallback(func(conn Conn, event RetransmitEvent) {
+		events <- event
+	}), WithRetransmitPolicy(func(subflow string) bool {
+		return subflow == allowed.Load().(string)
+	}))
+	defer client.Close()
+	defer server.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, bc.retransmitCandidates())
+	best := bc.sortedSubflows()[0].to
+	allowed.Store(best)
+	assert.Len(t, bc.retransmitCandidates(), 1)
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	select {
+	case event := <-events:
+		assert.Equal(t, best, event.To, "should never retransmit on the other subflow")
+	case <-time.After(time.Second):
+		t.Fatal("no retransmission reported")
+	}
+}
+
+// slowConn writes at the rate of about 1MB/s.
+type slowConn struct {
+	net.Conn
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(len(b)) * time.Microsecond)
+	return c.Conn.Write(b)
+}
+
+func TestLargeWrite(t *testing.T) {
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &slowConn{c}
+	})
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool {
+		return len(server.(*mpConn).sortedSubflows()) == 2
+	}, time.Second, 10*time.Millisecond)
+	n, err := server.Write(make([]byte, 3*maxFrameSize))
+	assert.Equal(t, ErrFrameTooLarge, err)
+	assert.Zero(t, n)
+
+	large := make([]byte, maxFrameSize)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	_, err = server.Write(large)
+	assert.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := server.Write([]byte("small"))
+		assert.NoError(t, err)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond), "the large frame should not block the subsequent writes")
+
+	b := make([]byte, len(large))
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(client, b)
+	assert.NoError(t, err)
+	assert.Equal(t, large, b)
+	b = make([]byte, 50)
+	_, err = io.ReadFull(client, b)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("small", 10), string(b))
+}
+
+// gatedConn blocks the writes while the gate is held.
+type gatedConn struct {
+	net.Conn
+	gate *sync.Mutex
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	c.gate.Lock()
+	c.gate.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestWritableReady(t *testing.T) {
+	var gate sync.Mutex
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &gatedConn{Conn: c, gate: &gate}
+	})
+	defer client.Close()
+	defer server.Close()
+	ready := client.(Conn).WritableReady()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		assert.Fail(t, "should signal when the subflow is added")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	gate.Lock()
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-ready:
+	default:
+	}
+	select {
+	case <-ready:
+		assert.Fail(t, "should not signal while the subflow is blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gate.Unlock()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		assert.Fail(t, "should signal once the frame is written")
+	}
+	_, err = io.ReadFull(server, make([]byte, 1))
+	assert.NoError(t, err)
+}
+
+func TestGoodput(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2, WithRedundancy(2))
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool { return len(client.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		_, err := client.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	_, err := io.ReadFull(server, make([]byte, 1000))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return server.(Conn).Goodput().Received == 2000
+	}, time.Second, 10*time.Millisecond, "should count the redundant copies as received")
+	stats := server.(Conn).Goodput()
+	assert.EqualValues(t, 1000, stats.Delivered, "should count the data read only once")
+	assert.False(t, stats.Since.IsZero())
+}
+
+func TestBytesReadWritten(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2, WithRedundancy(2))
+	defer client.Close()
+	defer server.Close()
+	_, err := client.Write(make([]byte, 100))
+	assert.NoError(t, err)
+	_, err = client.(Conn).WriteStream(1, make([]byte, 50))
+	assert.NoError(t, err)
+	_, err = client.Write(nil)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 60))
+	assert.NoError(t, err)
+	_, err = server.(Conn).ReadStream(1, make([]byte, 50))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 150, client.(Conn).BytesWritten(), "should count the payload once regardless of the copies")
+	assert.EqualValues(t, 110, server.(Conn).BytesRead())
+	assert.Zero(t, client.(Conn).BytesRead())
+	assert.Zero(t, server.(Conn).BytesWritten())
+}
+
+func TestChurn(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	defer server.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	stats := bc.Churn()
+	assert.EqualValues(t, 2, stats.SubflowsAdded)
+	assert.Zero(t, stats.SubflowsRemoved)
+	assert.True(t, stats.Uptime > 0)
+
+	bc.sortedSubflows()[0].close()
+	assert.EqualValues(t, 1, bc.Churn().SubflowsRemoved)
+	client.Close()
+	assert.Eventually(t, func() bool { return bc.Churn().SubflowsRemoved == 2 }, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 2, bc.Churn().SubflowsAdded)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var gate sync.Mutex
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &gatedConn{Conn: c, gate: &gate}
+	}, WithWriteTimeout(100*time.Millisecond))
+	defer client.Close()
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+	gate.Lock()
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	_, err = client.Write([]byte("b"))
+	assert.Equal(t, context.DeadlineExceeded, err, "should time out while the subflow is blocked")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	gate.Unlock()
+
+	_, err = client.Write([]byte("c"))
+	assert.NoError(t, err)
+	b := make([]byte, 2)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ac", string(b), "should leave no gap for the write timed out")
+}
+
+func TestWriteDeadline(t *testing.T) {
+	var gate sync.Mutex
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &gatedConn{Conn: c, gate: &gate}
+	}, WithWriteCoalescing(time.Hour, 100))
+	defer client.Close()
+	defer server.Close()
+	c := client.(Conn)
+	_, err := c.WriteDeadline([]byte("x"), time.Now().Add(-time.Second))
+	assert.Equal(t, context.DeadlineExceeded, err, "should fail right away past the deadline")
+	time.Sleep(50 * time.Millisecond)
+	gate.Lock()
+	_, err = c.WriteDeadline([]byte("a"), time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	_, err = c.WriteDeadline([]byte("b"), time.Now().Add(100*time.Millisecond))
+	assert.Equal(t, context.DeadlineExceeded, err, "should time out while the subflow is blocked")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	gate.Unlock()
+
+	_, err = c.WriteDeadline([]byte("c"), time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	b := make([]byte, 2)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ac", string(b), "should neither coalesce nor leave a gap for the write timed out")
+}
+
+func TestWriteTagged(t *testing.T) {
+	tags := make(chan uint64, 10)
+	client, server, _ := newTestConnPair(t, 2, WithAckCallback(func(conn Conn, tag uint64) {
+		tags <- tag
+	}), WithWriteCoalescing(time.Second, 100))
+	defer client.Close()
+	defer server.Close()
+	c := client.(Conn)
+	_, err := c.WriteTagged([]byte("a"), 1)
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("b"))
+	assert.NoError(t, err)
+	_, err = c.WriteTagged([]byte("c"), 2)
+	assert.NoError(t, err)
+	b := make([]byte, 3)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(b), "should flush the coalesced writes first")
+	var got []uint64
+	for i := 0; i < 2; i++ {
+		select {
+		case tag := <-tags:
+			got = append(got, tag)
+		case <-time.After(time.Second):
+			assert.Fail(t, "should call back on ack")
+		}
+	}
+	assert.ElementsMatch(t, []uint64{1, 2}, got)
+	select {
+	case tag := <-tags:
+		assert.Fail(t, "should call back once per tagged frame", "got %d", tag)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRetransmitStall(t *testing.T) {
+	var gate sync.Mutex
+	// a single worker writing for all the subflows, so that once it's stuck
+	// writing for one, the send queues of the others stay full without them
+	// being busy on write, which would make the retransmission give up
+	pool := NewSendPool(1)
+	defer pool.Close()
+	client, server, _ := newAsymmetricTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &gatedConn{Conn: c, gate: &gate}
+	}, []Option{WithSendPool(pool), WithRetransmitStallTimeout(100 * time.Millisecond)}, nil)
+	defer server.Close()
+	defer client.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	gate.Lock()
+	defer gate.Unlock()
+	// saturate all send queues
+	assert.Eventually(t, func() bool {
+		busy := 0
+		for _, sf := range bc.sortedSubflows() {
+			select {
+			case sf.sendQueue <- composeFrame(frameTypePing, nil):
+				sf.queued()
+			default:
+			}
+			if len(sf.sendQueue) == 0 {
+				return false
+			}
+			busy += int(atomic.LoadUint64(&sf.actuallyBusyOnWrite))
+		}
+		return busy == 1
+	}, time.Second, time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		bc.retransmit(composeFrame(minFrameNumber+1000, []byte("a")), RetransmitTimeout)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "should give up retransmitting")
+	}
+	select {
+	case <-bc.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "should close the stuck connection")
+	}
+}
+
+func TestPauseRetransmission(t *testing.T) {
+	var dropped sync.Once
+	var retransmitted int32
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber, once: &dropped}
+	}, WithRetransmitCallback(func(Conn, RetransmitEvent) {
+		atomic.AddInt32(&retransmitted, 1)
+	}), WithInitialRTO(100*time.Millisecond), WithMaxRTO(100*time.Millisecond))
+	defer server.Close()
+	defer client.Close()
+	bc := client.(Conn)
+	assert.Eventually(t, func() bool { return len(bc.Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	bc.PauseRetransmission()
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&retransmitted), "should not retransmit while paused")
+	assert.Equal(t, 1, bc.BytesInFlight(), "should keep the pending frame")
+
+	bc.ResumeRetransmission()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), b)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&retransmitted))
+}
+
+func TestPauseSubflow(t *testing.T) {
+	var dropped sync.Once
+	var mu sync.Mutex
+	var reasons []RetransmitReason
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber, once: &dropped}
+	}, WithRetransmitCallback(func(_ Conn, event RetransmitEvent) {
+		mu.Lock()
+		reasons = append(reasons, event.Reason)
+		mu.Unlock()
+	}), WithInitialRTO(time.Minute), WithMinRTO(time.Minute), WithMaxRTO(time.Minute), WithScheduleLog(10))
+	defer server.Close()
+	defer client.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, ErrUnknownSubflow, bc.PauseSubflow("unknown", false))
+	assert.Equal(t, ErrUnknownSubflow, bc.ResumeSubflow("unknown"))
+
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	var lostOn string
+	assert.Eventually(t, func() bool {
+		bc.pendingAckMu.RLock()
+		defer bc.pendingAckMu.RUnlock()
+		if pending := bc.pendingAckMap[minFrameNumber]; pending != nil {
+			lostOn = pending.outboundSf.to
+		}
+		return lostOn != ""
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, bc.PauseSubflow(lostOn, true))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err, "should re-home the frame in flight rather than waiting for the RTO")
+	mu.Lock()
+	assert.Equal(t, []RetransmitReason{RetransmitSubflowPaused}, reasons)
+	mu.Unlock()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Write([]byte("b"))
+		assert.NoError(t, err)
+	}
+	for _, decision := range bc.RecentSchedules()[1:] {
+		assert.NotEqual(t, lostOn, decision.To, "should not send on the paused subflow")
+	}
+	for _, info := range bc.Subflows() {
+		assert.Equal(t, info.To == lostOn, info.Paused)
+	}
+	assert.NoError(t, bc.ResumeSubflow(lostOn))
+	for _, info := range bc.Subflows() {
+		assert.False(t, info.Paused)
+	}
+	_, err = io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err)
+}
+
+func TestMinSubflows(t *testing.T) {
+	var below []int
+	var mu sync.Mutex
+	client, server, _ := newTestConnPair(t, 3, WithMinSubflows(2, true, func(conn Conn, healthy int) {
+		mu.Lock()
+		below = append(below, healthy)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	defer client.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 3 }, time.Second, 10*time.Millisecond)
+	bc.sortedSubflows()[0].close()
+	mu.Lock()
+	assert.Empty(t, below, "should not be called while at the min")
+	mu.Unlock()
+
+	bc.sortedSubflows()[0].close()
+	mu.Lock()
+	assert.Equal(t, []int{1}, below)
+	mu.Unlock()
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 3 }, time.Second, 10*time.Millisecond, "should redial the paths gone")
+	assert.EqualValues(t, 5, bc.Churn().SubflowsAdded)
+}
+
+func TestAbort(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	defer server.Close()
+	bc := client.(Conn)
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return server.(Conn).Goodput().Received == 1 }, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, bc.Abort())
+	assert.Zero(t, bc.BytesInFlight())
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, ErrClosed, err)
+	_, err = client.Write([]byte("a"))
+	assert.Equal(t, ErrClosed, err)
+
+	select {
+	case <-server.(Conn).Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "peer should be closed")
+	}
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, ErrConnReset, err, "should discard the data not read yet")
+	_, err = server.Write([]byte("a"))
+	assert.Equal(t, ErrConnReset, err)
+}
+
+func TestMaxRetransmissions(t *testing.T) {
+	chAbandoned := make(chan AbandonedFrame, 1)
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		// drop the frame on each subflow, so it's lost for good
+		return &droppingConn{Conn: c, fn: minFrameNumber, once: &sync.Once{}}
+	}, WithMaxRetransmissions(1), WithInitialRTO(100*time.Millisecond), WithMaxRTO(100*time.Millisecond),
+		WithAbandonCallback(func(_ Conn, frame AbandonedFrame) {
+			chAbandoned <- frame
+		}))
+	defer server.Close()
+	defer client.Close()
+	assert.Eventually(t, func() bool { return len(client.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	_, err := client.(Conn).WriteTagged([]byte("a"), 7)
+	assert.NoError(t, err)
+	_, err = client.Write([]byte("b"))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Equal(t, ErrAbandoned, client.(Conn).Flush(ctx), "should report the frame given up on")
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(b), "should skip the frame given up on")
+	assert.Eventually(t, func() bool { return client.(Conn).BytesInFlight() == 0 }, time.Second, 10*time.Millisecond)
+	select {
+	case frame := <-chAbandoned:
+		assert.Equal(t, minFrameNumber, frame.FN)
+		assert.EqualValues(t, 7, frame.Tag)
+		assert.Equal(t, "a", string(frame.Payload))
+		assert.Equal(t, 1, frame.Retransmissions)
+	default:
+		assert.Fail(t, "should report the frame given up on")
+	}
+}
+
+func TestRealTimeFirst(t *testing.T) {
+	var stalled int32
+	chAbandoned := make(chan AbandonedFrame, 1)
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: &stallingConn{c, &stalled}, fn: minFrameNumber, once: &sync.Once{}}
+	}, WithRealTimeFirst(50*time.Millisecond), WithInitialRTO(100*time.Millisecond), WithMaxRTO(100*time.Millisecond),
+		WithAbandonCallback(func(_ Conn, frame AbandonedFrame) {
+			chAbandoned <- frame
+		}))
+	defer server.Close()
+	defer client.Close()
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+
+	// the path congests until the writes block
+	atomic.StoreInt32(&stalled, 1)
+	chWritten := make(chan struct{})
+	go func() {
+		defer close(chWritten)
+		for _, s := range []string{"b", "c", "d"} {
+			_, err := client.Write([]byte(s))
+			assert.NoError(t, err)
+		}
+	}()
+	select {
+	case frame := <-chAbandoned:
+		assert.Equal(t, minFrameNumber, frame.FN)
+		assert.Zero(t, frame.Retransmissions, "should give up on the stale frame rather than retransmitting")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "should give up on the stale frame while congested")
+	}
+	atomic.StoreInt32(&stalled, 0)
+	<-chWritten
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 3)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "bcd", string(b), "should skip the frame given up on")
+}
+
+func TestSendControl(t *testing.T) {
+	chControl := make(chan string, 10)
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		// the extended frame type comes where a data frame has its number
+		return &droppingConn{Conn: c, fn: frameTypeControl, once: &sync.Once{}}
+	}, WithInitialRTO(100*time.Millisecond), WithControlCallback(func(_ Conn, msg []byte) {
+		chControl <- string(msg)
+	}))
+	defer server.Close()
+	defer client.Close()
+	_, err := client.Write([]byte("ab"))
+	assert.NoError(t, err)
+	assert.NoError(t, client.(Conn).SendControl([]byte("pause")))
+	assert.NoError(t, client.(Conn).SendControl(nil))
+	_, err = client.Write([]byte("cd"))
+	assert.NoError(t, err)
+	assert.NoError(t, client.(Conn).SendControl([]byte("resume")))
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(b), "should not mix the control messages with the data")
+	var msgs []string
+	for len(msgs) < 2 {
+		select {
+		case msg := <-chControl:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "should retransmit the lost control message")
+			return
+		}
+	}
+	assert.ElementsMatch(t, []string{"pause", "resume"}, msgs)
+	select {
+	case msg := <-chControl:
+		assert.Fail(t, "should hand over each control message once", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.ErrorIs(t, client.(Conn).SendControl(make([]byte, client.(*mpConn).cfg.maxFrameSize+1)), ErrFrameTooLarge)
+	client.Close()
+	assert.ErrorIs(t, client.(Conn).SendControl([]byte("late")), ErrClosed)
+}
+
+func TestInOrderSubflows(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2, WithRedundancy(2), WithInOrderSubflows(func(string) bool { return true }))
+	defer server.Close()
+	defer client.Close()
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+		expected = append(expected, byte(i))
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, len(expected))
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, b, "should deliver the frames received on both subflows in order and once")
+	assert.NotZero(t, server.(Conn).HeadOfLineBlocking().FastPathed)
+}
+
+func TestSubflowMTU(t *testing.T) {
+	mtu := func(subflow string) int {
+		if strings.Contains(subflow, "#0") {
+			return 100
+		}
+		return 9000
+	}
+	client, server, _ := newTestConnPair(t, 2, WithSubflowMTU(mtu), WithScheduleLog(20))
+	defer server.Close()
+	defer client.Close()
+	assert.Eventually(t, func() bool { return len(client.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	for _, info := range client.(Conn).Subflows() {
+		assert.Equal(t, mtu(info.To), info.MTU)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		// one at a time so that the jumbo subflow always has room
+		_, err := client.Write(b)
+		assert.NoError(t, err)
+		_, err = io.ReadFull(server, b)
+		assert.NoError(t, err)
+	}
+	best := 0
+	for _, decision := range client.(Conn).RecentSchedules() {
+		// #0 is still used if #1 happens to be busy with an ack
+		if decision.Reason == ScheduledBest {
+			best++
+			assert.Contains(t, decision.To, "#1", "should prefer #1 for the frames too large for the MTU of #0")
+		}
+	}
+	assert.NotZero(t, best)
+}
+
+func TestSchedulingMisses(t *testing.T) {
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber + 1, once: &sync.Once{}}
+	}, WithScheduleLog(10))
+	defer server.Close()
+	defer client.Close()
+	assert.Zero(t, client.(Conn).Scheduling())
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		// one at a time so that the subflow always has room
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+		_, err = io.ReadFull(server, b)
+		assert.NoError(t, err)
+	}
+	best := 0
+	for _, decision := range client.(Conn).RecentSchedules() {
+		if decision.Reason == ScheduledBest {
+			best++
+		}
+	}
+	stats := client.(Conn).Scheduling()
+	assert.EqualValues(t, best, stats.Best)
+	assert.EqualValues(t, 1, stats.Misses, "should count the frame lost on the best subflow")
+	assert.Equal(t, float64(stats.Misses)/float64(stats.Best), stats.MissRate)
+}
+
+func TestConcurrentWriteOrder(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2, WithScheduleLog(1000), WithOrderedWrites())
+	defer server.Close()
+	defer client.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := client.Write([]byte{byte(i), byte(j)})
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	decisions := client.(Conn).RecentSchedules()
+	if !assert.Len(t, decisions, 500) {
+		return
+	}
+	for i, decision := range decisions {
+		assert.Equal(t, minFrameNumber+uint64(i), decision.FN, "should queue the frames in the order of their numbers")
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1000)
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	next := make([]byte, 10)
+	for i := 0; i < len(b); i += 2 {
+		assert.Equal(t, next[b[i]], b[i+1], "should keep the order of the writes of each writer")
+		next[b[i]]++
+	}
+}
+
+func TestLastFrameNumber(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	defer server.Close()
+	defer client.Close()
+	conn := client.(Conn)
+	assert.Zero(t, conn.LastFrameNumber())
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, minFrameNumber, conn.LastFrameNumber())
+	assert.NoError(t, conn.SendControl([]byte("b")))
+	_, err = client.Write([]byte("c"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, minFrameNumber+2, conn.LastFrameNumber(), "should count the control messages too")
+	b := make([]byte, 2)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, conn.LastFrameNumber(), server.(Conn).HighestDelivered())
+}
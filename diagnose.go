@@ -0,0 +1,160 @@
+package multipath
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// degradedLossRate is the fraction of the data frames timing out on a subflow
+// beyond which Diagnose finds it degraded.
+const degradedLossRate = 0.05
+
+// PathHealth is the verdict of Diagnose on a subflow.
+type PathHealth int
+
+const (
+	// PathHealthy answered the probe and shows no sign of trouble.
+	PathHealthy PathHealth = iota
+	// PathDegraded answered the probe but loses frames, or is otherwise
+	// impaired, see PathDiagnosis.Reasons.
+	PathDegraded
+	// PathUnresponsive didn't answer the probe in time.
+	PathUnresponsive
+)
+
+func (h PathHealth) String() string {
+	switch h {
+	case PathHealthy:
+		return "healthy"
+	case PathDegraded:
+		return "degraded"
+	case PathUnresponsive:
+		return "unresponsive"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(h))
+	}
+}
+
+// PathDiagnosis is the health of a subflow found by Diagnose.
+type PathDiagnosis struct {
+	// Subflow is the status of the subflow once probed, including the
+	// estimated RTT, the frames queued and the last activity.
+	Subflow SubflowInfo
+	// Answered is true if the subflow answered the probe, and ProbeRTT is
+	// the RTT it took.
+	Answered bool
+	ProbeRTT time.Duration
+	// FramesSent is the number of data frames sent on the subflow so far,
+	// including the retransmissions, and FramesTimedOut the number of them
+	// which timed out. LossRate is the ratio of both.
+	FramesSent     uint64
+	FramesTimedOut uint64
+	LossRate       float64
+	Health         PathHealth
+	// Reasons explain any verdict other than PathHealthy.
+	Reasons []string
+}
+
+// DiagnosisReport is the health of a connection found by Diagnose.
+type DiagnosisReport struct {
+	// At is when the diagnosis started.
+	At time.Time
+	// Paths are the diagnoses of the subflows, in the order of Subflows.
+	Paths []PathDiagnosis
+	// HOL is the head-of-line blocking of the receive queue so far, and
+	// Stalled how long it has been held back by a missing frame, zero if it
+	// isn't.
+	HOL     HOLStats
+	Stalled time.Duration
+	// Healthy is true if there's at least one subflow and all are healthy.
+	Healthy bool
+}
+
+func (bc *mpConn) Diagnose(ctx context.Context) DiagnosisReport {
+	report := DiagnosisReport{At: time.Now()}
+	probed := make(map[string]*subflow)
+	for _, sf := range bc.sortedSubflows() {
+		probed[sf.to] = sf
+		go sf.probe()
+	}
+	bc.waitForAnswers(ctx, probed, report.At)
+
+	report.Healthy = len(probed) > 0
+	for _, info := range bc.Subflows() {
+		sf := probed[info.To]
+		if sf == nil {
+			// added after the probes were sent
+			continue
+		}
+		d := sf.diagnose(info, report.At)
+		report.Healthy = report.Healthy && d.Health == PathHealthy
+		report.Paths = append(report.Paths, d)
+	}
+	report.HOL = bc.recvQueue.holStats()
+	report.Stalled = bc.recvQueue.stalledFor()
+	return report
+}
+
+// waitForAnswers waits until all subflows answer the probes sent since, or
+// ctx is done, or the connection is closed.
+func (bc *mpConn) waitForAnswers(ctx context.Context, subflows map[string]*subflow, since time.Time) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		answered := true
+		for _, sf := range subflows {
+			answered = answered && sf.answeredSince(since)
+		}
+		if answered {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-bc.chDone:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// answeredSince tells if a pong is received on the subflow since t.
+func (sf *subflow) answeredSince(t time.Time) bool {
+	return atomic.LoadInt64(&sf.lastPong) >= t.UnixNano()
+}
+
+func (sf *subflow) diagnose(info SubflowInfo, since time.Time) PathDiagnosis {
+	d := PathDiagnosis{
+		Subflow:        info,
+		Answered:       sf.answeredSince(since),
+		FramesSent:     atomic.LoadUint64(&sf.dataFramesSent),
+		FramesTimedOut: atomic.LoadUint64(&sf.framesTimedOut),
+	}
+	if d.FramesSent > 0 {
+		d.LossRate = float64(d.FramesTimedOut) / float64(d.FramesSent)
+	}
+	if !d.Answered {
+		d.Health = PathUnresponsive
+		d.Reasons = append(d.Reasons, "no answer to the probe")
+		return d
+	}
+	d.ProbeRTT = time.Duration(atomic.LoadInt64(&sf.lastPongRTT))
+	if info.Lossy {
+		d.Reasons = append(d.Reasons, "deprioritized as frames timed out recently")
+	}
+	if d.LossRate >= degradedLossRate {
+		d.Reasons = append(d.Reasons, fmt.Sprintf("%.1f%% of the frames timed out", d.LossRate*100))
+	}
+	if info.Asymmetric {
+		d.Reasons = append(d.Reasons, "the acks come back on other subflows")
+	}
+	if info.Paused {
+		d.Reasons = append(d.Reasons, "paused")
+	}
+	if len(d.Reasons) > 0 {
+		d.Health = PathDegraded
+	}
+	return d
+}
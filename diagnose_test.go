@@ -0,0 +1,61 @@
+package multipath
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnose(t *testing.T) {
+	var wrapped, dead int32
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		if atomic.AddInt32(&wrapped, 1) == 1 {
+			return &deadPathConn{c, &dead}
+		}
+		return c
+	})
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool { return len(client.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+
+	report := client.(Conn).Diagnose(context.Background())
+	assert.True(t, report.Healthy)
+	if assert.Len(t, report.Paths, 2) {
+		for _, d := range report.Paths {
+			assert.True(t, d.Answered)
+			assert.NotZero(t, d.ProbeRTT)
+			assert.Equal(t, PathHealthy, d.Health)
+		}
+	}
+
+	atomic.StoreInt32(&dead, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	report = client.(Conn).Diagnose(ctx)
+	assert.False(t, report.Healthy)
+	health := make(map[PathHealth]int)
+	for _, d := range report.Paths {
+		health[d.Health]++
+	}
+	assert.Equal(t, map[PathHealth]int{PathHealthy: 1, PathUnresponsive: 1}, health, "should tell the dead path from the live one")
+}
+
+func TestDiagnoseVerdict(t *testing.T) {
+	since := time.Now()
+	sf := &subflow{lastPong: since.UnixNano(), dataFramesSent: 100, framesTimedOut: 1}
+	d := sf.diagnose(SubflowInfo{}, since)
+	assert.Equal(t, PathHealthy, d.Health)
+	assert.Equal(t, 0.01, d.LossRate)
+
+	sf.framesTimedOut = 10
+	d = sf.diagnose(SubflowInfo{Asymmetric: true}, since)
+	assert.Equal(t, PathDegraded, d.Health)
+	assert.Equal(t, []string{"10.0% of the frames timed out", "the acks come back on other subflows"}, d.Reasons)
+
+	d = sf.diagnose(SubflowInfo{}, since.Add(time.Nanosecond))
+	assert.Equal(t, PathUnresponsive, d.Health, "should not count the pongs before the probe")
+}
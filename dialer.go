@@ -7,6 +7,8 @@ import (
 	"math/rand"
 	"net"
 	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +23,71 @@ type Dialer interface {
 	Label() string
 }
 
+// DialFunc dials the underlying transport of a subflow. It has the same
+// signature as net.Dialer.DialContext, so subflows can be routed through
+// anything providing it, e.g. SOCKS proxies, Unix sockets or custom tunnels.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type netDialer struct {
+	network   string
+	addr      string
+	localAddr string
+	dial      DialFunc
+}
+
+// NewNetDialer creates a subflow Dialer which dials addr on network with the
+// dial function, or with a zero net.Dialer if dial is nil.
+func NewNetDialer(network, addr string, dial DialFunc) Dialer {
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return &netDialer{network: network, addr: addr, dial: dial}
+}
+
+// NewLocalAddrDialer creates a subflow Dialer which dials addr on network from
+// localAddr, so the subflow egresses the interface owning that address, e.g.
+// the Wi-Fi or the cellular one, rather than whatever the routing table picks.
+// Without it, the subflows to the same destination usually end up on the same
+// physical path. localAddr can be an IP or a host:port. The route still has to
+// exist for the OS to send from that address, which on Linux may need policy
+// routing. To combine it with a custom dial function, pass NewNetDialer the
+// DialContext of a net.Dialer with LocalAddr set instead.
+func NewLocalAddrDialer(network, localAddr, addr string) (Dialer, error) {
+	laddr, err := resolveLocalAddr(network, localAddr)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{LocalAddr: laddr}
+	return &netDialer{network: network, addr: addr, localAddr: localAddr, dial: d.DialContext}, nil
+}
+
+func resolveLocalAddr(network, localAddr string) (net.Addr, error) {
+	if _, _, err := net.SplitHostPort(localAddr); err != nil {
+		// any port
+		localAddr = net.JoinHostPort(localAddr, "0")
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return net.ResolveTCPAddr(network, localAddr)
+	case "udp", "udp4", "udp6":
+		return net.ResolveUDPAddr(network, localAddr)
+	default:
+		return nil, fmt.Errorf("can't bind %s to a local address", network)
+	}
+}
+
+func (nd *netDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	return nd.dial(ctx, nd.network, nd.addr)
+}
+
+func (nd *netDialer) Label() string {
+	if nd.localAddr != "" {
+		return fmt.Sprintf("%s://%s->%s", nd.network, nd.localAddr, nd.addr)
+	}
+	return fmt.Sprintf("%s://%s", nd.network, nd.addr)
+}
+
 // Stats is also provided by the multipath dialer so the caller can get and
 // print the status of each path.
 type Stats interface {
@@ -39,6 +106,7 @@ type subflowDialer struct {
 	bytesSent        uint64
 	bytesRetransmit  uint64
 	bytesRecv        uint64
+	writesBlocked    uint64
 	emaRTT           *ema.EMA
 }
 
@@ -71,78 +139,92 @@ func (sfd *subflowDialer) OnRetransmit(n uint64) {
 func (sfd *subflowDialer) UpdateRTT(rtt time.Duration) {
 	sfd.emaRTT.UpdateDuration(rtt)
 }
+func (sfd *subflowDialer) OnWriteBlocked() {
+	atomic.AddUint64(&sfd.writesBlocked, 1)
+}
 
 type mpDialer struct {
 	dest    string
 	dialers []*subflowDialer
+	cfg     *config
 }
 
-func NewDialer(dest string, dialers []Dialer) Dialer {
+// NewDialer creates a multipath dialer to dest, which is only used as a label,
+// with a subflow dialed by each of the dialers. It panics if the options are
+// invalid, see ValidateOptions.
+func NewDialer(dest string, dialers []Dialer, opts ...Option) Dialer {
 	var subflowDialers []*subflowDialer
 	for _, d := range dialers {
 		subflowDialers = append(subflowDialers, &subflowDialer{Dialer: d, label: d.Label(), emaRTT: ema.NewDuration(longRTT, rttAlpha)})
 	}
-	d := &mpDialer{dest, subflowDialers}
+	d := &mpDialer{dest, subflowDialers, newConfig(opts)}
 	return d
 }
 
+// Dial dials a multipath connection with a subflow to each of the targets,
+// which are either host:port over TCP, or network://addr, e.g. unix:///path.
+// It's a shortcut of NewDialer with a NewNetDialer per target, for one-off
+// connections. The returned net.Conn is a Conn.
+func Dial(targets []string, opts ...Option) (net.Conn, error) {
+	return DialContext(context.Background(), targets, opts...)
+}
+
+// DialContext is like Dial but with a context, see mpDialer.DialContext.
+func DialContext(ctx context.Context, targets []string, opts ...Option) (net.Conn, error) {
+	if err := ValidateOptions(opts...); err != nil {
+		return nil, err
+	}
+	var dialers []Dialer
+	for _, target := range targets {
+		network, addr := "tcp", target
+		if i := strings.Index(target, "://"); i >= 0 {
+			network, addr = target[:i], target[i+len("://"):]
+		}
+		dialers = append(dialers, NewNetDialer(network, addr, nil))
+	}
+	return NewDialer(strings.Join(targets, ","), dialers, opts...).DialContext(ctx)
+}
+
 // DialContext dials the addr using all dialers and returns a connection
-// contains subflows from whatever dialers available.
+// contains subflows from whatever dialers available. It returns as soon as the
+// first subflow is established, while the rest are dialed in the background
+// with the same ctx, so cancelling ctx also abandons the setup of them. The
+// returned net.Conn is a Conn.
 func (mpd *mpDialer) DialContext(ctx context.Context) (net.Conn, error) {
 	var bc *mpConn
-	dialOne := func(d *subflowDialer, cid connectionID) (connectionID, bool) {
-		conn, err := d.DialContext(ctx)
-		if err != nil {
-			log.Errorf("failed to dial %s: %v", d.Label(), err)
-			return zeroCID, false
-		}
-		probeStart := time.Now()
-		newCID, err := mpd.handshake(conn, cid)
-		if err != nil {
-			log.Errorf("failed to handshake %s, continuing: %v", d.Label(), err)
-			conn.Close()
-			return zeroCID, false
-		}
-		if cid == zeroCID {
-			bc = newMPConn(newCID, conn.RemoteAddr())
-			go func() {
-				for {
-					time.Sleep(time.Second)
-					select {
-					case <-ctx.Done():
-						return
-					default:
-						bc.pendingAckMu.RLock()
-						oldest := time.Duration(0)
-						oldestFN := uint64(0)
-						for fn, frame := range bc.pendingAckMap {
-							if time.Since(frame.sentAt) > oldest {
-								oldest = time.Since(frame.sentAt)
-								oldestFN = fn
-							}
-						}
-						bc.pendingAckMu.RUnlock()
-						if oldest > time.Second {
-							log.Debugf("Frame %d has not been acked for %v\n", oldestFN, oldest)
-						}
-					}
-				}
-			}()
-		}
-		bc.add(fmt.Sprintf("%x(%s)", newCID, d.label), conn, true, probeStart, d)
-		return newCID, true
-	}
+	start := time.Now()
 	dialers := mpd.sorted()
+	firstCtx := ctx
+	if mpd.cfg.establishTimeout > 0 {
+		var cancel context.CancelFunc
+		firstCtx, cancel = context.WithTimeout(ctx, mpd.cfg.establishTimeout)
+		defer cancel()
+	}
 	for i, d := range dialers {
 		// dial the first connection with zero connection ID
-		cid, ok := dialOne(d, zeroCID)
+		conn, cid, probeStart, ok := mpd.dialOne(firstCtx, d, zeroCID)
 		if !ok {
+			if firstCtx.Err() != nil {
+				return nil, firstCtx.Err()
+			}
 			continue
 		}
+		bc = newMPConn(cid, conn.RemoteAddr(), mpd.cfg)
+		bc.clientSide = true
+		go mpd.logUnackedFrames(ctx, bc)
+		// the handshake probes the RTT of the subflow on the client side
+		bc.timeToReady = time.Since(start)
+		bc.redial = func() { mpd.redial(bc) }
+		bc.add(fmt.Sprintf("%x(%s)", cid, d.label), conn, true, probeStart, d)
 		if i < len(dialers)-1 {
 			// dial the rest in parallel with server assigned connection ID
 			for _, d := range dialers[i+1:] {
-				go dialOne(d, cid)
+				go func(d *subflowDialer) {
+					conn, _, probeStart, ok := mpd.dialOne(ctx, d, cid)
+					if ok {
+						bc.add(fmt.Sprintf("%x(%s)", cid, d.label), conn, true, probeStart, d)
+					}
+				}(d)
 			}
 		}
 		return bc, nil
@@ -150,29 +232,142 @@ func (mpd *mpDialer) DialContext(ctx context.Context) (net.Conn, error) {
 	return nil, ErrFailOnAllDialers
 }
 
+// dialOne dials a subflow and does the handshake, abandoning it if ctx is done
+// or the per-subflow dial timeout elapses.
+func (mpd *mpDialer) dialOne(ctx context.Context, d *subflowDialer, cid connectionID) (net.Conn, connectionID, time.Time, bool) {
+	if mpd.cfg.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mpd.cfg.dialTimeout)
+		defer cancel()
+	}
+	conn, err := d.DialContext(ctx)
+	if err != nil {
+		log.Errorf("failed to dial %s: %v", d.Label(), err)
+		return nil, zeroCID, time.Time{}, false
+	}
+	newCID, probeStart, err := handshake(ctx, conn, cid, mpd.cfg.joinSecret)
+	if err != nil {
+		log.Errorf("failed to handshake %s, continuing: %v", d.Label(), err)
+		conn.Close()
+		return nil, zeroCID, time.Time{}, false
+	}
+	return conn, newCID, probeStart, true
+}
+
+// redial dials again the paths which have no subflow in the connection, until
+// it's closed.
+func (mpd *mpDialer) redial(bc *mpConn) {
+	present := make(map[string]bool)
+	for _, sf := range bc.sortedSubflows() {
+		present[sf.to] = true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-bc.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, d := range mpd.dialers {
+		label := fmt.Sprintf("%x(%s)", bc.cid, d.label)
+		if present[label] {
+			continue
+		}
+		wg.Add(1)
+		go func(d *subflowDialer, label string) {
+			defer wg.Done()
+			log.Debugf("redialing %s", label)
+			conn, _, probeStart, ok := mpd.dialOne(ctx, d, bc.cid)
+			if ok {
+				bc.add(label, conn, true, probeStart, d)
+			}
+		}(d, label)
+	}
+	wg.Wait()
+}
+
+// logUnackedFrames periodically logs the oldest frame not acked, until ctx is
+// done or the connection is closed.
+func (mpd *mpDialer) logUnackedFrames(ctx context.Context, bc *mpConn) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-bc.Done():
+			return
+		case <-ticker.C:
+			bc.pendingAckMu.RLock()
+			oldest := time.Duration(0)
+			oldestFN := uint64(0)
+			for fn, frame := range bc.pendingAckMap {
+				if frame.age() > oldest {
+					oldest = frame.age()
+					oldestFN = fn
+				}
+			}
+			bc.pendingAckMu.RUnlock()
+			if oldest > time.Second {
+				log.Debugf("Frame %d has not been acked for %v\n", oldestFN, oldest)
+			}
+		}
+	}
+}
+
 // handshake exchanges version and cid with the peer and returns the connnection ID
-// both end agrees if no error happens.
-func (mpd *mpDialer) handshake(conn net.Conn, cid connectionID) (connectionID, error) {
+// both end agrees if no error happens, along with when the peer was last
+// waited for, from which the initial RTT is measured. When joining an existing
+// connection with a secret, it answers the challenge of the peer. The exchange
+// is aborted when ctx is done.
+func handshake(ctx context.Context, conn net.Conn, cid connectionID, secret []byte) (connectionID, time.Time, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.SetDeadline(time.Time{})
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the pending read or write
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
 	var leadBytes [leadBytesLength]byte
 	// the first byte, version, is implicitly set to 0
 	copy(leadBytes[1:], cid[:])
-	_, err := conn.Write(leadBytes[:])
+	sentAt := time.Now()
+	_, err := writeFull(conn, leadBytes[:])
 	if err != nil {
-		return zeroCID, err
+		return zeroCID, sentAt, err
+	}
+	if len(secret) > 0 && cid != zeroCID {
+		if err := answerJoin(conn, secret, cid); err != nil {
+			return zeroCID, sentAt, err
+		}
+		sentAt = time.Now()
 	}
 	_, err = io.ReadFull(conn, leadBytes[:])
 	if err != nil {
-		return zeroCID, err
+		return zeroCID, sentAt, err
 	}
 	if uint8(leadBytes[0]) != 0 {
-		return zeroCID, ErrUnexpectedVersion
+		return zeroCID, sentAt, ErrUnexpectedVersion
 	}
 	var newCID connectionID
 	copy(newCID[:], leadBytes[1:])
 	if cid != zeroCID && cid != newCID {
-		return zeroCID, ErrUnexpectedCID
+		return zeroCID, sentAt, ErrUnexpectedCID
 	}
-	return newCID, nil
+	return newCID, sentAt, nil
 }
 
 func (mpd *mpDialer) Label() string {
@@ -196,7 +391,7 @@ func (mpd *mpDialer) sorted() []*subflowDialer {
 
 func (mpd *mpDialer) FormatStats() (stats []string) {
 	for _, d := range mpd.sorted() {
-		stats = append(stats, fmt.Sprintf("%s  S: %4d(%3d)  F: %4d  RTT: %6.0fms  SENT: %7d/%7s  RECV: %7d/%7s  RT: %7d/%7s",
+		stats = append(stats, fmt.Sprintf("%s  S: %4d(%3d)  F: %4d  RTT: %6.0fms  SENT: %7d/%7s  RECV: %7d/%7s  RT: %7d/%7s  BLK: %7d",
 			d.label,
 			atomic.LoadUint64(&d.successes),
 			atomic.LoadUint64(&d.consecSuccesses),
@@ -204,7 +399,8 @@ func (mpd *mpDialer) FormatStats() (stats []string) {
 			d.emaRTT.GetDuration().Seconds()*1000,
 			atomic.LoadUint64(&d.framesSent), humanize.Bytes(atomic.LoadUint64(&d.bytesSent)),
 			atomic.LoadUint64(&d.framesRecv), humanize.Bytes(atomic.LoadUint64(&d.bytesRecv)),
-			atomic.LoadUint64(&d.framesRetransmit), humanize.Bytes(atomic.LoadUint64(&d.bytesRetransmit))))
+			atomic.LoadUint64(&d.framesRetransmit), humanize.Bytes(atomic.LoadUint64(&d.bytesRetransmit)),
+			atomic.LoadUint64(&d.writesBlocked)))
 	}
 	return
 }
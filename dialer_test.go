@@ -0,0 +1,261 @@
+package multipath
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blackholeDialer never manages to connect until the context is done.
+type blackholeDialer struct{}
+
+func (blackholeDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blackholeDialer) Label() string { return "blackhole" }
+
+func TestDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	bl := NewListener([]net.Listener{l}, []StatsTracker{NullTracker{}})
+	defer bl.Close()
+	go func() {
+		for {
+			conn, err := bl.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// a listener which accepts but never completes the handshake
+	silent, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialers := []Dialer{blackholeDialer{}, newTestDialer(silent.Addr().String(), 0), newTestDialer(l.Addr().String(), 1)}
+	bd := NewDialer("endpoint", dialers, WithDialTimeout(100*time.Millisecond))
+	start := time.Now()
+	conn, err := bd.DialContext(context.Background())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "should not wait for the slow paths")
+
+	bd = NewDialer("endpoint", []Dialer{blackholeDialer{}, newTestDialer(silent.Addr().String(), 0)}, WithEstablishTimeout(200*time.Millisecond))
+	start = time.Now()
+	_, err = bd.DialContext(context.Background())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.InDelta(t, 200*time.Millisecond, time.Since(start), float64(100*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	bd = NewDialer("endpoint", []Dialer{blackholeDialer{}, newTestDialer(silent.Addr().String(), 0)})
+	_, err = bd.DialContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestNetDialer(t *testing.T) {
+	dir := t.TempDir()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tcpListener.Close()
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "subflow.sock"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer unixListener.Close()
+	bl := NewListener([]net.Listener{tcpListener, unixListener}, []StatsTracker{NullTracker{}, NullTracker{}})
+	defer bl.Close()
+
+	var dialed int32
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	bd := NewDialer("endpoint", []Dialer{
+		NewNetDialer("tcp", tcpListener.Addr().String(), nil),
+		NewNetDialer("unix", unixListener.Addr().String(), dial),
+	})
+	go func() {
+		conn, err := bd.DialContext(context.Background())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		io.ReadAll(conn)
+	}()
+	conn, err := bl.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	assert.Eventually(t, func() bool {
+		return len(conn.(*mpConn).sortedSubflows()) == 2
+	}, time.Second, 10*time.Millisecond, "should have a subflow on each transport")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dialed))
+	assert.Equal(t, "unix://"+unixListener.Addr().String(), NewNetDialer("unix", unixListener.Addr().String(), dial).Label())
+}
+
+func TestLocalAddrDialer(t *testing.T) {
+	for _, local := range []string{"127.0.0.2", "127.0.0.3"} {
+		// only Linux routes the whole 127.0.0.0/8 to the loopback by default
+		probe, err := net.Listen("tcp", local+":")
+		if err != nil {
+			t.Skipf("can't bind %s: %v", local, err)
+		}
+		probe.Close()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	bl := NewListener([]net.Listener{l, l}, []StatsTracker{NullTracker{}, NullTracker{}})
+	defer bl.Close()
+
+	var dialers []Dialer
+	for _, local := range []string{"127.0.0.2", "127.0.0.3:0"} {
+		d, err := NewLocalAddrDialer("tcp", local, l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		dialers = append(dialers, d)
+	}
+	assert.Equal(t, "tcp://127.0.0.2->"+l.Addr().String(), dialers[0].Label())
+	_, err = NewLocalAddrDialer("unix", "127.0.0.1", "/tmp/socket")
+	assert.Error(t, err)
+
+	bd := NewDialer("endpoint", dialers)
+	go func() {
+		conn, err := bd.DialContext(context.Background())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		io.ReadAll(conn)
+	}()
+	conn, err := bl.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	var subflows []*subflow
+	assert.Eventually(t, func() bool {
+		subflows = conn.(*mpConn).sortedSubflows()
+		return len(subflows) == 2
+	}, time.Second, 10*time.Millisecond)
+	remotes := make(map[string]bool)
+	for _, sf := range subflows {
+		host, _, _ := net.SplitHostPort(sf.conn.RemoteAddr().String())
+		remotes[host] = true
+	}
+	assert.Equal(t, map[string]bool{"127.0.0.2": true, "127.0.0.3": true}, remotes, "each subflow should come from its local address")
+}
+
+func TestTimeToReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	bl := NewListener([]net.Listener{l}, []StatsTracker{NullTracker{}})
+	defer bl.Close()
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := bl.Accept()
+		if err == nil {
+			chAccepted <- conn
+		}
+	}()
+
+	bd := NewDialer("endpoint", []Dialer{newTestDialer(l.Addr().String(), 0)})
+	start := time.Now()
+	conn, err := bd.DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	elapsed := time.Since(start)
+	ready := conn.(Conn).TimeToReady()
+	assert.Greater(t, int64(ready), int64(0))
+	assert.LessOrEqual(t, int64(ready), int64(elapsed))
+	server := <-chAccepted
+	defer server.Close()
+	assert.Zero(t, server.(Conn).TimeToReady())
+}
+
+func TestDial(t *testing.T) {
+	dir := t.TempDir()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tcpListener.Close()
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "subflow.sock"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer unixListener.Close()
+	bl := NewListener([]net.Listener{tcpListener, unixListener}, []StatsTracker{NullTracker{}, NullTracker{}})
+	defer bl.Close()
+	go func() {
+		conn, err := bl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := Dial([]string{tcpListener.Addr().String(), "unix://" + unixListener.Addr().String()}, WithMaxFrameSize(3))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	assert.Equal(t, ErrFrameTooLarge, err, "should apply the options")
+	_, err = conn.Write([]byte("hi"))
+	assert.NoError(t, err)
+	b := make([]byte, 2)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(b))
+	assert.Eventually(t, func() bool {
+		return len(conn.(Conn).Subflows()) == 2
+	}, time.Second, 10*time.Millisecond, "should dial all targets")
+
+	_, err = Dial([]string{"unix://" + filepath.Join(dir, "nonexistent.sock")})
+	assert.Equal(t, ErrFailOnAllDialers, err)
+}
@@ -0,0 +1,72 @@
+package multipath
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrDSCPUnsupported is returned when the DSCP can't be set on a conn, either
+// because the platform doesn't support it or the conn isn't a socket.
+var ErrDSCPUnsupported = errors.New("setting DSCP is not supported")
+
+// SetDSCP marks the packets sent on the raw socket of a subflow with the
+// Differentiated Services Code Point dscp, e.g. 46 for Expedited Forwarding,
+// by setting IP_TOS, or IPV6_TCLASS on IPv6. It's only supported on Linux,
+// macOS and FreeBSD, and returns ErrDSCPUnsupported on other platforms, or if
+// the conn doesn't expose a socket via syscall.Conn, e.g. a TLS conn. Whether
+// the marking is honored is up to the network.
+func SetDSCP(raw net.Conn, dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP %d", dscp)
+	}
+	sc, ok := raw.(syscall.Conn)
+	if !ok {
+		return ErrDSCPUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv6 := false
+	switch addr := raw.LocalAddr().(type) {
+	case *net.TCPAddr:
+		ipv6 = addr.IP.To4() == nil
+	case *net.UDPAddr:
+		ipv6 = addr.IP.To4() == nil
+	default:
+		return ErrDSCPUnsupported
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = setTrafficClass(fd, ipv6, dscp<<2)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// WithDSCP marks the packets of each subflow with the DSCP returned by dscp
+// given the subflow label, or leaves them unmarked if it returns a negative
+// value, so the network can prioritize e.g. the low latency path. It's applied
+// when a subflow is added, before the subflow callback is called. Failures are
+// only logged, see SetDSCP for the limitations.
+func WithDSCP(dscp func(subflow string) int) Option {
+	return func(cfg *config) {
+		cfg.dscp = dscp
+	}
+}
+
+func (bc *mpConn) markSubflow(to string, c net.Conn) {
+	if bc.cfg.dscp == nil {
+		return
+	}
+	dscp := bc.cfg.dscp(to)
+	if dscp < 0 {
+		return
+	}
+	if err := SetDSCP(c, dscp); err != nil {
+		log.Debugf("failed to set DSCP %d on %s: %v", dscp, to, err)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package multipath
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDSCPSocketOption(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.NoError(t, SetDSCP(conn, 46))
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var tos int
+	rc.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 46<<2, tos)
+}
+
+// readTrafficClass returns the IP_TOS, or IPV6_TCLASS on IPv6, of the socket
+// of raw.
+func readTrafficClass(raw net.Conn) (int, error) {
+	sc, ok := raw.(syscall.Conn)
+	if !ok {
+		return 0, ErrDSCPUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := raw.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	var tos int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		tos, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return tos, sockErr
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package multipath
+
+func setTrafficClass(fd uintptr, ipv6 bool, tos int) error {
+	return ErrDSCPUnsupported
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package multipath
+
+import "net"
+
+// readTrafficClass is only implemented on Linux.
+func readTrafficClass(raw net.Conn) (int, error) {
+	return 0, ErrDSCPUnsupported
+}
@@ -0,0 +1,71 @@
+package multipath
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDSCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.Error(t, SetDSCP(conn, 64))
+	pipe, _ := net.Pipe()
+	assert.Equal(t, ErrDSCPUnsupported, SetDSCP(pipe, 46))
+}
+
+func TestWithDSCP(t *testing.T) {
+	var mu sync.Mutex
+	marked := make(map[string]int)
+	raws := make(map[string]net.Conn)
+	client, server, _ := newTestConnPair(t, 2, WithDSCP(func(subflow string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		dscp := 46
+		if len(marked)%2 == 1 {
+			dscp = -1
+		}
+		marked[subflow] = dscp
+		return dscp
+	}), WithSubflowCallback(func(_ Conn, subflow string, raw net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		raws[subflow] = raw
+	}))
+	defer client.Close()
+	defer server.Close()
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = server.Read(make([]byte, 5))
+	assert.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, len(marked) >= 2)
+	for subflow, dscp := range marked {
+		raw := raws[subflow]
+		if !assert.NotNil(t, raw, subflow) {
+			continue
+		}
+		tos, err := readTrafficClass(raw)
+		if err == ErrDSCPUnsupported {
+			t.Skip("can't read the traffic class back on this platform")
+		}
+		assert.NoError(t, err)
+		if dscp < 0 {
+			assert.Zero(t, tos, "should leave %s unmarked", subflow)
+		} else {
+			assert.Equal(t, dscp<<2, tos, "should mark %s", subflow)
+		}
+	}
+}
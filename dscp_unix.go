@@ -0,0 +1,12 @@
+//go:build linux || darwin || freebsd
+
+package multipath
+
+import "syscall"
+
+func setTrafficClass(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
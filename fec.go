@@ -0,0 +1,262 @@
+package multipath
+
+import (
+	"bytes"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// fecEncoder accumulates the parity of the data frames written. Frames are
+// split into groups of groupSize consecutive frame numbers. Each group is
+// covered by parityFrames parity frames, the kth of which is the XOR of the
+// kth, (k+parityFrames)th... frames of the group, so up to parityFrames lost
+// frames can be recovered from a group as long as they are covered by
+// different parity frames.
+type fecEncoder struct {
+	groupSize    uint64
+	parityFrames uint64
+	groups       map[uint64]*fecGroup
+	mu           sync.Mutex
+}
+
+type fecGroup struct {
+	added   uint64
+	stripes []*fecStripe
+}
+
+// fecStripe is the running parity of the frames covered by one parity frame.
+// The payload is XORed in place within buf, a pooled buffer which keeps room
+// in front for the header, so it becomes the parity frame without copying.
+type fecStripe struct {
+	lenXor  uint64
+	buf     []byte
+	payload []byte
+}
+
+// parityHeadroom is the room for the header of a parity frame.
+const parityHeadroom = 6 * maxVarIntLength
+
+func newFECEncoder(groupSize, parityFrames int) *fecEncoder {
+	return &fecEncoder{
+		groupSize:    uint64(groupSize),
+		parityFrames: uint64(parityFrames),
+		groups:       make(map[uint64]*fecGroup),
+	}
+}
+
+// add accounts data frame fn with payload b, and returns the parity frames of
+// its group if it's the last frame of the group to be added.
+func (enc *fecEncoder) add(fn uint64, b []byte) []*sendFrame {
+	offset := fn - minFrameNumber
+	index := offset / enc.groupSize
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	group := enc.groups[index]
+	if group == nil {
+		group = &fecGroup{stripes: make([]*fecStripe, enc.parityFrames)}
+		for i := range group.stripes {
+			group.stripes[i] = &fecStripe{}
+		}
+		enc.groups[index] = group
+	}
+	group.stripes[offset%enc.groupSize%enc.parityFrames].add(b)
+	group.added++
+	if group.added < enc.groupSize {
+		return nil
+	}
+	delete(enc.groups, index)
+	first := minFrameNumber + index*enc.groupSize
+	var frames []*sendFrame
+	for k, stripe := range group.stripes {
+		count := (enc.groupSize - uint64(k) + enc.parityFrames - 1) / enc.parityFrames
+		frames = append(frames, composeParityFrame(first+uint64(k), enc.parityFrames, count, stripe))
+	}
+	return frames
+}
+
+func (stripe *fecStripe) add(b []byte) {
+	stripe.lenXor ^= uint64(len(b))
+	if n := len(stripe.payload); len(b) > n {
+		if parityHeadroom+len(b) > len(stripe.buf) {
+			// the pool rounds up to a power of two, so it rarely grows twice
+			grown := pool.Get(parityHeadroom + len(b))
+			grown = grown[:cap(grown)]
+			copy(grown[parityHeadroom:], stripe.payload)
+			pool.Put(stripe.buf)
+			stripe.buf = grown
+		}
+		stripe.payload = stripe.buf[parityHeadroom : parityHeadroom+len(b)]
+		// the pooled buffers are not zeroed
+		for i := n; i < len(b); i++ {
+			stripe.payload[i] = 0
+		}
+	}
+	xorInto(stripe.payload, b)
+}
+
+func xorInto(dst, src []byte) {
+	for i, c := range src {
+		dst[i] ^= c
+	}
+}
+
+func composeParityFrame(firstFN, stride, count uint64, stripe *fecStripe) *sendFrame {
+	fieldsLen := VarIntLen(firstFN) + VarIntLen(stride) + VarIntLen(count) + VarIntLen(stripe.lenXor)
+	sz := uint64(fieldsLen + len(stripe.payload))
+	var header [parityHeadroom]byte
+	wb := bytes.NewBuffer(header[:0])
+	WriteVarInt(wb, sz)
+	WriteVarInt(wb, frameTypeParity)
+	WriteVarInt(wb, firstFN)
+	WriteVarInt(wb, stride)
+	WriteVarInt(wb, count)
+	WriteVarInt(wb, stripe.lenXor)
+	if stripe.buf == nil {
+		// none of the frames covered had a payload
+		stripe.buf = pool.Get(parityHeadroom)
+	}
+	start := parityHeadroom - wb.Len()
+	copy(stripe.buf[start:], wb.Bytes())
+	var released int32
+	return &sendFrame{fn: frameTypeParity, sz: sz, buf: stripe.buf[start : parityHeadroom+len(stripe.payload)], released: &released}
+}
+
+// parityFrame is a received parity frame, covering count frames starting
+// from firstFN, stride apart.
+type parityFrame struct {
+	firstFN uint64
+	stride  uint64
+	count   uint64
+	lenXor  uint64
+	payload []byte
+}
+
+func (p *parityFrame) span() uint64 {
+	return p.stride * p.count
+}
+
+// fecDecoder keeps copies of the recently received data frames so that a
+// single frame missing from those covered by a parity frame can be
+// reconstructed from the others.
+type fecDecoder struct {
+	recent   map[uint64][]byte
+	parities []*parityFrame
+	horizon  uint64
+	// maxSpan is the receive window, beyond which a parity frame can't cover
+	// frames still useful to reconstruct, and would cost unbounded CPU and
+	// memory to resolve.
+	maxSpan uint64
+	mu      sync.Mutex
+}
+
+// maxPendingParities bounds the parity frames waiting for the frames they
+// cover.
+const maxPendingParities = 64
+
+func newFECDecoder(groupSize, window int) *fecDecoder {
+	return &fecDecoder{recent: make(map[uint64][]byte), horizon: 2 * uint64(groupSize), maxSpan: uint64(window)}
+}
+
+// onData records the data frame just received, and returns the frames it
+// allows to reconstruct. tip is the highest frame number up to which all
+// frames have been received.
+func (dec *fecDecoder) onData(fn uint64, b []byte, tip uint64) []*rxFrame {
+	dec.mu.Lock()
+	defer dec.mu.Unlock()
+	if _, exists := dec.recent[fn]; exists {
+		return nil
+	}
+	dec.recent[fn] = append([]byte(nil), b...)
+	return dec.resolve(tip)
+}
+
+// onParity records the parity frame just received, and returns the frame it
+// allows to reconstruct, if any.
+func (dec *fecDecoder) onParity(p *parityFrame, tip uint64) []*rxFrame {
+	// checked one by one first so the span can't overflow
+	if p.stride > dec.maxSpan || p.count > dec.maxSpan || p.span() > dec.maxSpan {
+		log.Errorf("Ignoring parity frame spanning %d x %d frames, beyond the receive window", p.count, p.stride)
+		return nil
+	}
+	dec.mu.Lock()
+	defer dec.mu.Unlock()
+	// bounded by twice the receive window
+	if 2*p.span() > dec.horizon {
+		dec.horizon = 2 * p.span()
+	}
+	dec.parities = append(dec.parities, p)
+	if len(dec.parities) > maxPendingParities {
+		dec.parities = dec.parities[1:]
+	}
+	return dec.resolve(tip)
+}
+
+func (dec *fecDecoder) resolve(tip uint64) []*rxFrame {
+	var recovered []*rxFrame
+	for {
+		var progress bool
+		var remains []*parityFrame
+		for _, p := range dec.parities {
+			var missing []uint64
+			for i := uint64(0); i < p.count; i++ {
+				fn := p.firstFN + i*p.stride
+				if _, exists := dec.recent[fn]; !exists {
+					missing = append(missing, fn)
+				}
+			}
+			if len(missing) == 0 || missing[0] <= tip {
+				// nothing to recover, or the payload needed is gone
+				continue
+			}
+			if len(missing) > 1 {
+				remains = append(remains, p)
+				continue
+			}
+			f := dec.reconstruct(p, missing[0])
+			if f == nil {
+				continue
+			}
+			log.Debugf("recovered frame %d with FEC", f.fn)
+			recovered = append(recovered, f)
+			progress = true
+		}
+		dec.parities = remains
+		if !progress {
+			break
+		}
+	}
+	if uint64(len(dec.recent)) > 2*dec.horizon && tip > dec.horizon {
+		for fn := range dec.recent {
+			if fn < tip-dec.horizon {
+				delete(dec.recent, fn)
+			}
+		}
+	}
+	return recovered
+}
+
+func (dec *fecDecoder) reconstruct(p *parityFrame, fn uint64) *rxFrame {
+	sz := p.lenXor
+	payload := append([]byte(nil), p.payload...)
+	for i := uint64(0); i < p.count; i++ {
+		other := p.firstFN + i*p.stride
+		if other == fn {
+			continue
+		}
+		b := dec.recent[other]
+		if len(b) > len(payload) {
+			// inconsistent with the parity, maybe from an older peer
+			return nil
+		}
+		sz ^= uint64(len(b))
+		xorInto(payload, b)
+	}
+	if sz == 0 || sz > uint64(len(payload)) {
+		return nil
+	}
+	dec.recent[fn] = payload[:sz]
+	buf := pool.Get(int(sz))
+	copy(buf, payload)
+	return &rxFrame{fn: fn, bytes: buf}
+}
@@ -0,0 +1,108 @@
+package multipath
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFECCodec(t *testing.T) {
+	enc := newFECEncoder(6, 2)
+	dec := newFECDecoder(6, recieveQueueLength)
+	var payloads [][]byte
+	for i := 0; i < 6; i++ {
+		payloads = append(payloads, bytes.Repeat([]byte{byte(i + 1)}, i+1))
+	}
+	var parities []*sendFrame
+	for i, b := range payloads {
+		parities = append(parities, enc.add(minFrameNumber+uint64(i), b)...)
+	}
+	if !assert.Len(t, parities, 2) {
+		return
+	}
+	assert.Empty(t, enc.groups)
+
+	// lose one frame covered by each parity frame
+	lost := map[uint64]bool{minFrameNumber + 2: true, minFrameNumber + 5: true}
+	var recovered []*rxFrame
+	for i, b := range payloads {
+		fn := minFrameNumber + uint64(i)
+		if !lost[fn] {
+			recovered = append(recovered, dec.onData(fn, b, minFrameNumber+1)...)
+		}
+	}
+	assert.Empty(t, recovered)
+	for _, frame := range parities {
+		p, ok := (&subflow{}).readParityFrame(&byteReader{Reader: bytes.NewReader(frame.buf[2:])}, frame.sz)
+		if assert.True(t, ok) {
+			recovered = append(recovered, dec.onParity(p, minFrameNumber+1)...)
+		}
+	}
+	if assert.Len(t, recovered, 2) {
+		for _, f := range recovered {
+			assert.True(t, lost[f.fn])
+			assert.Equal(t, payloads[f.fn-minFrameNumber], f.bytes)
+		}
+	}
+	assert.Empty(t, dec.parities)
+}
+
+func TestFECRejectsOversizedParity(t *testing.T) {
+	dec := newFECDecoder(6, 100)
+	for _, p := range []*parityFrame{
+		{firstFN: minFrameNumber, stride: 1, count: 101},
+		{firstFN: minFrameNumber, stride: 101, count: 1},
+		{firstFN: minFrameNumber, stride: 20, count: 20},
+		{firstFN: minFrameNumber, stride: 1 << 62, count: 1 << 62},
+	} {
+		assert.Empty(t, dec.onParity(p, minFrameNumber))
+	}
+	assert.Empty(t, dec.parities, "should drop the parity frames spanning beyond the receive window")
+	assert.EqualValues(t, 12, dec.horizon)
+	dec.onParity(&parityFrame{firstFN: minFrameNumber, stride: 10, count: 10}, 0)
+	assert.Len(t, dec.parities, 1)
+	assert.EqualValues(t, 200, dec.horizon)
+}
+
+func TestFECRecoversLostFrame(t *testing.T) {
+	var dropped sync.Once
+	// the min RTO keeps the lost frame from being retransmitted in time
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &droppingConn{Conn: c, fn: minFrameNumber + 1, once: &dropped}
+	}, WithFEC(4, 1), WithMinRTO(time.Hour), WithMaxRTO(time.Hour))
+	for i := 0; i < 4; i++ {
+		_, err := client.Write(bytes.Repeat([]byte{byte(i)}, i+1))
+		assert.NoError(t, err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 10)
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 1, 2, 2, 2, 3, 3, 3, 3}, b)
+}
+
+// droppingConn silently drops the first frame numbered fn written.
+type droppingConn struct {
+	net.Conn
+	fn   uint64
+	once *sync.Once
+}
+
+func (c *droppingConn) Write(b []byte) (int, error) {
+	r := &byteReader{Reader: bytes.NewReader(b)}
+	sz, _ := ReadVarInt(r)
+	fn, _ := ReadVarInt(r)
+	drop := false
+	if sz > 0 && fn == c.fn {
+		c.once.Do(func() { drop = true })
+	}
+	if drop {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
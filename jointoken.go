@@ -0,0 +1,58 @@
+package multipath
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	joinNonceLength = 16
+	joinTokenLength = sha256.Size
+)
+
+// ErrInvalidJoinToken means a subflow failed to prove it belongs to the
+// connection it claims, see WithJoinSecret.
+var ErrInvalidJoinToken = errors.New("invalid join token")
+
+// joinToken is the proof that the subflow joining connection cid knows the
+// secret, given the nonce chosen by the listener.
+func joinToken(secret []byte, cid connectionID, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(cid[:])
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// challengeJoin makes the subflow conn joining connection cid prove it knows
+// the secret.
+func challengeJoin(conn net.Conn, secret []byte, cid connectionID) error {
+	var nonce [joinNonceLength]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	if _, err := writeFull(conn, nonce[:]); err != nil {
+		return err
+	}
+	var token [joinTokenLength]byte
+	if _, err := io.ReadFull(conn, token[:]); err != nil {
+		return err
+	}
+	if !hmac.Equal(token[:], joinToken(secret, cid, nonce[:])) {
+		return ErrInvalidJoinToken
+	}
+	return nil
+}
+
+// answerJoin answers the challenge of the listener to join connection cid.
+func answerJoin(conn net.Conn, secret []byte, cid connectionID) error {
+	var nonce [joinNonceLength]byte
+	if _, err := io.ReadFull(conn, nonce[:]); err != nil {
+		return err
+	}
+	_, err := writeFull(conn, joinToken(secret, cid, nonce[:]))
+	return err
+}
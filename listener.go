@@ -1,9 +1,11 @@
 package multipath
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,22 +21,64 @@ type mpListener struct {
 	startOnce      sync.Once
 	chClose        chan struct{}
 	closeOnce      sync.Once
+	cfg            *config
+	ownsListeners  bool
 }
 
-func NewListener(listeners []net.Listener, stats []StatsTracker) net.Listener {
+// Listen listens on each of addrs on network, and returns a net.Listener
+// accepting the multipath connections whose subflows arrive on any of them.
+// It can be used anywhere a net.Listener is expected, e.g. by http.Server.
+// Closing it closes all the underlying listeners. Addr returns the addresses
+// listened on, separated by commas.
+func Listen(network string, addrs []string, opts ...Option) (net.Listener, error) {
+	if err := ValidateOptions(opts...); err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	var stats []StatsTracker
+	for _, addr := range addrs {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		stats = append(stats, NullTracker{})
+	}
+	mpl := NewListener(listeners, stats, opts...).(*mpListener)
+	mpl.ownsListeners = true
+	return mpl, nil
+}
+
+// NewListener creates a net.Listener accepting the multipath connections whose
+// subflows arrive on any of the listeners. Each incoming subflow is
+// handshaked in the background, so a slow one doesn't hold up the others.
+// The returned net.Conns are Conns. It panics if the number of stats trackers
+// doesn't match the listeners, or the options are invalid, see
+// ValidateOptions.
+func NewListener(listeners []net.Listener, stats []StatsTracker, opts ...Option) net.Listener {
 	if len(listeners) != len(stats) {
 		panic("the number of stats trackers should match listeners")
 	}
+	var safeStats []StatsTracker
+	for _, st := range stats {
+		safeStats = append(safeStats, safeTracker{st})
+	}
 	mpl := &mpListener{
 		listeners:      listeners,
-		listenerStats:  stats,
+		listenerStats:  safeStats,
 		mpConns:        make(map[connectionID]*mpConn),
 		chNextAccepted: make(chan net.Conn),
 		chClose:        make(chan struct{}),
+		cfg:            newConfig(opts),
 	}
 	return mpl
 }
 
+// Accept waits for the next multipath connection. The returned net.Conn is a
+// Conn.
 func (mpl *mpListener) Accept() (net.Conn, error) {
 	mpl.startOnce.Do(mpl.start)
 	select {
@@ -46,15 +90,32 @@ func (mpl *mpListener) Accept() (net.Conn, error) {
 }
 
 func (mpl *mpListener) Close() error {
-	mpl.closeOnce.Do(func() { close(mpl.chClose) })
+	mpl.closeOnce.Do(func() {
+		close(mpl.chClose)
+		if mpl.ownsListeners {
+			for _, l := range mpl.listeners {
+				l.Close()
+			}
+		}
+	})
 	return nil
 }
 
-// Addr satisfies the net.Listener interface. It returns a fake addr.
+// Addr satisfies the net.Listener interface. It returns the addresses of the
+// underlying listeners, separated by commas.
 func (mpl *mpListener) Addr() net.Addr {
-	return fakeAddr{}
+	var addrs []string
+	for _, l := range mpl.listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return listenerAddr(strings.Join(addrs, ","))
 }
 
+type listenerAddr string
+
+func (listenerAddr) Network() string  { return "multipath" }
+func (a listenerAddr) String() string { return string(a) }
+
 func (mpl *mpListener) start() {
 	for i, l := range mpl.listeners {
 		go func(l net.Listener, st StatsTracker) {
@@ -64,6 +125,9 @@ func (mpl *mpListener) start() {
 					case <-mpl.chClose:
 						return
 					default:
+						if errors.Is(err, net.ErrClosed) {
+							return
+						}
 						log.Debugf("failed to accept on %s: %v", l.Addr(), err)
 					}
 				}
@@ -77,8 +141,24 @@ func (mpl *mpListener) acceptFrom(l net.Listener, st StatsTracker) error {
 	if err != nil {
 		return err
 	}
+	go func() {
+		if mpl.cfg.dialTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(mpl.cfg.dialTimeout))
+		}
+		if err := mpl.handleSubflow(conn, st); err != nil {
+			conn.Close()
+			log.Debugf("failed to handle subflow from %v: %v", conn.RemoteAddr(), err)
+		}
+	}()
+	return nil
+}
+
+// handleSubflow does the handshake of a new subflow and adds it to the
+// connection it belongs to. Subflows claiming to belong to an unknown
+// connection are handled according to the UnknownCIDPolicy.
+func (mpl *mpListener) handleSubflow(conn net.Conn, st StatsTracker) error {
 	var leadBytes [leadBytesLength]byte
-	_, err = io.ReadFull(conn, leadBytes[:])
+	_, err := io.ReadFull(conn, leadBytes[:])
 	if err != nil {
 		return err
 	}
@@ -89,33 +169,68 @@ func (mpl *mpListener) acceptFrom(l net.Listener, st StatsTracker) error {
 	copy(cid[:], leadBytes[1:])
 	newConn := false
 	if cid == zeroCID {
+		if !mpl.cfg.memoryLimiter.admitConn() {
+			return fmt.Errorf("rejected new connection from %v: %w", conn.RemoteAddr(), ErrMemoryLimit)
+		}
 		newConn = true
 		cid = connectionID(uuid.New())
 		copy(leadBytes[1:], cid[:])
 		log.Tracef("New connection from %v, assigned CID %x", conn.RemoteAddr(), cid)
 	} else {
 		log.Tracef("New subflow of CID %x from %v", cid, conn.RemoteAddr())
+		mpl.muMPConns.Lock()
+		_, exists := mpl.mpConns[cid]
+		mpl.muMPConns.Unlock()
+		if !exists {
+			if mpl.cfg.unknownCIDPolicy == ResetUnknownCID {
+				// let the peer know immediately rather than timing out
+				var reset [leadBytesLength]byte
+				writeFull(conn, reset[:])
+			}
+			return fmt.Errorf("unexpected subflow of CID %x from %v", cid, conn.RemoteAddr())
+		}
+		if len(mpl.cfg.joinSecret) > 0 {
+			if err := challengeJoin(conn, mpl.cfg.joinSecret, cid); err != nil {
+				if err == ErrInvalidJoinToken {
+					// let the peer know rather than timing out
+					var reset [leadBytesLength]byte
+					writeFull(conn, reset[:])
+				}
+				return fmt.Errorf("subflow of CID %x from %v failed to join: %w", cid, conn.RemoteAddr(), err)
+			}
+		}
 	}
 	probeStart := time.Now()
 	// echo lead bytes back to the client
-	if _, err := conn.Write(leadBytes[:]); err != nil {
+	if _, err := writeFull(conn, leadBytes[:]); err != nil {
 		return err
 	}
 	mpl.muMPConns.Lock()
 	bc, exists := mpl.mpConns[cid]
 	if !exists {
 		if newConn {
-			bc = newMPConn(cid, conn.RemoteAddr())
+			bc = newMPConn(cid, conn.RemoteAddr(), mpl.cfg)
 			mpl.mpConns[cid] = bc
+			go func() {
+				<-bc.Done()
+				mpl.remove(cid)
+			}()
 		} else {
+			// the connection is gone during the handshake
 			mpl.muMPConns.Unlock()
-			return fmt.Errorf("unexpected subflow of CID %v from %v", cid, conn.RemoteAddr())
+			return fmt.Errorf("unexpected subflow of CID %x from %v", cid, conn.RemoteAddr())
 		}
 	}
 	mpl.muMPConns.Unlock()
+	conn.SetDeadline(time.Time{})
 	bc.add(fmt.Sprintf("%x(%s)", cid, conn.LocalAddr().String()), conn, false, probeStart, st)
 	if newConn {
-		mpl.chNextAccepted <- bc
+		select {
+		case mpl.chNextAccepted <- bc:
+		case <-mpl.chClose:
+			bc.Close()
+			return ErrClosed
+		}
 	}
 	return nil
 }
@@ -0,0 +1,148 @@
+package multipath
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownCID(t *testing.T) {
+	for _, policy := range []UnknownCIDPolicy{DropUnknownCID, ResetUnknownCID} {
+		l, err := net.Listen("tcp", "127.0.0.1:")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer l.Close()
+		bl := NewListener([]net.Listener{l}, []StatsTracker{NullTracker{}}, WithUnknownCIDPolicy(policy))
+		defer bl.Close()
+		go bl.Accept()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		var leadBytes [leadBytesLength]byte
+		copy(leadBytes[1:], []byte("phantom connection"))
+		_, err = conn.Write(leadBytes[:])
+		assert.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b, err := io.ReadAll(conn)
+		assert.NoError(t, err, "should close the subflow")
+		if policy == ResetUnknownCID {
+			assert.Equal(t, make([]byte, leadBytesLength), b)
+		} else {
+			assert.Empty(t, b)
+		}
+		assert.Empty(t, bl.(*mpListener).mpConns, "should not create any connection")
+	}
+
+	// the dialer fails immediately on reset
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	bl := NewListener([]net.Listener{l}, []StatsTracker{NullTracker{}}, WithUnknownCIDPolicy(ResetUnknownCID))
+	defer bl.Close()
+	go bl.Accept()
+	bd := NewDialer("endpoint", []Dialer{newTestDialer(l.Addr().String(), 0)}).(*mpDialer)
+	conn, err := bd.dialers[0].DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	var cid connectionID
+	copy(cid[:], []byte("phantom connection"))
+	_, _, err = handshake(context.Background(), conn, cid, nil)
+	assert.Equal(t, ErrUnexpectedCID, err)
+}
+
+func TestListen(t *testing.T) {
+	l, err := Listen("tcp", []string{"127.0.0.1:", "127.0.0.1:"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	addrs := strings.Split(l.Addr().String(), ",")
+	if !assert.Len(t, addrs, 2) {
+		return
+	}
+	// a subflow never completing the handshake should hold up no one
+	silent, err := net.Dial("tcp", addrs[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer silent.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	var dialers []Dialer
+	for _, addr := range addrs {
+		dialers = append(dialers, NewNetDialer("tcp", addr, nil))
+	}
+	conn, err := NewDialer("endpoint", dialers).DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	mpl := l.(*mpListener)
+	mpl.muMPConns.Lock()
+	assert.Len(t, mpl.mpConns, 1)
+	mpl.muMPConns.Unlock()
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		mpl.muMPConns.Lock()
+		defer mpl.muMPConns.Unlock()
+		return len(mpl.mpConns) == 0
+	}, 5*time.Second, 10*time.Millisecond, "should forget the closed connections")
+
+	l.Close()
+	_, err = net.Dial("tcp", addrs[1])
+	assert.Error(t, err, "should close the underlying listeners")
+}
+
+func TestJoinSecret(t *testing.T) {
+	secret := WithJoinSecret([]byte("secret"))
+	client, server, _ := newTestConnPair(t, 2, secret)
+	defer client.Close()
+	defer server.Close()
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond, "should join with the secret")
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err)
+
+	// guessed the CID but not the secret
+	accepted := server.(*mpConn)
+	conns := accepted.sortedSubflows()
+	addr := conns[0].conn.LocalAddr().String()
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, _, err = handshake(context.Background(), conn, bc.cid, []byte("guess"))
+	assert.Equal(t, ErrUnexpectedCID, err)
+	assert.Len(t, accepted.sortedSubflows(), 2, "should not join")
+}
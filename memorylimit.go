@@ -0,0 +1,129 @@
+package multipath
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrMemoryLimit is returned when a new connection is rejected because the
+// MemoryLimiter is near its limit.
+var ErrMemoryLimit = errors.New("memory limit reached")
+
+// MemoryLimiter caps the memory taken by the frame payloads buffered by all
+// the connections sharing it, i.e. the frames written but not acked yet,
+// which includes those in the send queues, and the frames received but not
+// read yet. A Write blocks while there's no room for its payload, applying
+// backpressure, and a data frame received while there's no room is dropped
+// without acking, to be retransmitted by the peer later, unless it's the one
+// the reader is waiting for, as reading it frees up memory. Once the usage
+// reaches 90% of the limit, new connections are rejected by the listeners,
+// leaving the room to the existing ones.
+//
+// A single frame larger than the limit is let through when nothing else is
+// buffered, so that it can't block forever.
+type MemoryLimiter struct {
+	limit int64
+	used  int64 // accessed atomically
+	// rejected is the number of connections rejected. Accessed
+	// atomically.
+	rejected uint64
+	mu       sync.Mutex
+	// chFreed is closed and replaced each time some memory is released,
+	// to wake up the writers waiting for room.
+	chFreed chan struct{}
+}
+
+// NewMemoryLimiter creates a MemoryLimiter capping the buffered payloads to
+// limit bytes. Pass it to all the connections to share the limit with
+// WithMemoryLimiter.
+func NewMemoryLimiter(limit int64) *MemoryLimiter {
+	return &MemoryLimiter{limit: limit, chFreed: make(chan struct{})}
+}
+
+// Limit returns the limit in bytes.
+func (ml *MemoryLimiter) Limit() int64 {
+	return ml.limit
+}
+
+// Used returns the bytes currently buffered.
+func (ml *MemoryLimiter) Used() int64 {
+	return atomic.LoadInt64(&ml.used)
+}
+
+// Rejected returns the number of new connections rejected so far.
+func (ml *MemoryLimiter) Rejected() uint64 {
+	return atomic.LoadUint64(&ml.rejected)
+}
+
+// tryAcquire takes n bytes if there's room for them. It's nil-safe, a nil
+// MemoryLimiter having unlimited room.
+func (ml *MemoryLimiter) tryAcquire(n int) bool {
+	acquired, _ := ml.acquireOrWait(n)
+	return acquired
+}
+
+// tryAcquireFrame is like tryAcquire for a received frame. The frames
+// received out of order can't use the last quarter of the limit, so that it's
+// left to those the reader needs to make progress. Otherwise, when mostly out
+// of order frames are buffered, each missing frame could only get in when it's
+// the very next to be read.
+func (ml *MemoryLimiter) tryAcquireFrame(n int, inOrder bool) bool {
+	if ml == nil || inOrder {
+		return ml.tryAcquire(n)
+	}
+	acquired, _ := ml.acquireBelow(n, ml.limit-ml.limit/4)
+	return acquired
+}
+
+// acquireOrWait takes n bytes if there's room for them, otherwise it returns
+// a channel which is closed when some memory is released.
+func (ml *MemoryLimiter) acquireOrWait(n int) (bool, <-chan struct{}) {
+	if ml == nil {
+		return true, nil
+	}
+	return ml.acquireBelow(n, ml.limit)
+}
+
+func (ml *MemoryLimiter) acquireBelow(n int, limit int64) (bool, <-chan struct{}) {
+	if n == 0 {
+		return true, nil
+	}
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	used := atomic.LoadInt64(&ml.used)
+	if used > 0 && used+int64(n) > limit {
+		return false, ml.chFreed
+	}
+	atomic.AddInt64(&ml.used, int64(n))
+	return true, nil
+}
+
+// forceAcquire takes n bytes even if it goes over the limit. It's nil-safe.
+func (ml *MemoryLimiter) forceAcquire(n int) {
+	if ml != nil {
+		atomic.AddInt64(&ml.used, int64(n))
+	}
+}
+
+// release gives back n bytes taken before. It's nil-safe.
+func (ml *MemoryLimiter) release(n int) {
+	if ml == nil || n == 0 {
+		return
+	}
+	ml.mu.Lock()
+	atomic.AddInt64(&ml.used, -int64(n))
+	close(ml.chFreed)
+	ml.chFreed = make(chan struct{})
+	ml.mu.Unlock()
+}
+
+// admitConn tells if a new connection can be accepted, counting it as
+// rejected if not. It's nil-safe.
+func (ml *MemoryLimiter) admitConn() bool {
+	if ml == nil || ml.Used() < ml.limit-ml.limit/10 {
+		return true
+	}
+	atomic.AddUint64(&ml.rejected, 1)
+	return false
+}
@@ -0,0 +1,116 @@
+package multipath
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	ml := NewMemoryLimiter(100)
+	assert.True(t, ml.tryAcquire(60))
+	assert.False(t, ml.tryAcquire(60))
+	_, chFreed := ml.acquireOrWait(60)
+	ml.release(60)
+	select {
+	case <-chFreed:
+	default:
+		assert.Fail(t, "should wake up the waiters on release")
+	}
+	assert.True(t, ml.tryAcquire(200), "should let a large frame through when nothing is buffered")
+	assert.EqualValues(t, 200, ml.Used())
+	assert.False(t, ml.admitConn())
+	assert.EqualValues(t, 1, ml.Rejected())
+	ml.release(200)
+	assert.True(t, ml.admitConn())
+
+	var unlimited *MemoryLimiter
+	assert.True(t, unlimited.tryAcquire(1<<30))
+	unlimited.release(1 << 30)
+}
+
+func TestMemoryLimit(t *testing.T) {
+	ml := NewMemoryLimiter(64 * 1024)
+	client, server, _ := newAsymmetricTestConnPair(t, 2, nil,
+		[]Option{WithWriteTimeout(200 * time.Millisecond), WithMaxRTO(200 * time.Millisecond)},
+		[]Option{WithMemoryLimiter(ml)})
+	defer client.Close()
+	defer server.Close()
+
+	// nobody reads, so the frames beyond the limit are dropped until the
+	// writes block for lack of acks
+	b := make([]byte, 1024)
+	written := 0
+	for written < 1024*1024 {
+		n, err := client.Write(b)
+		written += n
+		if err != nil {
+			assert.Equal(t, context.DeadlineExceeded, err)
+			break
+		}
+	}
+	assert.Less(t, written, 1024*1024, "should apply backpressure")
+	assert.LessOrEqual(t, ml.Used(), ml.Limit()+int64(len(b)))
+	assert.Equal(t, ErrMemoryLimit, dialWhileLimited(t, ml))
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.CopyN(io.Discard, server, int64(written))
+	assert.NoError(t, err, "should deliver everything written once read")
+	assert.Eventually(t, func() bool { return ml.Used() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryLimitClosedWithBlockedWriters(t *testing.T) {
+	ml := NewMemoryLimiter(1024 * 1024)
+	var stalled int32
+	wrap := func(c net.Conn) net.Conn { return &stallingConn{c, &stalled} }
+	client, server, _ := newAsymmetricTestConnPair(t, 1, wrap, []Option{WithMemoryLimiter(ml)}, nil)
+	defer server.Close()
+
+	// the subflow can't write, so the writers end up waiting for room on it
+	atomic.StoreInt32(&stalled, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := client.Write(make([]byte, 1000)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&client.(*mpConn).writersBlocked) == 8
+	}, 5*time.Second, 10*time.Millisecond)
+	client.Close()
+	server.Close()
+	atomic.StoreInt32(&stalled, 0)
+	wg.Wait()
+	assert.Eventually(t, func() bool { return ml.Used() == 0 }, 5*time.Second, 10*time.Millisecond, "should give the memory of the frames never sent back")
+
+	// as is the frame of a write failing for lack of subflows
+	bc := newMPConn(zeroCID, nil, newConfig([]Option{WithMemoryLimiter(ml)}))
+	defer bc.Close()
+	_, err := bc.Write(make([]byte, 1000))
+	assert.Equal(t, ErrClosed, err)
+	assert.Zero(t, ml.Used())
+}
+
+// dialWhileLimited returns the error of a listener sharing ml handling a new
+// connection.
+func dialWhileLimited(t *testing.T, ml *MemoryLimiter) error {
+	mpl := NewListener(nil, nil, WithMemoryLimiter(ml)).(*mpListener)
+	defer mpl.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	go writeFull(client, make([]byte, leadBytesLength))
+	return errors.Unwrap(mpl.handleSubflow(server, NullTracker{}))
+}
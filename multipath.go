@@ -14,6 +14,12 @@
 //      |  version(1)  |  cid(16)  |  frames (...)  |
 //       ----------------------------------------------------
 //
+// If a join secret is configured, a subsequent subflow has to prove it knows
+// the secret before the server sends the CID back. The server sends a random
+// 16-byte nonce, to which the client replies with the 32-byte HMAC-SHA256 of
+// the CID and the nonce keyed by the secret. If it doesn't match, the server
+// sends the all-zero CID back and closes the subflow.
+//
 // There are two types of frames. Data frame carries application data while ack
 // frame carries acknowledgement to the frame just received. When one data
 // frame is not acked in time, it is sent over another subflow, until all
@@ -29,9 +35,17 @@
 //      |  00000000  |  ack frame number (1-8)  |
 //       ---------------------------------------
 //
-// Ack frames with frame number < 10 are reserved for control. For now only 0
-// and 1 are used, for ping and pong frame respectively. They are for updating
-// RTT on inactive subflows and detecting recovered subflows.
+// Ack frames with frame number < 10 are reserved for control. For now only 0,
+// 1, 2 and 3 are used, for ping, pong, reset and close frame respectively.
+// Ping and pong are for updating RTT on inactive subflows and detecting
+// recovered subflows. Reset is sent on all subflows when the connection is
+// aborted, upon which the peer discards everything and fails the reads and
+// writes with ErrConnReset. Close is sent on all subflows when the connection
+// is closed, upon which the peer sends close back on the subflow and closes
+// it, unless it's closing as well, and its reads return io.EOF once the data
+// received in order is read. The closing side waits for the close from the
+// peer before tearing the subflows down, so both sides agree the connection
+// is closed cleanly even if they close it at the same time.
 //
 // Ping frame:
 //       -------------------------
@@ -43,6 +57,90 @@
 //      |  00000000  |  00000001  |
 //       -------------------------
 //
+// Reset frame:
+//       -------------------------
+//      |  00000000  |  00000010  |
+//       -------------------------
+//
+// Close frame:
+//       -------------------------
+//      |  00000000  |  00000011  |
+//       -------------------------
+//
+// Likewise, data frames with frame number < 10 are extended frames, whose
+// payload starts with type specific fields, which are counted in the payload
+// size too. Receivers skip extended frames of unknown types. 2 is used for data
+// frames carrying a piggybacked cumulative ack, i.e. all frames up to and
+// including the ack frame number have been received.
+//
+// Data frame with piggybacked ack:
+//       ------------------------------------------------------------------------------------------------
+//      |  payload size(1-8)  |  00000010  |  frame number (1-8)  |  ack frame number (1-8)  |  payload  |
+//       ------------------------------------------------------------------------------------------------
+//
+// 3 is used for parity frames when forward error correction is enabled. The
+// payload is the XOR of the payloads of the frames covered, padded with zeros
+// to the longest one, i.e. first frame number, first frame number + stride,
+// and so on for count frames. Likewise the length field is the XOR of their
+// payload sizes. Parity frames are neither acked nor retransmitted.
+//
+// Parity frame:
+//       --------------------------------------------------------------------------------------------------------------------------------
+//      |  payload size(1-8)  |  00000011  |  first frame number (1-8)  |  stride (1-8)  |  count (1-8)  |  length (1-8)  |  payload  |
+//       --------------------------------------------------------------------------------------------------------------------------------
+//
+// 4 is used for the data frames of the streams other than the default one.
+// They are numbered, acked and retransmitted like any data frame, but are
+// reordered within their stream by the stream sequence number, which starts
+// from 10 as well, so the frames missing on one stream don't hold back the
+// others. They are not covered by the parity frames, and never carry
+// piggybacked acks.
+//
+// Stream data frame:
+//       -----------------------------------------------------------------------------------------------------------------------
+//      |  payload size(1-8)  |  00000100  |  frame number (1-8)  |  stream ID (1-8)  |  stream sequence number (1-8)  |  payload  |
+//       -----------------------------------------------------------------------------------------------------------------------
+//
+// 5 is used for timestamp frames when one-way delay estimation is enabled,
+// carrying when the frame is sent, along with when the last timestamp frame
+// from the peer was sent and received, in microseconds since the Unix epoch,
+// or zeros if none yet. They have no payload, and are neither acked nor
+// retransmitted.
+//
+// Timestamp frame:
+//       ------------------------------------------------------------------------------------------------------
+//      |  payload size(1-8)  |  00000101  |  sent at (1-8)  |  echo sent at (1-8)  |  echo received at (1-8)  |
+//       ------------------------------------------------------------------------------------------------------
+//
+// 6 is used to tell the peer that a data frame is given up on after too many
+// retransmissions, so it skips the frame rather than waiting for it forever.
+// Stream ID and sequence number are zero for the default stream. It's sent on
+// all subflows and never acked.
+//
+// Abandon frame:
+//       -------------------------------------------------------------------------------------------------------
+//      |  payload size(1-8)  |  00000110  |  frame number (1-8)  |  stream ID (1-8)  |  stream sequence number (1-8)  |
+//       -------------------------------------------------------------------------------------------------------
+//
+// 7 is used for the control messages sent by SendControl. They are numbered,
+// acked and retransmitted like any data frame, but handed to the control
+// callback of the peer as soon as they are received, rather than read, so
+// they are delivered once but not necessarily in order. Like stream data
+// frames, they are not covered by the parity frames, and never carry
+// piggybacked acks.
+//
+// Control frame:
+//       ---------------------------------------------------------------
+//      |  payload size(1-8)  |  00000111  |  frame number (1-8)  |  payload  |
+//       ---------------------------------------------------------------
+//
+// 8 is used for the path advertisements sent by WithPathAdvertisement, which
+// are control frames in the same form, handled by the peer itself rather than
+// the control callback. The payload is the number of subflows followed by,
+// for each of them, the length of its label, the label, its RTT in
+// microseconds, and its flags, 1 if lossy and 2 if paused, all but the label
+// being varints.
+//
 package multipath
 
 import (
@@ -61,16 +159,44 @@ const (
 	minFrameNumber uint64 = 10
 	frameTypePing  uint64 = 0
 	frameTypePong  uint64 = 1
+	frameTypeReset uint64 = 2
+	frameTypeClose uint64 = 3
+	// extended frame types
+	frameTypeDataWithAck uint64 = 2
+	frameTypeParity      uint64 = 3
+	frameTypeStreamData  uint64 = 4
+	frameTypeTimestamp   uint64 = 5
+	frameTypeAbandon     uint64 = 6
+	frameTypeControl     uint64 = 7
+	frameTypePathAdvert  uint64 = 8
 
 	maxFrameSizeToCalculateRTT uint64 = 1500
 	leadBytesLength                   = 1 + 16 // 1 byte version + 16 bytes CID
 	// Assuming an average 1KB frame size, it would be able to buffer 4MB of
-	// data without back pressure before the upper layer reads them.
+	// data without back pressure before the upper layer reads them. It's the
+	// initial length, the receive queue adapts to the observed reordering.
 	recieveQueueLength = 4096
 	maxVarIntLength    = 8
 	probeInterval      = time.Minute
 	longRTT            = time.Minute
 	rttAlpha           = 0.5 // this causes EMA to reflect changes more rapidly
+	// closeTimeout is how long Close waits for the close from the peer.
+	closeTimeout = time.Second
+	// retransmitEvalInterval is how often the frames pending ack are checked
+	// for timeouts.
+	retransmitEvalInterval = 100 * time.Millisecond
+	// collapseWindow is the number of data frames over which the share of
+	// each subflow is evaluated, and collapseShare the share above which the
+	// traffic is considered collapsed onto a single subflow.
+	collapseWindow = 1000
+	collapseShare  = 0.95
+	// asymmetryWindow is the number of acks over which a subflow is evaluated
+	// for ack asymmetry.
+	asymmetryWindow = 100
+
+	// maxFrameSize is the largest payload a receiver accepts, anything bigger
+	// is considered as corrupted.
+	maxFrameSize = 1 << 20
 )
 
 var (
@@ -78,6 +204,14 @@ var (
 	ErrUnexpectedCID     = errors.New("unexpected connnection ID")
 	ErrClosed            = errors.New("closed connection")
 	ErrFailOnAllDialers  = errors.New("fail on all dialers")
+	ErrFrameTooLarge     = errors.New("frame too large")
+	ErrUnknownSubflow    = errors.New("unknown subflow")
+	ErrNotClientSide     = errors.New("only the dialing side can do this")
+	ErrInvalidOptions    = errors.New("invalid options")
+	ErrInvalidStream     = errors.New("invalid stream ID")
+	ErrConnReset         = errors.New("connection reset by peer")
+	ErrDegraded          = errors.New("connection degraded to a single subflow")
+	ErrAbandoned         = errors.New("frames given up on")
 	log                  = golog.LoggerFor("multipath")
 	zeroCID              connectionID
 )
@@ -87,6 +221,32 @@ type connectionID uuid.UUID
 type rxFrame struct {
 	fn    uint64
 	bytes []byte
+	// via is the label of the subflow which delivered the frame, size the
+	// original payload size.
+	via  string
+	size int
+	// stream is the ID of the stream the frame belongs to, and seq its
+	// sequence number in the stream. Zero for the default stream.
+	stream uint64
+	seq    uint64
+	// skipped is true for the placeholder of a frame given up on, which is
+	// skipped rather than read.
+	skipped bool
+	// abandoned is true for the notice that the peer gave up on the frame.
+	// It's passed along with the data frames so that it's never handled
+	// before the frame sent ahead of it on the same subflow.
+	abandoned bool
+	// closed is true for the close from the peer, passed along with the
+	// data frames likewise, so that the subflow isn't closed before the
+	// frames received ahead of it are queued.
+	closed bool
+	// control is true for a control message, see SendControl, and
+	// pathAdvert for a path advertisement, which is a control message too.
+	control    bool
+	pathAdvert bool
+	// inOrder is true for a frame received on a subflow trusted to deliver
+	// in order, see WithInOrderSubflows.
+	inOrder bool
 }
 
 type transmissionDatapoint struct {
@@ -97,12 +257,38 @@ type transmissionDatapoint struct {
 type sendFrame struct {
 	fn                 uint64
 	sz                 uint64
+	stream             uint64 // zero for the default stream
+	seq                uint64 // the sequence number in the stream
+	tag                uint64 // set by WriteTagged, zero if none
 	buf                []byte
 	released           *int32 // 1 == true; 0 == false. Use pointer so copied object still references the same address, as buf does
 	retransmissions    int
 	sentVia            []transmissionDatapoint // Contains the subflows it's already been written to, and when
 	beingRetransmitted uint64
 	changeLock         sync.Mutex
+	// mem is the MemoryLimiter memSize bytes are taken from for the payload,
+	// given back when the frame is released. nil if not limited. memSize is
+	// accessed atomically.
+	mem     *MemoryLimiter
+	memSize int64
+	// untracked is set for the frames sent by the single path fast path,
+	// which aren't pending ack. Protected by changeLock once queued.
+	untracked bool
+	// writing is the number of subflows writing the frame right now.
+	// Accessed atomically.
+	writing int32
+	// control is true for a control message, see SendControl.
+	control bool
+	// missBefore is the UnixNano time before which a retransmission counts
+	// as a scheduling miss, zero if it wasn't sent on the best subflow or is
+	// already retransmitted. Accessed atomically.
+	missBefore int64
+	// retransmitQueued is set while the frame waits in the retransmit queue
+	// of the connection. Protected by changeLock.
+	retransmitQueued bool
+	// jitter extends the retransmission timeout since the frame was last
+	// written, see WithRetransmitJitter. Accessed atomically.
+	jitter int64
 }
 
 func composeFrame(fn uint64, b []byte) *sendFrame {
@@ -118,13 +304,89 @@ func composeFrame(fn uint64, b []byte) *sendFrame {
 	return &sendFrame{fn: fn, sz: uint64(sz), buf: wb.Bytes(), released: &released}
 }
 
+// composeStreamFrame composes the data frame fn carrying b as the frame seq
+// of the stream.
+func composeStreamFrame(fn, stream, seq uint64, b []byte) *sendFrame {
+	sz := len(b)
+	buf := pool.Get(5*maxVarIntLength + sz)
+	wb := bytes.NewBuffer(buf[:0])
+	WriteVarInt(wb, uint64(VarIntLen(fn)+VarIntLen(stream)+VarIntLen(seq)+sz))
+	WriteVarInt(wb, frameTypeStreamData)
+	WriteVarInt(wb, fn)
+	WriteVarInt(wb, stream)
+	WriteVarInt(wb, seq)
+	wb.Write(b)
+	var released int32
+	return &sendFrame{fn: fn, sz: uint64(sz), stream: stream, seq: seq, buf: wb.Bytes(), released: &released}
+}
+
+// composeControlFrame composes the data frame fn of frameType, either
+// frameTypeControl or frameTypePathAdvert, carrying the control message b.
+func composeControlFrame(frameType, fn uint64, b []byte) *sendFrame {
+	sz := len(b)
+	buf := pool.Get(3*maxVarIntLength + sz)
+	wb := bytes.NewBuffer(buf[:0])
+	WriteVarInt(wb, uint64(VarIntLen(fn)+sz))
+	WriteVarInt(wb, frameType)
+	WriteVarInt(wb, fn)
+	wb.Write(b)
+	var released int32
+	return &sendFrame{fn: fn, sz: uint64(sz), control: true, buf: wb.Bytes(), released: &released}
+}
+
+// composeAbandonFrame composes the frame telling the peer that data frame fn,
+// which is the frame seq of the stream, is given up on.
+func composeAbandonFrame(fn, stream, seq uint64) *sendFrame {
+	sz := VarIntLen(fn) + VarIntLen(stream) + VarIntLen(seq)
+	buf := pool.Get(2*maxVarIntLength + sz)
+	wb := bytes.NewBuffer(buf[:0])
+	WriteVarInt(wb, uint64(sz))
+	WriteVarInt(wb, frameTypeAbandon)
+	WriteVarInt(wb, fn)
+	WriteVarInt(wb, stream)
+	WriteVarInt(wb, seq)
+	var released int32
+	return &sendFrame{fn: frameTypeAbandon, sz: uint64(sz), buf: wb.Bytes(), released: &released}
+}
+
+// attemptsVia returns the number of times the frame has been sent on sf, and
+// when the last time was.
+func (f *sendFrame) attemptsVia(sf *subflow) (attempts int, last time.Time) {
+	for _, dp := range f.sentVia {
+		if dp.sf == sf {
+			attempts++
+			last = dp.txTime
+		}
+	}
+	return
+}
+
 func (f *sendFrame) isDataFrame() bool {
-	return f.sz > 0
+	return f.sz > 0 && f.fn >= minFrameNumber
 }
 
 func (f *sendFrame) release() {
 	if atomic.CompareAndSwapInt32(f.released, 0, 1) {
 		pool.Put(f.buf)
+		f.releaseMemory()
+	}
+}
+
+// retransmitJitter returns the jitter drawn when the frame was last written,
+// zero for nil.
+func (f *sendFrame) retransmitJitter() time.Duration {
+	if f == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&f.jitter))
+}
+
+// releaseMemory gives the memory taken for the payload back to the
+// MemoryLimiter, without releasing the buffer, e.g. as the connection is gone
+// but the frame may still be being written.
+func (f *sendFrame) releaseMemory() {
+	if n := atomic.SwapInt64(&f.memSize, 0); n > 0 {
+		f.mem.release(int(n))
 	}
 }
 
@@ -137,6 +399,14 @@ type StatsTracker interface {
 	UpdateRTT(time.Duration)
 }
 
+// WriteBlockedTracker can be optionally implemented by a StatsTracker to be
+// notified each time a Write has to wait because the send queues of all
+// subflows are full, i.e. the connection is write bound. It's called on the
+// trackers of all subflows of the connection.
+type WriteBlockedTracker interface {
+	OnWriteBlocked()
+}
+
 type NullTracker struct{}
 
 func (st NullTracker) OnRecv(uint64)           {}
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -275,7 +276,6 @@ func TestE2EEarlyClose(t *testing.T) {
 			break
 		}
 	}
-	t.Fatalf("aaa %v", readBytes)
 }
 
 func TestE2EEarlyCloseOtherWay(t *testing.T) {
@@ -342,8 +342,8 @@ func TestE2EEarlyCloseOtherWay(t *testing.T) {
 					b := make([]byte, 1024)
 					n, err := conn.Read(b)
 					if err != nil {
-						fmt.Printf("Connection closed early at %v (%v)\n", readBytes, err)
-						t.FailNow()
+						t.Errorf("Connection closed early at %v (%v)", readBytes, err)
+						return
 					}
 					readBytes += n
 					if readBytes == 10*100000000 {
@@ -386,12 +386,13 @@ type testDialer struct {
 	delayEnforcer
 	addr string
 	idx  int
+	wrap func(net.Conn) net.Conn
 }
 
 func newTestDialer(addr string, idx int) *testDialer {
 	var lock sync.Mutex
 	td := &testDialer{
-		delayEnforcer{cond: sync.NewCond(&lock)}, addr, idx,
+		delayEnforcer: delayEnforcer{cond: sync.NewCond(&lock)}, addr: addr, idx: idx,
 	}
 	td.delayEnforcer.name = td.Label()
 	return td
@@ -403,6 +404,9 @@ func (td *testDialer) DialContext(ctx context.Context) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if td.wrap != nil {
+		conn = td.wrap(conn)
+	}
 	return &laggedConn{conn, conn, td.delayEnforcer.sleep}, nil
 }
 
@@ -413,12 +417,13 @@ func (td *testDialer) Label() string {
 type testListener struct {
 	net.Listener
 	delayEnforcer
-	l net.Listener
+	l    net.Listener
+	wrap func(net.Conn) net.Conn
 }
 
 func newTestListener(l net.Listener, idx int) *testListener {
 	var lock sync.Mutex
-	tl := &testListener{l, delayEnforcer{cond: sync.NewCond(&lock)}, l}
+	tl := &testListener{Listener: l, delayEnforcer: delayEnforcer{cond: sync.NewCond(&lock)}, l: l}
 	tl.delayEnforcer.name = fmt.Sprintf("listener %d", idx)
 	return tl
 }
@@ -428,6 +433,9 @@ func (tl *testListener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if tl.wrap != nil {
+		conn = tl.wrap(conn)
+	}
 	return &laggedConn{conn, conn, tl.delayEnforcer.sleep}, nil
 }
 
@@ -442,6 +450,14 @@ func (c *laggedConn) Read(b []byte) (int, error) {
 	return c.conn.Read(b)
 }
 
+// SyscallConn exposes the socket underneath, e.g. for SetDSCP.
+func (c *laggedConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, ErrDSCPUnsupported
+}
+
 func TestDelayEnforcer(t *testing.T) {
 	var lock sync.Mutex
 	d := delayEnforcer{cond: sync.NewCond(&lock)}
@@ -488,3 +504,97 @@ func (e *delayEnforcer) sleep() {
 		}
 	}
 }
+
+// newTestConnPair connects a client and a server multipath connection over
+// the given number of loopback TCP paths.
+func newTestConnPair(t testing.TB, paths int, opts ...Option) (client net.Conn, server net.Conn, trackers []*countingTracker) {
+	return newWrappedTestConnPair(t, paths, nil, opts...)
+}
+
+// newWrappedTestConnPair is like newTestConnPair but wraps the underlying
+// conns of both sides with wrap if it's not nil.
+func newWrappedTestConnPair(t testing.TB, paths int, wrap func(net.Conn) net.Conn, opts ...Option) (client net.Conn, server net.Conn, trackers []*countingTracker) {
+	return newAsymmetricTestConnPair(t, paths, wrap, opts, opts)
+}
+
+// newAsymmetricTestConnPair is like newWrappedTestConnPair but configures the
+// client and the server with different options.
+func newAsymmetricTestConnPair(t testing.TB, paths int, wrap func(net.Conn) net.Conn, clientOpts, serverOpts []Option) (client net.Conn, server net.Conn, trackers []*countingTracker) {
+	listeners := []net.Listener{}
+	stats := []StatsTracker{}
+	dialers := []Dialer{}
+	for i := 0; i < paths; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		tracker := &countingTracker{}
+		trackers = append(trackers, tracker)
+		tl := newTestListener(l, i)
+		td := newTestDialer(l.Addr().String(), i)
+		tl.wrap, td.wrap = wrap, wrap
+		listeners = append(listeners, tl)
+		stats = append(stats, tracker)
+		dialers = append(dialers, td)
+	}
+	bl := NewListener(listeners, stats, serverOpts...)
+	bd := NewDialer("endpoint", dialers, clientOpts...)
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := bl.Accept()
+		if assert.NoError(t, err) {
+			chAccepted <- conn
+		}
+	}()
+	client, err := bd.DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	select {
+	case server = <-chAccepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout accepting connection")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		bl.Close()
+		for _, l := range listeners {
+			l.Close()
+		}
+	})
+	return client, server, trackers
+}
+
+type countingTracker struct {
+	NullTracker
+	recv       uint64
+	sent       uint64
+	sentBytes  uint64
+	retransmit uint64
+	blocked    uint64
+}
+
+func (ct *countingTracker) OnRecv(uint64) { atomic.AddUint64(&ct.recv, 1) }
+func (ct *countingTracker) OnSent(n uint64) {
+	atomic.AddUint64(&ct.sent, 1)
+	atomic.AddUint64(&ct.sentBytes, n)
+}
+func (ct *countingTracker) OnRetransmit(uint64) { atomic.AddUint64(&ct.retransmit, 1) }
+func (ct *countingTracker) OnWriteBlocked()     { atomic.AddUint64(&ct.blocked, 1) }
+
+type panickingTracker struct{}
+
+func (panickingTracker) OnRecv(uint64)           { panic("OnRecv") }
+func (panickingTracker) OnSent(uint64)           { panic("OnSent") }
+func (panickingTracker) OnRetransmit(uint64)     { panic("OnRetransmit") }
+func (panickingTracker) UpdateRTT(time.Duration) { panic("UpdateRTT") }
+
+func TestPanickingTracker(t *testing.T) {
+	st := safeTracker{panickingTracker{}}
+	st.OnRecv(1)
+	st.OnSent(1)
+	st.OnRetransmit(1)
+	st.UpdateRTT(time.Second)
+	st.OnWriteBlocked()
+}
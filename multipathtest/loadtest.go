@@ -0,0 +1,172 @@
+package multipathtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/multipath"
+)
+
+// LoadTest drives synthetic traffic through many multipath connections at
+// once over in-memory paths, to measure the effect of the scheduling and the
+// retransmissions on the aggregate throughput.
+type LoadTest struct {
+	// Conns is the number of connections opened concurrently. Defaults to 1.
+	Conns int
+	// Paths creates the paths of the ith connection. Each connection needs
+	// its own paths, which are closed along with it. Defaults to two paths
+	// without latency.
+	Paths func(i int) []*Path
+	// BytesPerConn is the payload written on each connection, from the
+	// dialing end to the accepting end.
+	BytesPerConn int
+	// WriteSize is the size of each write. Defaults to 1024.
+	WriteSize int
+	// Options are used on both ends of all the connections. A retransmit
+	// callback among them is replaced by the one counting the
+	// retransmissions.
+	Options []multipath.Option
+}
+
+// LoadTestResult is the outcome of a LoadTest.
+type LoadTestResult struct {
+	// Conns is the number of connections the traffic went through.
+	Conns int
+	// Bytes is the total payload delivered on all connections.
+	Bytes uint64
+	// Elapsed is the time from when the first byte was written, once all
+	// the connections were established, until the last one was read.
+	Elapsed time.Duration
+	// Retransmissions is the total number of data frames retransmitted, by
+	// reason.
+	Retransmissions map[multipath.RetransmitReason]uint64
+}
+
+// Throughput returns the aggregate throughput of all connections, in bytes
+// per second.
+func (r LoadTestResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+// TotalRetransmissions returns the number of retransmissions of all reasons.
+func (r LoadTestResult) TotalRetransmissions() uint64 {
+	var total uint64
+	for _, n := range r.Retransmissions {
+		total += n
+	}
+	return total
+}
+
+func (r LoadTestResult) String() string {
+	return fmt.Sprintf("%d conns, %d bytes in %v (%.0f B/s), %d retransmissions",
+		r.Conns, r.Bytes, r.Elapsed, r.Throughput(), r.TotalRetransmissions())
+}
+
+// Run opens the connections, writes BytesPerConn on each of them
+// concurrently, and waits until all of it is read on the other end or ctx is
+// done. The connections are closed before it returns.
+func (lt *LoadTest) Run(ctx context.Context) (LoadTestResult, error) {
+	conns := lt.Conns
+	if conns < 1 {
+		conns = 1
+	}
+	newPaths := lt.Paths
+	if newPaths == nil {
+		newPaths = func(i int) []*Path {
+			return []*Path{NewPath(fmt.Sprintf("conn%d-a", i)), NewPath(fmt.Sprintf("conn%d-b", i))}
+		}
+	}
+	writeSize := lt.WriteSize
+	if writeSize < 1 {
+		writeSize = 1024
+	}
+
+	result := LoadTestResult{Conns: conns, Retransmissions: make(map[multipath.RetransmitReason]uint64)}
+	var muRetransmits sync.Mutex
+	retransmits := make(map[multipath.RetransmitReason]uint64)
+	opts := append(append([]multipath.Option(nil), lt.Options...),
+		multipath.WithRetransmitCallback(func(_ multipath.Conn, event multipath.RetransmitEvent) {
+			muRetransmits.Lock()
+			retransmits[event.Reason]++
+			muRetransmits.Unlock()
+		}))
+
+	type pair struct{ client, server multipath.Conn }
+	pairs := make([]pair, 0, conns)
+	defer func() {
+		for _, p := range pairs {
+			p.client.Close()
+			p.server.Close()
+		}
+	}()
+	for i := 0; i < conns; i++ {
+		client, server, err := NewConnPair(ctx, newPaths(i), opts...)
+		if err != nil {
+			return result, fmt.Errorf("opening connection %d: %w", i, err)
+		}
+		pairs = append(pairs, pair{client, server})
+	}
+
+	// unblock the reads and writes if ctx is done halfway
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, p := range pairs {
+				p.client.Close()
+				p.server.Close()
+			}
+		case <-stop:
+		}
+	}()
+
+	var delivered uint64
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*conns)
+	start := time.Now()
+	for i, p := range pairs {
+		wg.Add(2)
+		go func(i int, conn multipath.Conn) {
+			defer wg.Done()
+			b := make([]byte, writeSize)
+			for remain := lt.BytesPerConn; remain > 0; remain -= len(b) {
+				if remain < len(b) {
+					b = b[:remain]
+				}
+				if _, err := conn.Write(b); err != nil {
+					errs <- fmt.Errorf("writing to connection %d: %w", i, err)
+					return
+				}
+			}
+		}(i, p.client)
+		go func(i int, conn multipath.Conn) {
+			defer wg.Done()
+			n, err := io.CopyN(io.Discard, conn, int64(lt.BytesPerConn))
+			atomic.AddUint64(&delivered, uint64(n))
+			if err != nil {
+				errs <- fmt.Errorf("reading from connection %d: %w", i, err)
+			}
+		}(i, p.server)
+	}
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+	result.Bytes = atomic.LoadUint64(&delivered)
+	muRetransmits.Lock()
+	for reason, n := range retransmits {
+		result.Retransmissions[reason] = n
+	}
+	muRetransmits.Unlock()
+	close(errs)
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	return result, <-errs
+}
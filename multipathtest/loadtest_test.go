@@ -0,0 +1,37 @@
+package multipathtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lt := &LoadTest{Conns: 4, BytesPerConn: 256 * 1024}
+	result, err := lt.Run(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 4, result.Conns)
+	assert.EqualValues(t, 4*256*1024, result.Bytes)
+	assert.Greater(t, result.Throughput(), float64(0))
+	t.Log(result)
+
+	lt = &LoadTest{
+		Conns: 2,
+		Paths: func(i int) []*Path {
+			slow := NewPath("slow")
+			slow.SetLatency(time.Millisecond)
+			return []*Path{NewPath("fast"), slow}
+		},
+		BytesPerConn: 64 * 1024,
+		WriteSize:    1000,
+	}
+	result, err = lt.Run(ctx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2*64*1024, result.Bytes)
+}
@@ -0,0 +1,215 @@
+// Package multipathtest provides in-memory transports for testing code built
+// on multipath connections without real sockets, and a LoadTest helper to
+// measure their throughput.
+package multipathtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/multipath"
+)
+
+// ErrBroken is returned when dialing a broken Path.
+var ErrBroken = errors.New("path broken")
+
+// Path is an in-memory transport carrying subflows, made of a subflow Dialer
+// and a net.Listener connected by net.Pipe. Its latency can be changed and it
+// can be broken at any time to exercise the scheduling and the
+// retransmissions.
+type Path struct {
+	label    string
+	chConns  chan net.Conn
+	chClose  chan struct{}
+	close    sync.Once
+	mu       sync.Mutex
+	latency  time.Duration
+	broken   bool
+	conns    []net.Conn
+	accepted int
+}
+
+// NewPath creates a Path. The label identifies it in the stats and the logs.
+func NewPath(label string) *Path {
+	return &Path{label: label, chConns: make(chan net.Conn), chClose: make(chan struct{})}
+}
+
+// Dialer returns the subflow Dialer of the path.
+func (p *Path) Dialer() multipath.Dialer {
+	return pathDialer{p}
+}
+
+// Listener returns the end of the path accepting the subflows.
+func (p *Path) Listener() net.Listener {
+	return pathListener{p}
+}
+
+// SetLatency delays each write on the path by d in both directions, which
+// also caps the throughput as the writes are sequential.
+func (p *Path) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	p.latency = d
+	p.mu.Unlock()
+}
+
+// Break closes all the subflows on the path and makes the subsequent dials
+// fail, as if the network went away.
+func (p *Path) Break() {
+	p.mu.Lock()
+	p.broken = true
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Restore makes the path dialable again after Break.
+func (p *Path) Restore() {
+	p.mu.Lock()
+	p.broken = false
+	p.mu.Unlock()
+}
+
+// Accepted returns the number of subflows accepted on the path so far.
+func (p *Path) Accepted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+func (p *Path) getLatency() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latency
+}
+
+type pathDialer struct {
+	p *Path
+}
+
+func (d pathDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	p := d.p
+	p.mu.Lock()
+	broken := p.broken
+	p.mu.Unlock()
+	if broken {
+		return nil, ErrBroken
+	}
+	client, server := net.Pipe()
+	select {
+	case p.chConns <- &pathConn{Conn: server, p: p}:
+	case <-p.chClose:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	conn := &pathConn{Conn: client, p: p}
+	p.mu.Lock()
+	p.conns = append(p.conns, client, server)
+	p.mu.Unlock()
+	return conn, nil
+}
+
+func (d pathDialer) Label() string {
+	return d.p.label
+}
+
+type pathListener struct {
+	p *Path
+}
+
+func (l pathListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.p.chConns:
+		l.p.mu.Lock()
+		l.p.accepted++
+		l.p.mu.Unlock()
+		return conn, nil
+	case <-l.p.chClose:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l pathListener) Close() error {
+	l.p.close.Do(func() { close(l.p.chClose) })
+	return nil
+}
+
+func (l pathListener) Addr() net.Addr {
+	return pathAddr(l.p.label)
+}
+
+type pathAddr string
+
+func (pathAddr) Network() string  { return "pipe" }
+func (a pathAddr) String() string { return string(a) }
+
+type pathConn struct {
+	net.Conn
+	p *Path
+}
+
+func (c *pathConn) Write(b []byte) (int, error) {
+	if d := c.p.getLatency(); d > 0 {
+		time.Sleep(d)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *pathConn) LocalAddr() net.Addr  { return pathAddr(c.p.label) }
+func (c *pathConn) RemoteAddr() net.Addr { return pathAddr(c.p.label) }
+
+// NewConnPair creates a multipath connection over the paths, returning both
+// ends of it. The paths are closed along with the dialing end, so they can't
+// carry another connection afterwards.
+func NewConnPair(ctx context.Context, paths []*Path, opts ...multipath.Option) (client, server multipath.Conn, err error) {
+	var listeners []net.Listener
+	var stats []multipath.StatsTracker
+	var dialers []multipath.Dialer
+	for _, p := range paths {
+		listeners = append(listeners, p.Listener())
+		stats = append(stats, multipath.NullTracker{})
+		dialers = append(dialers, p.Dialer())
+	}
+	l := multipath.NewListener(listeners, stats, opts...)
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			chAccepted <- conn
+		}
+	}()
+	conn, err := multipath.NewDialer("pipe", dialers, opts...).DialContext(ctx)
+	if err != nil {
+		l.Close()
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, nil, err
+	}
+	select {
+	case accepted := <-chAccepted:
+		client := conn.(multipath.Conn)
+		go func() {
+			<-client.Done()
+			l.Close()
+			for _, l := range listeners {
+				l.Close()
+			}
+		}()
+		return client, accepted.(multipath.Conn), nil
+	case <-ctx.Done():
+		conn.Close()
+		l.Close()
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, nil, fmt.Errorf("accepting the connection: %w", ctx.Err())
+	}
+}
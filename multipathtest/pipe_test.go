@@ -0,0 +1,45 @@
+package multipathtest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnPair(t *testing.T) {
+	paths := []*Path{NewPath("wifi"), NewPath("cellular")}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, server, err := NewConnPair(ctx, paths)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool {
+		return len(client.Subflows()) == 2 && len(server.Subflows()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	echo := func(s string) {
+		_, err := client.Write([]byte(s))
+		assert.NoError(t, err)
+		b := make([]byte, len(s))
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(server, b)
+		assert.NoError(t, err)
+		assert.Equal(t, s, string(b))
+	}
+	echo("hello")
+	paths[1].SetLatency(10 * time.Millisecond)
+	echo("slow")
+
+	paths[0].Break()
+	assert.Eventually(t, func() bool {
+		return len(client.Subflows()) == 1
+	}, time.Second, 10*time.Millisecond)
+	echo("still there")
+	assert.Equal(t, 1, paths[0].Accepted())
+}
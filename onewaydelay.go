@@ -0,0 +1,127 @@
+package multipath
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/ema"
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// oneWayDelay estimates the delay of each direction of a subflow from the
+// timestamp frames exchanged with the peer. The delays are offset by the
+// difference between the clocks of both ends, so they are only meaningful if
+// the clocks are synchronized, though the offset is the same on all subflows
+// of a connection, so the differences between them are still meaningful.
+type oneWayDelay struct {
+	mu sync.Mutex
+	// peerSentAt and peerRecvAt are when the last timestamp frame from the
+	// peer was sent by its clock and received by ours, in microseconds since
+	// the Unix epoch. Zero if none yet.
+	peerSentAt uint64
+	peerRecvAt uint64
+
+	forward         *ema.EMA
+	reverse         *ema.EMA
+	forwardMeasured uint32 // accessed atomically
+	reverseMeasured uint32 // accessed atomically
+}
+
+func newOneWayDelay() *oneWayDelay {
+	return &oneWayDelay{forward: ema.NewDuration(0, rttAlpha), reverse: ema.NewDuration(0, rttAlpha)}
+}
+
+// forwardDelay returns the estimated delay from this end to the peer, and
+// whether it has been measured. It's nil-safe.
+func (owd *oneWayDelay) forwardDelay() (time.Duration, bool) {
+	if owd == nil || atomic.LoadUint32(&owd.forwardMeasured) == 0 {
+		return 0, false
+	}
+	return owd.forward.GetDuration(), true
+}
+
+// reverseDelay is like forwardDelay but from the peer to this end.
+func (owd *oneWayDelay) reverseDelay() (time.Duration, bool) {
+	if owd == nil || atomic.LoadUint32(&owd.reverseMeasured) == 0 {
+		return 0, false
+	}
+	return owd.reverse.GetDuration(), true
+}
+
+// compose composes the timestamp frame to be written right away, echoing the
+// last timestamp received from the peer.
+func (owd *oneWayDelay) compose() []byte {
+	owd.mu.Lock()
+	echoSentAt, echoRecvAt := owd.peerSentAt, owd.peerRecvAt
+	owd.mu.Unlock()
+	sentAt := uint64(time.Now().UnixMicro())
+	fieldsLen := VarIntLen(sentAt) + VarIntLen(echoSentAt) + VarIntLen(echoRecvAt)
+	buf := pool.Get(2*maxVarIntLength + fieldsLen)
+	wb := bytes.NewBuffer(buf[:0])
+	WriteVarInt(wb, uint64(fieldsLen))
+	WriteVarInt(wb, frameTypeTimestamp)
+	WriteVarInt(wb, sentAt)
+	WriteVarInt(wb, echoSentAt)
+	WriteVarInt(wb, echoRecvAt)
+	return wb.Bytes()
+}
+
+// received accounts the timestamp frame just received.
+func (owd *oneWayDelay) received(sentAt, echoSentAt, echoRecvAt uint64) {
+	now := uint64(time.Now().UnixMicro())
+	owd.mu.Lock()
+	owd.peerSentAt, owd.peerRecvAt = sentAt, now
+	owd.mu.Unlock()
+	owd.reverse.UpdateDuration(time.Duration(int64(now)-int64(sentAt)) * time.Microsecond)
+	atomic.StoreUint32(&owd.reverseMeasured, 1)
+	if echoSentAt != 0 {
+		owd.forward.UpdateDuration(time.Duration(int64(echoRecvAt)-int64(echoSentAt)) * time.Microsecond)
+		atomic.StoreUint32(&owd.forwardMeasured, 1)
+	}
+}
+
+// sendTimestamp queues a timestamp frame, which is composed when it's written
+// so the time it waits in the send queue doesn't count. It's skipped if the
+// send queue is full, as the next one will do, or the subflow is closing.
+func (sf *subflow) sendTimestamp() {
+	select {
+	case <-sf.chClose:
+		return
+	default:
+	}
+	var released int32
+	select {
+	case sf.sendQueue <- &sendFrame{fn: frameTypeTimestamp, released: &released}:
+		sf.queued()
+	default:
+	}
+}
+
+// readTimestampFrame reads the fields of a timestamp frame of size sz. Fields
+// added later by newer peers are skipped.
+func (sf *subflow) readTimestampFrame(r *byteReader, sz uint64) bool {
+	var fields [3]uint64
+	fieldsLen := uint64(0)
+	for i := range fields {
+		v, err := ReadVarInt(r)
+		if err != nil {
+			return false
+		}
+		fields[i] = v
+		fieldsLen += uint64(VarIntLen(v))
+	}
+	if fieldsLen > sz {
+		log.Errorf("Malformed timestamp frame from %s", sf.to)
+		return false
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(sz-fieldsLen)); err != nil {
+		return false
+	}
+	if sf.owd != nil {
+		sf.owd.received(fields[0], fields[1], fields[2])
+	}
+	return true
+}
@@ -0,0 +1,1071 @@
+package multipath
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultMinRTO                = 50 * time.Millisecond
+	defaultMaxRTO                = 512 * time.Millisecond
+	defaultMinReceiveQueueLength = 1024
+	defaultMaxReceiveQueueLength = 65536
+	defaultRetransmitStall       = time.Minute
+	defaultInitialRTO            = time.Second
+	defaultSaturationThreshold   = 10 * time.Millisecond
+)
+
+// config holds the tunables of a multipath connection. It is built from the
+// Options passed to NewDialer or NewListener and shared by every connection
+// they create.
+type config struct {
+	minRTO                time.Duration
+	maxRTO                time.Duration
+	peerAckDelay          time.Duration
+	peerAckDelaySet       bool
+	minReceiveQueueLength int
+	maxReceiveQueueLength int
+	dialTimeout           time.Duration
+	establishTimeout      time.Duration
+	maxFrameSize          int
+	onStateChange         func(conn Conn, from, to ConnState)
+	ackDelay              time.Duration
+	onAsymmetry           func(conn Conn, subflow string, asymmetric bool)
+	unknownCIDPolicy      UnknownCIDPolicy
+	retransmitOrder       RetransmitOrder
+	fecGroupSize          int
+	fecParityFrames       int
+	onDelivered           func(conn Conn, fn uint64, subflow string, size int)
+	coalesceDelay         time.Duration
+	coalesceSize          int
+	lossCooldown          time.Duration
+	lossThreshold         int
+	redundancy            int
+	onRetransmit          func(conn Conn, event RetransmitEvent)
+	onSubflowAdded        func(conn Conn, subflow string, raw net.Conn)
+	aggregationMode       AggregationMode
+	saturationThreshold   time.Duration
+	unmeasuredRTT         time.Duration
+	onCollapse            func(conn Conn, subflow string, collapsed bool)
+	allowRetransmit       func(subflow string) bool
+	dscp                  func(subflow string) int
+	costClass             func(subflow string) int
+	lateFramePolicy       LateFramePolicy
+	rttHistorySize        int
+	scheduleLogDepth      int
+	joinSecret            []byte
+	writeTimeout          time.Duration
+	orderedWrites         bool
+	onAck                 func(conn Conn, tag uint64)
+	retransmitStall       time.Duration
+	initialRTO            time.Duration
+	minSubflows           int
+	redialBelowMin        bool
+	onBelowMinSubflows    func(conn Conn, healthy int)
+	timestampInterval     time.Duration
+	maxRetransmissions    int
+	gapTimeout            time.Duration
+	onAbandon             func(conn Conn, frame AbandonedFrame)
+	maxQueueWait          time.Duration
+	subflowWarmup         time.Duration
+	singlePathFastPath    bool
+	memoryLimiter         *MemoryLimiter
+	retransmitJitter      time.Duration
+	staleAfter            time.Duration
+	newRTTEstimator       func() RTTEstimator
+	frameWindow           int
+	degradedWritePolicy   DegradedWritePolicy
+	degradedBufferSize    int
+	onControl             func(conn Conn, msg []byte)
+	inOrderSubflows       func(subflow string) bool
+	pathAdvertInterval    time.Duration
+	sendPool              *SendPool
+	subflowMTU            func(subflow string) int
+	onWrite               func(conn Conn, event WriteEvent)
+	// now is the clock timing the frames sent, time.Now unless a test
+	// replaces it.
+	now func() time.Time
+}
+
+func defaultConfig() *config {
+	return &config{
+		minRTO:                defaultMinRTO,
+		maxRTO:                defaultMaxRTO,
+		minReceiveQueueLength: defaultMinReceiveQueueLength,
+		maxReceiveQueueLength: defaultMaxReceiveQueueLength,
+		maxFrameSize:          maxFrameSize,
+		retransmitOrder:       OldestFrameFirst,
+		redundancy:            1,
+		retransmitStall:       defaultRetransmitStall,
+		initialRTO:            defaultInitialRTO,
+		saturationThreshold:   defaultSaturationThreshold,
+		newRTTEstimator:       func() RTTEstimator { return newEWMAEstimator() },
+		now:                   time.Now,
+	}
+}
+
+// newReceiveQueue creates the receive queue of a connection, starting with
+// the default length clamped into the configured bounds.
+func (cfg *config) newReceiveQueue() *receiveQueue {
+	size := recieveQueueLength
+	if size < cfg.minReceiveQueueLength {
+		size = cfg.minReceiveQueueLength
+	}
+	if size > cfg.maxReceiveQueueLength {
+		size = cfg.maxReceiveQueueLength
+	}
+	rq := newAdaptiveReceiveQueue(size, cfg.minReceiveQueueLength, cfg.maxReceiveQueueLength)
+	rq.discardLate = cfg.lateFramePolicy == DiscardLateFrames
+	rq.gapTimeout = cfg.gapTimeout
+	rq.mem = cfg.memoryLimiter
+	return rq
+}
+
+// ValidateOptions checks the options for invalid values and the combinations
+// which conflict with each other. The errors returned wrap ErrInvalidOptions.
+// Dial and Listen return them, while NewDialer and NewListener panic with
+// them, as they are programming errors.
+func ValidateOptions(opts ...Option) error {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg.validate()
+}
+
+func (cfg *config) validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+	for name, d := range map[string]time.Duration{
+		"min RTO":           cfg.minRTO,
+		"max RTO":           cfg.maxRTO,
+		"peer ack delay":    cfg.peerAckDelay,
+		"dial timeout":      cfg.dialTimeout,
+		"establish timeout": cfg.establishTimeout,
+		"ack delay":         cfg.ackDelay,
+		"coalescing delay":  cfg.coalesceDelay,
+		"loss cooldown":     cfg.lossCooldown,
+		"unmeasured RTT":    cfg.unmeasuredRTT,
+		"write timeout":     cfg.writeTimeout,
+		"retransmit stall":  cfg.retransmitStall,
+		"initial RTO":       cfg.initialRTO,
+		"one-way delay":     cfg.timestampInterval,
+		"gap timeout":       cfg.gapTimeout,
+		"max queue wait":    cfg.maxQueueWait,
+		"saturation":        cfg.saturationThreshold,
+		"subflow warmup":    cfg.subflowWarmup,
+		"retransmit jitter": cfg.retransmitJitter,
+		"stale after":       cfg.staleAfter,
+		"path advert":       cfg.pathAdvertInterval,
+	} {
+		if d < 0 {
+			return invalid("negative %s %v", name, d)
+		}
+	}
+	if cfg.minReceiveQueueLength < 1 || cfg.minReceiveQueueLength > cfg.maxReceiveQueueLength {
+		return invalid("receive queue bounds [%d, %d]", cfg.minReceiveQueueLength, cfg.maxReceiveQueueLength)
+	}
+	if cfg.maxRTO < cfg.minRTO {
+		return invalid("max RTO %v below min RTO %v", cfg.maxRTO, cfg.minRTO)
+	}
+	if cfg.maxFrameSize < 1 || cfg.maxFrameSize > maxFrameSize {
+		return invalid("max frame size %d", cfg.maxFrameSize)
+	}
+	if cfg.coalesceDelay > 0 && (cfg.coalesceSize < 1 || cfg.coalesceSize > cfg.maxFrameSize) {
+		return invalid("write coalescing size %d with max frame size %d", cfg.coalesceSize, cfg.maxFrameSize)
+	}
+	if cfg.lossCooldown > 0 && cfg.lossThreshold < 1 {
+		return invalid("loss threshold %d", cfg.lossThreshold)
+	}
+	switch cfg.aggregationMode {
+	case Aggregate, Failover, AggregateWhenSaturated:
+	default:
+		return invalid("aggregation mode %d", cfg.aggregationMode)
+	}
+	switch cfg.unknownCIDPolicy {
+	case DropUnknownCID, ResetUnknownCID:
+	default:
+		return invalid("unknown CID policy %d", cfg.unknownCIDPolicy)
+	}
+	switch cfg.lateFramePolicy {
+	case DrainLateFrames, DiscardLateFrames:
+	default:
+		return invalid("late frame policy %d", cfg.lateFramePolicy)
+	}
+	if cfg.redundancy < 1 {
+		return invalid("redundancy %d", cfg.redundancy)
+	}
+	if cfg.aggregationMode == Failover && cfg.redundancy > 1 {
+		return invalid("redundancy %d sends on more than the single subflow of the failover mode", cfg.redundancy)
+	}
+	if cfg.retransmitOrder == nil {
+		return invalid("nil retransmit order")
+	}
+	if cfg.newRTTEstimator == nil {
+		return invalid("nil RTT estimator")
+	}
+	if cfg.rttHistorySize < 0 {
+		return invalid("RTT history size %d", cfg.rttHistorySize)
+	}
+	if cfg.scheduleLogDepth < 0 {
+		return invalid("schedule log depth %d", cfg.scheduleLogDepth)
+	}
+	if cfg.minSubflows < 0 {
+		return invalid("min subflows %d", cfg.minSubflows)
+	}
+	if cfg.maxRetransmissions < 0 {
+		return invalid("max retransmissions %d", cfg.maxRetransmissions)
+	}
+	if cfg.frameWindow < 0 {
+		return invalid("frame window %d", cfg.frameWindow)
+	}
+	switch cfg.degradedWritePolicy {
+	case BlockWhenDegraded, FailWhenDegraded:
+	case BufferWhenDegraded:
+		if cfg.degradedBufferSize <= 0 {
+			return invalid("degraded buffer size %d", cfg.degradedBufferSize)
+		}
+	default:
+		return invalid("degraded write policy %d", cfg.degradedWritePolicy)
+	}
+	return nil
+}
+
+// newConfig builds the config from opts, panicking if they are invalid.
+func newConfig(opts []Option) *config {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		panic(err)
+	}
+	cfg.guardCallbacks()
+	return cfg
+}
+
+// Option configures the multipath connections created by a dialer or
+// listener.
+type Option func(*config)
+
+// WithMinRTO sets the floor of the retransmission timeout of each subflow.
+// On very low latency paths the RTT based timer can be shorter than the time
+// it realistically takes for an ack to come back, causing spurious
+// retransmissions. It can't be higher than the max RTO. Defaults to 50ms.
+func WithMinRTO(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.minRTO = d
+	}
+}
+
+// WithMaxRTO sets the ceiling of the retransmission timeout of each subflow,
+// so that a path whose RTT spikes doesn't hold the frames sent on it for too
+// long before retrying them elsewhere. It can't be lower than the min RTO.
+// Defaults to 512ms.
+func WithMaxRTO(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxRTO = d
+	}
+}
+
+// WithPeerAckDelay tells the sender how long the peer may hold the acks to the
+// frames it receives, i.e. the maxDelay of WithAckPiggybacking on the other
+// end. The retransmission timeout is never shorter than that plus the min RTO,
+// even if it exceeds the max RTO, so that delayed acks never trigger spurious
+// retransmissions. Defaults to the ack piggybacking delay of this end, which
+// matches the peer if both ends are configured the same way.
+func WithPeerAckDelay(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.peerAckDelay = d
+		cfg.peerAckDelaySet = true
+	}
+}
+
+// maxPeerAckDelay returns how long the peer may hold the acks.
+func (cfg *config) maxPeerAckDelay() time.Duration {
+	if cfg.peerAckDelaySet {
+		return cfg.peerAckDelay
+	}
+	return cfg.ackDelay
+}
+
+// WithReceiveQueueBounds sets the minimum and maximum number of frames the
+// receive queue can hold. The queue grows when it observes deep reordering
+// among the subflows and shrinks back when the frames arrive mostly in order.
+// Setting both to the same value disables resizing. Defaults to 1024 and
+// 65536.
+func WithReceiveQueueBounds(min, max int) Option {
+	return func(cfg *config) {
+		cfg.minReceiveQueueLength = min
+		cfg.maxReceiveQueueLength = max
+	}
+}
+
+// WithDialTimeout bounds the time dialing and handshaking each subflow may
+// take, after which the path is abandoned. On the listener, it bounds the
+// handshake of each incoming subflow. Zero means no limit, which is the
+// default.
+func WithDialTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.dialTimeout = d
+	}
+}
+
+// WithEstablishTimeout bounds the time the dialer waits for the first subflow
+// to be established. The connection is returned as soon as one subflow is up,
+// with the others joining when they are. Zero means no limit, which is the
+// default.
+func WithEstablishTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.establishTimeout = d
+	}
+}
+
+// WithMaxFrameSize caps the payload size a single Write accepts. Smaller
+// frames play nicer with the MTU of the paths and keep a single write from
+// monopolizing a subflow. It can't be larger than the 1MB a receiver accepts,
+// which is the default.
+func WithMaxFrameSize(n int) Option {
+	return func(cfg *config) {
+		cfg.maxFrameSize = n
+	}
+}
+
+// WithStateCallback sets a callback which is called each time a connection
+// transitions from one state to another, e.g. to Degraded when it's down to
+// one subflow. It's called synchronously so it should return quickly.
+func WithStateCallback(cb func(conn Conn, from, to ConnState)) Option {
+	return func(cfg *config) {
+		cfg.onStateChange = cb
+	}
+}
+
+// WithAckPiggybacking makes the acks to the received frames piggyback on the
+// outgoing data frames, which reduces the number of packets on bidirectional
+// flows. An ack is sent standalone only if there's no data to send within
+// maxDelay. Zero disables piggybacking, which is the default. The peer must
+// support piggybacked acks even if it doesn't send them itself. It only
+// affects the receiving side: the retransmission timeout of the peer should
+// account for the delay, see WithPeerAckDelay.
+func WithAckPiggybacking(maxDelay time.Duration) Option {
+	return func(cfg *config) {
+		cfg.ackDelay = maxDelay
+	}
+}
+
+// WithAsymmetryCallback sets a callback which is called when the acks to the
+// frames sent on a subflow start to consistently come back on other subflows,
+// and again when they no longer do. Only standalone acks are taken into
+// account.
+func WithAsymmetryCallback(cb func(conn Conn, subflow string, asymmetric bool)) Option {
+	return func(cfg *config) {
+		cfg.onAsymmetry = cb
+	}
+}
+
+// UnknownCIDPolicy defines how the listener handles a subflow claiming to
+// belong to a connection it doesn't know, e.g. one already closed, or a
+// spoofed connection ID. Such subflows are never accepted, as that would let
+// anyone spin up phantom connections. Only subflows with the all-zero CID
+// start new connections.
+type UnknownCIDPolicy int
+
+const (
+	// DropUnknownCID closes the subflow silently. This is the default.
+	DropUnknownCID UnknownCIDPolicy = iota
+	// ResetUnknownCID replies with the all-zero CID before closing the
+	// subflow, so the peer fails immediately with ErrUnexpectedCID rather
+	// than waiting for a timeout.
+	ResetUnknownCID
+)
+
+// WithUnknownCIDPolicy sets how the listener handles subflows with unknown
+// connection IDs.
+func WithUnknownCIDPolicy(policy UnknownCIDPolicy) Option {
+	return func(cfg *config) {
+		cfg.unknownCIDPolicy = policy
+	}
+}
+
+// LateFramePolicy defines how a connection handles the frames which still
+// arrive on its subflows after it's closed, before they are torn down. After
+// Close, or once the data received is fully read, they are always discarded.
+type LateFramePolicy int
+
+const (
+	// DrainLateFrames keeps accepting the frames arriving in order while the
+	// data received before the close is drained, so they can still be read.
+	// The frames out of order are discarded as they may never become
+	// readable. This is the default.
+	DrainLateFrames LateFramePolicy = iota
+	// DiscardLateFrames discards all frames arriving after the close, so
+	// Read only returns the data received before.
+	DiscardLateFrames
+)
+
+// WithLateFramePolicy sets how the frames arriving after the connection is
+// closed are handled.
+func WithLateFramePolicy(policy LateFramePolicy) Option {
+	return func(cfg *config) {
+		cfg.lateFramePolicy = policy
+	}
+}
+
+// PendingFrame describes a data frame not acked in time.
+type PendingFrame struct {
+	// FN is the frame number.
+	FN uint64
+	// Size is the payload size.
+	Size uint64
+	// SentAt is when the frame was last sent.
+	SentAt time.Time
+}
+
+// RetransmitOrder reports whether frame a should be retransmitted before b
+// when both of them time out at the same time.
+type RetransmitOrder func(a, b PendingFrame) bool
+
+var (
+	// OldestFrameFirst retransmits frames in the order they were written,
+	// so the receiver can deliver data as soon as possible. It usually suits
+	// bulk transfers best, and is the default.
+	OldestFrameFirst RetransmitOrder = func(a, b PendingFrame) bool { return a.FN < b.FN }
+	// NewestFrameFirst retransmits the most recently written frames first,
+	// for interactive traffic where fresh data matters more.
+	NewestFrameFirst RetransmitOrder = func(a, b PendingFrame) bool { return a.FN > b.FN }
+	// LongestWaitingFirst retransmits the frames which were sent the
+	// longest time ago first, regardless of the frame number.
+	LongestWaitingFirst RetransmitOrder = func(a, b PendingFrame) bool { return a.SentAt.Before(b.SentAt) }
+)
+
+// WithRetransmitOrder sets the order in which the frames timing out at the
+// same time are retransmitted.
+func WithRetransmitOrder(order RetransmitOrder) Option {
+	return func(cfg *config) {
+		cfg.retransmitOrder = order
+	}
+}
+
+// WithFEC enables forward error correction. For every groupSize data frames
+// written, parityFrames parity frames are sent, allowing the receiver to
+// reconstruct up to parityFrames lost frames of the group locally without
+// waiting for the retransmission, as long as they are not covered by the same
+// parity frame. It trades bandwidth for latency. Both ends need to enable it
+// to take effect, but the settings don't have to match. Disabled by default.
+func WithFEC(groupSize, parityFrames int) Option {
+	return func(cfg *config) {
+		if parityFrames > groupSize {
+			parityFrames = groupSize
+		}
+		if parityFrames < 1 {
+			groupSize = 0
+		}
+		cfg.fecGroupSize = groupSize
+		cfg.fecParityFrames = parityFrames
+	}
+}
+
+// WithDeliveryCallback sets a callback which is called each time a received
+// frame is fully read by the application, with the label of the subflow which
+// actually delivered it. As frames may be retransmitted on other subflows,
+// it can differ from where the peer first sent them. Frames reconstructed
+// with forward error correction are attributed to the subflow which carried
+// the parity frame. It's called synchronously from Read so it should return
+// quickly.
+func WithDeliveryCallback(cb func(conn Conn, fn uint64, subflow string, size int)) Option {
+	return func(cfg *config) {
+		cfg.onDelivered = cb
+	}
+}
+
+// WithWriteCoalescing makes small writes be held for up to maxDelay and sent
+// along with the subsequent ones in a single frame, similar to Nagle's
+// algorithm. The frame is sent as soon as the data held reaches size, which
+// can't be larger than the max frame size. It cuts the framing and acking overhead of
+// chatty protocols at the cost of latency. Flush sends the data held right
+// away, and Conn.SetNoDelay disables coalescing for a connection. As Write
+// returns once the data is held, an error sending it later is only logged,
+// and the data held is lost if the connection fails meanwhile, or Close
+// can't send it. Zero maxDelay disables coalescing, which is the default.
+func WithWriteCoalescing(maxDelay time.Duration, size int) Option {
+	return func(cfg *config) {
+		cfg.coalesceDelay = maxDelay
+		cfg.coalesceSize = size
+	}
+}
+
+// WithLossCooldown makes the subflows on which threshold or more frames time
+// out within cooldown be considered lossy for the next cooldown, during which
+// they are used only after all other subflows regardless of their RTT. It
+// keeps a briefly congested path from losing more frames. The threshold must
+// be at least 1. Zero cooldown disables it, which is the default.
+func WithLossCooldown(cooldown time.Duration, threshold int) Option {
+	return func(cfg *config) {
+		cfg.lossCooldown = cooldown
+		cfg.lossThreshold = threshold
+	}
+}
+
+// WithRedundancy makes each Write send the frame on the best k subflows at
+// once, trading bandwidth for latency and resilience. The writes don't wait
+// for room on the subflows to send the copies, which are dropped if too many
+// are already waiting. Conn.WriteRedundant overrides it for individual writes.
+// Defaults to 1, i.e. no redundancy.
+func WithRedundancy(k int) Option {
+	return func(cfg *config) {
+		cfg.redundancy = k
+	}
+}
+
+// RetransmitReason tells why a frame is retransmitted.
+type RetransmitReason int
+
+const (
+	// RetransmitTimeout means the frame was not acked in time.
+	RetransmitTimeout RetransmitReason = iota
+	// RetransmitSubflowFailed means the subflow the frame was sent or
+	// queued on failed or closed.
+	RetransmitSubflowFailed
+	// RetransmitQueueWait means the frame was not sent yet but taken out
+	// of the send queue of a subflow stuck writing, see WithMaxQueueWait.
+	RetransmitQueueWait
+	// RetransmitSubflowPaused means the subflow the frame was sent or
+	// queued on is paused with drain, see PauseSubflow.
+	RetransmitSubflowPaused
+)
+
+func (r RetransmitReason) String() string {
+	switch r {
+	case RetransmitTimeout:
+		return "timeout"
+	case RetransmitSubflowFailed:
+		return "subflow failed"
+	case RetransmitQueueWait:
+		return "queue wait"
+	case RetransmitSubflowPaused:
+		return "subflow paused"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// RetransmitEvent describes a retransmission of a data frame.
+type RetransmitEvent struct {
+	// FN is the frame number.
+	FN uint64
+	// From is the label of the subflow the frame was last sent on, and To
+	// the one it's retransmitted on. From is empty if the frame was queued
+	// on a subflow which failed before sending it.
+	From string
+	To   string
+	// Retransmissions is the number of times the frame has been
+	// retransmitted, including this one.
+	Retransmissions int
+	// SinceSent is the time since the frame was last sent.
+	SinceSent time.Duration
+	Reason    RetransmitReason
+}
+
+// WithRetransmitCallback sets a callback which is called each time a data frame
+// is retransmitted. It's called synchronously so it should return quickly.
+func WithRetransmitCallback(cb func(conn Conn, event RetransmitEvent)) Option {
+	return func(cfg *config) {
+		cfg.onRetransmit = cb
+	}
+}
+
+// WriteEvent describes a frame about to be written to a subflow.
+type WriteEvent struct {
+	// FN is the frame number of a data frame, or the frame type of any
+	// other frame.
+	FN uint64
+	// Data is true for the data frames.
+	Data bool
+	// Subflow is the label of the subflow the frame is written to.
+	Subflow string
+	// Size is the size of the frame, zero for the timestamp frames which
+	// are only composed when written.
+	Size int
+	// Retransmissions is the number of times the frame has been
+	// retransmitted before this write.
+	Retransmissions int
+}
+
+// WithWriteCallback sets a callback which is called right before each frame is
+// written to a subflow, which is closer to when the frame actually leaves than
+// when it's queued, e.g. to account the time frames spend in the send queues.
+// It's called synchronously from the send loop of the subflow, holding the
+// frames queued after it back, so it should return quickly. Nil calls nothing,
+// which is the default.
+func WithWriteCallback(cb func(conn Conn, event WriteEvent)) Option {
+	return func(cfg *config) {
+		cfg.onWrite = cb
+	}
+}
+
+// WithSubflowCallback sets a callback which is called with the underlying
+// net.Conn of each subflow before it starts to carry data, e.g. to set socket
+// options such as TCP_NODELAY, the congestion control algorithm or DSCP via
+// SyscallConn. The conn must never be read from, written to or closed by the
+// callback or afterwards, as that breaks the framing of the subflow. It's
+// called synchronously so it should return quickly.
+func WithSubflowCallback(cb func(conn Conn, subflow string, raw net.Conn)) Option {
+	return func(cfg *config) {
+		cfg.onSubflowAdded = cb
+	}
+}
+
+// AggregationMode defines how the subflows of a connection are used.
+type AggregationMode int
+
+const (
+	// Aggregate spreads the data over all subflows for maximum throughput,
+	// preferring the ones with lower RTT. This is the default.
+	Aggregate AggregationMode = iota
+	// Failover sends the data on a single active subflow, the one with the
+	// lowest RTT when it's picked, while the others stand by. The next best
+	// subflow is promoted when the active one fails, or becomes lossy if
+	// WithLossCooldown is set. The frames not acked in time are still
+	// retransmitted on the standby subflows.
+	Failover
+	// AggregateWhenSaturated sends the data on the subflow with the lowest
+	// RTT, and only spreads it over the others while that one is saturated,
+	// i.e. its send queue stays full for longer than the threshold set by
+	// WithSaturationThreshold. It goes back to the single subflow once that
+	// one is idle again. Data split over paths with very different RTTs
+	// arrives out of order, and the head of line blocking can cost more than
+	// the extra bandwidth brings, unless the fastest path can't keep up.
+	AggregateWhenSaturated
+)
+
+// WithCostClass assigns each subflow to the cost class returned by class given
+// the subflow label, e.g. 0 for free WiFi, 1 for metered LTE, 2 for
+// satellite. It's evaluated once when the subflow is added. The scheduler only
+// sends on a class when all the subflows of the cheaper classes, with lower
+// values, are busy, and by estimated delivery within a class. Without it all
+// subflows are in class 0.
+func WithCostClass(class func(subflow string) int) Option {
+	return func(cfg *config) {
+		cfg.costClass = class
+	}
+}
+
+// WithInOrderSubflows marks the subflows inOrder returns true for, given the
+// subflow label, as trusted to deliver in order, e.g. TCP connections. It's
+// evaluated once when the subflow is added, and only affects the receiving
+// side. A frame received on such a subflow which is the next one Read is
+// waiting for is handed over right away, bypassing the reorder buffer, which
+// cuts the latency of the streams kept on a single subflow. Any other frame is
+// reordered as usual: the frames sent on several subflows, either redundantly
+// or retransmitted, still come out in order and only once, whichever subflow
+// delivers them first. The in-order and the other subflows can be freely
+// mixed. HOLStats.FastPathed counts the frames handed over right away. Nil
+// trusts no subflow, which is the default.
+func WithInOrderSubflows(inOrder func(subflow string) bool) Option {
+	return func(cfg *config) {
+		cfg.inOrderSubflows = inOrder
+	}
+}
+
+// WithSubflowMTU sets the MTU of each subflow to the one returned by mtu given
+// the subflow label, e.g. 9000 for a jumbo frame LAN and 1280 for a tunnel.
+// It's evaluated once when the subflow is added, zero or less meaning
+// unknown. The scheduler sends a frame larger than the MTU of a subflow on
+// one whose MTU fits it, or failing that on the one with the largest MTU,
+// unless they are all busy. Frames are never split, so it doesn't make the
+// frames a subflow can carry any smaller. Nil leaves the MTU of all subflows
+// unknown, which is the default.
+func WithSubflowMTU(mtu func(subflow string) int) Option {
+	return func(cfg *config) {
+		cfg.subflowMTU = mtu
+	}
+}
+
+// WithPathAdvertisement advertises the subflows of this end, with their RTT
+// and whether they are lossy or paused, to the peer, which exposes them from
+// PeerPaths, so that each end knows the view of the other. They are
+// advertised with a control frame whenever a subflow is added or removed, and
+// every interval to keep the RTTs fresh. The peer must support the path
+// advertisements, or it never acks them. Zero disables it, which is the
+// default.
+func WithPathAdvertisement(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pathAdvertInterval = interval
+	}
+}
+
+// WithAggregationMode sets how the subflows of a connection are used.
+func WithAggregationMode(mode AggregationMode) Option {
+	return func(cfg *config) {
+		cfg.aggregationMode = mode
+	}
+}
+
+// WithSaturationThreshold sets how long the send queue of the fastest subflow
+// has to stay full before the other subflows are used too in the
+// AggregateWhenSaturated mode. The write waits for room on the fastest
+// subflow in the meantime. Zero spills onto the other subflows as soon as the
+// queue is full. Defaults to 10ms.
+func WithSaturationThreshold(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.saturationThreshold = d
+	}
+}
+
+// WithSinglePathFastPath skips the per frame bookkeeping while the connection
+// has a single subflow, which has to deliver in order anyway, like TCP does:
+// the data frames are neither timed for retransmission nor used to sample the
+// RTT, which relies on the probes alone, and they don't count in
+// BytesInFlight. They are still acked by the peer, and kept until then to be
+// sent on the other subflows if the single one fails. The full bookkeeping
+// resumes for the frames written once more subflows are added. It doesn't
+// apply to WriteRedundant, WriteTagged nor with forward error correction.
+// The wire format is unchanged, so the peer doesn't need it. Disabled by
+// default.
+func WithSinglePathFastPath() Option {
+	return func(cfg *config) {
+		cfg.singlePathFastPath = true
+	}
+}
+
+// WithSubflowWarmup keeps each subflow added from carrying data frames for d,
+// during which it only carries the probes and acks, so that its RTT is
+// measured before the scheduler relies on it. The subflows warming up are
+// still used if there's no other, e.g. when the connection is established.
+// Zero disables it, which is the default, leaving the new subflows to the
+// estimate set by WithUnmeasuredRTT.
+func WithSubflowWarmup(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.subflowWarmup = d
+	}
+}
+
+// WithUnmeasuredRTT sets the RTT the scheduler assumes for a newly added
+// subflow until its RTT is measured by the first probe, or the first ack.
+// Zero means the median RTT of the measured subflows of the connection, which
+// is the default. Without any measured subflow, the new one is the last
+// choice until measured.
+func WithUnmeasuredRTT(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.unmeasuredRTT = d
+	}
+}
+
+// WithCollapseCallback sets a callback which is called when more than 95% of
+// the data frames of a connection with multiple subflows are sent on a single
+// subflow over a window of 1000 frames, and again when it's no longer the case.
+// It means the paths are too imbalanced for the others to be of any use, or
+// they are dead but not removed. It's called synchronously so it should return
+// quickly.
+func WithCollapseCallback(cb func(conn Conn, subflow string, collapsed bool)) Option {
+	return func(cfg *config) {
+		cfg.onCollapse = cb
+	}
+}
+
+// WithRetransmitPolicy restricts the subflows the frames can be retransmitted
+// on to those allow returns true for, given the subflow label, e.g. to keep the
+// recovery traffic off a metered path. The data frames are still sent first on
+// any subflow. The frames which can't be retransmitted on any subflow are
+// retried when they time out again. If allow panics, the subflow is allowed.
+// Nil allows all subflows, which is the default.
+func WithRetransmitPolicy(allow func(subflow string) bool) Option {
+	return func(cfg *config) {
+		cfg.allowRetransmit = allow
+	}
+}
+
+// WithRTTHistory keeps the last size RTT samples of each subflow, exposed as
+// SubflowInfo.RTTHistory, e.g. to spot bimodal latency or route changes which
+// the smoothed RTT hides. Zero disables it, which is the default.
+func WithRTTHistory(size int) Option {
+	return func(cfg *config) {
+		cfg.rttHistorySize = size
+	}
+}
+
+// WithScheduleLog records which subflow each of the last depth data frames
+// was sent on and why, exposed by Conn.RecentSchedules. Zero disables it,
+// which is the default, sparing the locking on each write.
+func WithScheduleLog(depth int) Option {
+	return func(cfg *config) {
+		cfg.scheduleLogDepth = depth
+	}
+}
+
+// WithJoinSecret makes the subflows joining an existing connection prove they
+// know the secret, so that a subflow claiming a guessed connection ID can't be
+// grafted onto the connection. The listener challenges each joining subflow
+// with a random nonce, which the dialer answers with the HMAC-SHA256 of the
+// connection ID and the nonce keyed by the secret. Subflows failing the
+// challenge are rejected. The first subflow of a connection is not challenged.
+// Both ends must be configured with the same secret. Empty disables it, which
+// is the default.
+func WithJoinSecret(secret []byte) Option {
+	return func(cfg *config) {
+		cfg.joinSecret = secret
+	}
+}
+
+// WithWriteTimeout bounds the time a Write can take waiting for the subflows
+// to take the frame, unlike SetWriteDeadline which only applies to the
+// underlying conns. Write returns context.DeadlineExceeded once it elapses,
+// with nothing sent. As Write returns as soon as the frame is queued on a
+// subflow, it doesn't cover the delivery. Zero means no timeout, which is the
+// default.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = d
+	}
+}
+
+// WithOrderedWrites serializes the concurrent writes: a frame is numbered and
+// queued on a subflow before the next write starts composing its own, so the
+// frame numbers follow the queuing order and the peer reads the bytes in the
+// order the writes got through. The cost is that the writes wait for the
+// memory limiter and room on the subflows one at a time, so more writers don't
+// mean more throughput, though the subflows still write the queued frames in
+// parallel. Disabled by default. Either way, the writes take room in the frame
+// window one at a time, see WithFrameWindow.
+func WithOrderedWrites() Option {
+	return func(cfg *config) {
+		cfg.orderedWrites = true
+	}
+}
+
+// WithAckCallback sets a callback which is called with the tag of each frame
+// written by WriteTagged once the peer acks it. It's called synchronously when
+// the ack is received so it should return quickly.
+func WithAckCallback(cb func(conn Conn, tag uint64)) Option {
+	return func(cfg *config) {
+		cfg.onAck = cb
+	}
+}
+
+// WithControlCallback sets a callback which is called with each control
+// message sent by the peer with SendControl, once, as soon as it's received.
+// It's called synchronously on the goroutine reading the subflow it's
+// received on, so it should return quickly. msg is owned by the callback.
+func WithControlCallback(cb func(conn Conn, msg []byte)) Option {
+	return func(cfg *config) {
+		cfg.onControl = cb
+	}
+}
+
+// WithRetransmitStallTimeout sets how long a frame due for retransmission can
+// wait for room in the send queue of any subflow. If the send queues stay
+// full for that long the connection is stuck, and it's closed as if all the
+// subflows were gone. Zero means waiting forever. Defaults to 1 minute.
+func WithRetransmitStallTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.retransmitStall = d
+	}
+}
+
+// WithRetransmitJitter extends the retransmission timeout of each frame by a
+// random amount up to d, drawn anew each time the frame is written, so that
+// the frames timing out together after a path blip, on this connection or on
+// others, are retransmitted over a while rather than in a single burst, which
+// could congest the surviving paths. The timeouts are evaluated every 100ms,
+// so d has to be larger than that to take effect. Zero disables it, which is
+// the default.
+func WithRetransmitJitter(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.retransmitJitter = d
+	}
+}
+
+// WithInitialRTO sets the retransmission timeout of a subflow until its RTT is
+// measured, when the server side has yet to get the first pong. It's not
+// capped by the max RTO, so a large value avoids the spurious retransmissions
+// at the start on long fat networks, e.g. satellite links. Defaults to 1
+// second, as TCP does.
+func WithInitialRTO(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.initialRTO = d
+	}
+}
+
+// WithMinSubflows requires a connection to keep at least n healthy subflows,
+// i.e. subflows not deprioritized as lossy, see WithLossCooldown. When the
+// count drops below n, cb is called with the healthy count, and if redial is
+// true the dialing side dials again the paths whose subflows are gone. cb may
+// be nil. It's called again only after the count has been back to n, and not
+// when the connection is closed. It's called synchronously so it should
+// return quickly. Zero disables the check, which is the default.
+func WithMinSubflows(n int, redial bool, cb func(conn Conn, healthy int)) Option {
+	return func(cfg *config) {
+		cfg.minSubflows = n
+		cfg.redialBelowMin = redial
+		cfg.onBelowMinSubflows = cb
+	}
+}
+
+// WithOneWayDelay makes each subflow send a timestamp frame every interval,
+// from which the delay of each direction is estimated, see
+// SubflowInfo.ForwardDelay. The scheduler then uses the forward delay rather
+// than the RTT once the forward delays of all subflows are measured, which is
+// more accurate on paths with very different delays each way, e.g. satellite
+// links. The estimates assume the clocks of both ends are synchronized, but
+// the scheduler only uses the differences between the forward delays of the
+// subflows, which a constant offset doesn't affect. Both ends must enable it
+// for either to learn its forward delay. Zero disables it, which is the
+// default.
+func WithOneWayDelay(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timestampInterval = interval
+	}
+}
+
+// WithMaxRetransmissions gives up on a frame which still times out after being
+// retransmitted n times. The peer is told to skip it, so the frames after it
+// are delivered with a gap rather than held back forever, which suits the
+// applications tolerating some loss. Zero means retransmitting until the
+// frame is acked, which is the default. The peer must support skipping frames,
+// otherwise see WithGapTimeout. See WithAbandonCallback to learn the frames
+// lost.
+func WithMaxRetransmissions(n int) Option {
+	return func(cfg *config) {
+		cfg.maxRetransmissions = n
+	}
+}
+
+// WithRealTimeFirst favors the new data over the retransmissions while the
+// connection is congested, i.e. some writes are blocked waiting for room on
+// the subflows, which suits live streaming. The retransmissions wait for the
+// blocked writes to go first, and the frames first sent more than staleAfter
+// ago are given up on rather than retransmitted, as they are too late to
+// matter anyway. As with WithMaxRetransmissions, the peer is told to skip
+// them, and WithAbandonCallback learns them. Zero disables it, which is the
+// default.
+func WithRealTimeFirst(staleAfter time.Duration) Option {
+	return func(cfg *config) {
+		cfg.staleAfter = staleAfter
+	}
+}
+
+// WithRTTEstimator replaces the exponentially weighted moving average used to
+// estimate the RTT of each subflow, e.g. with one more robust to the outliers
+// or tracking the minimum RTT. newEstimator is called for each new subflow, as
+// each has an estimator of its own. If an estimator panics, the default one
+// takes over for its subflow.
+func WithRTTEstimator(newEstimator func() RTTEstimator) Option {
+	return func(cfg *config) {
+		cfg.newRTTEstimator = newEstimator
+	}
+}
+
+// WithGapTimeout makes the receiving side skip a missing frame once the frames
+// received after it have been held back for d, and deliver them with a gap,
+// e.g. in case the peer gives up on the frame but the notice is lost too. A
+// skipped frame is dropped if it arrives later. Zero means waiting forever,
+// which is the default.
+func WithGapTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.gapTimeout = d
+	}
+}
+
+// WithMaxQueueWait makes the data frames scheduled on a subflow which gets
+// stuck writing for longer than d, e.g. because the path slowed down after the
+// frames were scheduled, be taken out of its send queue and rescheduled onto
+// the other subflows. They are only rescheduled if another subflow is free to
+// send, and it counts as a retransmission. Zero disables it, which is the
+// default.
+func WithMaxQueueWait(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxQueueWait = d
+	}
+}
+
+// WithFrameWindow caps the frame numbers outstanding at once, i.e. from the
+// lowest one not acked yet to the last one sent, to n, as a flow control over
+// all subflows together, regardless of how much each of them could carry. A
+// write blocks until the acks advance the window, and is subject to the write
+// timeout while doing so. The concurrent writes take the room one at a time,
+// whether WithOrderedWrites is set or not, so they can't overrun the window.
+// The frames given up on no longer hold the window. Zero means no limit, which
+// is the default.
+func WithFrameWindow(n int) Option {
+	return func(cfg *config) {
+		cfg.frameWindow = n
+	}
+}
+
+// DegradedWritePolicy defines what a write does when the connection is
+// degraded to a single subflow and it has no room for the frame, i.e. when
+// there's no other subflow to spread the data over.
+type DegradedWritePolicy int
+
+const (
+	// BlockWhenDegraded waits for the subflow to have room, the same as with
+	// any number of subflows.
+	BlockWhenDegraded DegradedWritePolicy = iota
+	// FailWhenDegraded returns ErrDegraded right away without sending
+	// anything, so that the application can retry later or elsewhere.
+	FailWhenDegraded
+	// BufferWhenDegraded queues the frames in a buffer of the size given to
+	// WithDegradedWritePolicy, sent in the order they are buffered as the
+	// subflow has room, and only waits once the buffer is full. Concurrent
+	// writes may buffer their frames out of the order of their numbers,
+	// which the peer reorders like any other.
+	BufferWhenDegraded
+)
+
+// WithDegradedWritePolicy sets what a write does when the connection is
+// degraded to a single subflow which has no room for the frame. bufferSize is
+// the number of frames buffered by BufferWhenDegraded, and ignored by the
+// other policies. Defaults to BlockWhenDegraded.
+func WithDegradedWritePolicy(policy DegradedWritePolicy, bufferSize int) Option {
+	return func(cfg *config) {
+		cfg.degradedWritePolicy = policy
+		cfg.degradedBufferSize = bufferSize
+	}
+}
+
+// WithMemoryLimiter makes the connection account the payloads it buffers to
+// ml, which is usually shared by all the connections of the process to cap
+// their total memory usage, see MemoryLimiter. On a listener, it also
+// rejects the new connections when ml is near its limit.
+func WithMemoryLimiter(ml *MemoryLimiter) Option {
+	return func(cfg *config) {
+		cfg.memoryLimiter = ml
+	}
+}
+
+// WithSendPool makes the subflows of the connection write their frames on the
+// workers of p, which is usually shared by all the connections of a server,
+// rather than on a goroutine each, see SendPool. Nil gives each subflow its
+// own goroutine, which is the default.
+func WithSendPool(p *SendPool) Option {
+	return func(cfg *config) {
+		cfg.sendPool = p
+	}
+}
+
+// AbandonedFrame describes a frame given up on, see WithMaxRetransmissions.
+type AbandonedFrame struct {
+	// FN is the frame number.
+	FN uint64
+	// Tag is the tag passed to WriteTagged, zero if none.
+	Tag uint64
+	// Stream is the ID of the stream the frame was written to, zero for the
+	// default stream.
+	Stream uint64
+	// Payload is a copy of the data written, which the application can
+	// resend or log.
+	Payload []byte
+	// Retransmissions is how many times the frame was retransmitted.
+	Retransmissions int
+}
+
+// WithAbandonCallback sets a callback which is called when a frame is given
+// up on after the max retransmissions, so the application learns which data
+// was lost. It's called synchronously so it should return quickly.
+func WithAbandonCallback(cb func(conn Conn, frame AbandonedFrame)) Option {
+	return func(cfg *config) {
+		cfg.onAbandon = cb
+	}
+}
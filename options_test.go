@@ -0,0 +1,51 @@
+package multipath
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOptions(t *testing.T) {
+	assert.NoError(t, ValidateOptions())
+	assert.NoError(t, ValidateOptions(WithRedundancy(2), WithWriteCoalescing(time.Millisecond, 100), WithFEC(4, 1)))
+	assert.NoError(t, ValidateOptions(WithMinRTO(time.Second), WithMaxRTO(time.Second), WithLossCooldown(time.Second, 1)))
+	assert.NoError(t, ValidateOptions(WithLossCooldown(0, 0)), "should not check the threshold of a disabled cooldown")
+	for _, opts := range [][]Option{
+		{WithMinRTO(-time.Second)},
+		{WithMinRTO(time.Second), WithMaxRTO(time.Millisecond)},
+		{WithMinRTO(time.Second)},
+		{WithReceiveQueueBounds(100, 10)},
+		{WithReceiveQueueBounds(0, 10)},
+		{WithMaxFrameSize(0)},
+		{WithMaxFrameSize(maxFrameSize + 1)},
+		{WithWriteCoalescing(time.Millisecond, 0)},
+		{WithWriteCoalescing(time.Millisecond, 2000), WithMaxFrameSize(1000)},
+		{WithLossCooldown(time.Second, 0)},
+		{WithAggregationMode(AggregationMode(-1))},
+		{WithAggregationMode(AggregateWhenSaturated + 1)},
+		{WithUnknownCIDPolicy(ResetUnknownCID + 1)},
+		{WithLateFramePolicy(LateFramePolicy(-1))},
+		{WithRedundancy(0)},
+		{WithRedundancy(2), WithAggregationMode(Failover)},
+		{WithRetransmitOrder(nil)},
+		{WithRetransmitJitter(-time.Second)},
+		{WithRealTimeFirst(-time.Second)},
+		{WithRTTEstimator(nil)},
+		{WithFrameWindow(-1)},
+		{WithPathAdvertisement(-time.Second)},
+		{WithDegradedWritePolicy(BufferWhenDegraded, 0)},
+		{WithDegradedWritePolicy(DegradedWritePolicy(-1), 0)},
+	} {
+		err := ValidateOptions(opts...)
+		assert.True(t, errors.Is(err, ErrInvalidOptions), "%v", err)
+	}
+
+	_, err := Dial([]string{"127.0.0.1:1"}, WithRedundancy(0))
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+	_, err = Listen("tcp", []string{"127.0.0.1:"}, WithRedundancy(0))
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+	assert.Panics(t, func() { NewDialer("endpoint", nil, WithRedundancy(0)) })
+}
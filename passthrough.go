@@ -0,0 +1,159 @@
+package multipath
+
+import (
+	"sync"
+)
+
+// passthrough keeps the data frames sent by the single path fast path, see
+// WithSinglePathFastPath. They are kept in the order they are written until
+// acked, only to be retransmitted if their subflow fails, as there are no
+// retransmission timers for them. As a subflow delivers in order, an ack to
+// one of them acks the ones sent before it on the same subflow as well. The
+// order they are written in isn't necessarily the order of their numbers, as
+// concurrent writes may queue them the other way around.
+type passthrough struct {
+	mu     sync.Mutex
+	frames []*sendFrame
+}
+
+// canPassThrough tells if the data frame can be sent by the single path fast
+// path, i.e. it's enabled, the connection has a single subflow, and none of
+// the features relying on tracking each frame are involved.
+func (bc *mpConn) canPassThrough(frame *sendFrame, k int) bool {
+	if !bc.cfg.singlePathFastPath || k != 1 || frame.tag != 0 || bc.fecEncoder != nil {
+		return false
+	}
+	bc.muSubflows.RLock()
+	defer bc.muSubflows.RUnlock()
+	return len(bc.subflows) == 1
+}
+
+// passedThrough keeps the untracked frame about to be written.
+func (bc *mpConn) passedThrough(frame *sendFrame) {
+	bc.passthrough.mu.Lock()
+	bc.passthrough.frames = append(bc.passthrough.frames, frame)
+	bc.passthrough.mu.Unlock()
+}
+
+// passthroughAcked releases the untracked frame fn if it's one of them, along
+// with the ones sent before it on the same subflow. Acks to other frames are
+// left alone, as a frame sent on another subflow tells nothing about the order
+// on this one.
+func (bc *mpConn) passthroughAcked(fn uint64) {
+	pt := &bc.passthrough
+	pt.mu.Lock()
+	// usually the first one, as the acks come in order
+	i := 0
+	for i < len(pt.frames) && pt.frames[i].fn != fn {
+		i++
+	}
+	if i == len(pt.frames) {
+		pt.mu.Unlock()
+		return
+	}
+	if i == 0 {
+		acked := pt.frames[0]
+		pt.frames[0] = nil
+		pt.frames = pt.frames[1:]
+		pt.mu.Unlock()
+		acked.release()
+		bc.ackWaiters.signal()
+		return
+	}
+	via := sentOn(pt.frames[i])
+	var acked []*sendFrame
+	remains := pt.frames[:0]
+	for j, frame := range pt.frames {
+		if j <= i && sentOn(frame) == via {
+			acked = append(acked, frame)
+		} else {
+			remains = append(remains, frame)
+		}
+	}
+	for j := len(remains); j < len(pt.frames); j++ {
+		pt.frames[j] = nil
+	}
+	pt.frames = remains
+	pt.mu.Unlock()
+	for _, frame := range acked {
+		frame.release()
+	}
+	bc.ackWaiters.signal()
+}
+
+// sentOn returns the subflow the untracked frame was sent on.
+func sentOn(frame *sendFrame) *subflow {
+	if len(frame.sentVia) == 0 {
+		return nil
+	}
+	return frame.sentVia[0].sf
+}
+
+// passthroughCumulativeAcked releases the untracked frames up to and including
+// ackFN, as all of them are received.
+func (bc *mpConn) passthroughCumulativeAcked(ackFN uint64) {
+	pt := &bc.passthrough
+	pt.mu.Lock()
+	var acked []*sendFrame
+	remains := pt.frames[:0]
+	for _, frame := range pt.frames {
+		if frame.fn <= ackFN {
+			acked = append(acked, frame)
+		} else {
+			remains = append(remains, frame)
+		}
+	}
+	for j := len(remains); j < len(pt.frames); j++ {
+		pt.frames[j] = nil
+	}
+	pt.frames = remains
+	pt.mu.Unlock()
+	for _, frame := range acked {
+		frame.release()
+	}
+	if len(acked) > 0 {
+		bc.ackWaiters.signal()
+	}
+}
+
+// reschedulePassedThrough retransmits the untracked frames sent on sf once it
+// stops sending, as they would never time out.
+func (bc *mpConn) reschedulePassedThrough(sf *subflow) {
+	pt := &bc.passthrough
+	pt.mu.Lock()
+	var stranded []*sendFrame
+	remains := pt.frames[:0]
+	for _, frame := range pt.frames {
+		if sentOn(frame) == sf {
+			stranded = append(stranded, frame)
+		} else {
+			remains = append(remains, frame)
+		}
+	}
+	pt.frames = remains
+	pt.mu.Unlock()
+	for _, frame := range stranded {
+		go bc.retransmit(frame, RetransmitSubflowFailed)
+	}
+}
+
+// hasPassedThroughUpTo tells if any untracked frame up to lastFN isn't acked.
+func (bc *mpConn) hasPassedThroughUpTo(lastFN uint64) bool {
+	bc.passthrough.mu.Lock()
+	defer bc.passthrough.mu.Unlock()
+	for _, frame := range bc.passthrough.frames {
+		if frame.fn <= lastFN {
+			return true
+		}
+	}
+	return false
+}
+
+// releasePassedThroughMemory is like releaseMemory for the untracked frames.
+func (bc *mpConn) releasePassedThroughMemory() {
+	bc.passthrough.mu.Lock()
+	defer bc.passthrough.mu.Unlock()
+	for _, frame := range bc.passthrough.frames {
+		frame.releaseMemory()
+	}
+}
@@ -0,0 +1,117 @@
+package multipath
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSinglePathFastPath(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 1, WithSinglePathFastPath())
+	defer client.Close()
+	defer server.Close()
+	bc := client.(*mpConn)
+	for i := 0; i < 100; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	bc.pendingAckMu.RLock()
+	pending := len(bc.pendingAckMap)
+	bc.pendingAckMu.RUnlock()
+	assert.Zero(t, pending, "should not track the frames on a single path")
+	b := make([]byte, 100)
+	_, err := io.ReadFull(server, b)
+	assert.NoError(t, err)
+	for i := range b {
+		assert.Equal(t, byte(i), b[i])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.(Conn).Flush(ctx), "should wait for the acks to the untracked frames")
+	assert.False(t, bc.hasPassedThroughUpTo(atomic.LoadUint64(&bc.lastFN)))
+
+	_, err = client.(Conn).WriteTagged([]byte("tagged"), 1)
+	assert.NoError(t, err)
+	bc.passthrough.mu.Lock()
+	assert.Empty(t, bc.passthrough.frames, "should track the tagged frames")
+	bc.passthrough.mu.Unlock()
+	_, err = io.ReadFull(server, b[:6])
+	assert.NoError(t, err)
+}
+
+func TestSinglePathFastPathFailure(t *testing.T) {
+	oldL, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer oldL.Close()
+	newL, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer newL.Close()
+	bl := NewListener([]net.Listener{oldL, newL}, []StatsTracker{NullTracker{}, NullTracker{}})
+	defer bl.Close()
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := bl.Accept()
+		if assert.NoError(t, err) {
+			chAccepted <- conn
+		}
+	}()
+	var dead int32
+	td := newTestDialer(oldL.Addr().String(), 0)
+	td.wrap = func(c net.Conn) net.Conn { return &deadPathConn{c, &dead} }
+	client, err := NewDialer("endpoint", []Dialer{td}, WithSinglePathFastPath()).DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	server := <-chAccepted
+	defer server.Close()
+
+	// the frames lost on the single path never time out, but are sent again
+	// once it's gone
+	atomic.StoreInt32(&dead, 1)
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	conn, err := net.Dial("tcp", newL.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, client.(Conn).Migrate([]net.Conn{conn}))
+	b := make([]byte, 10)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, b)
+}
+
+func TestPassthroughOutOfOrder(t *testing.T) {
+	bc := &mpConn{}
+	// concurrent writes may queue the frames out of the order of their numbers
+	for _, fn := range []uint64{2, 1, 4, 3} {
+		bc.passthrough.frames = append(bc.passthrough.frames, composeFrame(fn, []byte{byte(fn)}))
+	}
+	frameNumbers := func() []uint64 {
+		var fns []uint64
+		for _, frame := range bc.passthrough.frames {
+			fns = append(fns, frame.fn)
+		}
+		return fns
+	}
+	assert.True(t, bc.hasPassedThroughUpTo(1))
+	bc.passthroughCumulativeAcked(1)
+	assert.Equal(t, []uint64{2, 4, 3}, frameNumbers(), "should release the frame acked behind an unacked one")
+	bc.passthroughCumulativeAcked(3)
+	assert.Equal(t, []uint64{4}, frameNumbers(), "should release all the frames acked")
+	assert.False(t, bc.hasPassedThroughUpTo(3))
+	assert.True(t, bc.hasPassedThroughUpTo(4))
+}
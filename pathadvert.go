@@ -0,0 +1,143 @@
+package multipath
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+const (
+	pathLossy  = 1
+	pathPaused = 2
+)
+
+// PeerPath is a subflow as seen by the peer.
+type PeerPath struct {
+	// To is the label of the subflow on the peer's end, which may differ
+	// from the label on this end, e.g. the address of this end as seen
+	// through a NAT.
+	To     string
+	RTT    time.Duration
+	Lossy  bool
+	Paused bool
+}
+
+// PeerPaths is the last view of the subflows advertised by the peer, see
+// WithPathAdvertisement.
+type PeerPaths struct {
+	// At is when the advertisement was received, zero if none yet.
+	At    time.Time
+	Paths []PeerPath
+}
+
+// advertisePaths sends the subflows of this end to the peer whenever one is
+// added or removed, and every interval.
+func (bc *mpConn) advertisePaths(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.chPathsChanged:
+		case <-ticker.C:
+		case <-bc.chDone:
+			return
+		}
+		b := encodePaths(bc.sortedSubflows())
+		_, err := bc.sendData(func() *sendFrame {
+			return composeControlFrame(frameTypePathAdvert, atomic.AddUint64(&bc.lastFN, 1), b)
+		}, b, 1, time.Time{})
+		if err != nil {
+			log.Debugf("failed to advertise the paths of %x: %v", bc.cid, err)
+		}
+	}
+}
+
+// pathsChanged tells advertisePaths to advertise the subflows right away, if
+// enabled.
+func (bc *mpConn) pathsChanged() {
+	select {
+	case bc.chPathsChanged <- struct{}{}:
+	default:
+	}
+}
+
+func encodePaths(subflows []*subflow) []byte {
+	var buf bytes.Buffer
+	WriteVarInt(&buf, uint64(len(subflows)))
+	for _, sf := range subflows {
+		WriteVarInt(&buf, uint64(len(sf.to)))
+		buf.WriteString(sf.to)
+		WriteVarInt(&buf, uint64(sf.getRTT()/time.Microsecond))
+		var flags uint64
+		if sf.lossy() {
+			flags |= pathLossy
+		}
+		if sf.isPaused() {
+			flags |= pathPaused
+		}
+		WriteVarInt(&buf, flags)
+	}
+	return buf.Bytes()
+}
+
+var errMalformedPaths = errors.New("malformed path advertisement")
+
+func decodePaths(b []byte) ([]PeerPath, error) {
+	r := bytes.NewReader(b)
+	n, err := ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(b)) {
+		return nil, errMalformedPaths
+	}
+	paths := make([]PeerPath, 0, n)
+	for i := uint64(0); i < n; i++ {
+		sz, err := ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		if sz > uint64(r.Len()) {
+			return nil, errMalformedPaths
+		}
+		label := make([]byte, sz)
+		r.Read(label)
+		rtt, err := ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, PeerPath{
+			To:     string(label),
+			RTT:    time.Duration(rtt) * time.Microsecond,
+			Lossy:  flags&pathLossy != 0,
+			Paused: flags&pathPaused != 0,
+		})
+	}
+	return paths, nil
+}
+
+// gotPathAdvert keeps the subflows advertised by the peer.
+func (bc *mpConn) gotPathAdvert(b []byte) {
+	defer pool.Put(b)
+	paths, err := decodePaths(b)
+	if err != nil {
+		log.Errorf("Ignoring the path advertisement of %x: %v", bc.cid, err)
+		return
+	}
+	bc.muPeerPaths.Lock()
+	bc.peerPaths = PeerPaths{At: time.Now(), Paths: paths}
+	bc.muPeerPaths.Unlock()
+}
+
+func (bc *mpConn) PeerPaths() PeerPaths {
+	bc.muPeerPaths.Lock()
+	defer bc.muPeerPaths.Unlock()
+	return PeerPaths{At: bc.peerPaths.At, Paths: append([]PeerPath(nil), bc.peerPaths.Paths...)}
+}
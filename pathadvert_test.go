@@ -0,0 +1,67 @@
+package multipath
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodePaths(t *testing.T) {
+	b := encodePaths(nil)
+	paths, err := decodePaths(b)
+	assert.NoError(t, err)
+	assert.Empty(t, paths)
+
+	// one path with a label of 10 bytes
+	_, err = decodePaths([]byte{1, 10, 'a'})
+	assert.Error(t, err, "should reject the label cut short")
+	_, err = decodePaths([]byte{200})
+	assert.Error(t, err)
+}
+
+func TestPathAdvertisement(t *testing.T) {
+	client, server, _ := newAsymmetricTestConnPair(t, 2, nil,
+		[]Option{WithPathAdvertisement(50 * time.Millisecond)},
+		[]Option{WithControlCallback(func(_ Conn, msg []byte) {
+			assert.Fail(t, "should not hand the path advertisements to the control callback")
+		})})
+	defer server.Close()
+	defer client.Close()
+	assert.Empty(t, client.(Conn).PeerPaths().Paths, "should not advertise unless enabled")
+	assert.Eventually(t, func() bool {
+		return len(server.(Conn).PeerPaths().Paths) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	peerPaths := server.(Conn).PeerPaths()
+	assert.False(t, peerPaths.At.IsZero())
+	var labels []string
+	for _, info := range client.(Conn).Subflows() {
+		labels = append(labels, info.To)
+	}
+	var advertised []string
+	for _, path := range peerPaths.Paths {
+		advertised = append(advertised, path.To)
+		assert.NotZero(t, path.RTT)
+		assert.False(t, path.Paused)
+	}
+	assert.ElementsMatch(t, labels, advertised)
+
+	assert.NoError(t, client.(Conn).PauseSubflow(labels[0], false))
+	assert.Eventually(t, func() bool {
+		for _, path := range server.(Conn).PeerPaths().Paths {
+			if path.To == labels[0] {
+				return path.Paused
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond, "should refresh the advertisement")
+
+	_, err := client.Write([]byte("data"))
+	assert.NoError(t, err)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(b), "should not mix the advertisements with the data")
+}
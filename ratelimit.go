@@ -0,0 +1,58 @@
+package multipath
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of bytes sent. Tokens are replenished at rate
+// per second up to burst. Taking more tokens than available leaves the bucket
+// in debt, so frames larger than the burst can still go through, and the
+// caller is told how long to wait for the debt to be repaid.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// refill must be called with mu held.
+func (tb *tokenBucket) refill() {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// take consumes n tokens and returns how long the caller should wait before
+// sending them.
+func (tb *tokenBucket) take(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// exhausted tells if sending anything now would have to wait.
+func (tb *tokenBucket) exhausted() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	return tb.tokens < 1
+}
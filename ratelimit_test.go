@@ -0,0 +1,19 @@
+package multipath
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(1000)
+	assert.Zero(t, tb.take(1000), "should allow the burst right away")
+	assert.True(t, tb.exhausted())
+	wait := tb.take(500)
+	assert.InDelta(t, 500*time.Millisecond, wait, float64(10*time.Millisecond))
+	time.Sleep(wait + 100*time.Millisecond)
+	assert.False(t, tb.exhausted())
+	assert.Zero(t, tb.take(50))
+}
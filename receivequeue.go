@@ -10,13 +10,31 @@ import (
 )
 
 // receiveQueue keeps received frames for the upper layer to read. It is
-// maintained as a ring buffer with fixed size. It takes advantage of the fact
-// that the frame number is sequential, so when a new frame arrives, it is
-// placed at buf[frameNumber % size].
+// maintained as a ring buffer. It takes advantage of the fact that the frame
+// number is sequential, so when a new frame arrives, it is placed at
+// buf[frameNumber % size].
+//
+// The ring buffer can be resized between minSize and maxSize according to the
+// observed reordering depth, i.e. how far ahead of the next expected frame the
+// received frames are. It doubles when a frame lands in the last quarter of the
+// window, and halves when the depth stays below a quarter of the window while a
+// whole window worth of frames is read. The gap between the two thresholds
+// prevents it from thrashing.
+//
+// The payload buffers of the frames are taken from the buffer pool by the
+// subflows and owned by the queue once added. As read copies the payloads to
+// the caller's slice, the caller never holds them, and each is returned to the
+// pool as soon as it's fully read, or dropped as a duplicate.
 type receiveQueue struct {
 	readFrameTip uint64
 	buf          []rxFrame
-	size         uint64
+	size         uint64 // always accessed atomically as it can be resized
+	minSize      uint64
+	maxSize      uint64
+	// maxDepth is the deepest reordering observed since the last time
+	// shrinking was evaluated, readSinceEval the number of frames read since.
+	maxDepth      uint64
+	readSinceEval uint64
 	// rp stands for read pointer, point to the index of the frame containing
 	// data yet to be read.
 	rp                    uint64
@@ -27,21 +45,86 @@ type receiveQueue struct {
 	closing               uint32 // 1 == true, 0 == false  -- This is used to "drain" the Queue
 	fullyClosed           uint32 // 1 == true, 0 == false
 	readLock              *sync.Mutex
+	// chClosed is closed along with the queue to release the subflows waiting
+	// for room in it.
+	chClosed  chan struct{}
+	closeOnce sync.Once
+	// discardLate tells to drop the frames arriving after the queue is closed
+	// instead of accepting them while it's drained.
+	discardLate bool
+	// gapTimeout is how long the frames can be held back waiting for a
+	// missing one before it's skipped, zero to wait forever.
+	gapTimeout time.Duration
+
+	// receivedTip is the frame number up to which all frames have been
+	// received, though not necessarily read yet. Accessed atomically.
+	receivedTip uint64
+	// onDelivered, if not nil, is called after each frame is fully read.
+	onDelivered func(fn uint64, via string, size int)
+	// onStreamFrame, if not nil, takes the frames of the streams other than
+	// the default one, returning false if the frame can't be accepted for
+	// now.
+	onStreamFrame func(f *rxFrame) bool
+	// onControl, if not nil, is called with each control message the first
+	// time it's received, and onPathAdvert likewise with each path
+	// advertisement.
+	onControl    func(b []byte)
+	onPathAdvert func(b []byte)
+	// buffered is the number of frames in the queue, peakBuffered the
+	// maximum of it since last taken. Protected by readLock.
+	buffered     int
+	peakBuffered int
+	// stallSince is when the frames after stallFN started to be held back
+	// waiting for it, zero if not stalled. Protected by readLock.
+	stallSince time.Time
+	stallFN    uint64
+	hol        HOLStats
+	// delivered is the total bytes read. Accessed atomically.
+	delivered uint64
+	// mem accounts the payloads of the frames in the queue, nil if not
+	// limited.
+	mem *MemoryLimiter
 }
 
 func newReceiveQueue(size int) *receiveQueue {
+	return newAdaptiveReceiveQueue(size, size, size)
+}
+
+// newAdaptiveReceiveQueue creates a receiveQueue starting with size slots
+// which is resized within [minSize, maxSize].
+func newAdaptiveReceiveQueue(size, minSize, maxSize int) *receiveQueue {
 	rq := &receiveQueue{
 		buf:                   make([]rxFrame, size),
 		size:                  uint64(size),
+		minSize:               uint64(minSize),
+		maxSize:               uint64(maxSize),
 		rp:                    minFrameNumber % uint64(size), // frame number starts with minFrameNumber, so should the read pointer
 		availableFrameChannel: make(chan bool, 1),
 		readNotifyChannel:     make(chan bool),
 		readLock:              &sync.Mutex{},
+		chClosed:              make(chan struct{}),
 	}
 	return rq
 }
 
 func (rq *receiveQueue) add(f *rxFrame, sf *subflow) {
+	if rq.offer(f, sf) {
+		sf.ackData(f.fn)
+	}
+}
+
+// offer adds the frame to the queue, and returns true if it's accepted or a
+// duplicate, i.e. it should be acked.
+func (rq *receiveQueue) offer(f *rxFrame, sf *subflow) bool {
+	if rq.dropLate(f) {
+		return false
+	}
+	if sf != nil && sf.inOrder {
+		f.inOrder = true
+	}
+	if f.inOrder && f.stream == 0 && !f.control && rq.deliverNext(f, sf) {
+		return true
+	}
 	select {
 	case rq.availableFrameChannel <- true:
 	default:
@@ -62,6 +145,12 @@ func (rq *receiveQueue) add(f *rxFrame, sf *subflow) {
 					abort = true
 					break
 				}
+			case <-rq.chClosed:
+				// Nobody may ever read again. As the queue is full
+				// of frames in order, this one couldn't be drained
+				// anyway.
+				pool.Put(f.bytes)
+				return false
 			}
 			if abort {
 				break
@@ -77,39 +166,370 @@ func (rq *receiveQueue) add(f *rxFrame, sf *subflow) {
 
 	if readFrameTip != 0 {
 		if readFrameTip > f.fn || readFrameTip == f.fn {
-			sf.ack(f.fn)
-			return
+			pool.Put(f.bytes)
+			return true
 		}
 	}
 
-	if f.fn > readFrameTip+rq.size && readFrameTip != 0 {
-		log.Debugf("Near corruption incident?? %v vs the max peek of %v (frametip %d)", f.fn, readFrameTip+rq.size-1, readFrameTip)
-		return // Nope! this will corrupt the buffer
+	size := atomic.LoadUint64(&rq.size)
+	if f.fn > readFrameTip+size && readFrameTip != 0 {
+		log.Debugf("Near corruption incident?? %v vs the max peek of %v (frametip %d)", f.fn, readFrameTip+size-1, readFrameTip)
+		return false // Nope! this will corrupt the buffer
 	}
 
+	f.size = len(f.bytes)
+	if sf != nil {
+		f.via = sf.to
+	}
+	if f.control {
+		// The message is handed over the first time it's received, leaving
+		// a placeholder here which is skipped as soon as it's reached.
+		accepted, first := rq.tryAddFirst(&rxFrame{fn: f.fn, bytes: []byte{}, via: f.via, control: true})
+		switch {
+		case first && f.pathAdvert && rq.onPathAdvert != nil:
+			rq.onPathAdvert(f.bytes)
+		case first && !f.pathAdvert && rq.onControl != nil:
+			rq.onControl(f.bytes)
+		default:
+			pool.Put(f.bytes)
+		}
+		return accepted
+	}
+	if f.stream != 0 {
+		// The frame is delivered to its own stream right away, leaving a
+		// placeholder here which is skipped as soon as it's reached.
+		if rq.onStreamFrame == nil || !rq.onStreamFrame(f) {
+			return false
+		}
+		f = &rxFrame{fn: f.fn, bytes: []byte{}, via: f.via, stream: f.stream}
+	}
 	if rq.tryAdd(f) {
-		sf.ack(f.fn)
-		return
+		return true
 	}
 
 	// Protect against the socket being closed
 	if atomic.LoadUint32(&rq.fullyClosed) == 1 {
 		pool.Put(f.bytes)
+	}
+	return false
+}
+
+// deliverNext hands the frame received on an in-order subflow to the reader
+// right away if it's the one Read is waiting for, skipping the checks for room
+// and reordering depth, which can't apply to the slot under the read pointer.
+// It returns false for any other frame, to be queued as usual.
+func (rq *receiveQueue) deliverNext(f *rxFrame, sf *subflow) bool {
+	rq.readLock.Lock()
+	if atomic.LoadUint32(&rq.fullyClosed) == 1 || f.fn != rq.nextFrameNumber() || rq.buf[rq.rp].bytes != nil {
+		rq.readLock.Unlock()
+		return false
+	}
+	f.size = len(f.bytes)
+	if sf != nil {
+		f.via = sf.to
+	}
+	// the reader is waiting for it, so it's never held back for memory
+	rq.mem.forceAcquire(f.size)
+	rq.buf[rq.rp] = *f
+	rq.buffered++
+	if rq.buffered > rq.peakBuffered {
+		rq.peakBuffered = rq.buffered
+	}
+	rq.hol.FastPathed++
+	rq.advanceReceivedTip()
+	rq.updateStall()
+	rq.readLock.Unlock()
+	select {
+	case rq.availableFrameChannel <- true:
+	default:
+	}
+	return true
+}
+
+// dropLate drops the frame if it arrives after the queue is closed and can't
+// be read any more, returning its buffer to the pool. While the queue is
+// drained, only the frame right after those received in order is accepted,
+// unless discardLate is set.
+func (rq *receiveQueue) dropLate(f *rxFrame) bool {
+	if atomic.LoadUint32(&rq.closing) == 0 {
+		return false
+	}
+	if atomic.LoadUint32(&rq.fullyClosed) == 0 && !rq.discardLate && f.fn == rq.nextReceivedFrameNumber() {
+		return false
+	}
+	log.Tracef("Dropping frame %d received after close", f.fn)
+	pool.Put(f.bytes)
+	return true
+}
+
+func (rq *receiveQueue) nextReceivedFrameNumber() uint64 {
+	tip := atomic.LoadUint64(&rq.receivedTip)
+	if readTip := atomic.LoadUint64(&rq.readFrameTip); readTip > tip {
+		tip = readTip
+	}
+	if tip == 0 {
+		return minFrameNumber
+	}
+	return tip + 1
+}
+
+// admit tells if frame fn fits in the current window of the queue, growing
+// the window first if the frame indicates deeper reordering than the queue was
+// sized for.
+func (rq *receiveQueue) admit(fn uint64) bool {
+	next := rq.nextFrameNumber()
+	if fn < next {
+		// already read, will be acked as a duplicate
+		return true
+	}
+	depth := fn - next
+	rq.readLock.Lock()
+	if depth > rq.maxDepth {
+		rq.maxDepth = depth
+	}
+	for depth >= rq.size-rq.size/4 && rq.size < rq.maxSize {
+		newSize := rq.size * 2
+		if newSize > rq.maxSize {
+			newSize = rq.maxSize
+		}
+		rq.resize(newSize)
+	}
+	size := rq.size
+	rq.readLock.Unlock()
+	return depth < size
+}
+
+func (rq *receiveQueue) nextFrameNumber() uint64 {
+	tip := atomic.LoadUint64(&rq.readFrameTip)
+	if tip == 0 {
+		return minFrameNumber
+	}
+	return tip + 1
+}
+
+// maybeShrink halves the window if the reordering has been shallow for a
+// whole window worth of reads. It must be called with readLock held.
+func (rq *receiveQueue) maybeShrink() {
+	rq.readSinceEval++
+	if rq.readSinceEval < rq.size {
+		return
+	}
+	newSize := rq.size / 2
+	if newSize >= rq.minSize && rq.maxDepth < rq.size/4 && rq.bufferedFitIn(newSize) {
+		rq.resize(newSize)
+	}
+	rq.maxDepth = 0
+	rq.readSinceEval = 0
+}
+
+// bufferedFitIn tells if all buffered frames still have a unique slot in a
+// window of newSize. It must be called with readLock held.
+func (rq *receiveQueue) bufferedFitIn(newSize uint64) bool {
+	next := rq.nextFrameNumber()
+	for _, f := range rq.buf {
+		if f.bytes != nil && f.fn >= next+newSize {
+			return false
+		}
+	}
+	return true
+}
+
+// resize re-places the buffered frames into a ring buffer of newSize. It must
+// be called with readLock held.
+func (rq *receiveQueue) resize(newSize uint64) {
+	newBuf := make([]rxFrame, newSize)
+	for _, f := range rq.buf {
+		if f.bytes != nil {
+			newBuf[f.fn%newSize] = f
+		}
+	}
+	log.Tracef("Resizing receiveQueue from %d to %d", rq.size, newSize)
+	rq.buf = newBuf
+	rq.rp = rq.nextFrameNumber() % newSize
+	atomic.StoreUint64(&rq.size, newSize)
+}
+
+// advanceReceivedTip moves receivedTip forward over the contiguous frames
+// in the buffer. It must be called with readLock held.
+func (rq *receiveQueue) advanceReceivedTip() {
+	tip := atomic.LoadUint64(&rq.receivedTip)
+	if readTip := atomic.LoadUint64(&rq.readFrameTip); readTip > tip {
+		tip = readTip
+	}
+	next := tip + 1
+	if tip == 0 {
+		next = minFrameNumber
+	}
+	for {
+		f := rq.buf[next%rq.size]
+		if f.bytes == nil || f.fn != next {
+			break
+		}
+		tip = next
+		next++
+	}
+	atomic.StoreUint64(&rq.receivedTip, tip)
+}
+
+// updateStall tracks the head-of-line blocking, i.e. the time frames are held
+// back waiting for a missing one. It must be called with readLock held after
+// the received tip is advanced.
+func (rq *receiveQueue) updateStall() {
+	tip := atomic.LoadUint64(&rq.receivedTip)
+	next := rq.nextFrameNumber()
+	contiguous := 0
+	if tip >= next {
+		contiguous = int(tip + 1 - next)
+	}
+	if !rq.stallSince.IsZero() && rq.stallFN <= tip {
+		stalled := time.Since(rq.stallSince)
+		rq.hol.Stalls++
+		rq.hol.Total += stalled
+		if stalled > rq.hol.Longest {
+			rq.hol.Longest = stalled
+		}
+		rq.stallSince = time.Time{}
+	}
+	if rq.stallSince.IsZero() && rq.buffered > contiguous {
+		rq.stallSince = time.Now()
+		rq.stallFN = next + uint64(contiguous)
+		if rq.gapTimeout > 0 {
+			time.AfterFunc(rq.gapTimeout, rq.skipStalled)
+		}
+	}
+}
+
+// skipStalled skips the frames missing for longer than the gap timeout, so
+// the frames received after them can be read. If they arrive later, they are
+// taken as duplicates.
+func (rq *receiveQueue) skipStalled() {
+	rq.readLock.Lock()
+	if rq.stallSince.IsZero() || atomic.LoadUint32(&rq.fullyClosed) == 1 {
+		rq.readLock.Unlock()
 		return
 	}
+	if wait := rq.gapTimeout - time.Since(rq.stallSince); wait > 0 {
+		// another stall started since
+		rq.readLock.Unlock()
+		time.AfterFunc(wait, rq.skipStalled)
+		return
+	}
+	next := rq.nextReceivedFrameNumber()
+	end := next
+	for end < next+rq.size && rq.buf[end%rq.size].bytes == nil {
+		end++
+	}
+	if end == next+rq.size {
+		// nothing is held back
+		end = next
+	}
+	for fn := next; fn < end; fn++ {
+		log.Debugf("skipping frame %d missing for %v", fn, rq.gapTimeout)
+		rq.buf[fn%rq.size] = rxFrame{fn: fn, bytes: []byte{}, skipped: true}
+		rq.buffered++
+	}
+	rq.skipPlaceholders()
+	rq.advanceReceivedTip()
+	rq.updateStall()
+	rq.readLock.Unlock()
+	select {
+	case rq.availableFrameChannel <- true:
+	default:
+	}
+}
 
+// skip accepts the gap of frame fn as the peer gave up on it. It's a no-op if
+// the frame is already received or doesn't fit in the queue.
+func (rq *receiveQueue) skip(fn uint64) {
+	rq.readLock.Lock()
+	fits := fn >= rq.nextFrameNumber() && fn < rq.nextFrameNumber()+rq.size
+	rq.readLock.Unlock()
+	if !fits {
+		return
+	}
+	if rq.tryAdd(&rxFrame{fn: fn, bytes: []byte{}, skipped: true}) {
+		select {
+		case rq.availableFrameChannel <- true:
+		default:
+		}
+	}
+}
+
+func (rq *receiveQueue) holStats() HOLStats {
+	rq.readLock.Lock()
+	defer rq.readLock.Unlock()
+	return rq.hol
+}
+
+// stalledFor returns how long the queue has been held back by a missing frame,
+// zero if it isn't.
+func (rq *receiveQueue) stalledFor() time.Duration {
+	rq.readLock.Lock()
+	defer rq.readLock.Unlock()
+	if rq.stallSince.IsZero() {
+		return 0
+	}
+	return time.Since(rq.stallSince)
+}
+
+// skipPlaceholders moves the read pointer over the placeholders of the frames
+// delivered to other streams or skipped. It must be called with readLock held.
+func (rq *receiveQueue) skipPlaceholders() {
+	for {
+		f := rq.buf[rq.rp]
+		if f.bytes == nil || (f.stream == 0 && !f.skipped && !f.control) {
+			return
+		}
+		atomic.StoreUint64(&rq.readFrameTip, f.fn)
+		rq.buf[rq.rp].bytes = nil
+		rq.buffered--
+		rq.rp = (rq.rp + 1) % rq.size
+		if rq.minSize < rq.maxSize {
+			rq.maybeShrink()
+		}
+	}
+}
+
+// takePeakBuffered returns the maximum number of frames buffered since last
+// called, and the current size of the queue.
+func (rq *receiveQueue) takePeakBuffered() (peak int, size int) {
+	rq.readLock.Lock()
+	defer rq.readLock.Unlock()
+	peak = rq.peakBuffered
+	rq.peakBuffered = rq.buffered
+	return peak, int(rq.size)
+}
+
+func (rq *receiveQueue) deliveredBytes() uint64 {
+	return atomic.LoadUint64(&rq.delivered)
+}
+
+// highestDelivered returns the frame number of the last frame read or moved
+// past, zero if none.
+func (rq *receiveQueue) highestDelivered() uint64 {
+	return atomic.LoadUint64(&rq.readFrameTip)
+}
+
+func (rq *receiveQueue) getReceivedTip() uint64 {
+	return atomic.LoadUint64(&rq.receivedTip)
 }
 
 func (rq *receiveQueue) isFull() bool {
 	printFull := false
-	for i := uint64(0); i < rq.size; i++ {
+	size := atomic.LoadUint64(&rq.size)
+	for i := uint64(0); i < size; i++ {
 		expectedFrameNumber := atomic.LoadUint64(&rq.readFrameTip) + i
-		idx := expectedFrameNumber % rq.size
 
 		rq.readLock.Lock()
+		if rq.size != size {
+			// resized in the meantime
+			rq.readLock.Unlock()
+			return false
+		}
+		idx := expectedFrameNumber % rq.size
 		if rq.buf[idx].fn != expectedFrameNumber {
 			if printFull {
-				log.Tracef("receiveQueue is %d%% full! (%d/%d)", int((float32(i) / float32(rq.size) * 100)), i, rq.size)
+				log.Tracef("receiveQueue is %d%% full! (%d/%d)", int((float32(i) / float32(size) * 100)), i, size)
 			}
 			rq.readLock.Unlock()
 			return false
@@ -121,7 +541,7 @@ func (rq *receiveQueue) isFull() bool {
 		}
 		rq.readLock.Unlock()
 
-		if i == rq.size/2 {
+		if i == size/2 {
 			printFull = true
 		}
 	}
@@ -130,11 +550,42 @@ func (rq *receiveQueue) isFull() bool {
 }
 
 func (rq *receiveQueue) tryAdd(f *rxFrame) bool {
+	accepted, _ := rq.tryAddFirst(f)
+	return accepted
+}
+
+// tryAddFirst is like tryAdd, but also tells if the frame is received for the
+// first time rather than a retransmission.
+func (rq *receiveQueue) tryAddFirst(f *rxFrame) (accepted bool, first bool) {
 	rq.readLock.Lock()
+	if atomic.LoadUint32(&rq.fullyClosed) == 1 {
+		// closed for good while being added
+		rq.readLock.Unlock()
+		return false, false
+	}
 	idx := f.fn % rq.size
 	if rq.buf[idx].bytes == nil {
 		// empty slot
+		inOrder := f.fn == rq.nextReceivedFrameNumber()
+		if !rq.mem.tryAcquireFrame(f.size, inOrder) {
+			if idx == rq.rp {
+				// the reader is waiting for it to free up any memory
+				rq.mem.forceAcquire(f.size)
+			} else {
+				rq.readLock.Unlock()
+				log.Tracef("No memory left for frame %d, dropping", f.fn)
+				pool.Put(f.bytes)
+				return false, false
+			}
+		}
 		rq.buf[idx] = *f
+		rq.buffered++
+		if rq.buffered > rq.peakBuffered {
+			rq.peakBuffered = rq.buffered
+		}
+		rq.skipPlaceholders()
+		rq.advanceReceivedTip()
+		rq.updateStall()
 		if idx == rq.rp {
 			select {
 			case rq.availableFrameChannel <- true:
@@ -142,20 +593,20 @@ func (rq *receiveQueue) tryAdd(f *rxFrame) bool {
 			}
 		}
 		rq.readLock.Unlock()
-		return true
+		return true, true
 	} else if rq.buf[idx].fn == f.fn {
 		rq.readLock.Unlock()
 		// retransmission, ignore
 		log.Tracef("Got a retransmit. for %d", f.fn)
 		pool.Put(f.bytes)
-		return true
+		return true, false
 	}
 	rq.readLock.Unlock()
 
 	if idx != 0 {
 		log.Tracef("Not what I was looking for, I'm looking for frame %v", rq.buf[idx-1].fn+1)
 	}
-	return false
+	return false, false
 }
 
 func (rq *receiveQueue) read(b []byte) (int, error) {
@@ -188,6 +639,15 @@ func (rq *receiveQueue) read(b []byte) (int, error) {
 		<-rq.availableFrameChannel
 	}
 
+	var delivered []rxFrame
+	if rq.onDelivered != nil {
+		defer func() {
+			// called without holding readLock
+			for _, f := range delivered {
+				rq.onDelivered(f.fn, f.via, f.size)
+			}
+		}()
+	}
 	rq.readLock.Lock()
 	defer rq.readLock.Unlock()
 
@@ -206,11 +666,21 @@ func (rq *receiveQueue) read(b []byte) (int, error) {
 		}
 		n := copy(b[totalN:], cur)
 		if n == len(cur) {
-			log.Tracef("Finished with read frame %d\n", rq.buf[rq.rp].fn)
+			if log.IsTraceEnabled() {
+				log.Tracef("Finished with read frame %d\n", rq.buf[rq.rp].fn)
+			}
 			atomic.StoreUint64(&rq.readFrameTip, rq.buf[rq.rp].fn)
+			if rq.onDelivered != nil {
+				delivered = append(delivered, rq.buf[rq.rp])
+			}
 			pool.Put(cur)
+			rq.mem.release(rq.buf[rq.rp].size)
 			rq.buf[rq.rp].bytes = nil
+			rq.buffered--
 			rq.rp = (rq.rp + 1) % rq.size
+			if rq.minSize < rq.maxSize {
+				rq.maybeShrink()
+			}
 		} else {
 			// The frames in the ring buffer are never overridden, so we can
 			// safely update the bytes to reflect the next read position.
@@ -218,9 +688,11 @@ func (rq *receiveQueue) read(b []byte) (int, error) {
 			log.Tracef("Partial read frame %d\n", rq.buf[rq.rp].fn)
 		}
 		totalN += n
+		rq.skipPlaceholders()
 		cur = rq.buf[rq.rp].bytes
 	}
 
+	atomic.AddUint64(&rq.delivered, uint64(totalN))
 	select {
 	case rq.readNotifyChannel <- true:
 	default:
@@ -229,6 +701,7 @@ func (rq *receiveQueue) read(b []byte) (int, error) {
 	if totalN == 0 && atomic.LoadUint32(&rq.closing) == 1 {
 		// close fully
 		atomic.StoreUint32(&rq.fullyClosed, 1)
+		rq.releaseBuffered()
 		return 0, ErrClosed
 	}
 
@@ -255,7 +728,11 @@ func (rq *receiveQueue) setReadDeadline(dl time.Time) {
 			}
 		} else {
 			time.AfterFunc(ttl, func() {
-				rq.availableFrameChannel <- true
+				select {
+				case rq.availableFrameChannel <- true:
+				default:
+					// the reader is going to wake up anyway
+				}
 			})
 		}
 	}
@@ -265,8 +742,25 @@ func (rq *receiveQueue) dlExceeded() bool {
 	return !rq.readDeadline.IsZero() && !rq.readDeadline.After(time.Now())
 }
 
+// releaseBuffered returns the buffers of the frames which can never be read,
+// i.e. those after a gap, to the pool. It must be called with readLock held.
+func (rq *receiveQueue) releaseBuffered() {
+	for i := range rq.buf {
+		if rq.buf[i].bytes != nil {
+			pool.Put(rq.buf[i].bytes)
+			rq.mem.release(rq.buf[i].size)
+			rq.buf[i].bytes = nil
+		}
+	}
+	rq.buffered = 0
+}
+
+// close marks the queue as closed but still drainable: read keeps returning
+// the frames which are already received in order, and only returns ErrClosed
+// once it reaches a missing frame.
 func (rq *receiveQueue) close() {
 	atomic.StoreUint32(&rq.closing, 1)
+	rq.closeOnce.Do(func() { close(rq.chClosed) })
 	abort := false
 
 	for {
@@ -280,3 +774,14 @@ func (rq *receiveQueue) close() {
 		}
 	}
 }
+
+// discard closes the queue for good, releasing the frames buffered. Read
+// returns ErrClosed right away afterwards, and the frames arriving later are
+// dropped.
+func (rq *receiveQueue) discard() {
+	rq.close()
+	rq.readLock.Lock()
+	atomic.StoreUint32(&rq.fullyClosed, 1)
+	rq.releaseBuffered()
+	rq.readLock.Unlock()
+}
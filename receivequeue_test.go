@@ -1,6 +1,8 @@
 package multipath
 
 import (
+	"bytes"
+	"io"
 	"testing"
 	"time"
 
@@ -88,3 +90,290 @@ func TestReadRXQEarlyClose(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestReceiveQueueResize(t *testing.T) {
+	q := newAdaptiveReceiveQueue(8, 4, 32)
+	shouldRead := func(s string) {
+		b := make([]byte, 1)
+		n, err := q.read(b)
+		assert.NoError(t, err)
+		assert.Equal(t, s, string(b[:n]))
+	}
+	addFrame := func(fn uint64) {
+		if assert.True(t, q.admit(fn), "frame %d should fit in the window", fn) {
+			q.add(&rxFrame{fn: fn, bytes: []byte{byte('a' + fn - minFrameNumber)}}, nil)
+		}
+	}
+
+	// a frame far beyond the end of the window grows the queue
+	assert.True(t, q.admit(minFrameNumber+20))
+	assert.EqualValues(t, 32, q.size)
+	assert.False(t, q.admit(minFrameNumber+32), "should not grow beyond the max")
+
+	// buffered frames are preserved though the resize
+	q = newAdaptiveReceiveQueue(8, 4, 32)
+	addFrame(minFrameNumber + 1)
+	addFrame(minFrameNumber + 5)
+	assert.EqualValues(t, 8, q.size)
+	addFrame(minFrameNumber + 7)
+	assert.EqualValues(t, 16, q.size)
+	for fn := minFrameNumber; fn < minFrameNumber+8; fn++ {
+		if fn != minFrameNumber+1 && fn != minFrameNumber+5 && fn != minFrameNumber+7 {
+			addFrame(fn)
+		}
+	}
+	for _, s := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		shouldRead(s)
+	}
+
+	// in order frames shrink the queue back, but not below the min
+	for fn := minFrameNumber + 8; fn < minFrameNumber+100; fn++ {
+		addFrame(fn)
+		shouldRead(string([]byte{byte('a' + fn - minFrameNumber)}))
+	}
+	assert.EqualValues(t, 4, q.size)
+
+	// a moderate reordering depth neither grows nor shrinks the queue
+	q = newAdaptiveReceiveQueue(16, 4, 32)
+	for fn := minFrameNumber; fn < minFrameNumber+100; fn += 5 {
+		for i := uint64(5); i > 0; i-- {
+			addFrame(fn + i - 1)
+		}
+		for i := uint64(0); i < 5; i++ {
+			shouldRead(string([]byte{byte('a' + fn + i - minFrameNumber)}))
+		}
+	}
+	assert.EqualValues(t, 16, q.size)
+}
+
+// frameStream generates data frames with increasing frame numbers.
+type frameStream struct {
+	payload []byte
+	fn      uint64
+	pending []byte
+	buf     [2*maxVarIntLength + 1024]byte
+}
+
+func (s *frameStream) Read(b []byte) (int, error) {
+	if len(s.pending) == 0 {
+		wb := bytes.NewBuffer(s.buf[:0])
+		WriteVarInt(wb, uint64(len(s.payload)))
+		WriteVarInt(wb, s.fn)
+		wb.Write(s.payload)
+		s.fn++
+		s.pending = wb.Bytes()
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func BenchmarkReceivePath(b *testing.B) {
+	bc := newMPConn(zeroCID, nil, defaultConfig())
+	defer bc.close()
+	sf := &subflow{to: "bench", mpc: bc, chClose: make(chan struct{}), sendQueue: make(chan *sendFrame, 64), tracker: NullTracker{}}
+	defer close(sf.chClose)
+	go func() {
+		for {
+			select {
+			case frame := <-sf.sendQueue:
+				frame.release()
+			case <-sf.chClose:
+				return
+			}
+		}
+	}()
+	ch := make(chan rxFrame)
+	go sf.readLoopFrames(ch, &byteReader{Reader: &frameStream{payload: make([]byte, 1024), fn: minFrameNumber}})
+	buf := make([]byte, 1024)
+	b.ReportAllocs()
+	b.SetBytes(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame := <-ch
+		bc.recvQueue.add(&frame, sf)
+		if _, err := io.ReadFull(bc, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHeadOfLineStats(t *testing.T) {
+	q := newReceiveQueue(16)
+	add := func(fn uint64) {
+		q.add(&rxFrame{fn: minFrameNumber + fn, bytes: []byte("a")}, nil)
+	}
+	add(0)
+	add(1)
+	assert.Equal(t, HOLStats{}, q.holStats(), "in order frames never stall")
+	add(3)
+	add(4)
+	time.Sleep(50 * time.Millisecond)
+	add(2)
+	stats := q.holStats()
+	assert.EqualValues(t, 1, stats.Stalls)
+	assert.GreaterOrEqual(t, int64(stats.Total), int64(50*time.Millisecond))
+	assert.Equal(t, stats.Total, stats.Longest)
+
+	// two gaps
+	add(6)
+	add(8)
+	add(5)
+	add(7)
+	stats = q.holStats()
+	assert.EqualValues(t, 3, stats.Stalls)
+	assert.Less(t, int64(stats.Longest), int64(stats.Total))
+}
+
+func TestLateFrames(t *testing.T) {
+	frame := func(fn uint64, s string) *rxFrame {
+		return &rxFrame{fn: minFrameNumber + fn, bytes: []byte(s)}
+	}
+	readAll := func(q *receiveQueue) string {
+		var all []byte
+		b := make([]byte, 10)
+		for {
+			n, err := q.read(b)
+			all = append(all, b[:n]...)
+			if err != nil {
+				assert.Equal(t, ErrClosed, err)
+				return string(all)
+			}
+		}
+	}
+
+	q := newReceiveQueue(10)
+	q.add(frame(0, "a"), nil)
+	q.close()
+	q.add(frame(1, "b"), nil)
+	q.add(frame(3, "d"), nil)
+	assert.Equal(t, "ab", readAll(q), "should accept late frames in order while draining")
+	assert.NotPanics(t, func() { q.add(frame(2, "c"), nil) })
+	assert.Equal(t, "", readAll(q), "should discard frames once drained")
+
+	q = newReceiveQueue(10)
+	q.discardLate = true
+	q.add(frame(0, "a"), nil)
+	q.close()
+	q.add(frame(1, "b"), nil)
+	assert.Equal(t, "a", readAll(q), "should discard late frames")
+
+	q = newReceiveQueue(10)
+	q.add(frame(0, "a"), nil)
+	q.discard()
+	q.add(frame(1, "b"), nil)
+	assert.Equal(t, "", readAll(q), "should discard everything after local close")
+
+	q = newReceiveQueue(2)
+	q.add(frame(0, "a"), nil)
+	q.add(frame(1, "b"), nil)
+	added := make(chan struct{})
+	go func() {
+		q.add(frame(2, "c"), nil)
+		close(added)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		assert.Fail(t, "adding to a full queue should not block after close")
+	}
+}
+
+func TestHighestDelivered(t *testing.T) {
+	q := newReceiveQueue(10)
+	bc := &mpConn{recvQueue: q}
+	assert.Zero(t, bc.HighestDelivered())
+	assert.False(t, bc.Delivered(minFrameNumber))
+	b := make([]byte, 10)
+	q.add(&rxFrame{fn: minFrameNumber, bytes: []byte("ab")}, nil)
+	q.add(&rxFrame{fn: minFrameNumber + 2, bytes: []byte("ef")}, nil)
+	_, err := q.read(b[:1])
+	assert.NoError(t, err)
+	assert.Zero(t, bc.HighestDelivered(), "should count the frames fully read only")
+	_, err = q.read(b)
+	assert.NoError(t, err)
+	assert.EqualValues(t, minFrameNumber, bc.HighestDelivered())
+	assert.True(t, bc.Delivered(minFrameNumber))
+	assert.False(t, bc.Delivered(minFrameNumber+2), "should wait for the frames before")
+
+	q.add(&rxFrame{fn: minFrameNumber + 1, bytes: []byte("cd")}, nil)
+	_, err = q.read(b)
+	assert.NoError(t, err)
+	assert.EqualValues(t, minFrameNumber+2, bc.HighestDelivered())
+	assert.True(t, bc.Delivered(minFrameNumber+1))
+	assert.False(t, bc.Delivered(minFrameNumber+3))
+}
+
+func TestSkipFrames(t *testing.T) {
+	frame := func(fn uint64, s string) *rxFrame {
+		return &rxFrame{fn: minFrameNumber + fn, bytes: []byte(s)}
+	}
+	b := make([]byte, 10)
+
+	q := newReceiveQueue(10)
+	q.add(frame(0, "a"), nil)
+	q.add(frame(2, "c"), nil)
+	q.skip(minFrameNumber + 1)
+	q.skip(minFrameNumber + 2)
+	n, err := q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ac", string(b[:n]), "should skip the frame given up on")
+	q.add(frame(1, "b"), nil)
+	q.add(frame(3, "d"), nil)
+	n, err = q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "d", string(b[:n]), "should drop the skipped frame arriving late")
+
+	q = newReceiveQueue(10)
+	q.gapTimeout = 50 * time.Millisecond
+	q.add(frame(1, "b"), nil)
+	q.add(frame(3, "d"), nil)
+	start := time.Now()
+	q.setReadDeadline(time.Now().Add(time.Second))
+	n, err = q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(b[:n]))
+	n, err = q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "d", string(b[:n]))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond, "should wait out each gap, took %v", elapsed)
+	assert.True(t, elapsed < time.Second, "should skip the gaps, took %v", elapsed)
+	assert.EqualValues(t, 2, q.holStats().Stalls)
+}
+
+func TestControlFrames(t *testing.T) {
+	var msgs []string
+	q := newReceiveQueue(10)
+	q.onControl = func(b []byte) { msgs = append(msgs, string(b)) }
+	q.add(&rxFrame{fn: minFrameNumber, bytes: []byte("a")}, nil)
+	q.add(&rxFrame{fn: minFrameNumber + 1, bytes: []byte("ctl"), control: true}, nil)
+	q.add(&rxFrame{fn: minFrameNumber + 1, bytes: []byte("ctl"), control: true}, nil)
+	q.add(&rxFrame{fn: minFrameNumber + 2, bytes: []byte("b")}, nil)
+	assert.Equal(t, []string{"ctl"}, msgs, "should hand over the control message once")
+	b := make([]byte, 10)
+	n, err := q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", string(b[:n]), "should skip the control frame when reading")
+}
+
+func TestInOrderFastPath(t *testing.T) {
+	q := newReceiveQueue(10)
+	q.add(&rxFrame{fn: minFrameNumber + 1, bytes: []byte("b"), inOrder: true}, nil)
+	assert.Zero(t, q.holStats().FastPathed, "should reorder the frame ahead of the next one")
+	q.add(&rxFrame{fn: minFrameNumber, bytes: []byte("a"), inOrder: true}, nil)
+	assert.EqualValues(t, 1, q.holStats().FastPathed, "should hand over the next frame right away")
+	q.add(&rxFrame{fn: minFrameNumber, bytes: []byte("a"), inOrder: true}, nil)
+	q.add(&rxFrame{fn: minFrameNumber + 2, bytes: []byte("c")}, nil)
+	b := make([]byte, 10)
+	n, err := q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(b[:n]))
+	q.add(&rxFrame{fn: minFrameNumber + 3, bytes: []byte("d"), inOrder: true}, nil)
+	n, err = q.read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "d", string(b[:n]))
+	assert.EqualValues(t, 2, q.holStats().FastPathed)
+}
@@ -0,0 +1,81 @@
+package multipath
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/ema"
+)
+
+// RTTEstimator estimates the RTT of a subflow from the samples taken as the
+// acks and pongs come back. The estimate drives the scheduling and the
+// retransmission timer of the subflow. It's only asked for an estimate once it
+// has been given a sample. It must be safe for concurrent use.
+type RTTEstimator interface {
+	AddSample(rtt time.Duration)
+	Estimate() time.Duration
+}
+
+// ewmaEstimator is the default RTTEstimator, an exponentially weighted moving
+// average of the samples.
+type ewmaEstimator struct {
+	*ema.EMA
+	sampled uint32
+}
+
+func newEWMAEstimator() *ewmaEstimator {
+	return &ewmaEstimator{EMA: ema.NewDuration(longRTT, rttAlpha)}
+}
+
+func (e *ewmaEstimator) AddSample(rtt time.Duration) {
+	if atomic.CompareAndSwapUint32(&e.sampled, 0, 1) {
+		// replace rather than average with the initial placeholder
+		e.SetDuration(rtt)
+		return
+	}
+	e.UpdateDuration(rtt)
+}
+
+func (e *ewmaEstimator) Estimate() time.Duration {
+	return e.GetDuration()
+}
+
+// recoveringEstimator guards a user supplied RTTEstimator. The default one is
+// fed the same samples, and takes over for good once the guarded one panics.
+type recoveringEstimator struct {
+	RTTEstimator
+	fallback *ewmaEstimator
+	failed   uint32 // accessed atomically
+}
+
+func (e *recoveringEstimator) AddSample(rtt time.Duration) {
+	e.fallback.AddSample(rtt)
+	if atomic.LoadUint32(&e.failed) == 1 {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e.fail(r)
+		}
+	}()
+	e.RTTEstimator.AddSample(rtt)
+}
+
+func (e *recoveringEstimator) Estimate() (rtt time.Duration) {
+	if atomic.LoadUint32(&e.failed) == 1 {
+		return e.fallback.Estimate()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e.fail(r)
+			rtt = e.fallback.Estimate()
+		}
+	}()
+	return e.RTTEstimator.Estimate()
+}
+
+func (e *recoveringEstimator) fail(r interface{}) {
+	if atomic.CompareAndSwapUint32(&e.failed, 0, 1) {
+		log.Errorf("RTT estimator panicked, falling back to the default one: %v", r)
+	}
+}
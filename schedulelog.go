@@ -0,0 +1,166 @@
+package multipath
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScheduleReason tells why the scheduler sent a data frame on a subflow.
+type ScheduleReason int
+
+const (
+	// ScheduledBest means the subflow had the earliest estimated delivery
+	// and room in its send queue.
+	ScheduledBest ScheduleReason = iota
+	// ScheduledNotFull means the subflows with earlier estimated delivery
+	// were busy writing, rate limited or had their send queue full, so the
+	// frame went to the best one with room.
+	ScheduledNotFull
+	// ScheduledRateLimited means all other subflows were busy, so the frame
+	// was queued on a rate limited one rather than waiting.
+	ScheduledRateLimited
+	// ScheduledAfterBlocking means no subflow had room at first, and the
+	// write waited for one to free up.
+	ScheduledAfterBlocking
+	// ScheduledRedundant means the frame is a copy sent by WithRedundancy or
+	// WriteRedundant.
+	ScheduledRedundant
+	// ScheduledFailover means the subflow is the active one of the failover
+	// mode.
+	ScheduledFailover
+	// ScheduledSaturated means the subflow with the lowest RTT was saturated
+	// in the AggregateWhenSaturated mode, so the frame went to the best of
+	// the others with room.
+	ScheduledSaturated
+	// ScheduledBuffered means the frame was buffered as the connection was
+	// degraded, see BufferWhenDegraded, and sent once the subflow had room.
+	ScheduledBuffered
+)
+
+func (r ScheduleReason) String() string {
+	switch r {
+	case ScheduledBest:
+		return "best"
+	case ScheduledNotFull:
+		return "not full"
+	case ScheduledRateLimited:
+		return "rate limited"
+	case ScheduledAfterBlocking:
+		return "after blocking"
+	case ScheduledRedundant:
+		return "redundant"
+	case ScheduledFailover:
+		return "failover"
+	case ScheduledSaturated:
+		return "saturated"
+	case ScheduledBuffered:
+		return "buffered"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// ScheduleDecision records the subflow a data frame was sent on and why.
+type ScheduleDecision struct {
+	At time.Time
+	// FN is the frame number.
+	FN uint64
+	// To is the label of the subflow.
+	To     string
+	Reason ScheduleReason
+}
+
+// scheduleLog keeps the recent scheduling decisions in a ring buffer.
+type scheduleLog struct {
+	mu   sync.Mutex
+	ring []ScheduleDecision
+	next int
+	full bool
+}
+
+func newScheduleLog(depth int) *scheduleLog {
+	return &scheduleLog{ring: make([]ScheduleDecision, depth)}
+}
+
+func (l *scheduleLog) add(fn uint64, sf *subflow, reason ScheduleReason) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.ring[l.next] = ScheduleDecision{At: time.Now(), FN: fn, To: sf.to, Reason: reason}
+	l.next = (l.next + 1) % len(l.ring)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// decisions returns a copy of the decisions, oldest first.
+func (l *scheduleLog) decisions() []ScheduleDecision {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]ScheduleDecision(nil), l.ring[:l.next]...)
+	}
+	return append(append([]ScheduleDecision(nil), l.ring[l.next:]...), l.ring[:l.next]...)
+}
+
+func (bc *mpConn) RecentSchedules() []ScheduleDecision {
+	return bc.scheduleLog.decisions()
+}
+
+// scheduled records that the data frame was queued on sf for reason.
+func (bc *mpConn) scheduled(frame *sendFrame, sf *subflow, reason ScheduleReason) {
+	bc.scheduleLog.add(frame.fn, sf, reason)
+	if reason == ScheduledBest {
+		atomic.AddUint64(&bc.scheduledBest, 1)
+		// an RTO after its first timeout, which is detected at the next
+		// evaluation, whatever the jitter drawn once it's written
+		window := 2*sf.retransTimer() + retransmitEvalInterval + bc.cfg.retransmitJitter
+		atomic.StoreInt64(&frame.missBefore, time.Now().Add(window).UnixNano())
+	}
+}
+
+// checkScheduleMiss counts the frame about to be retransmitted as a
+// scheduling miss if it was sent on the best subflow and is given up on there,
+// timed out or stranded, within an RTO of its first timeout. Later
+// retransmissions tell more about an outage than about the guess, and pausing
+// a subflow is no guess at all.
+func (bc *mpConn) checkScheduleMiss(frame *sendFrame, reason RetransmitReason) {
+	before := atomic.SwapInt64(&frame.missBefore, 0)
+	if before != 0 && reason != RetransmitSubflowPaused && time.Now().UnixNano() < before {
+		atomic.AddUint64(&bc.scheduleMisses, 1)
+	}
+}
+
+// SchedulingStats quantify the accuracy of the scheduler, i.e. how often the
+// subflow with the earliest estimated delivery didn't deliver the frame sent
+// on it. Comparing the miss rates tells how the scheduling options fare on
+// the same paths.
+type SchedulingStats struct {
+	// Best is the number of data frames sent on the subflow the scheduler
+	// picked as the best, see ScheduledBest.
+	Best uint64
+	// Misses is the number of them which had to be retransmitted within
+	// an RTO of their first timeout, i.e. which timed out on their first
+	// RTO or were stranded by their subflow failing.
+	Misses uint64
+	// MissRate is Misses as a fraction of Best, zero if none was sent.
+	MissRate float64
+}
+
+func (bc *mpConn) Scheduling() SchedulingStats {
+	stats := SchedulingStats{
+		Best:   atomic.LoadUint64(&bc.scheduledBest),
+		Misses: atomic.LoadUint64(&bc.scheduleMisses),
+	}
+	if stats.Best > 0 {
+		stats.MissRate = float64(stats.Misses) / float64(stats.Best)
+	}
+	return stats
+}
@@ -0,0 +1,230 @@
+package multipath
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pooledWriteStall is how long a worker of a SendPool waits for a write
+// before handing its subflow off to a goroutine of its own.
+const pooledWriteStall = 20 * time.Millisecond
+
+// SendPool is a fixed set of goroutines writing the frames queued on the
+// subflows of all the connections sharing it, instead of a goroutine per
+// subflow, see WithSendPool. It cuts the goroutines of a server with many
+// connections, at the cost of some latency: a subflow wakes its worker up
+// each time a frame is queued, which is slower than a goroutine of its own
+// waiting on the queue, and the worker writes a frame at a time, so a subflow
+// writing a large frame delays the others on the same worker. A subflow is
+// assigned to the worker with the fewest subflows when it's added, and gets a
+// goroutine of its own again to drain its queue once closing.
+//
+// A write which doesn't complete within pooledWriteStall, e.g. as the peer
+// stops reading or the subflow is held back by its rate limit, leaves the
+// subflow to the goroutine writing it, which keeps sending for it alone from
+// then on, while the worker carries on with a new goroutine. So a subflow
+// stalling delays the others on its worker by up to pooledWriteStall once,
+// rather than for as long as it stalls.
+type SendPool struct {
+	workers  []*sendWorker
+	chClosed chan struct{}
+	// closeOnce guards chClosed
+	closeOnce sync.Once
+}
+
+type sendWorker struct {
+	pool   *SendPool
+	mu     sync.Mutex
+	closed bool
+	// assigned are the subflows the worker writes for, and ready those of
+	// them having something queued since last served.
+	assigned map[*subflow]bool
+	ready    []*subflow
+	chWake   chan struct{}
+	// writing is the subflow being written by the worker, since
+	// writeStarted, nil if none.
+	writing      *subflow
+	writeStarted time.Time
+	// stallTimer hands writing off once stalled.
+	stallTimer *time.Timer
+	// subflows is the number of subflows assigned to the worker, to balance
+	// them without taking the lock of each. Accessed atomically.
+	subflows int32
+}
+
+// NewSendPool starts a SendPool of the given number of workers, at least one.
+// Pass it to the connections to share with WithSendPool.
+func NewSendPool(workers int) *SendPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &SendPool{chClosed: make(chan struct{})}
+	for i := 0; i < workers; i++ {
+		w := &sendWorker{
+			pool:     p,
+			assigned: make(map[*subflow]bool),
+			chWake:   make(chan struct{}, 1),
+		}
+		w.stallTimer = time.AfterFunc(time.Hour, w.handOff)
+		w.stallTimer.Stop()
+		p.workers = append(p.workers, w)
+		go w.run()
+	}
+	return p
+}
+
+// Close stops the workers. The subflows assigned to them, and those added
+// later, get a goroutine of their own.
+func (p *SendPool) Close() {
+	p.closeOnce.Do(func() { close(p.chClosed) })
+}
+
+// add assigns the subflow to the least loaded worker. It has to be called
+// before anything is queued on the subflow.
+func (p *SendPool) add(sf *subflow) {
+	w := p.workers[0]
+	for _, candidate := range p.workers[1:] {
+		if atomic.LoadInt32(&candidate.subflows) < atomic.LoadInt32(&w.subflows) {
+			w = candidate
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		go sf.sendLoop()
+		return
+	}
+	sf.sendWorker = w
+	w.assigned[sf] = true
+	atomic.AddInt32(&w.subflows, 1)
+}
+
+// wake marks the subflow as having something to send, or as closing.
+func (w *sendWorker) wake(sf *subflow) {
+	w.mu.Lock()
+	if w.assigned[sf] && !sf.sendReady {
+		sf.sendReady = true
+		w.ready = append(w.ready, sf)
+	}
+	w.mu.Unlock()
+	select {
+	case w.chWake <- struct{}{}:
+	default:
+	}
+}
+
+// remove stops serving the subflow.
+func (w *sendWorker) remove(sf *subflow) {
+	w.mu.Lock()
+	assigned := w.assigned[sf]
+	delete(w.assigned, sf)
+	w.mu.Unlock()
+	if assigned {
+		atomic.AddInt32(&w.subflows, -1)
+	}
+}
+
+func (w *sendWorker) run() {
+	for {
+		select {
+		case <-w.chWake:
+		case <-w.pool.chClosed:
+			w.mu.Lock()
+			w.closed = true
+			for sf := range w.assigned {
+				go sf.sendLoop()
+			}
+			w.assigned = nil
+			w.mu.Unlock()
+			return
+		}
+		for {
+			w.mu.Lock()
+			if len(w.ready) == 0 {
+				w.mu.Unlock()
+				break
+			}
+			sf := w.ready[0]
+			w.ready[0] = nil
+			w.ready = w.ready[1:]
+			sf.sendReady = false
+			w.mu.Unlock()
+			if !w.serve(sf) {
+				return
+			}
+		}
+	}
+}
+
+// serve writes a frame of the subflow if one is queued, a frame queued
+// meanwhile waking the worker up again. It returns false if the write stalled
+// and the subflow was handed off, after which the calling goroutine sends for
+// it alone until it closes, and is no longer the worker's.
+func (w *sendWorker) serve(sf *subflow) bool {
+	select {
+	case <-sf.chClose:
+		// drain the queue on its own like any subflow closing
+		w.remove(sf)
+		go sf.sendLoop()
+		return true
+	default:
+	}
+	select {
+	case frame := <-sf.sendQueue:
+		w.mu.Lock()
+		w.writing, w.writeStarted = sf, time.Now()
+		w.mu.Unlock()
+		w.stallTimer.Reset(pooledWriteStall)
+		ok := sf.writeQueued(frame)
+		w.stallTimer.Stop()
+		w.mu.Lock()
+		handedOff := w.writing != sf
+		w.writing = nil
+		w.mu.Unlock()
+		switch {
+		case handedOff && !ok:
+			sf.close()
+			sf.sendLoopDone()
+			return false
+		case handedOff:
+			sf.sendLoop()
+			return false
+		case !ok:
+			w.remove(sf)
+			go func() {
+				sf.close()
+				sf.sendLoopDone()
+			}()
+		}
+	default:
+	}
+	return true
+}
+
+// handOff leaves the subflow being written for too long to the goroutine
+// writing it, and starts a new one for the worker. It's called by stallTimer,
+// which may fire late, after the stalled write is done.
+func (w *sendWorker) handOff() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sf := w.writing
+	if sf == nil || w.closed || time.Since(w.writeStarted) < pooledWriteStall {
+		return
+	}
+	log.Debugf("write to %s stalled, sending on its own goroutine", sf.to)
+	w.writing = nil
+	delete(w.assigned, sf)
+	atomic.AddInt32(&w.subflows, -1)
+	for i, ready := range w.ready {
+		if ready == sf {
+			w.ready = append(w.ready[:i], w.ready[i+1:]...)
+			break
+		}
+	}
+	go w.run()
+	select {
+	case w.chWake <- struct{}{}:
+	default:
+	}
+}
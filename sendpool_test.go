@@ -0,0 +1,135 @@
+package multipath
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendPool(t *testing.T) {
+	pool := NewSendPool(2)
+	defer pool.Close()
+	assigned := func() int32 {
+		return atomic.LoadInt32(&pool.workers[0].subflows) + atomic.LoadInt32(&pool.workers[1].subflows)
+	}
+	client, server, _ := newTestConnPair(t, 2, WithSendPool(pool))
+	assert.Eventually(t, func() bool { return assigned() == 4 }, time.Second, 10*time.Millisecond, "should put the subflows of both ends on the pool")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&pool.workers[0].subflows), "should spread the subflows over the workers")
+	echo(t, client, server, 100)
+
+	client.Close()
+	server.Close()
+	assert.Eventually(t, func() bool { return assigned() == 0 }, 5*time.Second, 10*time.Millisecond, "should let go of the closed subflows")
+
+	client, server, _ = newTestConnPair(t, 2, WithSendPool(pool))
+	echo(t, client, server, 10)
+	pool.Close()
+	echo(t, client, server, 10)
+	client2, server2, _ := newTestConnPair(t, 1, WithSendPool(pool))
+	echo(t, client2, server2, 10)
+}
+
+func TestSendPoolStalledSubflow(t *testing.T) {
+	pool := NewSendPool(1)
+	defer pool.Close()
+	w := pool.workers[0]
+	var stalled int32
+	wrap := func(c net.Conn) net.Conn { return &stallingConn{c, &stalled} }
+	client, server, _ := newAsymmetricTestConnPair(t, 1, wrap, []Option{WithSendPool(pool)}, nil)
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&w.subflows) == 1 }, time.Second, 10*time.Millisecond)
+
+	// the peer stops reading, so the write blocks
+	atomic.StoreInt32(&stalled, 1)
+	_, err := client.Write([]byte{0})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&w.subflows) == 0 }, time.Second, 10*time.Millisecond, "should hand the stalled subflow off")
+
+	client2, server2, _ := newAsymmetricTestConnPair(t, 1, nil, []Option{WithSendPool(pool)}, nil)
+	defer client2.Close()
+	defer server2.Close()
+	echo(t, client2, server2, 10)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&w.subflows), "should keep serving the other subflows")
+
+	atomic.StoreInt32(&stalled, 0)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, make([]byte, 1))
+	assert.NoError(t, err, "should send the stalled frame once the peer reads again")
+	server.SetReadDeadline(time.Time{})
+	echo(t, client, server, 10)
+}
+
+// echo writes n frames from client to server and back.
+func echo(t testing.TB, client, server net.Conn, n int) {
+	go func() {
+		b := make([]byte, 1)
+		for i := 0; i < n; i++ {
+			if _, err := io.ReadFull(server, b); err != nil {
+				return
+			}
+			server.Write(b)
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer client.SetReadDeadline(time.Time{})
+	b := make([]byte, 1)
+	for i := 0; i < n; i++ {
+		_, err := client.Write([]byte{byte(i)})
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.ReadFull(client, b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, byte(i), b[0])
+	}
+}
+
+// BenchmarkSendLoop compares the goroutines and the throughput of many
+// connections with a goroutine per subflow and with a shared send pool.
+func BenchmarkSendLoop(b *testing.B) {
+	const conns = 50
+	for _, bench := range []struct {
+		name string
+		opts func() ([]Option, func())
+	}{
+		{"per subflow", func() ([]Option, func()) { return nil, func() {} }},
+		{"pool", func() ([]Option, func()) {
+			pool := NewSendPool(runtime.GOMAXPROCS(0))
+			return []Option{WithSendPool(pool)}, pool.Close
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			opts, done := bench.opts()
+			defer done()
+			before := runtime.NumGoroutine()
+			var clients []net.Conn
+			for i := 0; i < conns; i++ {
+				client, server, _ := newTestConnPair(b, 2, opts...)
+				clients = append(clients, client)
+				go io.Copy(io.Discard, server)
+			}
+			goroutines := runtime.NumGoroutine() - before
+			payload := make([]byte, 1024)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := clients[i%conns].Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(goroutines)/conns, "goroutines/conn")
+			for _, client := range clients {
+				client.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,590 @@
+package multipath
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSharedChunk is the largest payload of a chunk, so that a large
+	// frame of one path doesn't hold the shared transport for long.
+	maxSharedChunk = 16 * 1024
+	// sharedPathBacklog is the number of chunks buffered for each path, which
+	// is also the number of chunks the peer may send to a path before it's
+	// allowed more.
+	sharedPathBacklog = 64
+	// sharedCreditBatch is the number of chunks read from a path before the
+	// peer is allowed to send as many more.
+	sharedCreditBatch = sharedPathBacklog / 4
+	// sharedControlID is the path ID of the chunks carrying the credits
+	// granted, which is never opened by either side.
+	sharedControlID = 0
+	// sharedAcceptBacklog is the number of paths opened by the peer waiting
+	// to be accepted, beyond which new ones are rejected.
+	sharedAcceptBacklog = 16
+	// sharedMaxPeerPaths is the number of paths opened by the peer which can
+	// be open at once, accepted or not, beyond which new ones are rejected.
+	sharedMaxPeerPaths = 1024
+)
+
+// SharedTransport carries multiple subflows, possibly of different
+// connections, over a single underlying connection, e.g. a QUIC connection or
+// a UDP flow already made reliable, each being a logical path of its own. The
+// byte stream of each path is split into chunks in the following form, a zero
+// length meaning the path is closed.
+//
+//	 ---------------------------------------------
+//	|  path ID (1-8)  |  length (1-8)  |  bytes  |
+//	 ---------------------------------------------
+//
+// A path may have at most sharedPathBacklog chunks sent and not read yet by
+// the peer, which allows more as it reads them, in a chunk of path ID zero:
+//
+//	 ---------------------------------------------------------
+//	|  0  |  length (1-8)  |  path ID (1-8)  |  chunks (1-8)  |
+//	 ---------------------------------------------------------
+//
+// Each path starts with the version and the CID like any subflow, which is
+// how the listener routes it to its connection, and as a subflow of its own,
+// it has its RTT and losses tracked separately from the other paths.
+//
+// Threading model: a single goroutine per SharedTransport reads the underlying
+// connection and demuxes the chunks to their paths. It never waits for a path
+// to be read, which would hold back all the others, e.g. when a subflow stops
+// reading as the application doesn't read its connection. Instead, each path
+// buffers the chunks its peer is allowed to send, and a write to a path waits
+// for the peer to grant more once it has as many chunks in flight. A peer
+// sending more than allowed gets the path closed. The writes of all paths are
+// serialized, each chunk being written in a single call, so they never
+// interleave. A write failing halfway corrupts the shared stream, upon which
+// the underlying connection and all paths are closed.
+//
+// The side dialing opens paths with Dialer, while the other side accepts them
+// by passing the SharedTransport as a net.Listener to NewListener. The paths
+// opened by the peer beyond sharedAcceptBacklog waiting to be accepted, or
+// sharedMaxPeerPaths open, are rejected by closing them right away.
+type SharedTransport struct {
+	conn net.Conn
+	// nextID is the ID of the next path to open. The initiator opens the
+	// odd IDs and the other side the even ones, so they never collide.
+	nextID uint64
+	// paths are kept until closed by both sides, so that the late chunks to
+	// those closed locally are not taken as new paths.
+	paths map[uint64]*sharedPath
+	// peerPaths is the number of paths opened by the peer in paths.
+	peerPaths int
+	// rejected are the paths opened by the peer which were closed right
+	// away, until the peer closes them too, so that their late chunks are
+	// dropped rather than taken as new paths. They are not kept in paths
+	// not to hold their buffers.
+	rejected map[uint64]struct{}
+	mu       sync.Mutex
+	// chWrite is held while writing a chunk.
+	chWrite   chan struct{}
+	chAccept  chan *sharedPath
+	chClose   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSharedTransport starts demuxing conn. One end has to be the initiator
+// and the other not.
+func NewSharedTransport(conn net.Conn, initiator bool) *SharedTransport {
+	t := &SharedTransport{
+		conn:     conn,
+		nextID:   2,
+		paths:    make(map[uint64]*sharedPath),
+		rejected: make(map[uint64]struct{}),
+		chWrite:  make(chan struct{}, 1),
+		chAccept: make(chan *sharedPath, sharedAcceptBacklog),
+		chClose:  make(chan struct{}),
+	}
+	if initiator {
+		t.nextID = 1
+	}
+	go t.demux()
+	return t
+}
+
+// Open opens a new path to the peer.
+func (t *SharedTransport) Open() (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.chClose:
+		return nil, net.ErrClosed
+	default:
+	}
+	p := t.newPath(t.nextID)
+	t.nextID += 2
+	return p, nil
+}
+
+// Dialer returns a subflow Dialer opening a new path each time it dials.
+func (t *SharedTransport) Dialer(label string) Dialer {
+	return &sharedDialer{t: t, label: label}
+}
+
+// Accept waits for the next path opened by the peer.
+func (t *SharedTransport) Accept() (net.Conn, error) {
+	select {
+	case p := <-t.chAccept:
+		return p, nil
+	case <-t.chClose:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the local address of the underlying connection.
+func (t *SharedTransport) Addr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// Close closes the underlying connection along with all paths.
+func (t *SharedTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.chClose)
+		err = t.conn.Close()
+		t.mu.Lock()
+		for _, p := range t.paths {
+			p.closeRemote()
+		}
+		t.mu.Unlock()
+	})
+	return err
+}
+
+// newPath must be called with mu held.
+func (t *SharedTransport) newPath(id uint64) *sharedPath {
+	p := &sharedPath{
+		t:              t,
+		id:             id,
+		chunks:         make(chan []byte, sharedPathBacklog),
+		credit:         sharedPathBacklog,
+		chCredit:       make(chan struct{}, 1),
+		chRemoteClosed: make(chan struct{}),
+		chClosed:       make(chan struct{}),
+		readDeadline:   newDeadline(),
+		writeDeadline:  newDeadline(),
+	}
+	t.paths[id] = p
+	return p
+}
+
+func (t *SharedTransport) demux() {
+	defer t.Close()
+	r := bufio.NewReader(t.conn)
+	for {
+		id, err := ReadVarInt(r)
+		if err != nil {
+			return
+		}
+		sz, err := ReadVarInt(r)
+		if err != nil {
+			return
+		}
+		if sz > maxSharedChunk || (id == sharedControlID && sz == 0) {
+			log.Errorf("chunk of size %v on path %d is impossible", sz, id)
+			return
+		}
+		var b []byte
+		if sz > 0 {
+			b = make([]byte, sz)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+		}
+		if id == sharedControlID {
+			if !t.gotCredit(b) {
+				return
+			}
+			continue
+		}
+		p := t.pathFor(id, sz > 0)
+		if p == nil {
+			continue
+		}
+		if sz == 0 {
+			p.closeRemote()
+			t.forgetIfDone(p)
+			continue
+		}
+		if isClosed(p.chClosed) {
+			// closed locally, nobody is going to read it
+			continue
+		}
+		select {
+		case p.chunks <- b:
+		default:
+			log.Errorf("peer sent more chunks to path %d than granted, closing it", id)
+			go p.Close()
+		}
+	}
+}
+
+// gotCredit grants the path the chunks of the control chunk b, telling if b is
+// well formed.
+func (t *SharedTransport) gotCredit(b []byte) bool {
+	r := bytes.NewReader(b)
+	id, err := ReadVarInt(r)
+	if err != nil {
+		return false
+	}
+	chunks, err := ReadVarInt(r)
+	if err != nil || chunks > sharedPathBacklog {
+		return false
+	}
+	t.mu.Lock()
+	p := t.paths[id]
+	t.mu.Unlock()
+	if p != nil {
+		p.addCredit(int(chunks))
+	}
+	return true
+}
+
+// pathFor returns the path id, creating it if it's a new one opened by the
+// peer and create is true, unless it's rejected. It returns nil for the chunks
+// to the paths already closed by both sides or rejected, and forgets the
+// rejected path once the peer closes it.
+func (t *SharedTransport) pathFor(id uint64, create bool) *sharedPath {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p := t.paths[id]; p != nil {
+		return p
+	}
+	if _, rejected := t.rejected[id]; rejected {
+		if !create {
+			delete(t.rejected, id)
+		}
+		return nil
+	}
+	if !create || !t.openedByPeer(id) {
+		return nil
+	}
+	// only demux sends to chAccept, so it can't fill up in between
+	if len(t.chAccept) == cap(t.chAccept) || t.peerPaths >= sharedMaxPeerPaths {
+		log.Debugf("too many paths opened by the peer, rejecting path %d", id)
+		t.rejected[id] = struct{}{}
+		go t.writeChunk(id, nil, newDeadline())
+		return nil
+	}
+	p := t.newPath(id)
+	t.peerPaths++
+	t.chAccept <- p
+	return p
+}
+
+func (t *SharedTransport) openedByPeer(id uint64) bool {
+	return id%2 != t.nextID%2
+}
+
+// forgetIfDone forgets the path once closed by both sides.
+func (t *SharedTransport) forgetIfDone(p *sharedPath) {
+	if !isClosed(p.chClosed) || !isClosed(p.chRemoteClosed) {
+		return
+	}
+	t.mu.Lock()
+	if t.paths[p.id] == p {
+		delete(t.paths, p.id)
+		if t.openedByPeer(p.id) {
+			t.peerPaths--
+		}
+	}
+	t.mu.Unlock()
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeChunk writes b as a single chunk of path id. A zero length b closes
+// the path.
+func (t *SharedTransport) writeChunk(id uint64, b []byte, deadline *deadline) error {
+	select {
+	case t.chWrite <- struct{}{}:
+	case <-deadline.wait():
+		return os.ErrDeadlineExceeded
+	case <-t.chClose:
+		return net.ErrClosed
+	}
+	defer func() { <-t.chWrite }()
+	buf := bytes.NewBuffer(make([]byte, 0, maxVarIntLength*2+len(b)))
+	WriteVarInt(buf, id)
+	WriteVarInt(buf, uint64(len(b)))
+	buf.Write(b)
+	t.conn.SetWriteDeadline(deadline.get())
+	n, err := t.conn.Write(buf.Bytes())
+	t.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		if n == 0 && os.IsTimeout(err) {
+			return err
+		}
+		// the chunk may be cut short, nothing after it could be demuxed
+		t.Close()
+	}
+	return err
+}
+
+type sharedDialer struct {
+	t     *SharedTransport
+	label string
+}
+
+func (d *sharedDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.t.Open()
+}
+
+func (d *sharedDialer) Label() string {
+	return d.label
+}
+
+// sharedPath is a logical path of a SharedTransport.
+type sharedPath struct {
+	t  *SharedTransport
+	id uint64
+	// chunks are the chunks received but not read yet, the first of which
+	// may be partially read into pending.
+	chunks  chan []byte
+	pending []byte
+	// taken is the number of chunks read from chunks since the peer was
+	// last granted more.
+	taken  int
+	muRead sync.Mutex
+	// credit is the number of chunks which can be sent before the peer
+	// grants more, signaled on chCredit.
+	credit   int
+	muCredit sync.Mutex
+	chCredit chan struct{}
+	// chRemoteClosed is closed once the peer closed the path, after the
+	// last chunk is put in chunks.
+	chRemoteClosed  chan struct{}
+	remoteCloseOnce sync.Once
+	chClosed        chan struct{}
+	closeOnce       sync.Once
+	readDeadline    *deadline
+	writeDeadline   *deadline
+}
+
+func (p *sharedPath) Read(b []byte) (int, error) {
+	p.muRead.Lock()
+	defer p.muRead.Unlock()
+	if len(p.pending) == 0 {
+		select {
+		case <-p.chClosed:
+			return 0, net.ErrClosed
+		default:
+		}
+		select {
+		case p.pending = <-p.chunks:
+		case <-p.chRemoteClosed:
+			// the chunks put before the close come first
+			select {
+			case p.pending = <-p.chunks:
+			default:
+				return 0, io.EOF
+			}
+		case <-p.chClosed:
+			return 0, net.ErrClosed
+		case <-p.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.taken++
+		if p.taken == sharedCreditBatch {
+			p.taken = 0
+			p.grant(sharedCreditBatch)
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *sharedPath) Write(b []byte) (int, error) {
+	select {
+	case <-p.chClosed:
+		return 0, net.ErrClosed
+	case <-p.chRemoteClosed:
+		return 0, net.ErrClosed
+	default:
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > maxSharedChunk {
+			chunk = chunk[:maxSharedChunk]
+		}
+		if err := p.takeCredit(); err != nil {
+			return written, err
+		}
+		if err := p.t.writeChunk(p.id, chunk, p.writeDeadline); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// takeCredit waits until the peer allows one more chunk and takes it.
+func (p *sharedPath) takeCredit() error {
+	for {
+		p.muCredit.Lock()
+		if p.credit > 0 {
+			p.credit--
+			if p.credit > 0 {
+				// let the next concurrent write in
+				p.signalCredit()
+			}
+			p.muCredit.Unlock()
+			return nil
+		}
+		p.muCredit.Unlock()
+		select {
+		case <-p.chCredit:
+		case <-p.chClosed:
+			return net.ErrClosed
+		case <-p.chRemoteClosed:
+			return net.ErrClosed
+		case <-p.writeDeadline.wait():
+			return os.ErrDeadlineExceeded
+		case <-p.t.chClose:
+			return net.ErrClosed
+		}
+	}
+}
+
+// addCredit allows chunks more chunks to be sent.
+func (p *sharedPath) addCredit(chunks int) {
+	p.muCredit.Lock()
+	p.credit += chunks
+	p.signalCredit()
+	p.muCredit.Unlock()
+}
+
+func (p *sharedPath) signalCredit() {
+	select {
+	case p.chCredit <- struct{}{}:
+	default:
+	}
+}
+
+// grant lets the peer send chunks more chunks to the path.
+func (p *sharedPath) grant(chunks int) {
+	buf := bytes.NewBuffer(make([]byte, 0, maxVarIntLength*2))
+	WriteVarInt(buf, p.id)
+	WriteVarInt(buf, uint64(chunks))
+	p.t.writeChunk(sharedControlID, buf.Bytes(), newDeadline())
+}
+
+// Close closes the path, letting the peer know. Each side sends the close
+// once, after which the chunks it receives to the path are dropped.
+func (p *sharedPath) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.chClosed)
+		p.t.writeChunk(p.id, nil, newDeadline())
+		p.t.forgetIfDone(p)
+	})
+	return nil
+}
+
+// closeRemote marks the path as closed by the peer.
+func (p *sharedPath) closeRemote() {
+	p.remoteCloseOnce.Do(func() { close(p.chRemoteClosed) })
+}
+
+func (p *sharedPath) LocalAddr() net.Addr {
+	return p.t.conn.LocalAddr()
+}
+
+func (p *sharedPath) RemoteAddr() net.Addr {
+	return p.t.conn.RemoteAddr()
+}
+
+func (p *sharedPath) SetDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	p.writeDeadline.set(t)
+	return nil
+}
+
+func (p *sharedPath) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+func (p *sharedPath) SetWriteDeadline(t time.Time) error {
+	p.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a deadline which can be waited for, like the one of net.Pipe.
+type deadline struct {
+	mu    sync.Mutex
+	t     time.Time
+	timer *time.Timer
+	// chExceeded is closed once the deadline is exceeded.
+	chExceeded chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{chExceeded: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// wait for the timer to close the channel
+		<-d.chExceeded
+	}
+	d.timer = nil
+	d.t = t
+	exceeded := false
+	select {
+	case <-d.chExceeded:
+		exceeded = true
+	default:
+	}
+	if t.IsZero() {
+		if exceeded {
+			d.chExceeded = make(chan struct{})
+		}
+		return
+	}
+	if ttl := time.Until(t); ttl > 0 {
+		if exceeded {
+			d.chExceeded = make(chan struct{})
+		}
+		ch := d.chExceeded
+		d.timer = time.AfterFunc(ttl, func() { close(ch) })
+		return
+	}
+	if !exceeded {
+		close(d.chExceeded)
+	}
+}
+
+func (d *deadline) get() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.chExceeded
+}
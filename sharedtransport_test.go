@@ -0,0 +1,284 @@
+package multipath
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSharedTransportPair(t *testing.T) (*SharedTransport, *SharedTransport) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer l.Close()
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if assert.NoError(t, err) {
+			chAccepted <- conn
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return NewSharedTransport(conn, true), NewSharedTransport(<-chAccepted, false)
+}
+
+func TestSharedTransport(t *testing.T) {
+	client, server := newSharedTransportPair(t)
+	defer client.Close()
+	bl := NewListener([]net.Listener{server}, []StatsTracker{NullTracker{}})
+	defer bl.Close()
+	chAccepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := bl.Accept()
+			if err != nil {
+				return
+			}
+			chAccepted <- conn
+		}
+	}()
+
+	// two connections of two subflows each, all over the same transport
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		dialers := []Dialer{client.Dialer("shared #0"), client.Dialer("shared #1")}
+		conn, err := NewDialer("endpoint", dialers).DialContext(context.Background())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		assert.Eventually(t, func() bool { return len(conn.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		_, err := conn.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+		accepted := <-chAccepted
+		defer accepted.Close()
+		b := make([]byte, 1)
+		_, err = io.ReadFull(accepted, b)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, b, "should route the frames by the connection")
+		_, err = accepted.Write([]byte("pong"))
+		assert.NoError(t, err)
+		b = make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(b))
+	}
+}
+
+func TestSharedTransportStalledPath(t *testing.T) {
+	client, server := newSharedTransportPair(t)
+	defer client.Close()
+	chPaths := make(chan net.Conn, 1)
+	bl := NewListener([]net.Listener{&stallingListener{server, chPaths}}, []StatsTracker{NullTracker{}})
+	defer bl.Close()
+	chAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := bl.Accept()
+		if assert.NoError(t, err) {
+			chAccepted <- conn
+		}
+	}()
+
+	// nobody ever reads the first path, e.g. as it's a subflow whose
+	// connection is not read by the application
+	stalled, err := client.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stalled.Close()
+	var written int64
+	go func() {
+		b := make([]byte, maxSharedChunk)
+		for {
+			if _, err := stalled.Write(b); err != nil {
+				return
+			}
+			atomic.AddInt64(&written, int64(len(b)))
+		}
+	}()
+	unread := <-chPaths
+	defer unread.Close()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&written) >= maxSharedChunk*sharedPathBacklog
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, maxSharedChunk*sharedPathBacklog, atomic.LoadInt64(&written), "should stop writing to the path once its backlog is full")
+
+	conn, err := NewDialer("endpoint", []Dialer{client.Dialer("shared")}).DialContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	accepted := <-chAccepted
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(accepted, b)
+	assert.NoError(t, err, "should keep demuxing the other paths")
+	assert.Equal(t, "ping", string(b))
+	_, err = accepted.Write([]byte("pong"))
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(b))
+
+	// reading the path lets the writes through again
+	go io.Copy(io.Discard, unread)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&written) > maxSharedChunk*sharedPathBacklog
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// stallingListener hands the first path accepted to chPaths rather than to
+// the listener, which never reads it.
+type stallingListener struct {
+	*SharedTransport
+	chPaths chan net.Conn
+}
+
+func (l *stallingListener) Accept() (net.Conn, error) {
+	conn, err := l.SharedTransport.Accept()
+	if err == nil && len(l.chPaths) == 0 && cap(l.chPaths) > 0 {
+		l.chPaths <- conn
+		l.chPaths = nil
+		return l.SharedTransport.Accept()
+	}
+	return conn, err
+}
+
+func TestSharedTransportRejectsPaths(t *testing.T) {
+	client, server := newSharedTransportPair(t)
+	defer client.Close()
+	defer server.Close()
+	open := func() net.Conn {
+		p, err := client.Open()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_, err = p.Write([]byte{0})
+		assert.NoError(t, err)
+		return p
+	}
+	counts := func() (paths, peerPaths, rejected int) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.paths), server.peerPaths, len(server.rejected)
+	}
+	rejectedByServer := func(p net.Conn) bool {
+		return isClosed(p.(*sharedPath).chRemoteClosed)
+	}
+
+	// nobody accepts the paths yet
+	var opened []net.Conn
+	for i := 0; i < sharedAcceptBacklog+2; i++ {
+		opened = append(opened, open())
+	}
+	for _, p := range opened[sharedAcceptBacklog:] {
+		assert.Eventually(t, func() bool { return rejectedByServer(p) }, time.Second, 10*time.Millisecond)
+	}
+	paths, peerPaths, rejected := counts()
+	assert.Equal(t, sharedAcceptBacklog, paths, "should not keep the paths rejected")
+	assert.Equal(t, sharedAcceptBacklog, peerPaths)
+	assert.Equal(t, 2, rejected)
+	for _, p := range opened[sharedAcceptBacklog:] {
+		p.Close()
+	}
+	assert.Eventually(t, func() bool {
+		_, _, rejected := counts()
+		return rejected == 0
+	}, time.Second, 10*time.Millisecond, "should forget the paths rejected once closed by the peer")
+
+	// accepted or not, only so many of them can be open
+	var accepted []net.Conn
+	accept := func() {
+		p, err := server.Accept()
+		if assert.NoError(t, err) {
+			accepted = append(accepted, p)
+		}
+	}
+	for i := 0; i < sharedAcceptBacklog; i++ {
+		accept()
+	}
+	for i := sharedAcceptBacklog; i < sharedMaxPeerPaths; i++ {
+		open()
+		accept()
+	}
+	extra := open()
+	assert.Eventually(t, func() bool { return rejectedByServer(extra) }, time.Second, 10*time.Millisecond)
+	_, peerPaths, _ = counts()
+	assert.Equal(t, sharedMaxPeerPaths, peerPaths)
+
+	// closing one on both sides makes room for another
+	opened[0].Close()
+	accepted[0].Close()
+	assert.Eventually(t, func() bool {
+		_, peerPaths, _ := counts()
+		return peerPaths == sharedMaxPeerPaths-1
+	}, time.Second, 10*time.Millisecond)
+	another := open()
+	accept()
+	assert.False(t, rejectedByServer(another))
+}
+
+func TestSharedPath(t *testing.T) {
+	client, server := newSharedTransportPair(t)
+	defer client.Close()
+	defer server.Close()
+	a, err := client.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	large := make([]byte, maxSharedChunk*3+1)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	go a.Write(large)
+	b, err := server.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := make([]byte, len(large))
+	_, err = io.ReadFull(b, received)
+	assert.NoError(t, err)
+	assert.Equal(t, large, received, "should reassemble the chunks")
+
+	assert.NoError(t, b.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = b.Read(received)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.NoError(t, b.SetReadDeadline(time.Time{}))
+
+	_, err = a.Write([]byte("bye"))
+	assert.NoError(t, err)
+	assert.NoError(t, a.Close())
+	all, err := io.ReadAll(b)
+	assert.NoError(t, err, "should read EOF once closed by the peer")
+	assert.Equal(t, "bye", string(all))
+	_, err = b.Write([]byte("late"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.NoError(t, b.Close())
+	assert.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return len(client.paths) == 0
+	}, time.Second, 10*time.Millisecond, "should forget the path closed by both sides")
+
+	assert.NoError(t, client.Close())
+	_, err = server.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed, "should close along with the underlying connection")
+}
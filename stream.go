@@ -0,0 +1,114 @@
+package multipath
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxStreamID is the largest stream ID, so that a peer can't make a
+// connection allocate receive queues without bound.
+const maxStreamID = 255
+
+// stream is one of the ordered streams multiplexed over a connection other
+// than the default one. Its frames share the subflows, the frame numbers and
+// the retransmissions with the default stream, but are reordered in their own
+// receive queue.
+type stream struct {
+	lastSeq   uint64
+	recvQueue *receiveQueue
+}
+
+// stream returns the stream id, creating it if it doesn't exist yet.
+func (bc *mpConn) stream(id uint64) *stream {
+	bc.muStreams.Lock()
+	defer bc.muStreams.Unlock()
+	st := bc.streams[id]
+	if st != nil {
+		return st
+	}
+	rq := newAdaptiveReceiveQueue(bc.cfg.minReceiveQueueLength, bc.cfg.minReceiveQueueLength, bc.cfg.maxReceiveQueueLength)
+	rq.discardLate = bc.recvQueue.discardLate
+	rq.gapTimeout = bc.recvQueue.gapTimeout
+	rq.mem = bc.recvQueue.mem
+	bc.recvQueue.deadlineLock.Lock()
+	rq.readDeadline = bc.recvQueue.readDeadline
+	bc.recvQueue.deadlineLock.Unlock()
+	if atomic.LoadUint32(&bc.closedLocally) == 1 {
+		rq.discard()
+	} else if atomic.LoadUint32(&bc.closed) == 1 {
+		rq.close()
+	}
+	st = &stream{lastSeq: minFrameNumber - 1, recvQueue: rq}
+	bc.streams[id] = st
+	return st
+}
+
+// eachStream calls fn with the receive queue of each stream other than the
+// default one.
+func (bc *mpConn) eachStream(fn func(rq *receiveQueue)) {
+	bc.muStreams.Lock()
+	defer bc.muStreams.Unlock()
+	for _, st := range bc.streams {
+		fn(st.recvQueue)
+	}
+}
+
+// gotStreamFrame passes the frame received on to its stream.
+func (bc *mpConn) gotStreamFrame(f *rxFrame) bool {
+	return bc.stream(f.stream).recvQueue.offer(&rxFrame{fn: f.seq, bytes: f.bytes, via: f.via, inOrder: f.inOrder}, nil)
+}
+
+// gotAbandon skips the frame the peer gave up on, in its stream too.
+func (bc *mpConn) gotAbandon(fn, stream, seq uint64) {
+	bc.recvQueue.skip(fn)
+	if stream != 0 && stream <= maxStreamID {
+		bc.stream(stream).recvQueue.skip(seq)
+	}
+}
+
+// ReadStream is like Read but reads the data received on stream id. Stream 0
+// is the default stream.
+func (bc *mpConn) ReadStream(id uint64, b []byte) (n int, err error) {
+	if id == 0 {
+		return bc.Read(b)
+	}
+	if id > maxStreamID {
+		return 0, ErrInvalidStream
+	}
+	if atomic.LoadUint32(&bc.closedLocally) == 1 {
+		return 0, ErrClosed
+	}
+	n, err = bc.stream(id).recvQueue.read(b)
+	atomic.AddUint64(&bc.bytesRead, uint64(n))
+	if err == ErrClosed {
+		err = bc.readClosedErr()
+	}
+	return
+}
+
+// WriteStream is like Write but sends b on stream id. Stream 0 is the default
+// stream. Writes to other streams are never coalesced.
+func (bc *mpConn) WriteStream(id uint64, b []byte) (n int, err error) {
+	if id == 0 {
+		return bc.Write(b)
+	}
+	if id > maxStreamID {
+		return 0, ErrInvalidStream
+	}
+	if atomic.LoadUint32(&bc.closed) == 1 || atomic.LoadUint32(&bc.closedLocally) == 1 {
+		return 0, bc.closedErr()
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(b) > bc.cfg.maxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	st := bc.stream(id)
+	n, err = bc.sendData(func() *sendFrame {
+		seq := atomic.AddUint64(&st.lastSeq, 1)
+		return composeStreamFrame(atomic.AddUint64(&bc.lastFN, 1), id, seq, b)
+	}, b, bc.cfg.redundancy, time.Time{})
+	atomic.AddUint64(&bc.bytesWritten, uint64(n))
+	return n, err
+}
@@ -0,0 +1,71 @@
+package multipath
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreams(t *testing.T) {
+	t.Run("plain", func(t *testing.T) { testStreams(t) })
+	t.Run("FEC and piggybacking", func(t *testing.T) {
+		testStreams(t, WithFEC(4, 1), WithAckPiggybacking(10*time.Millisecond))
+	})
+}
+
+func testStreams(t *testing.T, opts ...Option) {
+	client, server, _ := newTestConnPair(t, 2, opts...)
+	defer client.Close()
+	defer server.Close()
+	c, s := client.(Conn), server.(Conn)
+	for i := 0; i < 10; i++ {
+		for id := uint64(0); id < 3; id++ {
+			_, err := c.WriteStream(id, []byte{byte('a' + id), byte('0' + i)})
+			assert.NoError(t, err)
+		}
+	}
+	for id := uint64(2); ; id-- {
+		b := make([]byte, 2)
+		for i := 0; i < 10; i++ {
+			_, err := io.ReadFull(readerFunc(func(p []byte) (int, error) { return s.ReadStream(id, p) }), b)
+			assert.NoError(t, err)
+			assert.Equal(t, string([]byte{byte('a' + id), byte('0' + i)}), string(b), "stream %d", id)
+		}
+		if id == 0 {
+			break
+		}
+	}
+
+	_, err := c.WriteStream(maxStreamID+1, []byte("a"))
+	assert.Equal(t, ErrInvalidStream, err)
+	_, err = s.ReadStream(maxStreamID+1, make([]byte, 1))
+	assert.Equal(t, ErrInvalidStream, err)
+}
+
+func TestStreamsNoHeadOfLineBlocking(t *testing.T) {
+	bc := newMPConn(connectionID{}, nil, newConfig(nil))
+	defer bc.Close()
+	read := func(id uint64) string {
+		b := make([]byte, 10)
+		bc.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := bc.ReadStream(id, b)
+		assert.NoError(t, err)
+		return string(b[:n])
+	}
+	// the first frame, of stream 1, is missing
+	bc.recvQueue.add(&rxFrame{fn: minFrameNumber + 1, stream: 2, seq: minFrameNumber, bytes: []byte("b")}, nil)
+	bc.recvQueue.add(&rxFrame{fn: minFrameNumber + 2, bytes: []byte("c")}, nil)
+	assert.Equal(t, "b", read(2), "should not wait for the frames of other streams")
+	bc.recvQueue.add(&rxFrame{fn: minFrameNumber, stream: 1, seq: minFrameNumber, bytes: []byte("a")}, nil)
+	assert.Equal(t, "a", read(1))
+	assert.Equal(t, "c", read(0), "should skip the frames of other streams")
+	bc.recvQueue.add(&rxFrame{fn: minFrameNumber + 1, stream: 2, seq: minFrameNumber, bytes: []byte("b")}, nil)
+	bc.recvQueue.add(&rxFrame{fn: minFrameNumber + 3, stream: 2, seq: minFrameNumber + 1, bytes: []byte("d")}, nil)
+	assert.Equal(t, "d", read(2), "should drop duplicates")
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
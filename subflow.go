@@ -1,7 +1,7 @@
 package multipath
 
 import (
-	"fmt"
+	"bytes"
 	"io"
 	"math/rand"
 	"net"
@@ -31,10 +31,178 @@ type subflow struct {
 	sendQueue           chan *sendFrame
 	pendingPing         *pendingAck // Only for pings
 	muPendingPing       sync.RWMutex
-	emaRTT              *ema.EMA
+	rtt                 RTTEstimator
+	emaSerialization    *ema.EMA // the time to write a data frame to the conn
 	tracker             StatsTracker
 	actuallyBusyOnWrite uint64
 	finishedClosing     chan bool
+	rateLimit           atomic.Value // *tokenBucket, nil if not limited
+	peakSendQueue       uint64       // accessed atomically
+	// lastSent and lastRecv are the UnixNano time of the last frame of any
+	// type sent and received. Accessed atomically.
+	lastSent int64
+	lastRecv int64
+	// writeStartedAt is the UnixNano time the write in progress started,
+	// zero if none. Accessed atomically.
+	writeStartedAt int64
+	// measured is 1 once the RTT is sampled, before which the scheduler
+	// uses an estimate. Accessed atomically.
+	measured uint32
+	// rttHistory keeps the recent RTT samples, nil if disabled.
+	rttHistory *rttHistory
+	// costClass is the class set by WithCostClass when the subflow is added.
+	costClass int
+	// heldCopies are the redundant copies waiting for room in the send
+	// queue, see holdCopy.
+	heldCopies   []*sendFrame
+	muHeldCopies sync.Mutex
+	// inOrder is set by WithInOrderSubflows when the subflow is added.
+	inOrder bool
+	// mtu is set by WithSubflowMTU when the subflow is added, zero or less
+	// if unknown.
+	mtu int
+	// sendWorker writes the frames queued on the subflow if it's on a
+	// SendPool, nil if it has a send loop of its own. sendReady is guarded
+	// by the mutex of the worker.
+	sendWorker *sendWorker
+	sendReady  bool
+	// warmUntil is when the warmup set by WithSubflowWarmup ends, zero if
+	// there's none.
+	warmUntil time.Time
+	// owd estimates the one-way delays, nil if disabled.
+	owd *oneWayDelay
+	// paused is 1 while paused by PauseSubflow. Accessed atomically.
+	paused uint32
+	// lastPong is the UnixNano time the last pong was received, and
+	// lastPongRTT the RTT it took. Accessed atomically.
+	lastPong    int64
+	lastPongRTT int64
+	// dataFramesSent is the number of data frames sent, including the
+	// retransmissions, and framesTimedOut the number of them which timed
+	// out. Accessed atomically.
+	dataFramesSent uint64
+	framesTimedOut uint64
+
+	// Attribution of the acks to the frames sent on this subflow, by whether
+	// they come back on this subflow or on others.
+	muAckAttribution sync.Mutex
+	acksViaSelf      uint64
+	acksViaOthers    uint64
+	acksVia          map[string]uint64
+	windowAcks       uint64
+	windowAcksOnSelf uint64
+	asymmetric       bool
+	// acksCarried is the number of acks to the frames sent on other subflows
+	// which came back on this one. Accessed atomically.
+	acksCarried uint64
+
+	// Frames timed out on this subflow recently, see recordLoss.
+	muLoss          sync.Mutex
+	lossWindowStart time.Time
+	losses          int
+	lossyUntil      time.Time
+}
+
+// SubflowInfo is a snapshot of the status of a subflow.
+type SubflowInfo struct {
+	// To is the label of the subflow.
+	To string
+	// RTT is the current estimated roundtrip time.
+	RTT time.Duration
+	// AcksViaSelf and AcksViaOthers are the number of acks to the frames
+	// sent on this subflow which came back on this subflow and on the
+	// others, respectively. AcksVia breaks them down by the label of the
+	// subflow they came back on, including this one.
+	AcksViaSelf   uint64
+	AcksViaOthers uint64
+	AcksVia       map[string]uint64
+	// AcksCarried is the number of acks to the frames sent on other subflows
+	// which came back on this one.
+	AcksCarried uint64
+	// Asymmetric is true if the acks to the frames sent on this subflow
+	// consistently come back on other subflows. It usually indicates NAT or
+	// routing issues.
+	Asymmetric bool
+	// BytesInFlight is the total payload size of the frames last sent on
+	// this subflow but not acked yet.
+	BytesInFlight int
+	// QueuedFrames is the number of frames waiting in the send queue of this
+	// subflow to be written.
+	QueuedFrames int
+	// Lossy is true if the subflow is deprioritized as frames timed out on
+	// it recently.
+	Lossy bool
+	// LastSent and LastRecv are when the last frame of any type, including
+	// acks and probes, was sent and received. A subflow which keeps sending
+	// but hasn't received anything for a while is likely broken one way.
+	// They are zero if it never happened.
+	LastSent time.Time
+	LastRecv time.Time
+	// EstimatedDelivery is how long the scheduler estimates a new frame sent
+	// on the subflow takes to be delivered, i.e. the RTT plus the time to
+	// write the frames queued before it.
+	EstimatedDelivery time.Duration
+	// RTTHistory is the recent RTT samples, oldest first, if enabled by
+	// WithRTTHistory.
+	RTTHistory []RTTSample
+	// ForwardDelay and ReverseDelay are the estimated one-way delays to and
+	// from the peer, if enabled by WithOneWayDelay. They are zero until
+	// measured, and may be off by the clock offset between both ends.
+	ForwardDelay time.Duration
+	ReverseDelay time.Duration
+	// CostClass is the class assigned by WithCostClass, zero if not set.
+	CostClass int
+	// MTU is the MTU set by WithSubflowMTU, zero or less if unknown.
+	MTU int
+	// Paused is true if the subflow is paused by PauseSubflow.
+	Paused bool
+}
+
+// RTTSample is an RTT measured at some point in time.
+type RTTSample struct {
+	At  time.Time
+	RTT time.Duration
+}
+
+func (sf *subflow) info() SubflowInfo {
+	sf.muAckAttribution.Lock()
+	defer sf.muAckAttribution.Unlock()
+	forward, _ := sf.owd.forwardDelay()
+	reverse, _ := sf.owd.reverseDelay()
+	return SubflowInfo{
+		To:            sf.to,
+		RTT:           sf.getRTT(),
+		AcksViaSelf:   sf.acksViaSelf,
+		AcksViaOthers: sf.acksViaOthers,
+		AcksVia:       copyCounts(sf.acksVia),
+		AcksCarried:   atomic.LoadUint64(&sf.acksCarried),
+		Asymmetric:    sf.asymmetric,
+		QueuedFrames:  len(sf.sendQueue),
+		Lossy:         sf.lossy(),
+		LastSent:      unixNanoTime(atomic.LoadInt64(&sf.lastSent)),
+		LastRecv:      unixNanoTime(atomic.LoadInt64(&sf.lastRecv)),
+		RTTHistory:    sf.rttHistory.samples(),
+		ForwardDelay:  forward,
+		ReverseDelay:  reverse,
+		CostClass:     sf.costClass,
+		MTU:           sf.mtu,
+		Paused:        sf.isPaused(),
+	}
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
 }
 
 func startSubflow(to string, c net.Conn, mpc *mpConn, clientSide bool, probeStart time.Time, tracker StatsTracker) *subflow {
@@ -47,14 +215,43 @@ func startSubflow(to string, c net.Conn, mpc *mpConn, clientSide bool, probeStar
 		finishedClosing: make(chan bool, 1),
 		// pendingPing is used for storing the subflow's ping data. Handy since pings are subflow dependent
 		pendingPing: nil,
-		emaRTT:      ema.NewDuration(longRTT, rttAlpha),
-		tracker:     tracker,
+		rtt:         mpc.cfg.newRTTEstimator(),
+		// zero until the first frame is written
+		emaSerialization: ema.NewDuration(0, rttAlpha),
+		tracker:          tracker,
+	}
+	if class := mpc.cfg.costClass; class != nil {
+		sf.costClass = class(to)
+	}
+	if inOrder := mpc.cfg.inOrderSubflows; inOrder != nil {
+		sf.inOrder = inOrder(to)
+	}
+	if mtu := mpc.cfg.subflowMTU; mtu != nil {
+		sf.mtu = mtu(to)
+	}
+	if warmup := mpc.cfg.subflowWarmup; warmup > 0 {
+		sf.warmUntil = time.Now().Add(warmup)
+	}
+	if size := mpc.cfg.rttHistorySize; size > 0 {
+		sf.rttHistory = newRTTHistory(size)
+	}
+	if mpc.cfg.timestampInterval > 0 {
+		sf.owd = newOneWayDelay()
+	}
+	if pool := mpc.cfg.sendPool; pool != nil {
+		pool.add(sf)
+	} else {
+		go sf.sendLoop()
+	}
+	if wait := mpc.cfg.maxQueueWait; wait > 0 {
+		go sf.watchQueue(wait)
 	}
-	go sf.sendLoop()
 	if clientSide {
 		initialRTT := time.Since(probeStart)
 		tracker.UpdateRTT(initialRTT)
-		sf.emaRTT.SetDuration(initialRTT)
+		sf.rtt.AddSample(initialRTT)
+		sf.rttHistory.add(initialRTT)
+		atomic.StoreUint32(&sf.measured, 1)
 		// pong immediately so the server can calculate the RTT between when it
 		// sends the leading bytes and receives the pong frame.
 		sf.ack(frameTypePong)
@@ -73,20 +270,35 @@ func startSubflow(to string, c net.Conn, mpc *mpConn, clientSide bool, probeStar
 }
 
 func (sf *subflow) readLoop() (err error) {
-	ch := make(chan *rxFrame)
-	r := byteReader{Reader: sf.conn}
+	ch := make(chan rxFrame)
+	r := &byteReader{Reader: sf.conn}
 	go sf.readLoopFrames(ch, r)
 
 	probeTimer := time.NewTimer(randomize(probeInterval))
 	go sf.probe() // Force a ping out right away, to calibrate our own timings
+	var timestampTick <-chan time.Time
+	if interval := sf.mpc.cfg.timestampInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		timestampTick = ticker.C
+		sf.sendTimestamp()
+	}
 
 	for {
 		select {
-		case frame := <-ch: // Fed by readLoopFrames
-			if frame == nil {
+		case frame, ok := <-ch: // Fed by readLoopFrames
+			if !ok {
 				return
 			}
-			sf.mpc.recvQueue.add(frame, sf)
+			if frame.abandoned {
+				sf.mpc.gotAbandon(frame.fn, frame.stream, frame.seq)
+				continue
+			}
+			if frame.closed {
+				sf.mpc.gotClose(sf)
+				continue
+			}
+			sf.mpc.recvQueue.add(&frame, sf)
 			if !probeTimer.Stop() {
 				<-probeTimer.C
 			}
@@ -94,17 +306,20 @@ func (sf *subflow) readLoop() (err error) {
 		case <-probeTimer.C:
 			go sf.probe()
 			probeTimer.Reset(randomize(probeInterval))
+		case <-timestampTick:
+			sf.sendTimestamp()
 		}
 	}
 }
 
-func (sf *subflow) readLoopFrames(ch chan *rxFrame, r byteReader) bool {
+func (sf *subflow) readLoopFrames(ch chan rxFrame, r *byteReader) bool {
 	defer close(ch)
 	var err error
 	for {
 		// The is the core "reactor" where frames are read. The frame format
 		// can be found in the top of multipath.go
-		var sz, fn uint64
+		var sz, fn, stream, seq uint64
+		var control, pathAdvert bool
 		sz, err = ReadVarInt(r)
 		if err != nil {
 			sf.close()
@@ -115,17 +330,135 @@ func (sf *subflow) readLoopFrames(ch chan *rxFrame, r byteReader) bool {
 			sf.close()
 			return true
 		}
+		atomic.StoreInt64(&sf.lastRecv, time.Now().UnixNano())
 		if sz == 0 {
+			if fn == frameTypeClose {
+				ch <- rxFrame{closed: true}
+				continue
+			}
 			sf.gotACK(fn)
 			continue
 		}
-		log.Tracef("got frame %d from %s with %d bytes", fn, sf.to, sz)
-		if sz > 1<<20 {
+		if log.IsTraceEnabled() {
+			// avoid boxing the arguments in the hot path
+			log.Tracef("got frame %d from %s with %d bytes", fn, sf.to, sz)
+		}
+		if sz > maxFrameSize {
 			// This almost always happens due to frame corruption.
 			log.Errorf("Frame of size %v from %s is impossible", sz, sf.to)
 			sf.close()
 			return true
 		}
+		if fn < minFrameNumber {
+			switch fn {
+			case frameTypeDataWithAck:
+				var ackFN uint64
+				fn, err = ReadVarInt(r)
+				if err != nil {
+					sf.close()
+					return true
+				}
+				ackFN, err = ReadVarInt(r)
+				if err != nil {
+					sf.close()
+					return true
+				}
+				fieldsLen := uint64(VarIntLen(fn) + VarIntLen(ackFN))
+				if fieldsLen >= sz || fn < minFrameNumber {
+					log.Errorf("Malformed frame with piggybacked ack from %s", sf.to)
+					sf.close()
+					return true
+				}
+				sz -= fieldsLen
+				sf.gotCumulativeACK(ackFN)
+			case frameTypeStreamData:
+				var fields [3]uint64
+				fieldsLen := uint64(0)
+				for i := range fields {
+					fields[i], err = ReadVarInt(r)
+					if err != nil {
+						sf.close()
+						return true
+					}
+					fieldsLen += uint64(VarIntLen(fields[i]))
+				}
+				fn, stream, seq = fields[0], fields[1], fields[2]
+				if fieldsLen >= sz || fn < minFrameNumber || stream == 0 || stream > maxStreamID || seq < minFrameNumber {
+					log.Errorf("Malformed stream data frame from %s", sf.to)
+					sf.close()
+					return true
+				}
+				sz -= fieldsLen
+			case frameTypeControl, frameTypePathAdvert:
+				pathAdvert = fn == frameTypePathAdvert
+				fn, err = ReadVarInt(r)
+				if err != nil {
+					sf.close()
+					return true
+				}
+				fieldLen := uint64(VarIntLen(fn))
+				if fieldLen >= sz || fn < minFrameNumber {
+					log.Errorf("Malformed control frame from %s", sf.to)
+					sf.close()
+					return true
+				}
+				sz -= fieldLen
+				control = true
+			case frameTypeParity:
+				if sf.mpc.fecDecoder == nil {
+					if _, err = io.CopyN(io.Discard, r, int64(sz)); err != nil {
+						sf.close()
+						return true
+					}
+					continue
+				}
+				p, ok := sf.readParityFrame(r, sz)
+				if !ok {
+					sf.close()
+					return true
+				}
+				if !sf.deliverRecovered(ch, sf.mpc.fecDecoder.onParity(p, sf.mpc.recvQueue.getReceivedTip())) {
+					return true
+				}
+				continue
+			case frameTypeTimestamp:
+				if !sf.readTimestampFrame(r, sz) {
+					sf.close()
+					return true
+				}
+				continue
+			case frameTypeAbandon:
+				var fields [3]uint64
+				fieldsLen := uint64(0)
+				for i := range fields {
+					fields[i], err = ReadVarInt(r)
+					if err != nil {
+						sf.close()
+						return true
+					}
+					fieldsLen += uint64(VarIntLen(fields[i]))
+				}
+				if fieldsLen > sz || fields[0] < minFrameNumber {
+					log.Errorf("Malformed abandon frame from %s", sf.to)
+					sf.close()
+					return true
+				}
+				if _, err = io.CopyN(io.Discard, r, int64(sz-fieldsLen)); err != nil {
+					sf.close()
+					return true
+				}
+				log.Debugf("peer gave up on frame %d", fields[0])
+				ch <- rxFrame{fn: fields[0], stream: fields[1], seq: fields[2], abandoned: true}
+				continue
+			default:
+				log.Debugf("Skipping extended frame of unknown type %d from %s", fn, sf.to)
+				if _, err = io.CopyN(io.Discard, r, int64(sz)); err != nil {
+					sf.close()
+					return true
+				}
+				continue
+			}
+		}
 		buf := pool.Get(int(sz))
 		_, err = io.ReadFull(r, buf)
 		if err != nil {
@@ -134,13 +467,26 @@ func (sf *subflow) readLoopFrames(ch chan *rxFrame, r byteReader) bool {
 			return true
 		}
 
-		if fn > (atomic.LoadUint64(&sf.mpc.recvQueue.readFrameTip) + sf.mpc.recvQueue.size) {
+		if !sf.mpc.recvQueue.admit(fn) {
 			// This frame dropped is too far in the future to apply
 			continue
 		}
 
-		ch <- &rxFrame{fn: fn, bytes: buf}
+		var recovered []*rxFrame
+		if sf.mpc.fecDecoder != nil {
+			covered := buf
+			if stream != 0 || control {
+				// stream and control frames count as empty in the parity
+				covered = nil
+			}
+			recovered = sf.mpc.fecDecoder.onData(fn, covered, sf.mpc.recvQueue.getReceivedTip())
+		}
+		ch <- rxFrame{fn: fn, bytes: buf, stream: stream, seq: seq, control: control, pathAdvert: pathAdvert}
 		sf.tracker.OnRecv(sz)
+		atomic.AddUint64(&sf.mpc.receivedBytes, sz)
+		if !sf.deliverRecovered(ch, recovered) {
+			return true
+		}
 		select {
 		case <-sf.chClose:
 			return true
@@ -149,22 +495,61 @@ func (sf *subflow) readLoopFrames(ch chan *rxFrame, r byteReader) bool {
 	}
 }
 
+// readParityFrame reads the fields and payload of a parity frame of size sz.
+func (sf *subflow) readParityFrame(r *byteReader, sz uint64) (*parityFrame, bool) {
+	var fields [4]uint64
+	fieldsLen := uint64(0)
+	for i := range fields {
+		v, err := ReadVarInt(r)
+		if err != nil {
+			return nil, false
+		}
+		fields[i] = v
+		fieldsLen += uint64(VarIntLen(v))
+	}
+	p := &parityFrame{firstFN: fields[0], stride: fields[1], count: fields[2], lenXor: fields[3]}
+	if fieldsLen > sz || p.firstFN < minFrameNumber || p.stride == 0 || p.count == 0 {
+		log.Errorf("Malformed parity frame from %s", sf.to)
+		return nil, false
+	}
+	p.payload = make([]byte, sz-fieldsLen)
+	if _, err := io.ReadFull(r, p.payload); err != nil {
+		return nil, false
+	}
+	return p, true
+}
+
+// deliverRecovered passes the frames reconstructed with FEC on as if they
+// were received on this subflow. It returns false if the subflow is closed.
+func (sf *subflow) deliverRecovered(ch chan rxFrame, frames []*rxFrame) bool {
+	for _, f := range frames {
+		if !sf.mpc.recvQueue.admit(f.fn) {
+			pool.Put(f.bytes)
+			continue
+		}
+		select {
+		case ch <- *f:
+		case <-sf.chClose:
+			return false
+		}
+	}
+	return true
+}
+
 func (sf *subflow) sendLoop() {
 	closing := false
+	chClose := sf.chClose
 	closeCountdown := time.NewTimer(time.Millisecond * 33)
 	closeCountdown.Stop()
-	defer func() {
-		sf.finishedClosing <- true
-	}()
-
-	go func() {
-		<-sf.chClose
-		closeCountdown.Reset(time.Millisecond * 33)
-		closing = true
-	}()
+	defer sf.sendLoopDone()
 
 	for {
 		select {
+		case <-chClose:
+			closing = true
+			// closed for good, stop selecting it
+			chClose = nil
+			closeCountdown.Reset(time.Millisecond * 33)
 		case <-closeCountdown.C:
 			sf.conn.Close()
 			return
@@ -172,96 +557,409 @@ func (sf *subflow) sendLoop() {
 			if closing {
 				closeCountdown.Reset(time.Millisecond * 33)
 			}
-			if closing {
-				closing = true
+			if !sf.writeQueued(frame) {
+				sf.close()
+				return
 			}
+		}
+	}
+}
 
-			frame.changeLock.Lock()
-			if frame.retransmissions != 0 {
-				log.Tracef("Retransmit on %d, for the %dth time", frame.fn, frame.retransmissions)
-			}
-			if *frame.released == 1 {
-				log.Errorf("Tried to send a frame that has already been released! Frame Number: %v", frame.fn)
+// queued lets the SendPool worker of the subflow, if any, know there's a
+// frame to send. It has to be called after each frame put in sendQueue.
+func (sf *subflow) queued() {
+	if w := sf.sendWorker; w != nil {
+		w.wake(sf)
+	}
+}
 
-				select {
-				case sf.mpc.writerMaybeReady <- true:
-				default:
-				}
+// maxHeldCopies bounds the redundant copies held by a subflow.
+const maxHeldCopies = 16
 
-				frame.changeLock.Unlock()
-				continue
-			}
-			if frame.retransmissions == 0 {
-				if frame.sentVia == nil {
-					frame.sentVia = make([]transmissionDatapoint, 0)
-				}
-				frame.sentVia = append(frame.sentVia, transmissionDatapoint{sf, time.Now()})
-			}
+// holdCopy keeps the redundant copy of a frame which doesn't fit in the send
+// queue, to be queued after one of the frames being written, rather than
+// blocking for room. The copy is dropped if too many are held already, as the
+// frame is sent anyway.
+func (sf *subflow) holdCopy(frame *sendFrame) {
+	sf.muHeldCopies.Lock()
+	if len(sf.heldCopies) >= maxHeldCopies {
+		sf.muHeldCopies.Unlock()
+		return
+	}
+	sf.heldCopies = append(sf.heldCopies, frame)
+	sf.muHeldCopies.Unlock()
+	// the send queue may have been emptied in the meantime
+	sf.queueHeldCopy()
+}
 
-			sf.addPendingAck(frame)
-			frame.changeLock.Unlock()
-
-			atomic.StoreUint64(&sf.actuallyBusyOnWrite, 1)
-			n, err := sf.conn.Write(frame.buf)
-			atomic.StoreUint64(&sf.actuallyBusyOnWrite, 0)
-			var abort bool
-			for {
-				// wake all writers up, since they might have something to send now that we likely
-				// have free capacity.
-				select {
-				case sf.mpc.writerMaybeReady <- true:
-				default:
-					abort = true
-				}
-				if abort {
-					break
-				}
-			}
+// queueHeldCopy moves the oldest copy held to the send queue if there's room.
+func (sf *subflow) queueHeldCopy() {
+	sf.muHeldCopies.Lock()
+	if len(sf.heldCopies) == 0 {
+		sf.muHeldCopies.Unlock()
+		return
+	}
+	select {
+	case sf.sendQueue <- sf.heldCopies[0]:
+		sf.heldCopies[0] = nil
+		sf.heldCopies = sf.heldCopies[1:]
+		sf.muHeldCopies.Unlock()
+		sf.queued()
+	default:
+		sf.muHeldCopies.Unlock()
+	}
+}
 
-			// only wake up one re-transmitter, to better control the possible hored of them
-			select {
-			case sf.mpc.tryRetransmit <- true:
-			default:
-			}
+// sendLoopDone reschedules the frames left behind once the subflow stops
+// sending.
+func (sf *subflow) sendLoopDone() {
+	sf.rescheduleQueued()
+	sf.mpc.reschedulePassedThrough(sf)
+	sf.finishedClosing <- true
+}
 
-			if err != nil {
-				log.Debugf("failed to write frame %d to %s: %v", frame.fn, sf.to, err)
+// writeQueued writes the frame just taken out of the send queue. It returns
+// false if the write failed, after which the subflow has to be closed.
+func (sf *subflow) writeQueued(frame *sendFrame) bool {
+	sf.recordSendQueueDepth(uint64(len(sf.sendQueue)) + 1)
+	if frame.isDataFrame() && !sf.waitForRateLimit(len(frame.buf)) {
+		// closed while waiting, leave the frame to other subflows
+		go sf.mpc.retransmit(frame, RetransmitSubflowFailed)
+		return true
+	}
 
-				if frame.isDataFrame() {
-					go sf.mpc.retransmit(frame)
-				}
+	frame.changeLock.Lock()
+	if frame.retransmissions != 0 {
+		log.Tracef("Retransmit on %d, for the %dth time", frame.fn, frame.retransmissions)
+	}
+	if *frame.released == 1 {
+		log.Errorf("Tried to send a frame that has already been released! Frame Number: %v", frame.fn)
 
-				if n != 0 && len(frame.buf) != n {
-					log.Tracef("We may have corrupted the output %#v vs %#v", n, len(frame.buf))
-					// In this case, we will not try and write the remaining, and instead we will assume
-					// that writing to the socket again will only make this worse, so aborting the subflow
-					sf.close()
-					return
-				}
+		select {
+		case sf.mpc.writerMaybeReady <- true:
+		default:
+		}
+		sf.mpc.signalWritable()
 
-				sf.close()
-				return
-			}
+		frame.changeLock.Unlock()
+		return true
+	}
+	if frame.retransmissions == 0 {
+		if frame.sentVia == nil {
+			frame.sentVia = make([]transmissionDatapoint, 0)
+		}
+		frame.sentVia = append(frame.sentVia, transmissionDatapoint{sf, time.Now()})
+	}
+
+	if frame.isDataFrame() {
+		atomic.StoreInt64(&frame.jitter, int64(sf.mpc.retransmitJitter()))
+	}
+	sf.addPendingAck(frame)
+	untracked := frame.untracked
+	retransmissions := frame.retransmissions
+	frame.changeLock.Unlock()
+
+	if cb := sf.mpc.cfg.onWrite; cb != nil {
+		cb(sf.mpc, WriteEvent{
+			FN:              frame.fn,
+			Data:            frame.isDataFrame(),
+			Subflow:         sf.to,
+			Size:            len(frame.buf),
+			Retransmissions: retransmissions,
+		})
+	}
+
+	atomic.StoreUint64(&sf.actuallyBusyOnWrite, 1)
+	writeStart := time.Now()
+	atomic.StoreInt64(&sf.writeStartedAt, writeStart.UnixNano())
+	atomic.AddInt32(&frame.writing, 1)
+	n, err := sf.writeFrame(frame)
+	atomic.AddInt32(&frame.writing, -1)
+	atomic.StoreInt64(&sf.writeStartedAt, 0)
+	atomic.StoreUint64(&sf.actuallyBusyOnWrite, 0)
+	if err == nil {
+		atomic.StoreInt64(&sf.lastSent, time.Now().UnixNano())
+		if frame.isDataFrame() {
+			sf.emaSerialization.UpdateDuration(time.Since(writeStart))
+		}
+		if frame.sz > maxFrameSizeToCalculateRTT && frame.isDataFrame() && !untracked {
+			sf.restartAckTimer(frame)
+		}
+	}
+	var abort bool
+	for {
+		// wake all writers up, since they might have something to send now that we likely
+		// have free capacity.
+		select {
+		case sf.mpc.writerMaybeReady <- true:
+		default:
+			abort = true
+		}
+		if abort {
+			break
+		}
+	}
+	sf.mpc.signalWritable()
+	if err == nil {
+		sf.queueHeldCopy()
+	}
+
+	// only wake up one re-transmitter, to better control the possible hored of them
+	select {
+	case sf.mpc.tryRetransmit <- true:
+	default:
+	}
+
+	if err != nil {
+		log.Debugf("failed to write frame %d to %s: %v", frame.fn, sf.to, err)
+
+		if frame.isDataFrame() && !untracked {
+			// the untracked ones are rescheduled once the loop exits
+			go sf.mpc.retransmit(frame, RetransmitSubflowFailed)
+		}
+
+		if n != 0 && len(frame.buf) != n {
+			log.Tracef("We may have corrupted the output %#v vs %#v", n, len(frame.buf))
+			// In this case, we will not try and write the remaining, and instead we will assume
+			// that writing to the socket again will only make this worse, so aborting the subflow
+		}
+		return false
+	}
+	if !frame.isDataFrame() {
+		frame.release()
+		return true
+	}
+	log.Tracef("done writing frame %d with %d bytes via %s", frame.fn, frame.sz, sf.to)
+	frame.changeLock.Lock()
+	if frame.retransmissions == 0 {
+		sf.tracker.OnSent(frame.sz)
+		sf.mpc.recordSent(sf)
+	} else {
+		sf.tracker.OnRetransmit(frame.sz)
+	}
+	frame.changeLock.Unlock()
+	return true
+}
 
-			if n != len(frame.buf) {
-				panic(fmt.Sprintf("expect to write %d bytes on %s, written %d", len(frame.buf), sf.to, n))
+// waitForRateLimit blocks until n bytes can be sent without exceeding the rate
+// limit of the subflow, if any. It returns false if the subflow is closed in
+// the meantime.
+func (sf *subflow) waitForRateLimit(n int) bool {
+	tb := sf.getRateLimit()
+	if tb == nil {
+		return true
+	}
+	wait := tb.take(n)
+	if wait <= 0 {
+		return true
+	}
+	// avoid being picked for retransmissions while waiting
+	atomic.StoreUint64(&sf.actuallyBusyOnWrite, 1)
+	defer atomic.StoreUint64(&sf.actuallyBusyOnWrite, 0)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-sf.chClose:
+		return false
+	}
+}
+
+func (sf *subflow) getRateLimit() *tokenBucket {
+	tb, _ := sf.rateLimit.Load().(*tokenBucket)
+	return tb
+}
+
+func (sf *subflow) setRateLimit(bytesPerSec int) {
+	if bytesPerSec <= 0 {
+		sf.rateLimit.Store((*tokenBucket)(nil))
+	} else {
+		sf.rateLimit.Store(newTokenBucket(bytesPerSec))
+	}
+}
+
+// rateLimited tells if the subflow has used up its rate limit for now, so new
+// frames had better be sent on other subflows.
+func (sf *subflow) rateLimited() bool {
+	tb := sf.getRateLimit()
+	return tb != nil && tb.exhausted()
+}
+
+// recordSendQueueDepth updates the peak number of frames waiting to be sent,
+// including the one being sent.
+func (sf *subflow) recordSendQueueDepth(depth uint64) {
+	for {
+		peak := atomic.LoadUint64(&sf.peakSendQueue)
+		if depth <= peak || atomic.CompareAndSwapUint64(&sf.peakSendQueue, peak, depth) {
+			return
+		}
+	}
+}
+
+func (sf *subflow) isPaused() bool {
+	return atomic.LoadUint32(&sf.paused) == 1
+}
+
+// requeue puts the frame taken out of the send queue back, unless the subflow
+// is closed meanwhile.
+func (sf *subflow) requeue(frame *sendFrame) {
+	select {
+	case sf.sendQueue <- frame:
+		sf.queued()
+	case <-sf.chClose:
+	}
+}
+
+// rescheduleQueued retransmits the data frames left in the send queue when
+// the send loop exits, which otherwise would never be sent.
+func (sf *subflow) rescheduleQueued() {
+	for {
+		select {
+		case frame := <-sf.sendQueue:
+			if frame.isDataFrame() && frame.fn >= minFrameNumber {
+				go sf.mpc.retransmit(frame, RetransmitSubflowFailed)
 			}
-			if !frame.isDataFrame() {
-				frame.release()
-				continue
+		default:
+			return
+		}
+	}
+}
+
+// watchQueue periodically checks if the subflow is stuck writing a frame for
+// longer than maxWait, in which case the data frames queued behind it are
+// taken out of the send queue and rescheduled onto the other subflows. The
+// frames are yanked by receiving them from the queue, so each of them is
+// either sent here or rescheduled, never both.
+func (sf *subflow) watchQueue(maxWait time.Duration) {
+	ticker := time.NewTicker(maxWait / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sf.chClose:
+			return
+		case <-ticker.C:
+		}
+		if sf.stuckWriting(maxWait) {
+			sf.yankQueued(maxWait)
+		}
+	}
+}
+
+// stuckWriting tells if the subflow has been writing a frame for longer than
+// maxWait while another subflow could take the frames queued behind it.
+func (sf *subflow) stuckWriting(maxWait time.Duration) bool {
+	started := atomic.LoadInt64(&sf.writeStartedAt)
+	return started != 0 && time.Since(time.Unix(0, started)) > maxWait && sf.mpc.hasOtherWritableSubflow(sf)
+}
+
+// yankQueued reschedules the data frames in the send queue. The other frames
+// belong to this subflow, so they are queued again, in the same order. That
+// waits for the stuck write to complete, meanwhile rescheduling the data
+// frames queued behind them every maxWait/2 too.
+func (sf *subflow) yankQueued(maxWait time.Duration) {
+	var others []*sendFrame
+	// requeued is the last frame queued again, which comes before the others
+	// left if it's taken out again
+	var requeued *sendFrame
+	take := func() {
+		for {
+			select {
+			case frame := <-sf.sendQueue:
+				switch {
+				case frame.isDataFrame() && frame.fn >= minFrameNumber:
+					log.Debugf("frame %d waited too long in the send queue of %s, rescheduling", frame.fn, sf.to)
+					go sf.mpc.retransmit(frame, RetransmitQueueWait)
+				case frame == requeued:
+					others = append([]*sendFrame{frame}, others...)
+					requeued = nil
+				default:
+					others = append(others, frame)
+				}
+			default:
+				return
 			}
-			log.Tracef("done writing frame %d with %d bytes via %s", frame.fn, frame.sz, sf.to)
-			frame.changeLock.Lock()
-			if frame.retransmissions == 0 {
-				sf.tracker.OnSent(frame.sz)
-			} else {
-				sf.tracker.OnRetransmit(frame.sz)
+		}
+	}
+	take()
+	if len(others) == 0 {
+		return
+	}
+	ticker := time.NewTicker(maxWait / 2)
+	defer ticker.Stop()
+	for len(others) > 0 {
+		select {
+		case sf.sendQueue <- others[0]:
+			sf.queued()
+			requeued, others = others[0], others[1:]
+		case <-ticker.C:
+			if sf.stuckWriting(maxWait) {
+				take()
 			}
-			frame.changeLock.Unlock()
+		case <-sf.chClose:
+			return
 		}
 	}
 }
 
+// writeFrame writes the frame to the wire. If ack piggybacking is enabled, a
+// data frame carries the cumulative ack of the frames received so far.
+func (sf *subflow) writeFrame(frame *sendFrame) (int, error) {
+	if frame.fn == frameTypeTimestamp && frame.buf == nil {
+		buf := sf.owd.compose()
+		defer pool.Put(buf)
+		return writeFull(sf.conn, buf)
+	}
+	if sf.mpc.cfg.ackDelay == 0 || !frame.isDataFrame() || frame.stream != 0 || frame.control {
+		return writeFull(sf.conn, frame.buf)
+	}
+	ackFN := sf.mpc.recvQueue.getReceivedTip()
+	if ackFN == 0 {
+		return writeFull(sf.conn, frame.buf)
+	}
+	sf.mpc.ackedUpTo(ackFN)
+	payload := frame.buf[len(frame.buf)-int(frame.sz):]
+	buf := pool.Get(4*maxVarIntLength + len(payload))
+	defer pool.Put(buf)
+	wb := bytes.NewBuffer(buf[:0])
+	WriteVarInt(wb, uint64(VarIntLen(frame.fn)+VarIntLen(ackFN)+len(payload)))
+	WriteVarInt(wb, frameTypeDataWithAck)
+	WriteVarInt(wb, frame.fn)
+	WriteVarInt(wb, ackFN)
+	wb.Write(payload)
+	return writeFull(sf.conn, wb.Bytes())
+}
+
+// writeFull writes the whole buf to conn. Some transports don't honor the
+// io.Writer contract and return successful short writes, which would
+// corrupt the stream if the rest of the frame is not written before the next
+// one.
+func writeFull(conn net.Conn, buf []byte) (int, error) {
+	written := 0
+	for written < len(buf) {
+		n, err := conn.Write(buf[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// ackData acknowledges the data frame received, either right away or later
+// if ack piggybacking is enabled.
+func (sf *subflow) ackData(fn uint64) {
+	if sf == nil {
+		// This should only ever happen in testing.
+		log.Debugf("Nil subflow requested to do an ack! (should only happen on tests)")
+		return
+	}
+	sf.mpc.queueAck(fn, sf)
+}
+
 func (sf *subflow) ack(fn uint64) {
 	if sf == nil {
 		// This should only ever happen in testing.
@@ -272,6 +970,7 @@ func (sf *subflow) ack(fn uint64) {
 	select {
 	case <-sf.chClose:
 	case sf.sendQueue <- composeFrame(fn, nil):
+		sf.queued()
 	}
 }
 
@@ -282,21 +981,137 @@ func (sf *subflow) gotACK(fn uint64) {
 		sf.ack(frameTypePong)
 		return
 	}
+	if fn == frameTypeReset {
+		sf.mpc.gotReset()
+		return
+	}
+	if fn == frameTypePong {
+		sf.muPendingPing.Lock()
+		pending := sf.pendingPing
+		sf.pendingPing = nil
+		sf.muPendingPing.Unlock()
+		if pending != nil {
+			atomic.StoreInt64(&sf.lastPongRTT, int64(pending.age()))
+			pending.updateRTT()
+		}
+		atomic.StoreInt64(&sf.lastPong, time.Now().UnixNano())
+		return
+	}
 
 	sf.mpc.pendingAckMu.RLock()
 	pending := sf.mpc.pendingAckMap[fn]
 	if sf.mpc.pendingAckMap[fn] != nil {
 		sf.mpc.pendingAckMu.RUnlock()
 		sf.mpc.pendingAckMu.Lock()
+		// another subflow may have got the ack in the meantime
+		_, cleared := sf.mpc.pendingAckMap[fn]
 		delete(sf.mpc.pendingAckMap, fn)
 		sf.mpc.pendingAckMu.Unlock()
+		if cleared {
+			sf.mpc.ackWaiters.signal()
+			sf.mpc.acked(pending)
+		}
 	} else {
 		sf.mpc.pendingAckMu.RUnlock()
+		if sf.mpc.cfg.singlePathFastPath {
+			sf.mpc.passthroughAcked(fn)
+		}
 		return
 	}
+	pending.updateRTT()
+	pending.outboundSf.ackedVia(sf)
+}
 
-	if time.Since(pending.sentAt) < time.Second {
-		pending.outboundSf.updateRTT(time.Since(pending.sentAt))
+// ackedVia attributes the ack to a frame sent on sf to the subflow where it
+// arrived. If none of the acks in a window arrives on sf, sf is considered
+// asymmetric.
+func (sf *subflow) ackedVia(via *subflow) {
+	sf.muAckAttribution.Lock()
+	sf.windowAcks++
+	if sf.acksVia == nil {
+		sf.acksVia = make(map[string]uint64)
+	}
+	sf.acksVia[via.to]++
+	if via == sf {
+		sf.acksViaSelf++
+		sf.windowAcksOnSelf++
+	} else {
+		sf.acksViaOthers++
+		atomic.AddUint64(&via.acksCarried, 1)
+	}
+	changed := false
+	if sf.windowAcks >= asymmetryWindow {
+		asymmetric := sf.windowAcksOnSelf == 0
+		changed = asymmetric != sf.asymmetric
+		sf.asymmetric = asymmetric
+		sf.windowAcks = 0
+		sf.windowAcksOnSelf = 0
+	}
+	asymmetric := sf.asymmetric
+	sf.muAckAttribution.Unlock()
+	if changed {
+		if asymmetric {
+			log.Debugf("acks to the frames sent on %s all arrive on other subflows", sf.to)
+		}
+		if sf.mpc.cfg.onAsymmetry != nil {
+			sf.mpc.cfg.onAsymmetry(sf.mpc, sf.to, asymmetric)
+		}
+	}
+}
+
+// gotCumulativeACK clears all pending frames up to and including ackFN. Only
+// the last one is used to update RTT, as the others may have been received
+// long before.
+func (sf *subflow) gotCumulativeACK(ackFN uint64) {
+	var last *pendingAck
+	var cleared []*pendingAck
+	sf.mpc.pendingAckMu.Lock()
+	for fn, pending := range sf.mpc.pendingAckMap {
+		if fn <= ackFN {
+			delete(sf.mpc.pendingAckMap, fn)
+			cleared = append(cleared, pending)
+			if fn == ackFN {
+				last = pending
+			}
+		}
+	}
+	sf.mpc.pendingAckMu.Unlock()
+	if len(cleared) > 0 {
+		sf.mpc.ackWaiters.signal()
+	}
+	for _, pending := range cleared {
+		sf.mpc.acked(pending)
+	}
+	if sf.mpc.cfg.singlePathFastPath {
+		sf.mpc.passthroughCumulativeAcked(ackFN)
+	}
+	if last != nil {
+		log.Tracef("got piggybacked ack for frames up to %d from %s", ackFN, sf.to)
+		last.updateRTT()
+	}
+}
+
+func (pending *pendingAck) toPendingFrame() PendingFrame {
+	return PendingFrame{FN: pending.fn, Size: pending.sz, SentAt: pending.sentAt}
+}
+
+// age returns how long ago the frame was sent. sentAt always comes from the
+// clock of the config, time.Now by default, so it carries a monotonic clock
+// reading, which Sub uses rather than the wall clock, so the age isn't
+// affected by wall clock adjustments e.g. by NTP. Never strip it, like
+// Round(0) or any sort of serialization does. The age is never negative even
+// if it happens.
+func (pending *pendingAck) age() time.Duration {
+	age := pending.outboundSf.mpc.cfg.now().Sub(pending.sentAt)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+func (pending *pendingAck) updateRTT() {
+	if age := pending.age(); age < time.Second {
+		pending.outboundSf.updateRTT(age)
 	} else {
 		pending.outboundSf.updateRTT(time.Second)
 	}
@@ -304,11 +1119,82 @@ func (sf *subflow) gotACK(fn uint64) {
 
 func (sf *subflow) updateRTT(rtt time.Duration) {
 	sf.tracker.UpdateRTT(rtt)
-	sf.emaRTT.UpdateDuration(rtt)
+	sf.rttHistory.add(rtt)
+	sf.rtt.AddSample(rtt)
+	atomic.StoreUint32(&sf.measured, 1)
+}
+
+// estimatedRTT returns the estimate of the RTT estimator, or longRTT as a
+// placeholder until the first sample.
+func (sf *subflow) estimatedRTT() time.Duration {
+	if atomic.LoadUint32(&sf.measured) == 0 {
+		return longRTT
+	}
+	return sf.rtt.Estimate()
+}
+
+// rttHistory is a ring buffer of the last RTT samples of a subflow. A nil
+// rttHistory records nothing.
+type rttHistory struct {
+	mu   sync.Mutex
+	ring []RTTSample
+	next int
+	full bool
+}
+
+func newRTTHistory(size int) *rttHistory {
+	return &rttHistory{ring: make([]RTTSample, size)}
+}
+
+func (h *rttHistory) add(rtt time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.ring[h.next] = RTTSample{At: time.Now(), RTT: rtt}
+	h.next = (h.next + 1) % len(h.ring)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.mu.Unlock()
+}
+
+// samples returns a copy of the samples, oldest first.
+func (h *rttHistory) samples() []RTTSample {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]RTTSample(nil), h.ring[:h.next]...)
+	}
+	return append(append([]RTTSample(nil), h.ring[h.next:]...), h.ring[:h.next]...)
+}
+
+// queueDelay estimates how long the frames queued or being written on the
+// subflow delay a new one.
+func (sf *subflow) queueDelay() time.Duration {
+	depth := len(sf.sendQueue) + int(atomic.LoadUint64(&sf.actuallyBusyOnWrite))
+	if depth == 0 {
+		return 0
+	}
+	return time.Duration(depth) * sf.emaSerialization.GetDuration()
+}
+
+// probeAge returns how long the pending probe has been waiting for the pong,
+// or zero if there's none.
+func (sf *subflow) probeAge() time.Duration {
+	sf.muPendingPing.RLock()
+	defer sf.muPendingPing.RUnlock()
+	if sf.pendingPing == nil {
+		return 0
+	}
+	return sf.pendingPing.age()
 }
 
 func (sf *subflow) getRTT() time.Duration {
-	recorded := sf.emaRTT.GetDuration()
+	recorded := sf.estimatedRTT()
 	// RTT is updated only when ack is received or retransmission timer raises,
 	// which can be stale when the subflow starts hanging. If that happens, the
 	// time since the earliest yet-to-be-acknowledged frame being sent is more
@@ -316,7 +1202,7 @@ func (sf *subflow) getRTT() time.Duration {
 	var realtime time.Duration
 	sf.muPendingPing.RLock()
 	if sf.pendingPing != nil {
-		realtime = time.Since(sf.pendingPing.sentAt)
+		realtime = sf.pendingPing.age()
 	} else {
 		sf.muPendingPing.RUnlock()
 		return recorded
@@ -329,26 +1215,49 @@ func (sf *subflow) getRTT() time.Duration {
 	}
 }
 
+// restartAckTimer restarts the ack timer of the large frame just written, so
+// the time it takes to push the frame through a slow path doesn't count
+// towards the retransmission timeout, otherwise it would time out as soon as
+// it's written.
+func (sf *subflow) restartAckTimer(frame *sendFrame) {
+	sf.mpc.pendingAckMu.Lock()
+	defer sf.mpc.pendingAckMu.Unlock()
+	if pending := sf.mpc.pendingAckMap[frame.fn]; pending != nil && pending.outboundSf == sf {
+		restarted := *pending
+		restarted.sentAt = sf.mpc.cfg.now()
+		sf.mpc.pendingAckMap[frame.fn] = &restarted
+	}
+}
+
 func (sf *subflow) addPendingAck(frame *sendFrame) {
 	switch frame.fn {
 	case frameTypePing:
 		// we expect pong for ping
 		sf.muPendingPing.Lock()
-		sf.pendingPing = &pendingAck{frameTypePong, 0, time.Now(), sf, nil}
+		sf.pendingPing = &pendingAck{frameTypePong, 0, sf.mpc.cfg.now(), sf, nil}
 		sf.muPendingPing.Unlock()
 	case frameTypePong:
 		// expect no response for pong
 	default:
 		if frame.isDataFrame() {
+			atomic.AddUint64(&sf.dataFramesSent, 1)
+			// kept before leaving queuedFrames, so that the frame window
+			// never misses it in between
+			if frame.untracked {
+				sf.mpc.passedThrough(frame)
+			}
 			sf.mpc.pendingAckMu.Lock()
-			sf.mpc.pendingAckMap[frame.fn] = &pendingAck{frame.fn, frame.sz, time.Now(), sf, frame}
+			delete(sf.mpc.queuedFrames, frame.fn)
+			if !frame.untracked {
+				sf.mpc.pendingAckMap[frame.fn] = &pendingAck{frame.fn, frame.sz, sf.mpc.cfg.now(), sf, frame}
+			}
 			sf.mpc.pendingAckMu.Unlock()
 		}
 	}
 }
 
 func (sf *subflow) isPendingAck(fn uint64) bool {
-	if fn > minFrameNumber {
+	if fn >= minFrameNumber {
 		sf.mpc.pendingAckMu.RLock()
 		defer sf.mpc.pendingAckMu.RUnlock()
 		return sf.mpc.pendingAckMap[fn] != nil
@@ -356,27 +1265,94 @@ func (sf *subflow) isPendingAck(fn uint64) bool {
 	return false
 }
 
+// recordLoss records that a frame sent on this subflow timed out. Once the
+// number of them within the loss cooldown reaches the loss threshold, the
+// subflow is considered lossy for the cooldown.
+func (sf *subflow) recordLoss() {
+	atomic.AddUint64(&sf.framesTimedOut, 1)
+	cooldown := sf.mpc.cfg.lossCooldown
+	if cooldown == 0 {
+		return
+	}
+	sf.muLoss.Lock()
+	now := time.Now()
+	if now.Sub(sf.lossWindowStart) > cooldown {
+		sf.lossWindowStart = now
+		sf.losses = 0
+	}
+	sf.losses++
+	becameLossy := false
+	if sf.losses >= sf.mpc.cfg.lossThreshold {
+		if now.After(sf.lossyUntil) {
+			log.Debugf("%s is lossy, deprioritizing it for %v", sf.to, cooldown)
+			becameLossy = true
+		}
+		sf.lossyUntil = now.Add(cooldown)
+	}
+	sf.muLoss.Unlock()
+	if becameLossy {
+		sf.mpc.checkMinSubflows(true)
+	}
+}
+
+func (sf *subflow) lossy() bool {
+	sf.muLoss.Lock()
+	defer sf.muLoss.Unlock()
+	return time.Now().Before(sf.lossyUntil)
+}
+
 func (sf *subflow) probe() {
 	log.Tracef("ping %s", sf.to)
 	sf.ack(frameTypePing)
 }
 
 func (sf *subflow) retransTimer() time.Duration {
-	d := sf.emaRTT.GetDuration() * 2
-	if d > 512*time.Millisecond {
-		d = 512 * time.Millisecond
+	cfg := sf.mpc.cfg
+	var d time.Duration
+	if atomic.LoadUint32(&sf.measured) == 0 {
+		d = cfg.initialRTO
+	} else {
+		d = sf.rtt.Estimate() * 2
+		if d > cfg.maxRTO {
+			d = cfg.maxRTO
+		}
 	}
-	if d < 1*time.Millisecond {
-		d = time.Millisecond
+	// Acks on very fast paths can't realistically come back within a
+	// fraction of a millisecond, so never go below the configured floor.
+	if d < cfg.minRTO {
+		d = cfg.minRTO
+	}
+	// The peer may hold the ack for up to its ack delay.
+	if floor := cfg.maxPeerAckDelay() + cfg.minRTO; d < floor {
+		d = floor
 	}
 	return d
 }
 
+// reset discards the frames queued on the subflow, lets the peer know the
+// connection is aborted and closes the subflow.
+func (sf *subflow) reset() {
+	for drained := false; !drained; {
+		select {
+		case <-sf.sendQueue:
+		default:
+			drained = true
+		}
+	}
+	select {
+	case sf.sendQueue <- composeFrame(frameTypeReset, nil):
+		sf.queued()
+	case <-sf.chClose:
+	}
+	sf.close()
+}
+
 func (sf *subflow) close() {
 	sf.closeOnce.Do(func() {
 		log.Tracef("closing subflow to %s", sf.to)
 		sf.mpc.remove(sf)
 		close(sf.chClose)
+		sf.queued()
 		drainTime := time.Now()
 		maxDrainTime := time.NewTimer(time.Second)
 		select {
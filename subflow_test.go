@@ -0,0 +1,689 @@
+package multipath
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/ema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetransTimerFloor(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	rtt := newEWMAEstimator()
+	sf := &subflow{mpc: mpc, rtt: rtt, measured: 1}
+	rtt.SetDuration(100 * time.Microsecond)
+	assert.Equal(t, defaultMinRTO, sf.retransTimer())
+
+	mpc.cfg.minRTO = time.Millisecond
+	assert.Equal(t, time.Millisecond, sf.retransTimer())
+
+	rtt.SetDuration(time.Hour)
+	assert.Equal(t, 512*time.Millisecond, sf.retransTimer())
+}
+
+func TestRetransTimerCoversAckDelay(t *testing.T) {
+	mpc := &mpConn{cfg: newConfig([]Option{WithMaxRTO(100 * time.Millisecond)})}
+	rtt := newEWMAEstimator()
+	sf := &subflow{mpc: mpc, rtt: rtt, measured: 1}
+	rtt.SetDuration(time.Hour)
+	assert.Equal(t, 100*time.Millisecond, sf.retransTimer())
+
+	mpc.cfg = newConfig([]Option{WithMaxRTO(100 * time.Millisecond), WithAckPiggybacking(200 * time.Millisecond)})
+	assert.Equal(t, 250*time.Millisecond, sf.retransTimer(), "should assume the peer delays acks the same way")
+	mpc.cfg = newConfig([]Option{WithAckPiggybacking(200 * time.Millisecond), WithPeerAckDelay(0)})
+	rtt.SetDuration(time.Millisecond)
+	assert.Equal(t, defaultMinRTO, sf.retransTimer(), "should be independent of the local ack delay")
+}
+
+func TestInitialRTO(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	sf := &subflow{mpc: mpc, rtt: newEWMAEstimator(), tracker: NullTracker{}}
+	assert.Equal(t, time.Second, sf.retransTimer(), "should not be capped by the max RTO")
+	mpc.cfg = newConfig([]Option{WithInitialRTO(3 * time.Second)})
+	assert.Equal(t, 3*time.Second, sf.retransTimer())
+	sf.updateRTT(10 * time.Millisecond)
+	assert.Equal(t, defaultMinRTO, sf.retransTimer(), "should apply only until measured")
+}
+
+// minRTTEstimator estimates the RTT as the lowest sample so far.
+type minRTTEstimator struct {
+	min int64
+}
+
+func (e *minRTTEstimator) AddSample(rtt time.Duration) {
+	for {
+		min := atomic.LoadInt64(&e.min)
+		if min != 0 && min <= int64(rtt) || atomic.CompareAndSwapInt64(&e.min, min, int64(rtt)) {
+			return
+		}
+	}
+}
+
+func (e *minRTTEstimator) Estimate() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.min))
+}
+
+func TestRTTEstimator(t *testing.T) {
+	var created int32
+	opt := WithRTTEstimator(func() RTTEstimator {
+		atomic.AddInt32(&created, 1)
+		return &minRTTEstimator{}
+	})
+	mpc := &mpConn{cfg: newConfig([]Option{opt})}
+	sf := &subflow{mpc: mpc, rtt: mpc.cfg.newRTTEstimator(), tracker: NullTracker{}}
+	assert.Equal(t, longRTT, sf.getRTT(), "should not ask for an estimate before the first sample")
+	sf.updateRTT(100 * time.Millisecond)
+	sf.updateRTT(50 * time.Millisecond)
+	sf.updateRTT(200 * time.Millisecond)
+	assert.Equal(t, 50*time.Millisecond, sf.getRTT())
+	assert.Equal(t, 100*time.Millisecond, sf.retransTimer())
+
+	atomic.StoreInt32(&created, 0)
+	client, server, _ := newTestConnPair(t, 2, opt)
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool { return len(server.(Conn).Subflows()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 4, atomic.LoadInt32(&created), "should give each subflow an estimator of its own")
+}
+
+type panickingEstimator struct{}
+
+func (panickingEstimator) AddSample(time.Duration) { panic("AddSample") }
+func (panickingEstimator) Estimate() time.Duration { panic("Estimate") }
+
+func TestPanickingRTTEstimator(t *testing.T) {
+	mpc := &mpConn{cfg: newConfig([]Option{WithRTTEstimator(func() RTTEstimator { return panickingEstimator{} })})}
+	sf := &subflow{mpc: mpc, rtt: mpc.cfg.newRTTEstimator(), tracker: NullTracker{}}
+	sf.updateRTT(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, sf.getRTT(), "should fall back to the default estimator")
+	sf.updateRTT(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, sf.getRTT())
+
+	mpc = &mpConn{cfg: newConfig([]Option{WithRTTEstimator(func() RTTEstimator { panic("new") })})}
+	assert.IsType(t, &ewmaEstimator{}, mpc.cfg.newRTTEstimator())
+
+	client, server, _ := newTestConnPair(t, 2, WithRTTEstimator(func() RTTEstimator { return panickingEstimator{} }))
+	defer client.Close()
+	defer server.Close()
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+		_, err = io.ReadFull(server, make([]byte, 5))
+		assert.NoError(t, err)
+	}
+}
+
+// writeLaggedConn delays each write, which simulates the latency for the
+// frames sent one at a time.
+type writeLaggedConn struct {
+	net.Conn
+	lag time.Duration
+}
+
+func (c *writeLaggedConn) Write(b []byte) (int, error) {
+	time.Sleep(c.lag)
+	return c.Conn.Write(b)
+}
+
+func TestNoSpuriousRetransmitOnLongPath(t *testing.T) {
+	var retransmits uint64
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		// 600ms RTT
+		return &writeLaggedConn{Conn: c, lag: 300 * time.Millisecond}
+	}, WithMaxRTO(2*time.Second), WithRetransmitCallback(func(conn Conn, event RetransmitEvent) {
+		atomic.AddUint64(&retransmits, 1)
+	}))
+	defer client.Close()
+	defer server.Close()
+	// the server side is yet to measure the RTT
+	_, err := server.Write([]byte("a"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, 1))
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	assert.Zero(t, atomic.LoadUint64(&retransmits))
+}
+
+func TestNoSpuriousRetransmitOnFastPath(t *testing.T) {
+	client, server, trackers := newTestConnPair(t, 1)
+	const frames = 1000
+	go func() {
+		b := make([]byte, 100)
+		for i := 0; i < frames; i++ {
+			if _, err := server.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	b := make([]byte, 100)
+	for i := 0; i < frames; i++ {
+		_, err := io.ReadFull(client, b)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	// give the acks of the last frames a chance to arrive
+	time.Sleep(200 * time.Millisecond)
+	assert.EqualValues(t, frames, atomic.LoadUint64(&trackers[0].sent))
+	assert.Zero(t, atomic.LoadUint64(&trackers[0].retransmit))
+	infos := server.(Conn).Subflows()
+	if assert.Len(t, infos, 1) {
+		assert.EqualValues(t, frames, infos[0].AcksViaSelf)
+		assert.Zero(t, infos[0].AcksViaOthers)
+		assert.False(t, infos[0].Asymmetric)
+	}
+}
+
+// oneByteConn writes at most one byte per call without returning an error,
+// which is allowed by some transports though it violates io.Writer.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c *oneByteConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(b[:1])
+}
+
+func TestShortWrites(t *testing.T) {
+	client, server, _ := newWrappedTestConnPair(t, 2, func(c net.Conn) net.Conn {
+		return &oneByteConn{c}
+	})
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := server.Read(b)
+			if err != nil {
+				return
+			}
+			if _, err := server.Write(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	b := make([]byte, 2000)
+	b2 := make([]byte, len(b))
+	for i := 0; i < 20; i++ {
+		rand.Read(b)
+		_, err := client.Write(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.ReadFull(client, b2)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, b, b2)
+	}
+}
+
+type writeCountingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestAckPiggybacking(t *testing.T) {
+	const rounds = 100
+	pingPong := func(opts ...Option) int64 {
+		var writes int64
+		client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+			return &writeCountingConn{c, &writes}
+		}, opts...)
+		go func() {
+			b := make([]byte, 10)
+			for {
+				n, err := server.Read(b)
+				if err != nil {
+					return
+				}
+				if _, err := server.Write(b[:n]); err != nil {
+					return
+				}
+			}
+		}()
+		b := make([]byte, 10)
+		for i := 0; i < rounds; i++ {
+			_, err := client.Write(b)
+			assert.NoError(t, err)
+			_, err = io.ReadFull(client, b)
+			assert.NoError(t, err)
+		}
+		for _, conn := range []net.Conn{client, server} {
+			bc := conn.(*mpConn)
+			assert.Eventually(t, func() bool {
+				bc.pendingAckMu.RLock()
+				defer bc.pendingAckMu.RUnlock()
+				return len(bc.pendingAckMap) == 0
+			}, time.Second, 10*time.Millisecond, "all frames should be acked eventually")
+		}
+		return atomic.LoadInt64(&writes)
+	}
+	standalone := pingPong()
+	piggybacked := pingPong(WithAckPiggybacking(50 * time.Millisecond))
+	assert.Greater(t, standalone, int64(4*rounds-10))
+	assert.Less(t, piggybacked, int64(3*rounds))
+
+	// acks are sent standalone if there's no data going the other direction
+	client, server, _ := newTestConnPair(t, 2, WithAckPiggybacking(20*time.Millisecond))
+	for i := 0; i < rounds; i++ {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}
+	_, err := io.ReadFull(server, make([]byte, 5*rounds))
+	assert.NoError(t, err)
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool {
+		bc.pendingAckMu.RLock()
+		defer bc.pendingAckMu.RUnlock()
+		return len(bc.pendingAckMap) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAckAsymmetry(t *testing.T) {
+	var events []bool
+	cfg := defaultConfig()
+	WithAsymmetryCallback(func(conn Conn, subflow string, asymmetric bool) {
+		assert.Equal(t, "a", subflow)
+		events = append(events, asymmetric)
+	})(cfg)
+	mpc := &mpConn{cfg: cfg}
+	a := &subflow{to: "a", mpc: mpc, rtt: newEWMAEstimator()}
+	b := &subflow{to: "b", mpc: mpc, rtt: newEWMAEstimator()}
+
+	for i := 0; i < asymmetryWindow*3/2; i++ {
+		a.ackedVia(b)
+	}
+	assert.Equal(t, []bool{true}, events)
+	assert.True(t, a.info().Asymmetric)
+	// a single ack via itself in a window is enough to clear it
+	a.ackedVia(a)
+	for i := 0; i < asymmetryWindow; i++ {
+		a.ackedVia(b)
+	}
+	assert.Equal(t, []bool{true, false}, events)
+	info := a.info()
+	assert.False(t, info.Asymmetric)
+	assert.EqualValues(t, 1, info.AcksViaSelf)
+	assert.EqualValues(t, asymmetryWindow*5/2, info.AcksViaOthers)
+	assert.Equal(t, map[string]uint64{"a": 1, "b": asymmetryWindow * 5 / 2}, info.AcksVia)
+	assert.Zero(t, info.AcksCarried)
+	assert.EqualValues(t, asymmetryWindow*5/2, b.info().AcksCarried)
+	assert.Empty(t, b.info().AcksVia)
+}
+
+func TestSubflowRateLimit(t *testing.T) {
+	client, server, trackers := newTestConnPair(t, 2)
+	bc := server.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, ErrUnknownSubflow, server.(Conn).SetSubflowRateLimit("nonexistent", 1000))
+
+	limited := bc.sortedSubflows()[0]
+	var limitedTracker *countingTracker
+	for _, tracker := range trackers {
+		if limited.tracker == StatsTracker(safeTracker{tracker}) {
+			limitedTracker = tracker
+		}
+	}
+	const rate = 20000
+	assert.NoError(t, server.(Conn).SetSubflowRateLimit(limited.to, rate))
+	go io.Copy(io.Discard, client)
+	start := time.Now()
+	b := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		_, err := server.Write(b)
+		assert.NoError(t, err)
+	}
+	elapsed := time.Since(start)
+	sentOnLimited := atomic.LoadUint64(&limitedTracker.sentBytes)
+	assert.LessOrEqual(t, float64(sentOnLimited), rate*(1+elapsed.Seconds())+float64(len(b)),
+		"should not exceed the burst plus the rate")
+	assert.Less(t, elapsed, time.Second, "should send the rest via the unlimited subflow")
+}
+
+func TestPendingAckAgeIsMonotonic(t *testing.T) {
+	bc := newMPConn(zeroCID, nil, newConfig(nil))
+	defer bc.Close()
+	var muClock sync.Mutex
+	clock := time.Now()
+	bc.cfg.now = func() time.Time {
+		muClock.Lock()
+		defer muClock.Unlock()
+		return clock
+	}
+	step := func(d time.Duration) {
+		muClock.Lock()
+		clock = clock.Add(d)
+		muClock.Unlock()
+	}
+	sf := &subflow{mpc: bc}
+	frame := composeFrame(atomic.AddUint64(&bc.lastFN, 1), []byte("hello"))
+	sf.addPendingAck(frame)
+	pending := bc.pendingAckMap[frame.fn]
+	if !assert.NotNil(t, pending) {
+		return
+	}
+	step(time.Second)
+	assert.Equal(t, time.Second, pending.age())
+
+	// a clock stepped back makes the frame look sent in the future
+	step(-time.Hour)
+	assert.Zero(t, pending.age(), "should never be negative")
+	step(time.Hour + time.Second)
+	assert.Equal(t, 2*time.Second, pending.age())
+}
+
+func TestLossCooldown(t *testing.T) {
+	client, _, _ := newTestConnPair(t, 2, WithLossCooldown(time.Hour, 2))
+	bc := client.(*mpConn)
+	assert.Eventually(t, func() bool { return len(bc.sortedSubflows()) == 2 }, time.Second, 10*time.Millisecond)
+	first := bc.sortedSubflows()[0]
+	first.recordLoss()
+	assert.False(t, first.lossy(), "below the threshold")
+	first.recordLoss()
+	assert.Equal(t, first, bc.sortedSubflows()[1], "lossy subflow should go to the back")
+	for _, info := range bc.Subflows() {
+		assert.Equal(t, info.To == first.to, info.Lossy)
+	}
+
+	first.muLoss.Lock()
+	first.lossyUntil = time.Now()
+	first.muLoss.Unlock()
+	assert.False(t, first.lossy(), "cooldown elapsed")
+}
+
+func TestUnmeasuredSubflowScheduling(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	newSubflow := func(to string, rtt time.Duration) *subflow {
+		sf := &subflow{to: to, mpc: mpc, rtt: newEWMAEstimator(), tracker: NullTracker{}}
+		if rtt > 0 {
+			sf.updateRTT(rtt)
+		}
+		mpc.subflows = append(mpc.subflows, sf)
+		return sf
+	}
+	order := func() (labels []string) {
+		for _, sf := range mpc.sortedSubflows() {
+			labels = append(labels, sf.to)
+		}
+		return
+	}
+	newSubflow("new", 0)
+	assert.Equal(t, []string{"new"}, order())
+	newSubflow("c", 50*time.Millisecond)
+	assert.Equal(t, []string{"c", "new"}, order(), "should never prefer the new one without a hint")
+	newSubflow("a", 10*time.Millisecond)
+	newSubflow("b", 30*time.Millisecond)
+	assert.Equal(t, []string{"a", "b", "new", "c"}, order(), "should be scheduled with the median RTT")
+
+	mpc.cfg.unmeasuredRTT = 5 * time.Millisecond
+	assert.Equal(t, []string{"new", "a", "b", "c"}, order())
+	mpc.subflows[0].pendingPing = &pendingAck{sentAt: time.Now().Add(-20 * time.Millisecond), outboundSf: mpc.subflows[0]}
+	assert.Equal(t, []string{"a", "new", "b", "c"}, order(), "should not be lower than the time waited for the probe")
+
+	mpc.subflows[0].updateRTT(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, mpc.subflows[0].rtt.Estimate(), "should replace the placeholder")
+	assert.Equal(t, []string{"a", "b", "c", "new"}, order())
+}
+
+func TestPongMeasuresRTT(t *testing.T) {
+	client, server, _ := newTestConnPair(t, 2)
+	defer client.Close()
+	defer server.Close()
+	assert.Eventually(t, func() bool {
+		subflows := server.(*mpConn).sortedSubflows()
+		for _, sf := range subflows {
+			if atomic.LoadUint32(&sf.measured) == 0 || sf.getRTT() > time.Second {
+				return false
+			}
+		}
+		return len(subflows) == 2
+	}, 5*time.Second, 10*time.Millisecond, "the accepting side should measure the RTT with the pongs")
+}
+
+func TestCollapseCallback(t *testing.T) {
+	type event struct {
+		subflow   string
+		collapsed bool
+	}
+	var events []event
+	cfg := newConfig([]Option{WithCollapseCallback(func(conn Conn, subflow string, collapsed bool) {
+		events = append(events, event{subflow, collapsed})
+	})})
+	mpc := &mpConn{cfg: cfg, windowSent: make(map[*subflow]int)}
+	a := &subflow{to: "a", mpc: mpc, rtt: newEWMAEstimator()}
+	b := &subflow{to: "b", mpc: mpc, rtt: newEWMAEstimator()}
+	mpc.subflows = []*subflow{a, b}
+	send := func(sf *subflow, n int) {
+		for i := 0; i < n; i++ {
+			mpc.recordSent(sf)
+		}
+	}
+	send(a, collapseWindow*9/10)
+	send(b, collapseWindow/10)
+	assert.Empty(t, events)
+	send(b, collapseWindow/100)
+	send(a, collapseWindow*99/100)
+	assert.Equal(t, []event{{"a", true}}, events)
+	send(a, collapseWindow)
+	assert.Len(t, events, 1, "should only be called on changes")
+	send(b, collapseWindow)
+	assert.Equal(t, []event{{"a", true}, {"a", false}, {"b", true}}, events)
+
+	mpc.subflows = []*subflow{b}
+	send(b, collapseWindow)
+	assert.Equal(t, event{"b", false}, events[len(events)-1], "a single subflow is not a collapse")
+}
+
+func TestRTTHistory(t *testing.T) {
+	var disabled *rttHistory
+	disabled.add(time.Millisecond)
+	assert.Nil(t, disabled.samples())
+
+	h := newRTTHistory(3)
+	rtts := func() []time.Duration {
+		var rtts []time.Duration
+		for _, s := range h.samples() {
+			rtts = append(rtts, s.RTT)
+		}
+		return rtts
+	}
+	h.add(1)
+	h.add(2)
+	assert.Equal(t, []time.Duration{1, 2}, rtts())
+	h.add(3)
+	h.add(4)
+	assert.Equal(t, []time.Duration{2, 3, 4}, rtts(), "should keep the last samples, oldest first")
+	samples := h.samples()
+	assert.False(t, samples[0].At.After(samples[2].At))
+
+	client, server, _ := newTestConnPair(t, 1, WithRTTHistory(4))
+	defer client.Close()
+	defer server.Close()
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		history := client.(Conn).Subflows()[0].RTTHistory
+		return len(history) >= 2 && len(history) <= 4
+	}, time.Second, 10*time.Millisecond, "should record the handshake and the ack")
+}
+
+func TestQueueDepthScheduling(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	newSubflow := func(to string, rtt time.Duration) *subflow {
+		sf := &subflow{to: to, mpc: mpc, rtt: newEWMAEstimator(),
+			emaSerialization: ema.NewDuration(0, rttAlpha), tracker: NullTracker{}, sendQueue: make(chan *sendFrame, 1)}
+		sf.updateRTT(rtt)
+		mpc.subflows = append(mpc.subflows, sf)
+		return sf
+	}
+	order := func() (labels []string) {
+		for _, sf := range mpc.sortedSubflows() {
+			labels = append(labels, sf.to)
+		}
+		return
+	}
+	fast := newSubflow("fast", 10*time.Millisecond)
+	newSubflow("slow", 30*time.Millisecond)
+	assert.Equal(t, []string{"fast", "slow"}, order())
+
+	fast.emaSerialization.SetDuration(15 * time.Millisecond)
+	fast.sendQueue <- &sendFrame{}
+	assert.Equal(t, []string{"fast", "slow"}, order(), "10ms + 15ms is still earlier")
+	atomic.StoreUint64(&fast.actuallyBusyOnWrite, 1)
+	assert.Equal(t, []string{"slow", "fast"}, order(), "10ms + 2 * 15ms is later")
+	assert.Equal(t, 40*time.Millisecond, mpc.schedulingRTTs(mpc.subflows)[fast].delivery())
+}
+
+func TestForwardDelayScheduling(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	newSubflow := func(to string, rtt, forward time.Duration) *subflow {
+		sf := &subflow{to: to, mpc: mpc, rtt: newEWMAEstimator(),
+			emaSerialization: ema.NewDuration(0, rttAlpha), tracker: NullTracker{}, sendQueue: make(chan *sendFrame, 1)}
+		sf.updateRTT(rtt)
+		atomic.StoreUint32(&sf.measured, 1)
+		if forward != 0 {
+			sf.owd = newOneWayDelay()
+			sf.owd.forward.SetDuration(forward)
+			atomic.StoreUint32(&sf.owd.forwardMeasured, 1)
+		}
+		mpc.subflows = append(mpc.subflows, sf)
+		return sf
+	}
+	// both forward delays are skewed by the clocks 100ms apart
+	up := newSubflow("up", 40*time.Millisecond, -90*time.Millisecond)
+	down := newSubflow("down", 30*time.Millisecond, -80*time.Millisecond)
+	rtts := mpc.schedulingRTTs(mpc.subflows)
+	assert.Equal(t, 40*time.Millisecond, rtts[up].rtt)
+	assert.Equal(t, 60*time.Millisecond, rtts[down].rtt, "should add twice the extra forward delay to the RTT of the lowest")
+
+	other := newSubflow("other", 20*time.Millisecond, 0)
+	rtts = mpc.schedulingRTTs(mpc.subflows)
+	assert.Equal(t, 30*time.Millisecond, rtts[down].rtt, "should fall back to the RTTs unless all forward delays are measured")
+	assert.Equal(t, 20*time.Millisecond, rtts[other].rtt)
+}
+
+func TestYankQueuedKeepsOrder(t *testing.T) {
+	mpc := &mpConn{cfg: defaultConfig()}
+	stuck := &subflow{to: "stuck", mpc: mpc, sendQueue: make(chan *sendFrame, 1), chClose: make(chan struct{})}
+	mpc.subflows = []*subflow{stuck, {to: "other", chClose: make(chan struct{})}}
+	atomic.StoreInt64(&stuck.writeStartedAt, time.Now().Add(-time.Second).UnixNano())
+	ping, pong := composeFrame(frameTypePing, nil), composeFrame(frameTypePong, nil)
+	stuck.sendQueue <- ping
+	done := make(chan struct{})
+	go func() {
+		stuck.yankQueued(20 * time.Millisecond)
+		close(done)
+	}()
+	go func() { stuck.sendQueue <- pong }()
+	time.Sleep(100 * time.Millisecond)
+	// the write completes
+	atomic.StoreInt64(&stuck.writeStartedAt, 0)
+	for _, expected := range []*sendFrame{ping, pong} {
+		select {
+		case frame := <-stuck.sendQueue:
+			assert.Equal(t, expected.fn, frame.fn, "should queue the frames again in order")
+		case <-time.After(time.Second):
+			t.Fatal("frame not queued again")
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("should be done once all frames are queued again")
+	}
+}
+
+func TestSubflowWarmup(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.subflowWarmup = time.Minute
+	mpc := &mpConn{cfg: cfg}
+	newSubflow := func(to string, rtt time.Duration, warmUntil time.Time) {
+		sf := &subflow{to: to, mpc: mpc, rtt: newEWMAEstimator(),
+			emaSerialization: ema.NewDuration(0, rttAlpha), tracker: NullTracker{}, sendQueue: make(chan *sendFrame, 1),
+			warmUntil: warmUntil}
+		sf.updateRTT(rtt)
+		mpc.subflows = append(mpc.subflows, sf)
+	}
+	labels := func(subflows []*subflow) (labels []string) {
+		for _, sf := range subflows {
+			labels = append(labels, sf.to)
+		}
+		return
+	}
+	newSubflow("new", 10*time.Millisecond, time.Now().Add(time.Minute))
+	assert.Equal(t, []string{"new"}, labels(mpc.dataSubflows()), "should use the subflow warming up if there's no other")
+	newSubflow("old", 30*time.Millisecond, time.Now().Add(-time.Second))
+	assert.Equal(t, []string{"old"}, labels(mpc.dataSubflows()), "should leave the subflow warming up out")
+	assert.Equal(t, []string{"new", "old"}, labels(mpc.sortedSubflows()))
+
+	client, server, _ := newTestConnPair(t, 2, WithSubflowWarmup(time.Minute))
+	defer client.Close()
+	defer server.Close()
+	_, err := client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err, "should send on the subflows warming up when all of them are")
+}
+
+func TestOneWayDelay(t *testing.T) {
+	owd := newOneWayDelay()
+	_, ok := owd.forwardDelay()
+	assert.False(t, ok)
+	now := uint64(time.Now().UnixMicro())
+	owd.received(now-100000, 0, 0)
+	reverse, ok := owd.reverseDelay()
+	assert.True(t, ok)
+	assert.InDelta(t, 100*time.Millisecond, reverse, float64(10*time.Millisecond))
+	_, ok = owd.forwardDelay()
+	assert.False(t, ok, "should not know the forward delay until the peer echoes")
+
+	owd.received(now, now-50000, now-40000)
+	forward, ok := owd.forwardDelay()
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, forward)
+
+	r := &byteReader{Reader: bytes.NewReader(owd.compose())}
+	sz, _ := ReadVarInt(r)
+	typ, _ := ReadVarInt(r)
+	assert.Equal(t, frameTypeTimestamp, typ)
+	sentAt, _ := ReadVarInt(r)
+	echoSentAt, _ := ReadVarInt(r)
+	echoRecvAt, _ := ReadVarInt(r)
+	assert.Equal(t, uint64(VarIntLen(sentAt)+VarIntLen(echoSentAt)+VarIntLen(echoRecvAt)), sz)
+	assert.Equal(t, now, echoSentAt, "should echo the last timestamp of the peer")
+	assert.True(t, echoRecvAt >= now)
+}
+
+func TestOneWayDelayEndToEnd(t *testing.T) {
+	client, server, _ := newWrappedTestConnPair(t, 1, func(c net.Conn) net.Conn {
+		return &writeLaggedConn{Conn: c, lag: 20 * time.Millisecond}
+	}, WithOneWayDelay(50*time.Millisecond))
+	defer client.Close()
+	defer server.Close()
+	for _, conn := range []net.Conn{client, server} {
+		assert.Eventually(t, func() bool {
+			info := conn.(Conn).Subflows()[0]
+			return info.ForwardDelay >= 15*time.Millisecond && info.ReverseDelay >= 15*time.Millisecond
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+	_, err := client.Write([]byte("a"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 1))
+	assert.NoError(t, err, "should not corrupt the data frames")
+}
@@ -110,7 +110,7 @@ type byteReader struct {
 	b [1]byte
 }
 
-func (r byteReader) ReadByte() (byte, error) {
+func (r *byteReader) ReadByte() (byte, error) {
 	_, err := r.Reader.Read(r.b[:])
 	if err != nil {
 		return 0, err